@@ -0,0 +1,56 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package agentcfg
+
+import (
+	"context"
+	"strconv"
+)
+
+// IngestDisabledKey is the agent configuration setting which, when set to
+// "true", causes APM Server to reject events for the service.
+const IngestDisabledKey = "ingest_disabled"
+
+// ServiceDenylist reports whether ingestion has been disabled for services,
+// using the IngestDisabledKey setting of the agent configuration retrieved by
+// a Fetcher. As the setting is retrieved with each check, services may be
+// disabled and enabled without restarting APM Server or redeploying agents,
+// subject to the Fetcher's cache expiration.
+type ServiceDenylist struct {
+	fetcher Fetcher
+}
+
+// NewServiceDenylist returns a ServiceDenylist which uses f to retrieve
+// agent configuration.
+func NewServiceDenylist(f Fetcher) *ServiceDenylist {
+	return &ServiceDenylist{fetcher: f}
+}
+
+// Denied reports whether ingestion is disabled for the service with the
+// given name and environment. If the agent configuration cannot be fetched,
+// Denied returns false so that ingestion is not interrupted.
+func (d *ServiceDenylist) Denied(ctx context.Context, name, environment string) bool {
+	result, err := d.fetcher.Fetch(ctx, Query{
+		Service: Service{Name: name, Environment: environment},
+	})
+	if err != nil {
+		return false
+	}
+	disabled, _ := strconv.ParseBool(result.Source.Settings[IngestDisabledKey])
+	return disabled
+}
@@ -0,0 +1,107 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package agentcfg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/elastic/apm-server/beater/config"
+	"github.com/elastic/apm-server/kibana"
+	"github.com/elastic/apm-server/kibana/kibanatest"
+)
+
+func TestServiceDenylist(t *testing.T) {
+	cfgs := []config.AgentConfig{{
+		Service: config.Service{Name: "disabled"},
+		Config:  map[string]string{IngestDisabledKey: "true"},
+	}, {
+		Service: config.Service{Name: "prod-disabled", Environment: "production"},
+		Config:  map[string]string{IngestDisabledKey: "true"},
+	}, {
+		Service: config.Service{Name: "enabled"},
+		Config:  map[string]string{IngestDisabledKey: "false", TransactionSamplingRateKey: "0.5"},
+	}}
+	denylist := NewServiceDenylist(NewDirectFetcher(cfgs))
+	ctx := context.Background()
+
+	assert.True(t, denylist.Denied(ctx, "disabled", ""))
+	assert.True(t, denylist.Denied(ctx, "disabled", "production"))
+	assert.True(t, denylist.Denied(ctx, "prod-disabled", "production"))
+	assert.False(t, denylist.Denied(ctx, "prod-disabled", "staging"))
+	assert.False(t, denylist.Denied(ctx, "enabled", ""))
+	assert.False(t, denylist.Denied(ctx, "unknown", ""))
+}
+
+func TestServiceDenylistDynamic(t *testing.T) {
+	kb := &settingsKibanaClient{Client: kibanatest.MockKibana(http.StatusOK, m{}, mockVersion, true)}
+	denylist := NewServiceDenylist(NewKibanaFetcher(kb, testExpiration))
+
+	// Disable and re-enable the service in Kibana; the
+	// change is observed once the cached result expires.
+	for _, disabled := range []bool{false, true, false, true} {
+		kb.settings = m{}
+		if disabled {
+			kb.settings[IngestDisabledKey] = true
+		}
+		time.Sleep(testExpiration)
+		assert.Equal(t, disabled, denylist.Denied(context.Background(), "service", ""))
+	}
+}
+
+// settingsKibanaClient is a kibana.Client which responds
+// to agent configuration queries with the given settings.
+type settingsKibanaClient struct {
+	kibana.Client
+	settings m
+}
+
+func (c *settingsKibanaClient) Send(
+	_ context.Context,
+	method, extraPath string, params url.Values,
+	headers http.Header,
+	body io.Reader,
+) (*http.Response, error) {
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(m{"_source": m{"settings": c.settings, "etag": "123"}}); err != nil {
+		return nil, err
+	}
+	return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(&buf)}, nil
+}
+
+func TestServiceDenylistFetchError(t *testing.T) {
+	denylist := NewServiceDenylist(fetcherFunc(func(context.Context, Query) (Result, error) {
+		return Result{}, errors.New("boom")
+	}))
+	assert.False(t, denylist.Denied(context.Background(), "service", ""))
+}
+
+type fetcherFunc func(context.Context, Query) (Result, error)
+
+func (f fetcherFunc) Fetch(ctx context.Context, query Query) (Result, error) {
+	return f(ctx, query)
+}
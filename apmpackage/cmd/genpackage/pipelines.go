@@ -113,8 +113,9 @@ var clientGeoIPPipeline = []map[string]interface{}{{
 
 // This pipeline translates `event.duration` (defaulting to zero if not
 // found) to `transaction.duration.us` or `span.duration.us` depending on
-// the event type, and then removes `event.duration`. Older versions of
-// APM Server will send `<event>.duration.us`, in which case we skip this
+// the event type, and then removes `event.duration`. Transactions with a
+// zero duration are left without `transaction.duration.us`. Older versions
+// of APM Server will send `<event>.duration.us`, in which case we skip this
 // pipeline.
 //
 // TODO(axw) remove this pipeline when we are ready to migrate the UI to
@@ -125,7 +126,9 @@ var eventDurationPipeline = []map[string]interface{}{{
 		"source": strings.TrimSpace(`
 def durationNanos = ctx.event?.duration ?: 0;
 def eventType = ctx.processor.event;
-ctx.get(ctx.processor.event).duration = ["us": (int)(durationNanos/1000)];
+if (durationNanos > 0 || eventType != "transaction") {
+  ctx.get(eventType).duration = ["us": (int)(durationNanos/1000)];
+}
 `),
 	},
 }, {
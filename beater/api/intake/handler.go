@@ -23,11 +23,13 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
 	"strings"
 
 	"github.com/elastic/elastic-agent-libs/monitoring"
 
 	"github.com/elastic/apm-server/beater/auth"
+	"github.com/elastic/apm-server/beater/config"
 	"github.com/elastic/apm-server/beater/headers"
 	"github.com/elastic/apm-server/beater/ratelimit"
 	"github.com/elastic/apm-server/beater/request"
@@ -46,9 +48,9 @@ var (
 	MonitoringMap = request.DefaultMonitoringMapForRegistry(registry)
 	registry      = monitoring.Default.NewRegistry("apm-server.server")
 
-	errMethodNotAllowed   = errors.New("only POST requests are supported")
-	errServerShuttingDown = errors.New("server is shutting down")
-	errInvalidContentType = errors.New("invalid content type")
+	errMethodNotAllowed   = &codedError{code: "method_not_allowed", message: "only POST requests are supported"}
+	errServerShuttingDown = &codedError{code: stream.ErrorCodeShuttingDown, message: "server is shutting down"}
+	errInvalidContentType = &codedError{code: stream.ErrorCodeValidation, message: "invalid content type"}
 )
 
 // StreamHandler is an interface for handling an Elastic APM agent ND-JSON event
@@ -70,19 +72,36 @@ type StreamHandler interface {
 type RequestMetadataFunc func(*request.Context) model.APMEvent
 
 // Handler returns a request.Handler for managing intake requests for backend and rum events.
-func Handler(handler StreamHandler, requestMetadataFunc RequestMetadataFunc, batchProcessor model.BatchProcessor) request.Handler {
+func Handler(
+	handler StreamHandler,
+	requestMetadataFunc RequestMetadataFunc,
+	batchProcessor model.BatchProcessor,
+	cfg config.IntakeConfig,
+) request.Handler {
+	lenient := cfg.ResponseMode == config.IntakeResponseModeLenient
+	decompressionLimits := decoder.DecompressionLimits{
+		MaxRatio: cfg.MaxDecompressionRatio,
+		MaxBytes: cfg.MaxDecompressedSize,
+	}
 	return func(c *request.Context) {
 		if err := validateRequest(c); err != nil {
 			writeError(c, err)
 			return
 		}
 
-		reader, err := decoder.CompressedRequestReader(c.Request)
+		reader, err := decoder.CompressedRequestReaderLimits(c.Request, decompressionLimits)
 		if err != nil {
 			writeError(c, compressedRequestReaderError{err})
 			return
 		}
 
+		// Clients accepting trailers get the response header before the
+		// stream is decoded, and the result in trailers once it has been.
+		trailers := cfg.ResponseTrailers && c.AcceptsTrailers()
+		if trailers {
+			c.WriteHeaderWithTrailers(headers.APMAccepted, headers.APMErrors)
+		}
+
 		base := requestMetadataFunc(c)
 		var result stream.Result
 		if err := handler.HandleStream(
@@ -95,7 +114,12 @@ func Handler(handler StreamHandler, requestMetadataFunc RequestMetadataFunc, bat
 		); err != nil {
 			result.Add(err)
 		}
-		writeStreamResult(c, &result)
+		writeStreamResult(c, &result, lenient)
+		if trailers {
+			header := c.ResponseWriter.Header()
+			header.Set(headers.APMAccepted, strconv.Itoa(result.Accepted))
+			header.Set(headers.APMErrors, strconv.Itoa(len(result.Errors)+result.ErrorsOmitted))
+		}
 	}
 }
 
@@ -115,56 +139,69 @@ func validateRequest(c *request.Context) error {
 func writeError(c *request.Context, err error) {
 	var result stream.Result
 	result.Add(err)
-	writeStreamResult(c, &result)
+	writeStreamResult(c, &result, false)
 }
 
-func writeStreamResult(c *request.Context, sr *stream.Result) {
+// writeStreamResult writes a response describing sr.
+//
+// If lenient is true and some events were accepted, while all errors
+// describe rejected events rather than stream-level failures, then the
+// response will have the status code 207 (Multi-Status), and a body
+// describing the rejected events. At most 5 rejected events are described
+// individually; any further rejected events are counted in the body's
+// "omitted" field.
+func writeStreamResult(c *request.Context, sr *stream.Result, lenient bool) {
 	statusCode := http.StatusAccepted
 	id := request.IDResponseValidAccepted
-	jsonResult := jsonResult{Accepted: sr.Accepted}
 	var errorMessages []string
+	onlyInvalidInput := true
 
 	if n := len(sr.Errors); n > 0 {
-		jsonResult.Errors = make([]jsonError, n)
 		errorMessages = make([]string, n)
 	}
 
 	for i, err := range sr.Errors {
 		errID := request.IDResponseErrorsInternal
 		var invalidInput *stream.InvalidInputError
+		var terminal *stream.TerminalError
 		if errors.As(err, &invalidInput) {
 			if invalidInput.TooLarge {
 				errID = request.IDResponseErrorsRequestTooLarge
 			} else {
 				errID = request.IDResponseErrorsValidate
 			}
-			jsonResult.Errors[i] = jsonError{
-				Message:  invalidInput.Message,
-				Document: invalidInput.Document,
-			}
+			errorMessages[i] = invalidInput.Message
 		} else {
 			if errors.As(err, &compressedRequestReaderError{}) {
 				errID = request.IDResponseErrorsValidate
 			} else {
 				switch {
-				case errors.Is(err, publish.ErrChannelClosed):
+				case errors.Is(err, publish.ErrChannelClosed), errors.Is(err, stream.ErrShuttingDown):
 					errID = request.IDResponseErrorsShuttingDown
-					err = errServerShuttingDown
+					sr.Errors[i] = errServerShuttingDown
 				case errors.Is(err, publish.ErrFull):
 					errID = request.IDResponseErrorsFullQueue
+				case errors.Is(err, stream.ErrInFlightLimitExceeded):
+					errID = request.IDResponseErrorsServiceUnavailable
 				case errors.Is(err, errMethodNotAllowed):
 					errID = request.IDResponseErrorsMethodNotAllowed
 				case errors.Is(err, errInvalidContentType):
 					errID = request.IDResponseErrorsValidate
-				case errors.Is(err, ratelimit.ErrRateLimitExceeded):
+				case errors.Is(err, ratelimit.ErrRateLimitExceeded), errors.Is(err, stream.ErrEventRateLimitExceeded):
 					errID = request.IDResponseErrorsRateLimit
-				case errors.Is(err, auth.ErrUnauthorized):
+				case errors.Is(err, auth.ErrUnauthorized), errors.Is(err, stream.ErrServiceDisabled):
+					errID = request.IDResponseErrorsForbidden
+				case errors.As(err, &terminal) && terminal.Kind == stream.TerminalErrorTimeout:
+					errID = request.IDResponseErrorsTimeout
+				case errors.As(err, &terminal) && terminal.Kind == stream.TerminalErrorTooLarge:
+					errID = request.IDResponseErrorsRequestTooLarge
+				case errors.As(err, new(*stream.StreamRejectedError)):
 					errID = request.IDResponseErrorsForbidden
 				}
 			}
-			jsonResult.Errors[i] = jsonError{Message: err.Error()}
+			errorMessages[i] = sr.Errors[i].Error()
+			onlyInvalidInput = false
 		}
-		errorMessages[i] = jsonResult.Errors[i].Message
 
 		var errStatusCode int
 		switch errID {
@@ -183,14 +220,21 @@ func writeStreamResult(c *request.Context, sr *stream.Result) {
 		}
 	}
 
+	if lenient && onlyInvalidInput && len(sr.Errors) > 0 && sr.Accepted > 0 {
+		id = request.IDResponseValidPartial
+		statusCode = request.MapResultIDToStatus[id].Code
+	}
+
 	var err error
 	if len(errorMessages) > 0 {
 		err = errors.New(strings.Join(errorMessages, ", "))
 	}
-	writeResult(c, id, statusCode, &jsonResult, err)
+	writeResult(c, id, statusCode, sr, err)
 }
 
-func writeResult(c *request.Context, id request.ResultID, statusCode int, result *jsonResult, err error) {
+// writeResult writes result as the response body, which is encoded with
+// stream.Result.MarshalJSON so responses match results recorded elsewhere.
+func writeResult(c *request.Context, id request.ResultID, statusCode int, result *stream.Result, err error) {
 	var body interface{}
 	if statusCode >= http.StatusBadRequest {
 		// this signals to the client that we're closing the connection
@@ -198,6 +242,12 @@ func writeResult(c *request.Context, id request.ResultID, statusCode int, result
 		// https://golang.org/src/net/http/server.go#L1254
 		c.ResponseWriter.Header().Add(headers.Connection, "Close")
 		body = result
+	} else if statusCode == http.StatusMultiStatus {
+		// partial success responses always describe the rejected events
+		body = result
+	} else if len(result.Warnings) > 0 {
+		// warnings are always described, without affecting the status
+		body = result
 	} else if _, ok := c.Request.URL.Query()["verbose"]; ok {
 		body = result
 	}
@@ -205,16 +255,28 @@ func writeResult(c *request.Context, id request.ResultID, statusCode int, result
 	c.WriteResult()
 }
 
-type compressedRequestReaderError struct {
-	error
+// codedError is an error recorded in a stream.Result by the handler,
+// with the code describing it in the result's JSON encoding.
+type codedError struct {
+	code    string
+	message string
+}
+
+func (e *codedError) Error() string {
+	return e.message
 }
 
-type jsonResult struct {
-	Accepted int         `json:"accepted"`
-	Errors   []jsonError `json:"errors,omitempty"`
+// ErrorCode returns e.code.
+func (e *codedError) ErrorCode() string {
+	return e.code
+}
+
+type compressedRequestReaderError struct {
+	error
 }
 
-type jsonError struct {
-	Message  string `json:"message"`
-	Document string `json:"document,omitempty"`
+// ErrorCode returns stream.ErrorCodeValidation, as the request body
+// could not be decompressed.
+func (compressedRequestReaderError) ErrorCode() string {
+	return stream.ErrorCodeValidation
 }
@@ -22,10 +22,15 @@ import (
 	"compress/gzip"
 	"compress/zlib"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -34,6 +39,7 @@ import (
 	"github.com/elastic/apm-server/approvaltest"
 	"github.com/elastic/apm-server/beater/config"
 	"github.com/elastic/apm-server/beater/headers"
+	"github.com/elastic/apm-server/beater/ratelimit"
 	"github.com/elastic/apm-server/beater/request"
 	"github.com/elastic/apm-server/model"
 	"github.com/elastic/apm-server/model/modelprocessor"
@@ -86,10 +92,21 @@ func TestIntakeHandler(t *testing.T) {
 			r:    compressedRequest(t, "gzip", true),
 			code: http.StatusAccepted, id: request.IDResponseValidAccepted,
 		},
+		"BodyShorterThanContentLength": {
+			path: "errors.ndjson",
+			r: func() *http.Request {
+				data, err := os.ReadFile("../../../testdata/intake-v2/errors.ndjson")
+				require.NoError(t, err)
+				req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(data))
+				req.ContentLength += 10
+				return req
+			}(),
+			code: http.StatusBadRequest, id: request.IDResponseErrorsValidate,
+		},
 		"TooLarge": {
 			path: "errors.ndjson",
 			processor: func() *stream.Processor {
-				p := stream.BackendProcessor(config.DefaultConfig(), make(chan struct{}, 1))
+				p := stream.BackendProcessor(config.DefaultConfig(), make(chan struct{}, 1), nil)
 				p.MaxEventSize = 10
 				return p
 			}(),
@@ -106,6 +123,26 @@ func TestIntakeHandler(t *testing.T) {
 				return publish.ErrFull
 			}),
 			code: http.StatusServiceUnavailable, id: request.IDResponseErrorsFullQueue},
+		"Timeout": {
+			path: "errors.ndjson",
+			batchProcessor: model.ProcessBatchFunc(func(context.Context, *model.Batch) error {
+				return context.DeadlineExceeded
+			}),
+			code: http.StatusServiceUnavailable, id: request.IDResponseErrorsTimeout},
+		"InFlightLimitExceeded": {
+			path:      "errors.ndjson",
+			processor: stream.BackendProcessor(config.DefaultConfig(), make(chan struct{}, 1), stream.NewInFlightLimiter(1)),
+			code:      http.StatusServiceUnavailable, id: request.IDResponseErrorsServiceUnavailable},
+		"ServiceDisabled": {
+			path:      "errors.ndjson",
+			processor: newDenyAllProcessor(),
+			code:      http.StatusForbidden, id: request.IDResponseErrorsForbidden},
+		"StreamRejected": {
+			r:    metadataFilterRequest(t, errors.New("quota exceeded")),
+			code: http.StatusForbidden, id: request.IDResponseErrorsForbidden},
+		"StreamRejectedRateLimit": {
+			r:    metadataFilterRequest(t, ratelimit.ErrRateLimitExceeded),
+			code: http.StatusTooManyRequests, id: request.IDResponseErrorsRateLimit},
 		"InvalidEvent": {
 			path: "invalid-event.ndjson",
 			code: http.StatusBadRequest, id: request.IDResponseErrorsValidate},
@@ -134,7 +171,7 @@ func TestIntakeHandler(t *testing.T) {
 			tc.setup(t)
 
 			// call handler
-			h := Handler(tc.processor, emptyRequestMetadata, tc.batchProcessor)
+			h := Handler(tc.processor, emptyRequestMetadata, tc.batchProcessor, config.DefaultConfig().Intake)
 			h(tc.c)
 
 			require.Equal(t, string(tc.id), string(tc.c.Result.ID))
@@ -167,12 +204,304 @@ func TestIntakeHandlerContentType(t *testing.T) {
 		}
 
 		tc.setup(t)
-		h := Handler(tc.processor, emptyRequestMetadata, tc.batchProcessor)
+		h := Handler(tc.processor, emptyRequestMetadata, tc.batchProcessor, config.DefaultConfig().Intake)
 		h(tc.c)
 		assert.Equal(t, tc.code, tc.w.Code, tc.c.Result.Err)
 	}
 }
 
+func TestIntakeHandlerResponseMode(t *testing.T) {
+	for name, test := range map[string]struct {
+		mode string
+		path string
+		code int
+		id   request.ResultID
+	}{
+		"StrictPartial": {
+			mode: config.IntakeResponseModeStrict,
+			path: "invalid-event.ndjson",
+			code: http.StatusBadRequest, id: request.IDResponseErrorsValidate,
+		},
+		"LenientPartial": {
+			mode: config.IntakeResponseModeLenient,
+			path: "invalid-event.ndjson",
+			code: http.StatusMultiStatus, id: request.IDResponseValidPartial,
+		},
+		"LenientAllRejected": {
+			mode: config.IntakeResponseModeLenient,
+			path: "invalid-metadata.ndjson",
+			code: http.StatusBadRequest, id: request.IDResponseErrorsValidate,
+		},
+		"LenientSuccess": {
+			mode: config.IntakeResponseModeLenient,
+			path: "errors.ndjson",
+			code: http.StatusAccepted, id: request.IDResponseValidAccepted,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			data, err := os.ReadFile(filepath.Join("../../../testdata/intake-v2", test.path))
+			require.NoError(t, err)
+			tc := testcaseIntakeHandler{r: httptest.NewRequest("POST", "/", bytes.NewBuffer(data))}
+			tc.setup(t)
+			// Partial success responses must include a body even without ?verbose.
+			tc.r.URL.RawQuery = ""
+
+			h := Handler(tc.processor, emptyRequestMetadata, tc.batchProcessor, config.IntakeConfig{ResponseMode: test.mode})
+			h(tc.c)
+			assert.Equal(t, string(test.id), string(tc.c.Result.ID))
+			assert.Equal(t, test.code, tc.w.Code)
+
+			if test.code == http.StatusMultiStatus {
+				var body struct {
+					Accepted int
+					Errors   []struct{ Message, Document string }
+				}
+				require.NoError(t, json.Unmarshal(tc.w.Body.Bytes(), &body))
+				assert.Equal(t, 1, body.Accepted)
+				require.Len(t, body.Errors, 1)
+				assert.NotEmpty(t, body.Errors[0].Document)
+				assert.Empty(t, tc.w.Header().Get(headers.Connection))
+			}
+		})
+	}
+}
+
+func TestIntakeHandlerResponseModeLenientOmitted(t *testing.T) {
+	var payload strings.Builder
+	payload.WriteString(`{"metadata": {"service": {"name": "svc", "agent": {"name": "go", "version": "2.0.0"}}}}` + "\n")
+	payload.WriteString(`{"error": {"id": "cdefab0123456789", "exception": {"message": "boom"}}}` + "\n")
+	for i := 0; i < 8; i++ {
+		payload.WriteString(`{"error": {"exception": {"message": "boom"}}}` + "\n")
+	}
+	tc := testcaseIntakeHandler{r: httptest.NewRequest("POST", "/", strings.NewReader(payload.String()))}
+	tc.setup(t)
+	tc.r.URL.RawQuery = ""
+
+	h := Handler(tc.processor, emptyRequestMetadata, tc.batchProcessor, config.IntakeConfig{ResponseMode: config.IntakeResponseModeLenient})
+	h(tc.c)
+	assert.Equal(t, http.StatusMultiStatus, tc.w.Code)
+
+	var body struct {
+		Accepted int
+		Errors   []interface{}
+		Omitted  int
+	}
+	require.NoError(t, json.Unmarshal(tc.w.Body.Bytes(), &body))
+	assert.Equal(t, 1, body.Accepted)
+	assert.Len(t, body.Errors, 5)
+	assert.Equal(t, 3, body.Omitted)
+}
+
+func TestIntakeHandlerWarnings(t *testing.T) {
+	payload := `{"metadata": {"service": {"name": "svc", "agent": {"name": "go", "version": "2.0.0"}}}}
+{"error": {"id": "cdefab0123456789", "exception": {"message": "boom"}, "context": {"request": {"method": "GET", "cookies": {"a": "1", "b": "2"}}}}}
+`
+	cfg := config.DefaultConfig()
+	cfg.Cookies = config.CookiesConfig{Max: 1}
+	tc := testcaseIntakeHandler{
+		r:         httptest.NewRequest("POST", "/", strings.NewReader(payload)),
+		processor: stream.BackendProcessor(cfg, make(chan struct{}, 1), nil),
+	}
+	tc.setup(t)
+	// Warnings are described even without ?verbose.
+	tc.r.URL.RawQuery = ""
+
+	h := Handler(tc.processor, emptyRequestMetadata, tc.batchProcessor, cfg.Intake)
+	h(tc.c)
+	assert.Equal(t, string(request.IDResponseValidAccepted), string(tc.c.Result.ID))
+	assert.Equal(t, http.StatusAccepted, tc.w.Code)
+
+	var body struct {
+		Accepted int
+		Errors   []interface{}
+		Warnings []struct {
+			Code, Message string
+			Count         int
+		}
+	}
+	require.NoError(t, json.Unmarshal(tc.w.Body.Bytes(), &body))
+	assert.Equal(t, 1, body.Accepted)
+	assert.Empty(t, body.Errors)
+	require.Len(t, body.Warnings, 1)
+	assert.Equal(t, "cookies_truncated", body.Warnings[0].Code)
+	assert.Equal(t, "HTTP request cookies limited to 1 of 2", body.Warnings[0].Message)
+	assert.Equal(t, 1, body.Warnings[0].Count)
+}
+
+func TestIntakeHandlerMaxResponseSize(t *testing.T) {
+	var lines []string
+	lines = append(lines, `{"metadata": {"service": {"name": "svc", "agent": {"name": "go", "version": "2.0.0"}}}}`)
+	for i := 0; i < 3; i++ {
+		lines = append(lines, `{"error": {"invalid": "`+strings.Repeat("x", 100)+`"}}`)
+	}
+	tc := testcaseIntakeHandler{r: httptest.NewRequest("POST", "/", strings.NewReader(strings.Join(lines, "\n")))}
+	tc.setup(t)
+	tc.c = request.NewContextWithConfig(request.ContextConfig{MaxResponseSize: 500})
+	tc.c.Reset(tc.w, tc.r)
+
+	h := Handler(tc.processor, emptyRequestMetadata, tc.batchProcessor, config.IntakeConfig{})
+	h(tc.c)
+	assert.Equal(t, http.StatusBadRequest, tc.w.Code)
+	assert.LessOrEqual(t, tc.w.Body.Len(), 500)
+	assert.Equal(t, tc.w.Body.Len(), tc.c.BytesWritten())
+
+	var body struct {
+		Errors []struct{ Message, Document string }
+	}
+	require.NoError(t, json.Unmarshal(tc.w.Body.Bytes(), &body))
+	require.Len(t, body.Errors, 2)
+	assert.NotEmpty(t, body.Errors[0].Document)
+	assert.Equal(t, "2 more errors omitted: maximum response size exceeded", body.Errors[1].Message)
+}
+
+func TestIntakeHandlerDecompressionLimits(t *testing.T) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	fmt.Fprintln(w, `{"metadata": {"service": {"name": "svc", "agent": {"name": "go", "version": "2.0.0"}}}}`)
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintln(w, `{"error": {"id": "cdefab0123456789", "exception": {"message": "boom"}}}`)
+	}
+	require.NoError(t, w.Close())
+
+	for name, cfg := range map[string]config.IntakeConfig{
+		"MaxDecompressedSize":   {MaxDecompressedSize: 10 * 1024},
+		"MaxDecompressionRatio": {MaxDecompressionRatio: 1},
+	} {
+		t.Run(name, func(t *testing.T) {
+			tc := testcaseIntakeHandler{r: httptest.NewRequest("POST", "/", bytes.NewReader(buf.Bytes()))}
+			tc.r.Header.Set("Content-Encoding", "gzip")
+			tc.setup(t)
+
+			h := Handler(tc.processor, emptyRequestMetadata, tc.batchProcessor, cfg)
+			h(tc.c)
+			if cfg.MaxDecompressionRatio > 0 {
+				// The ratio is not enforced for bodies decompressing
+				// to less than 1MiB.
+				assert.Equal(t, http.StatusAccepted, tc.w.Code)
+				return
+			}
+			assert.Equal(t, string(request.IDResponseErrorsRequestTooLarge), string(tc.c.Result.ID))
+			assert.Equal(t, http.StatusBadRequest, tc.w.Code)
+
+			var body struct {
+				Errors []struct{ Code, Message string }
+			}
+			require.NoError(t, json.Unmarshal(tc.w.Body.Bytes(), &body))
+			require.Len(t, body.Errors, 1)
+			assert.Equal(t, stream.ErrorCodeTooLarge, body.Errors[0].Code)
+			assert.Contains(t, body.Errors[0].Message, "decompressed body exceeds the maximum size")
+		})
+	}
+}
+
+func TestIntakeHandlerResponseTrailers(t *testing.T) {
+	for name, test := range map[string]struct {
+		path     string
+		proto    string
+		te       string
+		cfg      config.IntakeConfig
+		trailers bool
+		status   string
+		accepted string
+		errors   string
+	}{
+		"Accepted": {
+			path: "errors.ndjson", proto: "HTTP/2.0", te: "trailers",
+			cfg:      config.IntakeConfig{ResponseTrailers: true},
+			trailers: true, status: "202", accepted: "5", errors: "0",
+		},
+		"Invalid": {
+			path: "invalid-event.ndjson", proto: "HTTP/2.0", te: "trailers",
+			cfg:      config.IntakeConfig{ResponseTrailers: true},
+			trailers: true, status: "400", accepted: "1", errors: "1",
+		},
+		"NotAccepted": {
+			path: "errors.ndjson", proto: "HTTP/2.0",
+			cfg: config.IntakeConfig{ResponseTrailers: true},
+		},
+		"HTTP1": {
+			path: "errors.ndjson", proto: "HTTP/1.1", te: "trailers",
+			cfg: config.IntakeConfig{ResponseTrailers: true},
+		},
+		"Disabled": {
+			path: "errors.ndjson", proto: "HTTP/2.0", te: "trailers",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			tc := testcaseIntakeHandler{path: test.path}
+			tc.setup(t)
+			tc.r.Proto = test.proto
+			tc.r.ProtoMajor, tc.r.ProtoMinor, _ = http.ParseHTTPVersion(test.proto)
+			if test.te != "" {
+				tc.r.Header.Set(headers.TE, test.te)
+			}
+
+			h := Handler(tc.processor, emptyRequestMetadata, tc.batchProcessor, test.cfg)
+			h(tc.c)
+
+			response := tc.w.Result()
+			if !test.trailers {
+				assert.NotEqual(t, http.StatusOK, response.StatusCode)
+				assert.Empty(t, response.Trailer)
+				assert.Empty(t, tc.w.Header().Values(headers.Trailer))
+				return
+			}
+			assert.Equal(t, http.StatusOK, response.StatusCode)
+			assert.Equal(t, test.status, response.Trailer.Get(headers.APMStatus))
+			assert.Equal(t, test.accepted, response.Trailer.Get(headers.APMAccepted))
+			assert.Equal(t, test.errors, response.Trailer.Get(headers.APMErrors))
+
+			// The body still describes the result.
+			var body struct{ Accepted int }
+			require.NoError(t, json.Unmarshal(tc.w.Body.Bytes(), &body))
+			assert.Equal(t, test.accepted, strconv.Itoa(body.Accepted))
+		})
+	}
+}
+
+func TestIntakeHandlerResponseTrailersHTTP1Server(t *testing.T) {
+	// HTTP/1.1 clients accepting trailers get the result in the status
+	// code and body, once the whole request body has been read: net/http
+	// stops reading the body once the response header has been flushed.
+	data, err := os.ReadFile("../../../testdata/intake-v2/errors.ndjson")
+	require.NoError(t, err)
+	lines := bytes.SplitN(data, []byte("\n"), 2)
+	metadata, events := lines[0], bytes.TrimSpace(lines[1])
+	const repeat = 1000
+	var body bytes.Buffer
+	body.Write(metadata)
+	for i := 0; i < repeat; i++ {
+		body.WriteByte('\n')
+		body.Write(events)
+	}
+	body.WriteByte('\n')
+
+	cfg := config.DefaultConfig()
+	processor := stream.BackendProcessor(cfg, make(chan struct{}, cfg.MaxConcurrentDecoders), nil)
+	h := Handler(processor, emptyRequestMetadata, modelprocessor.Nop{}, config.IntakeConfig{ResponseTrailers: true})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := request.NewContext()
+		c.Reset(w, r)
+		h(c)
+	}))
+	defer srv.Close()
+
+	req, err := http.NewRequest(http.MethodPost, srv.URL+"/?verbose", &body)
+	require.NoError(t, err)
+	req.Header.Set(headers.Accept, "application/json")
+	req.Header.Set(headers.TE, "trailers")
+	resp, err := srv.Client().Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "HTTP/1.1", resp.Proto)
+
+	var result struct{ Accepted int }
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	assert.Equal(t, 5*repeat, result.Accepted)
+	assert.Empty(t, resp.Trailer)
+}
+
 type testcaseIntakeHandler struct {
 	c              *request.Context
 	w              *httptest.ResponseRecorder
@@ -189,7 +518,7 @@ type testcaseIntakeHandler struct {
 func (tc *testcaseIntakeHandler) setup(t *testing.T) {
 	if tc.processor == nil {
 		cfg := config.DefaultConfig()
-		tc.processor = stream.BackendProcessor(cfg, make(chan struct{}, cfg.MaxConcurrentDecoders))
+		tc.processor = stream.BackendProcessor(cfg, make(chan struct{}, cfg.MaxConcurrentDecoders), nil)
 	}
 	if tc.batchProcessor == nil {
 		tc.batchProcessor = modelprocessor.Nop{}
@@ -241,3 +570,24 @@ func compressedRequest(t *testing.T, compressionType string, compressPayload boo
 func emptyRequestMetadata(*request.Context) model.APMEvent {
 	return model.APMEvent{}
 }
+
+// metadataFilterRequest returns a request for errors.ndjson, with a
+// stream.MetadataFilter rejecting the stream with err.
+func metadataFilterRequest(t *testing.T, err error) *http.Request {
+	data, readErr := os.ReadFile("../../../testdata/intake-v2/errors.ndjson")
+	require.NoError(t, readErr)
+	r := httptest.NewRequest("POST", "/", bytes.NewBuffer(data))
+	return r.WithContext(stream.ContextWithMetadataFilter(r.Context(), func(model.APMEvent) error {
+		return err
+	}))
+}
+
+func newDenyAllProcessor() *stream.Processor {
+	p := stream.BackendProcessor(config.DefaultConfig(), make(chan struct{}, 1), nil)
+	p.ServiceDenylist = denyAllServices{}
+	return p
+}
+
+type denyAllServices struct{}
+
+func (denyAllServices) Denied(context.Context, string, string) bool { return true }
@@ -18,6 +18,10 @@
 package api
 
 import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	httppprof "net/http/pprof"
@@ -26,6 +30,7 @@ import (
 
 	"github.com/gorilla/mux"
 	"github.com/pkg/errors"
+	"go.opentelemetry.io/collector/receiver/otlpreceiver"
 
 	"github.com/elastic/beats/v7/libbeat/beat"
 	"github.com/elastic/elastic-agent-libs/logp"
@@ -81,6 +86,11 @@ const (
 
 // NewMux creates a new gorilla/mux router, with routes registered for handling the
 // APM Server API.
+//
+// NewMux also returns a function which shuts down the router's intake stream
+// processors, rejecting new streams and waiting for in-flight streams to
+// complete. This should be called on server shutdown, before the batch
+// processor's publisher is stopped.
 func NewMux(
 	beatInfo beat.Info,
 	beaterConfig *config.Config,
@@ -91,8 +101,12 @@ func NewMux(
 	sourcemapFetcher sourcemap.Fetcher,
 	fleetManaged bool,
 	publishReady func() bool,
-) (*mux.Router, error) {
-	pool := request.NewContextPool()
+	intakeStats *stream.IntakeStatsRecorder,
+) (*mux.Router, func(context.Context) error, error) {
+	pool := request.NewContextPool(request.ContextConfig{
+		XForwardedForTrustDepth: beaterConfig.XForwardedForTrustDepth,
+		MaxResponseSize:         beaterConfig.MaxResponseSize,
+	})
 	logger := logp.NewLogger(logs.Handler)
 	router := mux.NewRouter()
 	router.NotFoundHandler = pool.HTTPHandler(notFoundHandler)
@@ -105,7 +119,11 @@ func NewMux(
 		ratelimitStore:   ratelimitStore,
 		sourcemapFetcher: sourcemapFetcher,
 		fleetManaged:     fleetManaged,
+		agentcfgFetcher:  fetcher,
 		intakeSemaphore:  make(chan struct{}, beaterConfig.MaxConcurrentDecoders),
+		intakeLimiter:    stream.NewInFlightLimiter(beaterConfig.MaxInFlightBatchBytes),
+		intakeStats:      intakeStats,
+		apiKeyStreams:    ratelimit.NewStreamLimiter(beaterConfig.AgentAuth.APIKey.StreamLimit),
 	}
 
 	type route struct {
@@ -113,9 +131,9 @@ func NewMux(
 		handlerFn func() (request.Handler, error)
 	}
 
-	otlpHandlers, err := otlp.NewHTTPHandlers(batchProcessor)
+	otlpHandlers, err := otlp.NewHTTPHandlers(batchProcessor, builder.intakeSemaphore, beaterConfig.OTLP)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	routeMap := []route{
@@ -127,15 +145,23 @@ func NewMux(
 		{IntakePath, builder.backendIntakeHandler},
 		// The profile endpoint is in Beta
 		{ProfilePath, builder.profileHandler},
-		{OTLPTracesIntakePath, builder.otlpHandler(otlpHandlers.TraceHandler, otlp.HTTPTracesMonitoringMap)},
-		{OTLPMetricsIntakePath, builder.otlpHandler(otlpHandlers.MetricsHandler, otlp.HTTPMetricsMonitoringMap)},
-		{OTLPLogsIntakePath, builder.otlpHandler(otlpHandlers.LogsHandler, otlp.HTTPLogsMonitoringMap)},
+	}
+	// OTLP handlers are nil if their signal is disabled, or if they
+	// could not be created and best-effort registration is enabled.
+	if otlpHandlers.TraceHandler != nil {
+		routeMap = append(routeMap, route{OTLPTracesIntakePath, builder.otlpHandler(otlpHandlers.TraceHandler, otlp.HTTPTracesMonitoringMap())})
+	}
+	if otlpHandlers.MetricsHandler != nil {
+		routeMap = append(routeMap, route{OTLPMetricsIntakePath, builder.otlpHandler(otlpHandlers.MetricsHandler, otlp.HTTPMetricsMonitoringMap())})
+	}
+	if otlpHandlers.LogsHandler != nil {
+		routeMap = append(routeMap, route{OTLPLogsIntakePath, builder.otlpHandler(otlpHandlers.LogsHandler, otlp.HTTPLogsMonitoringMap())})
 	}
 
 	for _, route := range routeMap {
 		h, err := route.handlerFn()
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		logger.Infof("Path %s added to request handler", route.path)
 		router.Handle(route.path, pool.HTTPHandler(h))
@@ -159,7 +185,7 @@ func NewMux(
 		pprofRouter.Handle("/symbol", http.HandlerFunc(httppprof.Symbol))
 		pprofRouter.Handle("/trace", http.HandlerFunc(httppprof.Trace))
 	}
-	return router, nil
+	return router, builder.shutdownStreamProcessors, nil
 }
 
 type routeBuilder struct {
@@ -170,7 +196,32 @@ type routeBuilder struct {
 	ratelimitStore   *ratelimit.Store
 	sourcemapFetcher sourcemap.Fetcher
 	fleetManaged     bool
+	agentcfgFetcher  agentcfg.Fetcher
 	intakeSemaphore  chan struct{}
+	intakeLimiter    *stream.InFlightLimiter
+	intakeStats      *stream.IntakeStatsRecorder
+	apiKeyStreams    *ratelimit.StreamLimiter
+	streamProcessors []*stream.Processor
+}
+
+// shutdownStreamProcessors shuts down each of the intake stream processors,
+// returning the first error encountered.
+func (r *routeBuilder) shutdownStreamProcessors(ctx context.Context) error {
+	var firstErr error
+	for _, p := range r.streamProcessors {
+		if err := p.Shutdown(ctx); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// setServiceDenylist sets p.ServiceDenylist if the service denylist is enabled.
+func (r *routeBuilder) setServiceDenylist(p *stream.Processor) *stream.Processor {
+	if r.cfg.KibanaAgentConfig.ServiceDenylist.Enabled {
+		p.ServiceDenylist = agentcfg.NewServiceDenylist(r.agentcfgFetcher)
+	}
+	return p
 }
 
 func (r *routeBuilder) profileHandler() (request.Handler, error) {
@@ -179,20 +230,69 @@ func (r *routeBuilder) profileHandler() (request.Handler, error) {
 }
 
 func (r *routeBuilder) backendIntakeHandler() (request.Handler, error) {
-	h := intake.Handler(stream.BackendProcessor(r.cfg, r.intakeSemaphore), backendRequestMetadataFunc(r.cfg), r.batchProcessor)
-	return middleware.Wrap(h, backendMiddleware(r.cfg, r.authenticator, r.ratelimitStore, intake.MonitoringMap)...)
+	streamProcessor := r.setServiceDenylist(stream.BackendProcessor(r.cfg, r.intakeSemaphore, r.intakeLimiter))
+	streamProcessor.Stats = r.intakeStats
+	r.streamProcessors = append(r.streamProcessors, streamProcessor)
+	h := intake.Handler(streamProcessor, backendRequestMetadataFunc(r.cfg), r.batchProcessor, r.cfg.Intake)
+	m := backendMiddleware(r.cfg, r.authenticator, r.ratelimitStore, intake.MonitoringMap)
+	m = append(m, middleware.APIKeyStreamLimitMiddleware(r.apiKeyStreams))
+	return middleware.Wrap(h, m...)
 }
 
 func (r *routeBuilder) otlpHandler(handler http.HandlerFunc, monitoringMap map[request.ResultID]*monitoring.Int) func() (request.Handler, error) {
 	return func() (request.Handler, error) {
 		h := func(c *request.Context) {
+			if err := limitRequestBody(c.Request, r.cfg.MaxOTLPRequestSize); err != nil {
+				// The result is recorded for monitoring, but the response
+				// is encoded as an OTLP Status, as for the OTLP handlers.
+				if errors.Is(err, errRequestTooLarge) {
+					status := request.MapResultIDToStatus[request.IDResponseErrorsRequestTooLarge]
+					c.Result.Set(request.IDRequestTooLarge, status.Code, status.Keyword, nil, err)
+				} else {
+					c.Result.SetWithError(request.IDResponseErrorsValidate, err)
+				}
+				otlpreceiver.WriteHTTPError(c.ResponseWriter, c.Request, err.Error(), c.Result.StatusCode)
+				return
+			}
 			handler(c.ResponseWriter, c.Request)
 		}
-		return middleware.Wrap(h, backendMiddleware(r.cfg, r.authenticator, r.ratelimitStore, monitoringMap)...)
+		// StatusClassMonitoringMiddleware goes first so that responses
+		// written by all of the other middleware are counted.
+		m := append(
+			[]middleware.Middleware{middleware.StatusClassMonitoringMiddleware(monitoringMap)},
+			backendMiddleware(r.cfg, r.authenticator, r.ratelimitStore, monitoringMap)...,
+		)
+		return middleware.Wrap(h, m...)
+	}
+}
+
+var errRequestTooLarge = errors.New("request body too large")
+
+// limitRequestBody reads the request body into memory, replacing req.Body,
+// and returns errRequestTooLarge if it is greater than max bytes. The body
+// is read up to at most max+1 bytes, so chunked request bodies or bodies
+// with an incorrect Content-Length are also capped. If max is zero or less,
+// the body is left unchanged.
+func limitRequestBody(req *http.Request, max int64) error {
+	if max <= 0 {
+		return nil
 	}
+	if req.ContentLength > max {
+		return errors.Wrapf(errRequestTooLarge, "content length %d exceeds limit of %d bytes", req.ContentLength, max)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, max+1))
+	req.Body.Close()
+	if err != nil {
+		return errors.Wrap(err, "failed to read request body")
+	}
+	if int64(len(body)) > max {
+		return errors.Wrapf(errRequestTooLarge, "exceeds limit of %d bytes", max)
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return nil
 }
 
-func (r *routeBuilder) rumIntakeHandler(newProcessor func(*config.Config, chan struct{}) *stream.Processor) func() (request.Handler, error) {
+func (r *routeBuilder) rumIntakeHandler(newProcessor func(*config.Config, chan struct{}, *stream.InFlightLimiter) *stream.Processor) func() (request.Handler, error) {
 	return func() (request.Handler, error) {
 		var batchProcessors modelprocessor.Chained
 		// The order of these processors is important. Source mapping must happen before identifying library frames, or
@@ -221,7 +321,10 @@ func (r *routeBuilder) rumIntakeHandler(newProcessor func(*config.Config, chan s
 			batchProcessors = append(batchProcessors, modelprocessor.SetCulprit{})
 		}
 		batchProcessors = append(batchProcessors, r.batchProcessor) // r.batchProcessor always goes last
-		h := intake.Handler(newProcessor(r.cfg, r.intakeSemaphore), rumRequestMetadataFunc(r.cfg), batchProcessors)
+		streamProcessor := r.setServiceDenylist(newProcessor(r.cfg, r.intakeSemaphore, r.intakeLimiter))
+		streamProcessor.Stats = r.intakeStats
+		r.streamProcessors = append(r.streamProcessors, streamProcessor)
+		h := intake.Handler(streamProcessor, rumRequestMetadataFunc(r.cfg), batchProcessors, r.cfg.Intake)
 		return middleware.Wrap(h, rumMiddleware(r.cfg, r.authenticator, r.ratelimitStore, intake.MonitoringMap)...)
 	}
 }
@@ -272,17 +375,21 @@ func agentConfigHandler(
 	return middleware.Wrap(h, mw...)
 }
 
-func apmMiddleware(m map[request.ResultID]*monitoring.Int) []middleware.Middleware {
-	return []middleware.Middleware{
+func apmMiddleware(cfg *config.Config, m map[request.ResultID]*monitoring.Int) []middleware.Middleware {
+	apmMiddleware := []middleware.Middleware{
 		middleware.LogMiddleware(),
 		middleware.TimeoutMiddleware(),
 		middleware.RecoverPanicMiddleware(),
 		middleware.MonitoringMiddleware(m),
 	}
+	if cfg.EnforceAcceptCharset {
+		apmMiddleware = append(apmMiddleware, middleware.AcceptCharsetMiddleware())
+	}
+	return apmMiddleware
 }
 
 func backendMiddleware(cfg *config.Config, authenticator *auth.Authenticator, ratelimitStore *ratelimit.Store, m map[request.ResultID]*monitoring.Int) []middleware.Middleware {
-	backendMiddleware := append(apmMiddleware(m),
+	backendMiddleware := append(apmMiddleware(cfg, m),
 		middleware.ResponseHeadersMiddleware(cfg.ResponseHeaders),
 		middleware.AuthMiddleware(authenticator, true),
 		middleware.AnonymousRateLimitMiddleware(ratelimitStore),
@@ -294,7 +401,7 @@ func rumMiddleware(cfg *config.Config, authenticator *auth.Authenticator, rateli
 	msg := "RUM endpoint is disabled. " +
 		"Configure the `apm-server.rum` section in apm-server.yml to enable ingestion of RUM events. " +
 		"If you are not using the RUM agent, you can safely ignore this error."
-	rumMiddleware := append(apmMiddleware(m),
+	rumMiddleware := append(apmMiddleware(cfg, m),
 		middleware.ResponseHeadersMiddleware(cfg.ResponseHeaders),
 		middleware.ResponseHeadersMiddleware(cfg.RumConfig.ResponseHeaders),
 		middleware.CORSMiddleware(cfg.RumConfig.AllowOrigins, cfg.RumConfig.AllowHeaders),
@@ -305,7 +412,7 @@ func rumMiddleware(cfg *config.Config, authenticator *auth.Authenticator, rateli
 }
 
 func rootMiddleware(cfg *config.Config, authenticator *auth.Authenticator) []middleware.Middleware {
-	return append(apmMiddleware(root.MonitoringMap),
+	return append(apmMiddleware(cfg, root.MonitoringMap),
 		middleware.ResponseHeadersMiddleware(cfg.ResponseHeaders),
 		middleware.AuthMiddleware(authenticator, false),
 	)
@@ -54,6 +54,20 @@ func TestIntakeBackendHandler_AuthorizationMiddleware(t *testing.T) {
 	})
 }
 
+func TestIntakeBackendHandler_AcceptCharsetMiddleware(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.EnforceAcceptCharset = true
+	h := map[string]string{headers.AcceptCharset: "iso-8859-1"}
+	rec, err := requestToMuxerWithHeader(cfg, IntakePath, http.MethodPost, h)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusNotAcceptable, rec.Code)
+
+	h[headers.AcceptCharset] = "utf8"
+	rec, err = requestToMuxerWithHeader(cfg, IntakePath, http.MethodPost, h)
+	require.NoError(t, err)
+	assert.NotEqual(t, http.StatusNotAcceptable, rec.Code)
+}
+
 func TestIntakeBackendHandler_PanicMiddleware(t *testing.T) {
 	testPanicMiddleware(t, "/intake/v2/events", approvalPathIntakeBackend(t.Name()))
 }
@@ -22,6 +22,7 @@ import (
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
@@ -158,7 +159,7 @@ func (m muxBuilder) build(cfg *config.Config) (http.Handler, error) {
 	nopBatchProcessor := model.ProcessBatchFunc(func(context.Context, *model.Batch) error { return nil })
 	ratelimitStore, _ := ratelimit.NewStore(1000, 1000, 1000)
 	authenticator, _ := auth.NewAuthenticator(cfg.AgentAuth)
-	return NewMux(
+	router, _, err := NewMux(
 		beat.Info{Version: "1.2.3"},
 		cfg,
 		nopBatchProcessor,
@@ -168,5 +169,31 @@ func (m muxBuilder) build(cfg *config.Config) (http.Handler, error) {
 		m.SourcemapFetcher,
 		m.Managed,
 		func() bool { return true },
+		nil,
 	)
+	return router, err
+}
+
+func TestMuxShutdownStreamProcessors(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.RumConfig.Enabled = true
+	nopBatchProcessor := model.ProcessBatchFunc(func(context.Context, *model.Batch) error { return nil })
+	ratelimitStore, _ := ratelimit.NewStore(1000, 1000, 1000)
+	authenticator, _ := auth.NewAuthenticator(cfg.AgentAuth)
+	router, shutdown, err := NewMux(
+		beat.Info{Version: "1.2.3"}, cfg, nopBatchProcessor, authenticator,
+		agentcfg.NewFetcher(cfg), ratelimitStore, nil, false,
+		func() bool { return true }, nil,
+	)
+	require.NoError(t, err)
+	require.NoError(t, shutdown(context.Background()))
+
+	// Once shut down, the intake handlers reject new streams.
+	for _, path := range []string{IntakePath, IntakeRUMPath, IntakeRUMV3Path} {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(`{"metadata":{}}`))
+		req.Header.Set("Content-Type", "application/x-ndjson")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusServiceUnavailable, rec.Code, path)
+	}
 }
@@ -33,6 +33,7 @@ import (
 	"github.com/elastic/apm-server/decoder"
 	"github.com/elastic/apm-server/model"
 	"github.com/elastic/apm-server/model/modeldecoder"
+	"github.com/elastic/apm-server/model/modeldecoder/modeldecoderutil"
 	v2 "github.com/elastic/apm-server/model/modeldecoder/v2"
 	"github.com/elastic/apm-server/publish"
 )
@@ -158,7 +159,7 @@ func Handler(requestMetadataFunc RequestMetadataFunc, processor model.BatchProce
 
 		var batch model.Batch
 		for _, profile := range profiles {
-			batch = appendProfileSampleBatch(profile, baseEvent, batch)
+			batch = modeldecoderutil.AppendProfileSampleBatch(profile, baseEvent, batch)
 		}
 		if err := processor.ProcessBatch(c.Request.Context(), &batch); err != nil {
 			switch err {
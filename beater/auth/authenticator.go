@@ -82,7 +82,22 @@ var errAuthMissing = fmt.Errorf("%w: missing or improperly formatted Authorizati
 // ErrUnauthorized is an error returned by Authorizer.Authorize to indicate that
 // the client is unauthorized for some action and resource. This should be wrapped
 // to provide a reason, and checked using `errors.Is`.
-var ErrUnauthorized = errors.New("unauthorized")
+//
+// ErrUnauthorized has an ErrorCode method returning "unauthorized", which
+// the stream processor uses to classify errors without depending on this
+// package.
+var ErrUnauthorized error = unauthorizedError{}
+
+type unauthorizedError struct{}
+
+func (unauthorizedError) Error() string {
+	return "unauthorized"
+}
+
+// ErrorCode returns "unauthorized".
+func (unauthorizedError) ErrorCode() string {
+	return "unauthorized"
+}
 
 // Authenticator authenticates clients.
 type Authenticator struct {
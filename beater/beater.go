@@ -800,9 +800,46 @@ func (s *serverRunner) wrapRunServerWithPreprocessors(runServer RunServerFunc) R
 			DefaultServiceEnvironment: s.config.DefaultServiceEnvironment,
 		})
 	}
+	if s.config.Transaction.MaxNameLength > 0 || s.config.Transaction.MaxTypeLength > 0 {
+		processors = append(processors, &modelprocessor.TruncateTransactionNames{
+			NameMaxLength: s.config.Transaction.MaxNameLength,
+			TypeMaxLength: s.config.Transaction.MaxTypeLength,
+		})
+	}
+	if s.config.Transaction.Result.Normalize {
+		processors = append(processors, modelprocessor.NewNormalizeTransactionResults(
+			s.config.Transaction.Result.Allowed...,
+		))
+	}
+	if s.config.CustomFields.MaxDepth > 0 || s.config.CustomFields.Numbers != config.CustomFieldsNumbersAsDecoded {
+		processors = append(processors, &modelprocessor.NormalizeCustomFields{
+			MaxDepth: s.config.CustomFields.MaxDepth,
+			Numbers:  customFieldsNumbers(s.config.CustomFields.Numbers),
+		})
+	}
+	if s.config.URLDomain.Policy != config.URLDomainPolicyNone {
+		processors = append(processors, &modelprocessor.NormalizeURLDomain{
+			RemoveInvalid: s.config.URLDomain.Policy == config.URLDomainPolicyStrict,
+		})
+	}
+	if s.config.Intake.SortByTimestamp {
+		processors = append(processors, modelprocessor.SortByTimestamp{})
+	}
 	return WrapRunServerWithProcessors(runServer, processors...)
 }
 
+// customFieldsNumbers returns the modelprocessor.CustomNumbers
+// policy for the custom_fields.numbers config value.
+func customFieldsNumbers(numbers string) modelprocessor.CustomNumbers {
+	switch numbers {
+	case config.CustomFieldsNumbersFloat:
+		return modelprocessor.CustomNumbersFloat
+	case config.CustomFieldsNumbersPreserveIntegers:
+		return modelprocessor.CustomNumbersPreserveIntegers
+	}
+	return modelprocessor.CustomNumbersAsDecoded
+}
+
 func hasElasticsearchOutput(b *beat.Beat) bool {
 	return b.Config != nil && b.Config.Output.Name() == "elasticsearch"
 }
@@ -27,7 +27,8 @@ import (
 
 // KibanaAgentConfig holds remote agent config information
 type KibanaAgentConfig struct {
-	Cache Cache `config:"cache"`
+	Cache           Cache           `config:"cache"`
+	ServiceDenylist ServiceDenylist `config:"service_denylist"`
 }
 
 // Cache holds config information about cache expiration
@@ -35,6 +36,15 @@ type Cache struct {
 	Expiration time.Duration `config:"expiration"`
 }
 
+// ServiceDenylist holds configuration for rejecting intake requests from
+// services whose agent configuration has the "ingest_disabled" setting
+// set to "true". The agent configuration is fetched, and cached, at the
+// start of each intake request, so services may be disabled and enabled
+// dynamically.
+type ServiceDenylist struct {
+	Enabled bool `config:"enabled"`
+}
+
 // defaultKibanaAgentConfig holds the default KibanaAgentConfig
 func defaultKibanaAgentConfig() KibanaAgentConfig {
 	return KibanaAgentConfig{
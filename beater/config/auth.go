@@ -52,6 +52,7 @@ func (a *AgentAuth) setAnonymousDefaults(logger *logp.Logger, rumEnabled bool) e
 type APIKeyAgentAuth struct {
 	Enabled     bool                  `config:"enabled"`
 	LimitPerMin int                   `config:"limit"`
+	StreamLimit int                   `config:"stream_limit" validate:"min=0"`
 	ESConfig    *elasticsearch.Config `config:"elasticsearch"`
 
 	configured   bool // api_key explicitly defined
@@ -55,6 +55,8 @@ type Config struct {
 	ReadTimeout               time.Duration           `config:"read_timeout"`
 	WriteTimeout              time.Duration           `config:"write_timeout"`
 	MaxEventSize              int                     `config:"max_event_size"`
+	MaxMetadataSize           int                     `config:"max_metadata_size" validate:"min=0"`
+	MaxDocumentLength         int                     `config:"max_document_length"`
 	ShutdownTimeout           time.Duration           `config:"shutdown_timeout"`
 	TLS                       *tlscommon.ServerConfig `config:"ssl"`
 	MaxConnections            int                     `config:"max_connections"`
@@ -70,9 +72,19 @@ type Config struct {
 	DataStreams               DataStreamsConfig       `config:"data_streams"`
 	DefaultServiceEnvironment string                  `config:"default_service_environment"`
 	JavaAttacherConfig        JavaAttacherConfig      `config:"java_attacher"`
+	Intake                    IntakeConfig            `config:"intake"`
+	URLDomain                 URLDomainConfig         `config:"url_domain"`
+	Cookies                   CookiesConfig           `config:"cookies"`
+	CustomFields              CustomFieldsConfig      `config:"custom_fields"`
+	Transaction               TransactionConfig       `config:"transaction"`
+	OTLP                      OTLPConfig              `config:"otlp"`
 
 	AgentConfigs []AgentConfig `config:"agent_config"`
 
+	// DefaultLabels holds labels to add to intake events by event type,
+	// and optionally by type and subtype.
+	DefaultLabels []DefaultLabelsConfig `config:"default_labels"`
+
 	// WaitReadyInterval holds the interval for checks when waiting for
 	// the integration package to be installed, and for checking the
 	// Elasticsearch license level.
@@ -83,6 +95,42 @@ type Config struct {
 	// memory consumed by the processors decodeing the incoming intake events.
 	// This setting is beta and subject to breaking changes and removal.
 	MaxConcurrentDecoders uint `config:"max_concurrent_decoders"`
+
+	// MaxInFlightBatchBytes sets the limit on the total size in bytes of
+	// the events read into batches that have not yet been processed, across
+	// all intake streams. When the limit is reached, new intake requests are
+	// rejected with 503 Service Unavailable, and existing intake requests block
+	// until in-flight batches have been processed. Profile events additionally
+	// reserve the maximum size of their decompressed data. Zero means no limit.
+	// This setting is beta and subject to breaking changes and removal.
+	MaxInFlightBatchBytes int64 `config:"max_in_flight_batch_bytes" validate:"min=0"`
+
+	// MaxOTLPRequestSize sets the limit on the size in bytes of OTLP/HTTP
+	// request bodies. Larger requests are rejected with 413 Request Entity
+	// Too Large before being unmarshaled. Zero means no limit.
+	MaxOTLPRequestSize int64 `config:"max_otlp_request_size" validate:"min=0"`
+
+	// XForwardedForTrustDepth holds the number of trusted proxies in front
+	// of APM Server which append themselves to the X-Forwarded-For header.
+	// That many rightmost entries are ignored when determining the client IP,
+	// and the client-controlled Forwarded and X-Real-IP headers are ignored.
+	// When zero, the leftmost entry is used. This applies to the headers of
+	// HTTP and gRPC requests received by APM Server, not to the HTTP request
+	// headers reported in events, which passed through the monitored
+	// application's own proxies.
+	XForwardedForTrustDepth int `config:"x_forwarded_for_trust_depth" validate:"min=0"`
+
+	// EnforceAcceptCharset controls whether requests whose Accept-Charset
+	// header does not accept UTF-8 are responded to with 406 Not Acceptable,
+	// before they are handled. When false, the header is ignored and
+	// responses are UTF-8 encoded.
+	EnforceAcceptCharset bool `config:"enforce_accept_charset"`
+
+	// MaxResponseSize holds the maximum size in bytes of HTTP response
+	// bodies, or zero for no limit. Errors are omitted from intake responses
+	// exceeding the limit, and bodies which still do not fit are replaced
+	// with a short error body.
+	MaxResponseSize int `config:"max_response_size" validate:"min=0"`
 }
 
 // NewConfig creates a Config struct based on the default config and the given input params
@@ -130,15 +178,16 @@ func NewConfig(ucfg *config.C, outputESCfg *config.C) (*Config, error) {
 // DefaultConfig returns a config with default settings for `apm-server` config options.
 func DefaultConfig() *Config {
 	return &Config{
-		Host:            net.JoinHostPort("localhost", DefaultPort),
-		MaxHeaderSize:   1 * 1024 * 1024, // 1mb
-		MaxConnections:  0,               // unlimited
-		IdleTimeout:     45 * time.Second,
-		ReadTimeout:     30 * time.Second,
-		WriteTimeout:    30 * time.Second,
-		MaxEventSize:    300 * 1024, // 300 kb
-		ShutdownTimeout: 30 * time.Second,
-		AugmentEnabled:  true,
+		Host:              net.JoinHostPort("localhost", DefaultPort),
+		MaxHeaderSize:     1 * 1024 * 1024, // 1mb
+		MaxConnections:    0,               // unlimited
+		IdleTimeout:       45 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		WriteTimeout:      30 * time.Second,
+		MaxEventSize:      300 * 1024, // 300 kb
+		MaxDocumentLength: 4 * 1024,   // 4 kb
+		ShutdownTimeout:   30 * time.Second,
+		AugmentEnabled:    true,
 		Expvar: ExpvarConfig{
 			Enabled: false,
 			URL:     "/debug/vars",
@@ -152,6 +201,12 @@ func DefaultConfig() *Config {
 		DataStreams:           defaultDataStreamsConfig(),
 		AgentAuth:             defaultAgentAuth(),
 		JavaAttacherConfig:    defaultJavaAttacherConfig(),
+		Intake:                defaultIntakeConfig(),
+		URLDomain:             defaultURLDomainConfig(),
+		Cookies:               defaultCookiesConfig(),
+		CustomFields:          defaultCustomFieldsConfig(),
+		Transaction:           defaultTransactionConfig(),
+		OTLP:                  defaultOTLPConfig(),
 		WaitReadyInterval:     5 * time.Second,
 		MaxConcurrentDecoders: 200,
 	}
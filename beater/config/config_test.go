@@ -85,20 +85,59 @@ func TestUnpackConfig(t *testing.T) {
 		},
 		"overwrite default": {
 			inpCfg: map[string]interface{}{
-				"host":                    "localhost:3000",
-				"max_header_size":         8,
-				"max_event_size":          100,
-				"idle_timeout":            5 * time.Second,
-				"read_timeout":            3 * time.Second,
-				"write_timeout":           4 * time.Second,
-				"shutdown_timeout":        9 * time.Second,
-				"capture_personal_data":   true,
-				"max_concurrent_decoders": 100,
+				"host":                           "localhost:3000",
+				"max_header_size":                8,
+				"max_event_size":                 100,
+				"max_metadata_size":              200,
+				"max_document_length":            -1,
+				"idle_timeout":                   5 * time.Second,
+				"read_timeout":                   3 * time.Second,
+				"write_timeout":                  4 * time.Second,
+				"shutdown_timeout":               9 * time.Second,
+				"capture_personal_data":          true,
+				"max_concurrent_decoders":        100,
+				"max_in_flight_batch_bytes":      1048576,
+				"max_otlp_request_size":          2097152,
+				"x_forwarded_for_trust_depth":    2,
+				"enforce_accept_charset":         true,
+				"max_response_size":              4096,
+				"intake.response_mode":           "lenient",
+				"intake.stats_interval":          "30s",
+				"intake.whitespace_lines":        "reject",
+				"intake.sort_by_timestamp":       true,
+				"intake.max_buffered_events":     100,
+				"intake.max_decompression_ratio": 100,
+				"intake.max_decompressed_size":   1073741824,
+				"intake.label_conflicts":         "metadata_wins",
+				"intake.negative_span_count":     "reject",
+				"intake.timestamp_window":        "24h",
+				"intake.timestamp_out_of_window": "drop",
+				"intake.response_trailers":       true,
+				"url_domain.policy":              "strict",
+				"cookies.drop":                   false,
+				"cookies.max":                    5,
+				"custom_fields.max_depth":        3,
+				"custom_fields.numbers":          "float",
+				"transaction.max_name_length":    512,
+				"transaction.max_type_length":    256,
+				"transaction.result.normalize":   true,
+				"transaction.result.allowed":     []string{"success"},
+				"otlp": map[string]interface{}{
+					"best_effort_registration": true,
+					"metrics.enabled":          false,
+					"logs.enabled":             false,
+					"resource_attribute_labels": []map[string]interface{}{{
+						"attribute": "tenant.id",
+						"label":     "tenant_id",
+					}},
+					"log_body": "preserve",
+				},
 				"auth": map[string]interface{}{
 					"secret_token": "1234random",
 					"api_key": map[string]interface{}{
 						"enabled":             true,
 						"limit":               200,
+						"stream_limit":        4,
 						"elasticsearch.hosts": []string{"localhost:9201", "localhost:9202"},
 					},
 					"anonymous": map[string]interface{}{
@@ -148,8 +187,9 @@ func TestUnpackConfig(t *testing.T) {
 						},
 					},
 				},
-				"kibana":                        map[string]interface{}{"enabled": "true"},
-				"agent.config.cache.expiration": "2m",
+				"kibana":                                map[string]interface{}{"enabled": "true"},
+				"agent.config.cache.expiration":         "2m",
+				"agent.config.service_denylist.enabled": true,
 				"aggregation": map[string]interface{}{
 					"transactions": map[string]interface{}{
 						"interval":                         "1s",
@@ -163,19 +203,27 @@ func TestUnpackConfig(t *testing.T) {
 				"default_service_environment": "overridden",
 			},
 			outCfg: &Config{
-				Host:                  "localhost:3000",
-				MaxHeaderSize:         8,
-				MaxEventSize:          100,
-				IdleTimeout:           5000000000,
-				ReadTimeout:           3000000000,
-				WriteTimeout:          4000000000,
-				ShutdownTimeout:       9000000000,
-				MaxConcurrentDecoders: 100,
+				Host:                    "localhost:3000",
+				MaxHeaderSize:           8,
+				MaxEventSize:            100,
+				MaxMetadataSize:         200,
+				MaxDocumentLength:       -1,
+				IdleTimeout:             5000000000,
+				ReadTimeout:             3000000000,
+				WriteTimeout:            4000000000,
+				ShutdownTimeout:         9000000000,
+				MaxConcurrentDecoders:   100,
+				MaxInFlightBatchBytes:   1048576,
+				MaxOTLPRequestSize:      2097152,
+				XForwardedForTrustDepth: 2,
+				EnforceAcceptCharset:    true,
+				MaxResponseSize:         4096,
 				AgentAuth: AgentAuth{
 					SecretToken: "1234random",
 					APIKey: APIKeyAgentAuth{
 						Enabled:     true,
 						LimitPerMin: 200,
+						StreamLimit: 4,
 						ESConfig: &elasticsearch.Config{
 							Hosts:            elasticsearch.Hosts{"localhost:9201", "localhost:9202"},
 							Protocol:         "http",
@@ -239,7 +287,10 @@ func TestUnpackConfig(t *testing.T) {
 					Enabled:      true,
 					ClientConfig: defaultDecodedKibanaClientConfig,
 				},
-				KibanaAgentConfig: KibanaAgentConfig{Cache: Cache{Expiration: 2 * time.Minute}},
+				KibanaAgentConfig: KibanaAgentConfig{
+					Cache:           Cache{Expiration: 2 * time.Minute},
+					ServiceDenylist: ServiceDenylist{Enabled: true},
+				},
 				Aggregation: AggregationConfig{
 					Transactions: TransactionAggregationConfig{
 						Interval:                       time.Second,
@@ -267,6 +318,37 @@ func TestUnpackConfig(t *testing.T) {
 					WaitForIntegration: true,
 				},
 				WaitReadyInterval: 5 * time.Second,
+				Intake: IntakeConfig{
+					ResponseMode:          IntakeResponseModeLenient,
+					StatsInterval:         30 * time.Second,
+					WhitespaceLines:       IntakeWhitespaceLinesReject,
+					SortByTimestamp:       true,
+					MaxBufferedEvents:     100,
+					MaxDecompressionRatio: 100,
+					MaxDecompressedSize:   1073741824,
+					LabelConflicts:        IntakeLabelConflictsMetadataWins,
+					NegativeSpanCount:     IntakeNegativeSpanCountReject,
+					TimestampWindow:       24 * time.Hour,
+					TimestampOutOfWindow:  IntakeTimestampOutOfWindowDrop,
+					ResponseTrailers:      true,
+				},
+				URLDomain:    URLDomainConfig{Policy: URLDomainPolicyStrict},
+				Cookies:      CookiesConfig{Drop: false, Max: 5},
+				CustomFields: CustomFieldsConfig{MaxDepth: 3, Numbers: CustomFieldsNumbersFloat},
+				Transaction: TransactionConfig{
+					MaxNameLength: 512,
+					MaxTypeLength: 256,
+					Result:        TransactionResultConfig{Normalize: true, Allowed: []string{"success"}},
+				},
+				OTLP: OTLPConfig{
+					BestEffortRegistration: true,
+					Traces:                 OTLPSignalConfig{Enabled: true},
+					ResourceAttributeLabels: []OTLPResourceAttributeLabel{{
+						Attribute: "tenant.id",
+						Label:     "tenant_id",
+					}},
+					LogBody: OTLPLogBodyPreserve,
+				},
 			},
 		},
 		"merge config with default": {
@@ -327,6 +409,7 @@ func TestUnpackConfig(t *testing.T) {
 				Host:                  "localhost:3000",
 				MaxHeaderSize:         1048576,
 				MaxEventSize:          307200,
+				MaxDocumentLength:     4096,
 				IdleTimeout:           45000000000,
 				ReadTimeout:           30000000000,
 				WriteTimeout:          30000000000,
@@ -415,6 +498,27 @@ func TestUnpackConfig(t *testing.T) {
 					WaitForIntegration: false,
 				},
 				WaitReadyInterval: 5 * time.Second,
+				Intake: IntakeConfig{
+					ResponseMode:         IntakeResponseModeStrict,
+					StatsInterval:        10 * time.Second,
+					WhitespaceLines:      IntakeWhitespaceLinesSkip,
+					LabelConflicts:       IntakeLabelConflictsEventWins,
+					NegativeSpanCount:    IntakeNegativeSpanCountClamp,
+					TimestampOutOfWindow: IntakeTimestampOutOfWindowClamp,
+
+					MaxDecompressionRatio: 200,
+					MaxDecompressedSize:   256 * 1024 * 1024,
+				},
+				URLDomain:    URLDomainConfig{Policy: URLDomainPolicyNone},
+				Cookies:      CookiesConfig{Drop: true},
+				CustomFields: CustomFieldsConfig{MaxDepth: 10, Numbers: CustomFieldsNumbersAsDecoded},
+				Transaction:  TransactionConfig{MaxNameLength: 1024, MaxTypeLength: 1024},
+				OTLP: OTLPConfig{
+					Traces:  OTLPSignalConfig{Enabled: true},
+					Metrics: OTLPSignalConfig{Enabled: true},
+					Logs:    OTLPSignalConfig{Enabled: true},
+					LogBody: OTLPLogBodyStringify,
+				},
 			},
 		},
 		"kibana trailing slash": {
@@ -467,6 +571,132 @@ func TestUnpackConfig(t *testing.T) {
 	}
 }
 
+func TestUnpackConfigInvalidIntakeResponseMode(t *testing.T) {
+	inpCfg, err := config.NewConfigFrom(map[string]interface{}{
+		"intake.response_mode": "relaxed",
+	})
+	require.NoError(t, err)
+	_, err = NewConfig(inpCfg, nil)
+	assert.EqualError(t, err, `Error processing configuration: invalid value "relaxed" for intake.response_mode, expected one of "strict" or "lenient" accessing 'intake'`)
+}
+
+func TestUnpackConfigInvalidIntakeWhitespaceLines(t *testing.T) {
+	inpCfg, err := config.NewConfigFrom(map[string]interface{}{
+		"intake.whitespace_lines": "ignore",
+	})
+	require.NoError(t, err)
+	_, err = NewConfig(inpCfg, nil)
+	assert.EqualError(t, err, `Error processing configuration: invalid value "ignore" for intake.whitespace_lines, expected one of "skip" or "reject" accessing 'intake'`)
+}
+
+func TestUnpackConfigInvalidIntakeLabelConflicts(t *testing.T) {
+	inpCfg, err := config.NewConfigFrom(map[string]interface{}{
+		"intake.label_conflicts": "merge",
+	})
+	require.NoError(t, err)
+	_, err = NewConfig(inpCfg, nil)
+	assert.EqualError(t, err, `Error processing configuration: invalid value "merge" for intake.label_conflicts, expected one of "event_wins", "metadata_wins" or "error" accessing 'intake'`)
+}
+
+func TestUnpackConfigInvalidIntakeNegativeSpanCount(t *testing.T) {
+	inpCfg, err := config.NewConfigFrom(map[string]interface{}{
+		"intake.negative_span_count": "ignore",
+	})
+	require.NoError(t, err)
+	_, err = NewConfig(inpCfg, nil)
+	assert.EqualError(t, err, `Error processing configuration: invalid value "ignore" for intake.negative_span_count, expected one of "clamp" or "reject" accessing 'intake'`)
+}
+
+func TestUnpackConfigInvalidIntakeTimestampWindow(t *testing.T) {
+	inpCfg, err := config.NewConfigFrom(map[string]interface{}{
+		"intake.timestamp_out_of_window": "ignore",
+	})
+	require.NoError(t, err)
+	_, err = NewConfig(inpCfg, nil)
+	assert.EqualError(t, err, `Error processing configuration: invalid value "ignore" for intake.timestamp_out_of_window, expected one of "clamp" or "drop" accessing 'intake'`)
+
+	inpCfg, err = config.NewConfigFrom(map[string]interface{}{
+		"intake.timestamp_window": "-1h",
+	})
+	require.NoError(t, err)
+	_, err = NewConfig(inpCfg, nil)
+	assert.EqualError(t, err, `Error processing configuration: intake.timestamp_window must not be negative accessing 'intake'`)
+}
+
+func TestUnpackConfigInvalidOTLPLogBody(t *testing.T) {
+	inpCfg, err := config.NewConfigFrom(map[string]interface{}{
+		"otlp.log_body": "flatten",
+	})
+	require.NoError(t, err)
+	_, err = NewConfig(inpCfg, nil)
+	assert.EqualError(t, err, `Error processing configuration: invalid value "flatten" for otlp.log_body, expected one of "stringify" or "preserve" accessing 'otlp'`)
+}
+
+func TestUnpackConfigInvalidIntakeStatsInterval(t *testing.T) {
+	inpCfg, err := config.NewConfigFrom(map[string]interface{}{
+		"intake.stats_interval": "0s",
+	})
+	require.NoError(t, err)
+	_, err = NewConfig(inpCfg, nil)
+	assert.EqualError(t, err, `Error processing configuration: intake.stats_interval must be greater than zero accessing 'intake'`)
+}
+
+func TestUnpackConfigInvalidURLDomainPolicy(t *testing.T) {
+	inpCfg, err := config.NewConfigFrom(map[string]interface{}{
+		"url_domain.policy": "lowercase",
+	})
+	require.NoError(t, err)
+	_, err = NewConfig(inpCfg, nil)
+	assert.EqualError(t, err, `Error processing configuration: invalid value "lowercase" for url_domain.policy, expected one of "none", "normalize" or "strict" accessing 'url_domain'`)
+}
+
+func TestUnpackConfigInvalidCustomFieldsNumbers(t *testing.T) {
+	inpCfg, err := config.NewConfigFrom(map[string]interface{}{
+		"custom_fields.numbers": "int",
+	})
+	require.NoError(t, err)
+	_, err = NewConfig(inpCfg, nil)
+	assert.EqualError(t, err, `Error processing configuration: invalid value "int" for custom_fields.numbers, expected one of "as_decoded", "float" or "preserve_integers" accessing 'custom_fields'`)
+}
+
+func TestUnpackConfigDefaultLabels(t *testing.T) {
+	cfg, err := NewConfig(config.MustNewConfigFrom(`{"default_labels":[{"event":"span","type":"db","labels":{"team":"data"}}]}`), nil)
+	require.NoError(t, err)
+	assert.Equal(t, []DefaultLabelsConfig{{
+		Event:  "span",
+		Type:   "db",
+		Labels: map[string]string{"team": "data"},
+	}}, cfg.DefaultLabels)
+
+	for name, tc := range map[string]struct {
+		config string
+		err    string
+	}{
+		"invalid_event": {
+			config: `{"default_labels":[{"event":"log","labels":{"team":"data"}}]}`,
+			err:    `invalid value "log" for default_labels.event, expected one of "error", "metricset", "span" or "transaction"`,
+		},
+		"error_type": {
+			config: `{"default_labels":[{"event":"error","type":"db","labels":{"team":"data"}}]}`,
+			err:    `default_labels: type and subtype are not supported for "error" events`,
+		},
+		"transaction_subtype": {
+			config: `{"default_labels":[{"event":"transaction","subtype":"http","labels":{"team":"data"}}]}`,
+			err:    `default_labels: subtype is not supported for "transaction" events`,
+		},
+		"no_labels": {
+			config: `{"default_labels":[{"event":"span","type":"db"}]}`,
+			err:    `default_labels: no labels set`,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := NewConfig(config.MustNewConfigFrom(tc.config), nil)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tc.err)
+		})
+	}
+}
+
 func TestTLSSettings(t *testing.T) {
 	t.Run("ClientAuthentication", func(t *testing.T) {
 		for name, tc := range map[string]struct {
@@ -0,0 +1,38 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package config
+
+// CookiesConfig holds configuration related to the HTTP request cookies
+// reported by agents in transaction and error events.
+type CookiesConfig struct {
+	// Drop controls whether all HTTP request cookies are dropped from
+	// events. Cookies may hold sensitive information, so they are dropped
+	// by default.
+	Drop bool `config:"drop"`
+
+	// Max holds the maximum number of HTTP request cookies stored per
+	// event, if Drop is false. Cookies are kept in lexicographical order
+	// of their names. Zero means there is no limit.
+	Max int `config:"max" validate:"min=0"`
+}
+
+func defaultCookiesConfig() CookiesConfig {
+	return CookiesConfig{
+		Drop: true,
+	}
+}
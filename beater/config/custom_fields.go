@@ -0,0 +1,69 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package config
+
+import "github.com/pkg/errors"
+
+const (
+	// CustomFieldsNumbersAsDecoded leaves numbers in custom fields as they
+	// were decoded, so their encoding may depend on the agent or protocol.
+	CustomFieldsNumbersAsDecoded = "as_decoded"
+
+	// CustomFieldsNumbersFloat causes all numbers in custom fields to be
+	// stored as floating point numbers.
+	CustomFieldsNumbersFloat = "float"
+
+	// CustomFieldsNumbersPreserveIntegers causes numbers with integral values
+	// in custom fields to be stored as integers, e.g. 1.0 as 1, and other
+	// numbers as floating point numbers.
+	CustomFieldsNumbersPreserveIntegers = "preserve_integers"
+)
+
+// CustomFieldsConfig holds configuration related to the custom fields
+// reported by agents in transaction and error events.
+type CustomFieldsConfig struct {
+	// MaxDepth holds the maximum nesting depth of objects in the custom
+	// fields of events received from all agents. More deeply nested objects
+	// are replaced with "[truncated]". Zero means there is no limit.
+	MaxDepth int `config:"max_depth" validate:"min=0"`
+
+	// Numbers controls the types of numbers in custom fields, so they are
+	// mapped consistently. This must be one of CustomFieldsNumbersAsDecoded,
+	// CustomFieldsNumbersFloat or CustomFieldsNumbersPreserveIntegers.
+	Numbers string `config:"numbers"`
+}
+
+// Validate validates the custom_fields configuration.
+func (c *CustomFieldsConfig) Validate() error {
+	switch c.Numbers {
+	case CustomFieldsNumbersAsDecoded, CustomFieldsNumbersFloat, CustomFieldsNumbersPreserveIntegers:
+	default:
+		return errors.Errorf(
+			"invalid value %q for custom_fields.numbers, expected one of %q, %q or %q",
+			c.Numbers, CustomFieldsNumbersAsDecoded, CustomFieldsNumbersFloat, CustomFieldsNumbersPreserveIntegers,
+		)
+	}
+	return nil
+}
+
+func defaultCustomFieldsConfig() CustomFieldsConfig {
+	return CustomFieldsConfig{
+		MaxDepth: 10,
+		Numbers:  CustomFieldsNumbersAsDecoded,
+	}
+}
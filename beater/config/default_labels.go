@@ -0,0 +1,62 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package config
+
+import "github.com/pkg/errors"
+
+// DefaultLabelsConfig holds labels to add to the intake events matching
+// Event, and optionally Type and Subtype. Labels already set on an event,
+// e.g. by the agent, are not overridden.
+type DefaultLabelsConfig struct {
+	// Event holds the intake event type to match: one of "error",
+	// "metricset", "span" or "transaction".
+	Event string `config:"event"`
+
+	// Type, if non-empty, holds the span or transaction type to match.
+	Type string `config:"type"`
+
+	// Subtype, if non-empty, holds the span subtype to match.
+	Subtype string `config:"subtype"`
+
+	// Labels holds the labels to add to matching events.
+	Labels map[string]string `config:"labels"`
+}
+
+// Validate validates the default labels configuration.
+func (c *DefaultLabelsConfig) Validate() error {
+	switch c.Event {
+	case "error", "metricset":
+		if c.Type != "" || c.Subtype != "" {
+			return errors.Errorf("default_labels: type and subtype are not supported for %q events", c.Event)
+		}
+	case "transaction":
+		if c.Subtype != "" {
+			return errors.New(`default_labels: subtype is not supported for "transaction" events`)
+		}
+	case "span":
+	default:
+		return errors.Errorf(
+			"invalid value %q for default_labels.event, expected one of %q, %q, %q or %q",
+			c.Event, "error", "metricset", "span", "transaction",
+		)
+	}
+	if len(c.Labels) == 0 {
+		return errors.New("default_labels: no labels set")
+	}
+	return nil
+}
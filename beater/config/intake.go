@@ -0,0 +1,211 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package config
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// IntakeResponseModeStrict causes intake requests with any rejected
+	// events to be responded to with a 4xx status code.
+	IntakeResponseModeStrict = "strict"
+
+	// IntakeResponseModeLenient causes intake requests for which some events
+	// were accepted and others rejected as invalid to be responded to with
+	// 207 Multi-Status, and a body describing the rejected events. Only the
+	// first few rejected events are described; the number of others is
+	// reported in the body's "omitted" field.
+	IntakeResponseModeLenient = "lenient"
+
+	// IntakeWhitespaceLinesSkip causes empty lines of an intake stream, and
+	// lines holding only whitespace, to be skipped.
+	IntakeWhitespaceLinesSkip = "skip"
+
+	// IntakeWhitespaceLinesReject causes empty lines between the events of
+	// an intake stream, and lines holding only whitespace, to be rejected
+	// as invalid events.
+	IntakeWhitespaceLinesReject = "reject"
+
+	// IntakeLabelConflictsEventWins causes labels set by an event to
+	// override labels of the same name defined in the stream's metadata.
+	IntakeLabelConflictsEventWins = "event_wins"
+
+	// IntakeLabelConflictsMetadataWins causes labels defined in the
+	// stream's metadata to be kept when an event sets labels of the
+	// same name.
+	IntakeLabelConflictsMetadataWins = "metadata_wins"
+
+	// IntakeLabelConflictsError causes events setting labels defined
+	// in the stream's metadata to be rejected as invalid events.
+	IntakeLabelConflictsError = "error"
+
+	// IntakeNegativeSpanCountClamp causes negative transaction span
+	// counts to be set to zero, with a warning.
+	IntakeNegativeSpanCountClamp = "clamp"
+
+	// IntakeNegativeSpanCountReject causes transactions with negative
+	// span counts to be rejected as invalid events.
+	IntakeNegativeSpanCountReject = "reject"
+
+	// IntakeTimestampOutOfWindowClamp causes the timestamps of events
+	// outside the accepted timestamp window to be set to the time at
+	// which the request was received, with a warning.
+	IntakeTimestampOutOfWindowClamp = "clamp"
+
+	// IntakeTimestampOutOfWindowDrop causes events with timestamps outside
+	// the accepted timestamp window to be rejected as invalid events.
+	IntakeTimestampOutOfWindowDrop = "drop"
+)
+
+// IntakeConfig holds configuration related to the intake API.
+type IntakeConfig struct {
+	// ResponseMode controls the status code of responses to intake requests
+	// for which some, but not all, events were rejected. This must be one of
+	// IntakeResponseModeStrict or IntakeResponseModeLenient.
+	ResponseMode string `config:"response_mode"`
+
+	// StatsInterval holds the interval at which aggregated intake
+	// statistics are reported to the IntakeStatsCallback registered
+	// in the server parameters, if any.
+	StatsInterval time.Duration `config:"stats_interval"`
+
+	// WhitespaceLines controls the handling of intake stream lines which
+	// are empty or hold only whitespace. This must be one of IntakeWhitespaceLinesSkip or
+	// IntakeWhitespaceLinesReject.
+	WhitespaceLines string `config:"whitespace_lines"`
+
+	// SortByTimestamp controls whether the events of each batch are sorted
+	// by @timestamp before being processed, for consumers sensitive to
+	// ordering. Events without a timestamp are placed last. Sorting adds
+	// CPU overhead, so this is disabled by default.
+	SortByTimestamp bool `config:"sort_by_timestamp"`
+
+	// MaxBufferedEvents holds the maximum number of decoded events that are
+	// buffered in the batch being read from an intake stream. When it is
+	// reached, the batch is processed immediately, even if fewer than the
+	// usual number of stream lines have been read, to cap the time before
+	// events from slowly filling streams become visible. A single line may
+	// decode to multiple events, e.g. profile samples. Zero means no limit.
+	MaxBufferedEvents int `config:"max_buffered_events" validate:"min=0"`
+
+	// MaxDecompressionRatio holds the maximum ratio of decompressed to
+	// compressed bytes of compressed intake request bodies, enforced once
+	// 1MiB has been decompressed, and MaxDecompressedSize the maximum
+	// number of decompressed bytes. Requests exceeding either are aborted,
+	// guarding against small bodies decompressing to large streams.
+	// These default to 200 and 256MiB, well beyond what agents send;
+	// zero means no limit.
+	MaxDecompressionRatio float64 `config:"max_decompression_ratio" validate:"min=0"`
+	MaxDecompressedSize   int64   `config:"max_decompressed_size" validate:"min=0"`
+
+	// LabelConflicts controls the handling of events setting labels already
+	// defined in their stream's metadata. This must be one of
+	// IntakeLabelConflictsEventWins, IntakeLabelConflictsMetadataWins or
+	// IntakeLabelConflictsError.
+	LabelConflicts string `config:"label_conflicts"`
+
+	// NegativeSpanCount controls the handling of transactions with negative
+	// dropped or started span counts. This must be one of
+	// IntakeNegativeSpanCountClamp or IntakeNegativeSpanCountReject.
+	NegativeSpanCount string `config:"negative_span_count"`
+
+	// TimestampWindow holds the maximum difference between the timestamps
+	// of intake events and the time at which their request was received,
+	// guarding against agents with broken clocks. Zero means no limit.
+	// TimestampOutOfWindow controls the handling of events outside the
+	// window, and must be one of IntakeTimestampOutOfWindowClamp or
+	// IntakeTimestampOutOfWindowDrop.
+	TimestampWindow      time.Duration `config:"timestamp_window"`
+	TimestampOutOfWindow string        `config:"timestamp_out_of_window"`
+
+	// ResponseTrailers controls whether intake responses to HTTP/2 clients
+	// accepting trailers, with "TE: trailers", begin with a 200 OK header
+	// sent before the stream is decoded, and report the result in the
+	// Apm-Status, Apm-Accepted and Apm-Errors trailers. Responses to other
+	// clients, including all HTTP/1.x clients, report the result in the
+	// status code and body as usual.
+	ResponseTrailers bool `config:"response_trailers"`
+}
+
+// Validate validates the intake configuration.
+func (c *IntakeConfig) Validate() error {
+	switch c.ResponseMode {
+	case IntakeResponseModeStrict, IntakeResponseModeLenient:
+	default:
+		return errors.Errorf(
+			"invalid value %q for intake.response_mode, expected one of %q or %q",
+			c.ResponseMode, IntakeResponseModeStrict, IntakeResponseModeLenient,
+		)
+	}
+	switch c.WhitespaceLines {
+	case IntakeWhitespaceLinesSkip, IntakeWhitespaceLinesReject:
+	default:
+		return errors.Errorf(
+			"invalid value %q for intake.whitespace_lines, expected one of %q or %q",
+			c.WhitespaceLines, IntakeWhitespaceLinesSkip, IntakeWhitespaceLinesReject,
+		)
+	}
+	switch c.LabelConflicts {
+	case IntakeLabelConflictsEventWins, IntakeLabelConflictsMetadataWins, IntakeLabelConflictsError:
+	default:
+		return errors.Errorf(
+			"invalid value %q for intake.label_conflicts, expected one of %q, %q or %q",
+			c.LabelConflicts, IntakeLabelConflictsEventWins, IntakeLabelConflictsMetadataWins, IntakeLabelConflictsError,
+		)
+	}
+	switch c.NegativeSpanCount {
+	case IntakeNegativeSpanCountClamp, IntakeNegativeSpanCountReject:
+	default:
+		return errors.Errorf(
+			"invalid value %q for intake.negative_span_count, expected one of %q or %q",
+			c.NegativeSpanCount, IntakeNegativeSpanCountClamp, IntakeNegativeSpanCountReject,
+		)
+	}
+	switch c.TimestampOutOfWindow {
+	case IntakeTimestampOutOfWindowClamp, IntakeTimestampOutOfWindowDrop:
+	default:
+		return errors.Errorf(
+			"invalid value %q for intake.timestamp_out_of_window, expected one of %q or %q",
+			c.TimestampOutOfWindow, IntakeTimestampOutOfWindowClamp, IntakeTimestampOutOfWindowDrop,
+		)
+	}
+	if c.TimestampWindow < 0 {
+		return errors.New("intake.timestamp_window must not be negative")
+	}
+	if c.StatsInterval <= 0 {
+		return errors.New("intake.stats_interval must be greater than zero")
+	}
+	return nil
+}
+
+func defaultIntakeConfig() IntakeConfig {
+	return IntakeConfig{
+		ResponseMode:         IntakeResponseModeStrict,
+		StatsInterval:        10 * time.Second,
+		WhitespaceLines:      IntakeWhitespaceLinesSkip,
+		LabelConflicts:       IntakeLabelConflictsEventWins,
+		NegativeSpanCount:    IntakeNegativeSpanCountClamp,
+		TimestampOutOfWindow: IntakeTimestampOutOfWindowClamp,
+
+		MaxDecompressionRatio: 200,
+		MaxDecompressedSize:   256 * 1024 * 1024,
+	}
+}
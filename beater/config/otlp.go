@@ -0,0 +1,97 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package config
+
+import "github.com/pkg/errors"
+
+const (
+	// OTLPLogBodyStringify causes the bodies of OTLP log records to be
+	// recorded as the event message, with the entries of map bodies also
+	// recorded as labels. This is the default.
+	OTLPLogBodyStringify = "stringify"
+
+	// OTLPLogBodyPreserve causes the map bodies of OTLP log records to be
+	// recorded in the log.body field, keeping their structure. Other
+	// bodies are recorded as the event message.
+	OTLPLogBodyPreserve = "preserve"
+)
+
+// OTLPConfig holds configuration related to OpenTelemetry Protocol intake.
+type OTLPConfig struct {
+	// BestEffortRegistration controls whether the OTLP/HTTP receivers are
+	// registered on a best-effort basis. When true, a receiver that fails
+	// to be created is logged and skipped, and the other receivers are
+	// still registered; otlp.HTTPStatus reports which were registered.
+	// When false, any failure prevents the server from starting.
+	BestEffortRegistration bool `config:"best_effort_registration"`
+
+	// Traces, Metrics, and Logs control whether each signal is accepted.
+	// A disabled signal's OTLP/HTTP receiver is not registered, and its
+	// path is responded to with 404 Not Found.
+	Traces  OTLPSignalConfig `config:"traces"`
+	Metrics OTLPSignalConfig `config:"metrics"`
+	Logs    OTLPSignalConfig `config:"logs"`
+
+	// ResourceAttributeLabels maps OTLP resource attribute keys to label
+	// keys. Mapped resource attributes received over OTLP/gRPC or OTLP/HTTP
+	// are recorded as labels with the given key; unmapped attributes are
+	// unaffected.
+	ResourceAttributeLabels []OTLPResourceAttributeLabel `config:"resource_attribute_labels"`
+
+	// LogBody controls how the bodies of OTLP log records received over
+	// OTLP/HTTP are mapped to events. This must be one of
+	// OTLPLogBodyStringify or OTLPLogBodyPreserve.
+	LogBody string `config:"log_body"`
+}
+
+// Validate validates the OTLP configuration.
+func (c *OTLPConfig) Validate() error {
+	switch c.LogBody {
+	case OTLPLogBodyStringify, OTLPLogBodyPreserve:
+	default:
+		return errors.Errorf(
+			"invalid value %q for otlp.log_body, expected one of %q or %q",
+			c.LogBody, OTLPLogBodyStringify, OTLPLogBodyPreserve,
+		)
+	}
+	return nil
+}
+
+// OTLPResourceAttributeLabel holds the mapping of an OTLP resource
+// attribute to a label.
+//
+// This is a list entry rather than a map, as resource attribute keys
+// conventionally contain dots, which would be expanded by the config.
+type OTLPResourceAttributeLabel struct {
+	Attribute string `config:"attribute" validate:"required"`
+	Label     string `config:"label" validate:"required"`
+}
+
+// OTLPSignalConfig holds configuration for an OTLP signal.
+type OTLPSignalConfig struct {
+	Enabled bool `config:"enabled"`
+}
+
+func defaultOTLPConfig() OTLPConfig {
+	return OTLPConfig{
+		Traces:  OTLPSignalConfig{Enabled: true},
+		Metrics: OTLPSignalConfig{Enabled: true},
+		Logs:    OTLPSignalConfig{Enabled: true},
+		LogBody: OTLPLogBodyStringify,
+	}
+}
@@ -0,0 +1,53 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package config
+
+// TransactionConfig holds configuration related to the transactions
+// received from all sources, applied before they are aggregated.
+type TransactionConfig struct {
+	// MaxNameLength and MaxTypeLength hold the maximum number of characters
+	// in transaction.name and transaction.type. Longer values are truncated
+	// when they are decoded, with the last character replaced by "…". Zero
+	// means there is no limit.
+	MaxNameLength int `config:"max_name_length" validate:"min=0"`
+	MaxTypeLength int `config:"max_type_length" validate:"min=0"`
+
+	// Result holds configuration for normalizing transaction.result.
+	Result TransactionResultConfig `config:"result"`
+}
+
+// TransactionResultConfig holds configuration for limiting the cardinality
+// of transaction.result, e.g. when agents record request IDs as results.
+type TransactionResultConfig struct {
+	// Normalize controls whether transaction results are normalized before
+	// they are aggregated. HTTP status class results such as "HTTP 2xx" and
+	// the results in Allowed are kept, HTTP status code results such as
+	// "HTTP 404" are replaced with their status class, and all other results
+	// are replaced with "other".
+	Normalize bool `config:"normalize"`
+
+	// Allowed holds the results which are kept when Normalize is true.
+	Allowed []string `config:"allowed"`
+}
+
+func defaultTransactionConfig() TransactionConfig {
+	return TransactionConfig{
+		MaxNameLength: 1024,
+		MaxTypeLength: 1024,
+	}
+}
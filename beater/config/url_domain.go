@@ -0,0 +1,62 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package config
+
+import "github.com/pkg/errors"
+
+const (
+	// URLDomainPolicyNone leaves url.domain as reported by agents.
+	URLDomainPolicyNone = "none"
+
+	// URLDomainPolicyNormalize causes url.domain to be normalized: any port
+	// is moved into url.port, the domain is lowercased, and a trailing dot
+	// is removed.
+	URLDomainPolicyNormalize = "normalize"
+
+	// URLDomainPolicyStrict causes url.domain to be normalized as with
+	// URLDomainPolicyNormalize, and removed if it is not a valid hostname
+	// or IP address.
+	URLDomainPolicyStrict = "strict"
+)
+
+// URLDomainConfig holds configuration related to the handling of url.domain.
+type URLDomainConfig struct {
+	// Policy controls how url.domain is normalized and validated. This must
+	// be one of URLDomainPolicyNone, URLDomainPolicyNormalize, or
+	// URLDomainPolicyStrict.
+	Policy string `config:"policy"`
+}
+
+// Validate validates the url.domain configuration.
+func (c *URLDomainConfig) Validate() error {
+	switch c.Policy {
+	case URLDomainPolicyNone, URLDomainPolicyNormalize, URLDomainPolicyStrict:
+	default:
+		return errors.Errorf(
+			"invalid value %q for url_domain.policy, expected one of %q, %q or %q",
+			c.Policy, URLDomainPolicyNone, URLDomainPolicyNormalize, URLDomainPolicyStrict,
+		)
+	}
+	return nil
+}
+
+func defaultURLDomainConfig() URLDomainConfig {
+	return URLDomainConfig{
+		Policy: URLDomainPolicyNone,
+	}
+}
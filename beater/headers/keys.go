@@ -20,6 +20,7 @@ package headers
 // http header keys
 const (
 	Accept                     = "Accept"
+	AcceptCharset              = "Accept-Charset"
 	AccessControlAllowHeaders  = "Access-Control-Allow-Headers"
 	AccessControlAllowMethods  = "Access-Control-Allow-Methods"
 	AccessControlAllowOrigin   = "Access-Control-Allow-Origin"
@@ -36,7 +37,17 @@ const (
 	Etag                       = "Etag"
 	IfNoneMatch                = "If-None-Match"
 	Origin                     = "Origin"
+	TE                         = "TE"
+	Trailer                    = "Trailer"
 	UserAgent                  = "User-Agent"
 	Vary                       = "Vary"
 	XContentTypeOptions        = "X-Content-Type-Options"
 )
+
+// trailer keys used for reporting intake results,
+// see request.Context.WriteHeaderWithTrailers
+const (
+	APMStatus   = "Apm-Status"
+	APMAccepted = "Apm-Accepted"
+	APMErrors   = "Apm-Errors"
+)
@@ -33,7 +33,10 @@ import (
 // extracts metadata relating to the gRPC client, and adds it to the context.
 //
 // Metadata can be extracted from context using ClientMetadataFromContext.
-func ClientMetadata() grpc.UnaryServerInterceptor {
+//
+// xffTrustDepth holds the number of trusted proxies which append themselves to
+// the X-Forwarded-For header; see netutil.ClientAddrFromHeadersTrustDepth.
+func ClientMetadata(xffTrustDepth int) grpc.UnaryServerInterceptor {
 	return func(
 		ctx context.Context,
 		req interface{},
@@ -52,7 +55,7 @@ func ClientMetadata() grpc.UnaryServerInterceptor {
 				values.UserAgent = ua[0]
 			}
 			// Account for `forwarded`, `x-real-ip`, `x-forwarded-for` headers
-			if ip, port := netutil.ClientAddrFromHeaders(http.Header(md)); ip != nil {
+			if ip, port := netutil.ClientAddrFromHeadersTrustDepth(http.Header(md), xffTrustDepth); ip != nil {
 				values.SourceNATIP = values.ClientIP
 				values.ClientIP = ip
 				values.SourceAddr = &net.TCPAddr{IP: ip, Port: int(port)}
@@ -37,7 +37,7 @@ func TestClientMetadata(t *testing.T) {
 		Port: 1111,
 	}
 
-	interceptor := ClientMetadata()
+	interceptor := ClientMetadata(0)
 
 	for _, test := range []struct {
 		peer     *peer.Peer
@@ -85,3 +85,29 @@ func TestClientMetadata(t *testing.T) {
 		assert.Equal(t, test.expected, got)
 	}
 }
+
+func TestClientMetadataTrustDepth(t *testing.T) {
+	tcpAddr := &net.TCPAddr{
+		IP:   net.ParseIP("1.2.3.4"),
+		Port: 56837,
+	}
+	interceptor := ClientMetadata(1)
+
+	ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: tcpAddr})
+	ctx = metadata.NewIncomingContext(ctx, metadata.Pairs(
+		"X-Real-Ip", "9.9.9.9",
+		"X-Forwarded-For", "9.9.9.9, 5.6.7.8, 10.0.0.1",
+	))
+	var got ClientMetadataValues
+	var ok bool
+	interceptor(ctx, nil, nil, func(ctx context.Context, req interface{}) (interface{}, error) {
+		got, ok = ClientMetadataFromContext(ctx)
+		return nil, nil
+	})
+	assert.True(t, ok)
+	assert.Equal(t, ClientMetadataValues{
+		SourceAddr:  &net.TCPAddr{IP: net.ParseIP("5.6.7.8")},
+		ClientIP:    net.ParseIP("5.6.7.8"),
+		SourceNATIP: tcpAddr.IP,
+	}, got)
+}
@@ -0,0 +1,42 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package middleware
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/elastic/apm-server/beater/request"
+)
+
+var errUTF8NotAcceptable = errors.New("responses are only available in the utf-8 charset")
+
+// AcceptCharsetMiddleware returns a Middleware responding with 406 Not Acceptable
+// to requests whose Accept-Charset header does not accept UTF-8, before the
+// request is handled.
+func AcceptCharsetMiddleware() Middleware {
+	return func(h request.Handler) (request.Handler, error) {
+		return func(c *request.Context) {
+			if c.AcceptsUTF8() {
+				h(c)
+			} else {
+				c.Result.SetWithError(request.IDResponseErrorsNotAcceptable, errUTF8NotAcceptable)
+				c.WriteResult()
+			}
+		}, nil
+	}
+}
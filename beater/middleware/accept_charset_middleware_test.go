@@ -0,0 +1,47 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package middleware
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/elastic/apm-server/beater/beatertest"
+	"github.com/elastic/apm-server/beater/headers"
+	"github.com/elastic/apm-server/beater/request"
+)
+
+func TestAcceptCharsetMiddleware(t *testing.T) {
+	t.Run("Acceptable", func(t *testing.T) {
+		c, rec := beatertest.DefaultContextWithResponseRecorder()
+		c.Request.Header.Set(headers.AcceptCharset, "iso-8859-1, utf8;q=0.5")
+		Apply(AcceptCharsetMiddleware(), beatertest.Handler202)(c)
+		assert.Equal(t, http.StatusAccepted, rec.Code)
+	})
+	t.Run("NotAcceptable", func(t *testing.T) {
+		var handled bool
+		c, rec := beatertest.DefaultContextWithResponseRecorder()
+		c.Request.Header.Set(headers.AcceptCharset, "iso-8859-1")
+		Apply(AcceptCharsetMiddleware(), func(c *request.Context) { handled = true })(c)
+		assert.False(t, handled)
+		assert.Equal(t, http.StatusNotAcceptable, rec.Code)
+		assert.Equal(t, request.IDResponseErrorsNotAcceptable, c.Result.ID)
+	})
+}
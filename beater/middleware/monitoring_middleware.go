@@ -51,3 +51,62 @@ func MonitoringMiddleware(m map[request.ResultID]*monitoring.Int) Middleware {
 
 	}
 }
+
+// StatusClassMonitoringMiddleware returns a middleware that increases the
+// request.IDResponseStatus2xx, IDResponseStatus4xx and IDResponseStatus5xx
+// counters in m according to the status code written to c.ResponseWriter.
+//
+// Unlike MonitoringMiddleware, this does not rely on c.Result, and so also
+// covers handlers that write directly to c.ResponseWriter.
+func StatusClassMonitoringMiddleware(m map[request.ResultID]*monitoring.Int) Middleware {
+	return func(h request.Handler) (request.Handler, error) {
+		return func(c *request.Context) {
+			w := &statusRecorder{ResponseWriter: c.ResponseWriter}
+			c.ResponseWriter = w
+			h(c)
+			c.ResponseWriter = w.ResponseWriter
+
+			var id request.ResultID
+			switch status := w.statusCode(); {
+			case status >= 500 && status < 600:
+				id = request.IDResponseStatus5xx
+			case status >= 400 && status < 500:
+				id = request.IDResponseStatus4xx
+			case status >= 200 && status < 300:
+				id = request.IDResponseStatus2xx
+			}
+			if counter, ok := m[id]; ok {
+				counter.Inc()
+			}
+		}, nil
+	}
+}
+
+// statusRecorder records the status code written to an http.ResponseWriter.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+// statusCode returns the recorded status code. If nothing was written,
+// net/http responds with 200 OK.
+func (w *statusRecorder) statusCode() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
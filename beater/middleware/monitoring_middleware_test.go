@@ -18,6 +18,7 @@
 package middleware
 
 import (
+	"net/http"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -99,3 +100,34 @@ func TestMonitoringHandler(t *testing.T) {
 			mockMonitoringNil)
 	})
 }
+
+func TestStatusClassMonitoringMiddleware(t *testing.T) {
+	m := request.MonitoringMapForRegistry(mockMonitoringRegistry, []request.ResultID{
+		request.IDResponseStatus2xx,
+		request.IDResponseStatus4xx,
+		request.IDResponseStatus5xx,
+	})
+	check := func(t *testing.T, h request.Handler, expected map[request.ResultID]int) {
+		beatertest.ClearRegistry(m)
+		c, _ := beatertest.DefaultContextWithResponseRecorder()
+		Apply(StatusClassMonitoringMiddleware(m), h)(c)
+		equal, result := beatertest.CompareMonitoringInt(expected, m)
+		assert.True(t, equal, result)
+	}
+
+	t.Run("Result", func(t *testing.T) {
+		check(t, beatertest.Handler403, map[request.ResultID]int{request.IDResponseStatus4xx: 1})
+		check(t, beatertest.Handler202, map[request.ResultID]int{request.IDResponseStatus2xx: 1})
+	})
+	t.Run("ResponseWriter", func(t *testing.T) {
+		check(t, func(c *request.Context) {
+			c.ResponseWriter.WriteHeader(http.StatusServiceUnavailable)
+		}, map[request.ResultID]int{request.IDResponseStatus5xx: 1})
+		check(t, func(c *request.Context) {
+			c.ResponseWriter.Write([]byte("ok"))
+		}, map[request.ResultID]int{request.IDResponseStatus2xx: 1})
+	})
+	t.Run("Idle", func(t *testing.T) {
+		check(t, beatertest.HandlerIdle, map[request.ResultID]int{request.IDResponseStatus2xx: 1})
+	})
+}
@@ -50,3 +50,33 @@ func AnonymousRateLimitMiddleware(store *ratelimit.Store) Middleware {
 		}, nil
 	}
 }
+
+// APIKeyStreamLimitMiddleware limits the number of concurrent requests
+// authenticated with the same API key, responding with 429 Too Many Requests
+// when the limit is exceeded. The stream is released when the wrapped handler
+// returns.
+//
+// This middleware must be wrapped by AuthorizationMiddleware, as it depends on
+// the value of c.Authentication.
+func APIKeyStreamLimitMiddleware(limiter *ratelimit.StreamLimiter) Middleware {
+	return func(h request.Handler) (request.Handler, error) {
+		if limiter == nil {
+			return h, nil
+		}
+		return func(c *request.Context) {
+			if c.Authentication.Method == auth.MethodAPIKey && c.Authentication.APIKey != nil {
+				key := c.Authentication.APIKey.ID
+				if !limiter.Acquire(key) {
+					c.Result.SetWithError(
+						request.IDResponseErrorsRateLimit,
+						ratelimit.ErrStreamLimitExceeded,
+					)
+					c.WriteResult()
+					return
+				}
+				defer limiter.Release(key)
+			}
+			h(c)
+		}, nil
+	}
+}
@@ -20,11 +20,13 @@ package middleware
 import (
 	"net/http"
 	"net/http/httptest"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	"github.com/elastic/apm-server/beater/auth"
 	"github.com/elastic/apm-server/beater/ratelimit"
 	"github.com/elastic/apm-server/beater/request"
 )
@@ -107,3 +109,69 @@ func TestAnonymousRateLimitMiddlewareForIP(t *testing.T) {
 	// ratelimit.Store size is 2: the 3rd IP reuses an existing (depleted) rate limiter.
 	assert.Equal(t, http.StatusTooManyRequests, requestWithIP("10.1.1.3"))
 }
+
+func TestAPIKeyStreamLimitMiddleware(t *testing.T) {
+	const limit = 3
+	const streams = 10
+
+	entered := make(chan struct{}, streams)
+	unblock := make(chan struct{})
+	handler := func(c *request.Context) {
+		entered <- struct{}{}
+		<-unblock
+	}
+	wrapped, err := APIKeyStreamLimitMiddleware(ratelimit.NewStreamLimiter(limit))(handler)
+	require.NoError(t, err)
+
+	requestWithAPIKey := func(id string) int {
+		c := request.NewContext()
+		w := httptest.NewRecorder()
+		c.Reset(w, httptest.NewRequest("POST", "/", nil))
+		c.Authentication.Method = auth.MethodAPIKey
+		c.Authentication.APIKey = &auth.APIKeyAuthenticationDetails{ID: id}
+		wrapped(c)
+		return w.Code
+	}
+
+	codes := make(chan int, streams)
+	var wg sync.WaitGroup
+	for i := 0; i < streams; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes <- requestWithAPIKey("key")
+		}()
+	}
+
+	// Excess streams are rejected while the first ones are active.
+	for i := 0; i < streams-limit; i++ {
+		assert.Equal(t, http.StatusTooManyRequests, <-codes)
+	}
+	for i := 0; i < limit; i++ {
+		<-entered
+	}
+
+	// Streams for other API keys, and for requests not authenticated
+	// with an API key, are not affected.
+	go requestWithAPIKey("other")
+	<-entered
+	go func() {
+		c := request.NewContext()
+		c.Reset(httptest.NewRecorder(), httptest.NewRequest("POST", "/", nil))
+		c.Authentication.Method = auth.MethodSecretToken
+		wrapped(c)
+	}()
+	<-entered
+
+	close(unblock)
+	wg.Wait()
+	close(codes)
+	for code := range codes {
+		assert.Equal(t, http.StatusOK, code)
+	}
+
+	// Streams are released when the handler returns.
+	for i := 0; i < limit; i++ {
+		assert.Equal(t, http.StatusOK, requestWithAPIKey("key"))
+	}
+}
@@ -31,6 +31,16 @@ var (
 		request.IDResponseErrorsTimeout,
 		request.IDResponseErrorsUnauthorized,
 	)
+
+	// httpMonitoringKeys additionally holds counters for OTLP/HTTP
+	// requests rejected for being too large, and for OTLP/HTTP
+	// responses by status code class.
+	httpMonitoringKeys = append(append([]request.ResultID{}, monitoringKeys...),
+		request.IDRequestTooLarge,
+		request.IDResponseStatus2xx,
+		request.IDResponseStatus4xx,
+		request.IDResponseStatus5xx,
+	)
 )
 
 type monitoredConsumer struct {
@@ -56,5 +66,11 @@ func (m *monitoredConsumer) collect(mode monitoring.Mode, V monitoring.Visitor)
 	}
 
 	stats := c.Stats()
+	// unsupported_dropped is kept for backwards compatibility.
+	// Only metrics have unsupported data items, which are dropped.
 	monitoring.ReportInt(V, "unsupported_dropped", stats.UnsupportedMetricsDropped)
+	monitoring.ReportNamespace(V, "metrics", func() {
+		monitoring.ReportInt(V, "unsupported_dropped", stats.UnsupportedMetricsDropped)
+	})
+	monitoring.ReportInt(V, "invalid_spans_dropped", stats.InvalidSpansDropped)
 }
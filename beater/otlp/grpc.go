@@ -27,6 +27,7 @@ import (
 	"github.com/elastic/elastic-agent-libs/monitoring"
 
 	"github.com/elastic/apm-server/beater/auth"
+	"github.com/elastic/apm-server/beater/config"
 	"github.com/elastic/apm-server/beater/interceptors"
 	"github.com/elastic/apm-server/beater/request"
 	"github.com/elastic/apm-server/model"
@@ -73,11 +74,15 @@ func MethodAuthenticators(authenticator *auth.Authenticator) map[string]intercep
 }
 
 // RegisterGRPCServices registers OTLP consumer services with the given gRPC server.
-func RegisterGRPCServices(grpcServer *grpc.Server, processor model.BatchProcessor) error {
+// Resource attributes are mapped to labels as configured in cfg.
+func RegisterGRPCServices(grpcServer *grpc.Server, processor model.BatchProcessor, cfg config.OTLPConfig) error {
 	// TODO(axw) stop assuming we have only one OTLP gRPC service running
 	// at any time, and instead aggregate metrics from consumers that are
 	// dynamically registered and unregistered.
-	consumer := &otel.Consumer{Processor: processor}
+	consumer := &otel.Consumer{
+		Processor:               processor,
+		ResourceAttributeLabels: resourceAttributeLabels(cfg),
+	}
 	gRPCMonitoredConsumer.set(consumer)
 
 	if err := otlpreceiver.RegisterGRPCTraceReceiver(context.Background(), consumer, grpcServer); err != nil {
@@ -31,6 +31,7 @@ import (
 	"google.golang.org/grpc/credentials/insecure"
 	"google.golang.org/grpc/status"
 
+	"github.com/elastic/apm-server/beater/config"
 	"github.com/elastic/apm-server/beater/interceptors"
 	"github.com/elastic/apm-server/beater/otlp"
 	"github.com/elastic/apm-server/model"
@@ -56,6 +57,8 @@ func TestConsumeTracesGRPC(t *testing.T) {
 	traces := pdata.NewTraces()
 	span := traces.ResourceSpans().AppendEmpty().InstrumentationLibrarySpans().AppendEmpty().Spans().AppendEmpty()
 	span.SetName("operation_name")
+	span.SetTraceID(pdata.NewTraceID([16]byte{1}))
+	span.SetSpanID(pdata.NewSpanID([8]byte{2}))
 
 	tracesRequest := otlpgrpc.NewTracesRequest()
 	tracesRequest.SetTraces(traces)
@@ -123,7 +126,9 @@ func TestConsumeMetricsGRPC(t *testing.T) {
 		actual[key] = value
 	})
 	assert.Equal(t, map[string]interface{}{
-		"consumer.unsupported_dropped": int64(0),
+		"consumer.unsupported_dropped":         int64(0),
+		"consumer.metrics.unsupported_dropped": int64(0),
+		"consumer.invalid_spans_dropped":       int64(0),
 
 		"request.count":                int64(2),
 		"response.count":               int64(2),
@@ -184,14 +189,46 @@ func TestConsumeLogsGRPC(t *testing.T) {
 	}, actual)
 }
 
+func TestConsumeGRPCResourceAttributeLabels(t *testing.T) {
+	var batches []model.Batch
+	var batchProcessor model.ProcessBatchFunc = func(ctx context.Context, batch *model.Batch) error {
+		batches = append(batches, *batch)
+		return nil
+	}
+
+	cfg := config.DefaultConfig().OTLP
+	cfg.ResourceAttributeLabels = []config.OTLPResourceAttributeLabel{
+		{Attribute: "tenant.id", Label: "tenant_id"},
+	}
+	conn := newGRPCServerConfig(t, cfg, batchProcessor)
+	client := otlpgrpc.NewLogsClient(conn)
+
+	logs := pdata.NewLogs()
+	resourceLogs := logs.ResourceLogs().AppendEmpty()
+	resourceLogs.Resource().Attributes().InsertString("tenant.id", "abc")
+	resourceLogs.InstrumentationLibraryLogs().AppendEmpty().LogRecords().AppendEmpty().SetName("log_name")
+
+	logsRequest := otlpgrpc.NewLogsRequest()
+	logsRequest.SetLogs(logs)
+	_, err := client.Export(context.Background(), logsRequest)
+	require.NoError(t, err)
+	require.Len(t, batches, 1)
+	require.Len(t, batches[0], 1)
+	assert.Equal(t, model.LabelValue{Value: "abc"}, batches[0][0].Labels["tenant_id"])
+}
+
 func newGRPCServer(t *testing.T, batchProcessor model.BatchProcessor) *grpc.ClientConn {
+	return newGRPCServerConfig(t, config.DefaultConfig().OTLP, batchProcessor)
+}
+
+func newGRPCServerConfig(t *testing.T, cfg config.OTLPConfig, batchProcessor model.BatchProcessor) *grpc.ClientConn {
 	lis, err := net.Listen("tcp", "localhost:0")
 	require.NoError(t, err)
 	logger := logp.NewLogger("otlp.grpc.test")
 	srv := grpc.NewServer(
 		grpc.UnaryInterceptor(interceptors.Metrics(logger, otlp.GRPCRegistryMonitoringMaps)),
 	)
-	err = otlp.RegisterGRPCServices(srv, batchProcessor)
+	err = otlp.RegisterGRPCServices(srv, batchProcessor, cfg)
 	require.NoError(t, err)
 
 	go srv.Serve(lis)
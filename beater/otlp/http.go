@@ -19,53 +19,210 @@ package otlp
 
 import (
 	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
 
 	"github.com/pkg/errors"
 	"go.opentelemetry.io/collector/receiver/otlpreceiver"
 
+	"github.com/elastic/apm-server/beater/config"
 	"github.com/elastic/apm-server/beater/request"
+	logs "github.com/elastic/apm-server/log"
 	"github.com/elastic/apm-server/model"
 	"github.com/elastic/apm-server/processor/otel"
+	"github.com/elastic/elastic-agent-libs/logp"
 	"github.com/elastic/elastic-agent-libs/monitoring"
 )
 
 var (
-	httpMetricsRegistry      = monitoring.Default.NewRegistry("apm-server.otlp.http.metrics")
-	HTTPMetricsMonitoringMap = request.MonitoringMapForRegistry(httpMetricsRegistry, monitoringKeys)
-	httpTracesRegistry       = monitoring.Default.NewRegistry("apm-server.otlp.http.traces")
-	HTTPTracesMonitoringMap  = request.MonitoringMapForRegistry(httpTracesRegistry, monitoringKeys)
-	httpLogsRegistry         = monitoring.Default.NewRegistry("apm-server.otlp.http.logs")
-	HTTPLogsMonitoringMap    = request.MonitoringMapForRegistry(httpLogsRegistry, monitoringKeys)
+	// httpRegistry holds the OTLP/HTTP consumer stats for all signals,
+	// as "consumer", whichever signals are enabled.
+	httpRegistry = monitoring.Default.NewRegistry("apm-server.otlp.http")
+
+	// The HTTP monitoring registries of each signal are created when first
+	// used, so that no registry exists for a disabled signal. The metrics
+	// registry also reports the consumer stats, for backwards compatibility.
+	httpMetricsMonitoringMap = lazyMonitoringMap{
+		name: "apm-server.otlp.http.metrics",
+		init: func(registry *monitoring.Registry) {
+			monitoring.NewFunc(registry, "consumer", httpMonitoredConsumer.collect, monitoring.Report)
+		},
+	}
+	httpTracesMonitoringMap = lazyMonitoringMap{name: "apm-server.otlp.http.traces"}
+	httpLogsMonitoringMap   = lazyMonitoringMap{name: "apm-server.otlp.http.logs"}
 
 	httpMonitoredConsumer monitoredConsumer
+
+	httpStatusMu sync.RWMutex
+	httpStatus   HTTPReceiverStatus
 )
 
 func init() {
-	monitoring.NewFunc(httpMetricsRegistry, "consumer", httpMonitoredConsumer.collect, monitoring.Report)
+	monitoring.NewFunc(httpRegistry, "consumer", httpMonitoredConsumer.collect, monitoring.Report)
+}
+
+// HTTPMetricsMonitoringMap returns the monitoring map for OTLP/HTTP metrics
+// requests, creating the "apm-server.otlp.http.metrics" registry if needed.
+func HTTPMetricsMonitoringMap() map[request.ResultID]*monitoring.Int {
+	return httpMetricsMonitoringMap.get()
+}
+
+// HTTPTracesMonitoringMap returns the monitoring map for OTLP/HTTP trace
+// requests, creating the "apm-server.otlp.http.traces" registry if needed.
+func HTTPTracesMonitoringMap() map[request.ResultID]*monitoring.Int {
+	return httpTracesMonitoringMap.get()
+}
+
+// HTTPLogsMonitoringMap returns the monitoring map for OTLP/HTTP logs
+// requests, creating the "apm-server.otlp.http.logs" registry if needed.
+func HTTPLogsMonitoringMap() map[request.ResultID]*monitoring.Int {
+	return httpLogsMonitoringMap.get()
+}
+
+type lazyMonitoringMap struct {
+	once sync.Once
+	name string
+	init func(*monitoring.Registry)
+	m    map[request.ResultID]*monitoring.Int
+}
+
+func (l *lazyMonitoringMap) get() map[request.ResultID]*monitoring.Int {
+	l.once.Do(func() {
+		registry := monitoring.Default.NewRegistry(l.name)
+		if l.init != nil {
+			l.init(registry)
+		}
+		l.m = request.MonitoringMapForRegistry(registry, httpMonitoringKeys)
+	})
+	return l.m
+}
+
+// HTTPReceiverStatus records which OTLP/HTTP receivers are registered.
+type HTTPReceiverStatus struct {
+	Traces  bool
+	Metrics bool
+	Logs    bool
+
+	// disabled records the receivers that are not registered
+	// because their signal is disabled in configuration.
+	disabled struct {
+		traces, metrics, logs bool
+	}
+}
+
+// Err returns an error naming the enabled receivers that are not
+// registered, or nil if all enabled receivers are registered.
+func (s HTTPReceiverStatus) Err() error {
+	var missing []string
+	if !s.Traces && !s.disabled.traces {
+		missing = append(missing, "traces")
+	}
+	if !s.Metrics && !s.disabled.metrics {
+		missing = append(missing, "metrics")
+	}
+	if !s.Logs && !s.disabled.logs {
+		missing = append(missing, "logs")
+	}
+	switch len(missing) {
+	case 0:
+		return nil
+	case 1:
+		return fmt.Errorf("%s receiver not registered", missing[0])
+	}
+	return fmt.Errorf("%s receivers not registered", strings.Join(missing, ", "))
 }
 
-func NewHTTPHandlers(processor model.BatchProcessor) (*otlpreceiver.HTTPHandlers, error) {
+// HTTPStatus returns the status of the OTLP/HTTP receivers created by
+// the most recent call to NewHTTPHandlers.
+func HTTPStatus() HTTPReceiverStatus {
+	httpStatusMu.RLock()
+	defer httpStatusMu.RUnlock()
+	return httpStatus
+}
+
+// NewHTTPHandlers returns OTLP/HTTP handlers which convert and send data
+// to processor. If sem is non-nil, it is used to limit the number of OTLP
+// requests processed concurrently; it may be shared with intake.
+//
+// Handlers for signals that are disabled in cfg are left nil. If
+// cfg.BestEffortRegistration is true, receivers that cannot be created
+// are also logged and their handlers left nil, rather than an error returned.
+func NewHTTPHandlers(processor model.BatchProcessor, sem chan struct{}, cfg config.OTLPConfig) (*otlpreceiver.HTTPHandlers, error) {
 	// TODO(axw) stop assuming we have only one OTLP HTTP consumer running
 	// at any time, and instead aggregate metrics from consumers that are
 	// dynamically registered and unregistered.
-	consumer := &otel.Consumer{Processor: processor}
+	consumer := &otel.Consumer{
+		Processor:               processor,
+		Semaphore:               sem,
+		ResourceAttributeLabels: resourceAttributeLabels(cfg),
+		PreserveLogBodies:       cfg.LogBody == config.OTLPLogBodyPreserve,
+	}
 	httpMonitoredConsumer.set(consumer)
 
-	tracesHandler, err := otlpreceiver.TracesHTTPHandler(context.Background(), consumer)
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to create OTLP trace receiver")
+	var tracesHandler, metricsHandler, logsHandler http.HandlerFunc
+	var err error
+	if cfg.Traces.Enabled {
+		tracesHandler, err = otlpreceiver.TracesHTTPHandler(context.Background(), consumer)
+		if err := receiverError(err, "trace", cfg); err != nil {
+			return nil, err
+		}
 	}
-	metricsHandler, err := otlpreceiver.MetricsHTTPHandler(context.Background(), consumer)
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to create OTLP metrics receiver")
+	if cfg.Metrics.Enabled {
+		metricsHandler, err = otlpreceiver.MetricsHTTPHandler(context.Background(), consumer)
+		if err := receiverError(err, "metrics", cfg); err != nil {
+			return nil, err
+		}
 	}
-	logsHandler, err := otlpreceiver.LogsHTTPHandler(context.Background(), consumer)
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to create OTLP logs receiver")
+	if cfg.Logs.Enabled {
+		logsHandler, err = otlpreceiver.LogsHTTPHandler(context.Background(), consumer)
+		if err := receiverError(err, "logs", cfg); err != nil {
+			return nil, err
+		}
 	}
+	status := HTTPReceiverStatus{
+		Traces:  tracesHandler != nil,
+		Metrics: metricsHandler != nil,
+		Logs:    logsHandler != nil,
+	}
+	status.disabled.traces = !cfg.Traces.Enabled
+	status.disabled.metrics = !cfg.Metrics.Enabled
+	status.disabled.logs = !cfg.Logs.Enabled
+	httpStatusMu.Lock()
+	httpStatus = status
+	httpStatusMu.Unlock()
 	return &otlpreceiver.HTTPHandlers{
 		TraceHandler:   tracesHandler,
 		MetricsHandler: metricsHandler,
 		LogsHandler:    logsHandler,
 	}, nil
 }
+
+// resourceAttributeLabels returns the resource attribute to label
+// mapping configured in cfg, or nil if there is none.
+func resourceAttributeLabels(cfg config.OTLPConfig) map[string]string {
+	if len(cfg.ResourceAttributeLabels) == 0 {
+		return nil
+	}
+	labels := make(map[string]string, len(cfg.ResourceAttributeLabels))
+	for _, m := range cfg.ResourceAttributeLabels {
+		labels[m.Attribute] = m.Label
+	}
+	return labels
+}
+
+// receiverError wraps a non-nil error from creating the named receiver.
+// If best-effort registration is enabled, the error is logged and nil
+// is returned.
+func receiverError(err error, name string, cfg config.OTLPConfig) error {
+	if err == nil {
+		return nil
+	}
+	err = errors.Wrapf(err, "failed to create OTLP %s receiver", name)
+	if cfg.BestEffortRegistration {
+		logp.NewLogger(logs.Otel).Warn(err)
+		return nil
+	}
+	return err
+}
@@ -20,20 +20,25 @@ package otlp_test
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"go.opentelemetry.io/collector/model/otlpgrpc"
 	"go.opentelemetry.io/collector/model/pdata"
+	"google.golang.org/grpc/codes"
 
 	"github.com/elastic/apm-server/agentcfg"
 	"github.com/elastic/apm-server/beater/api"
 	"github.com/elastic/apm-server/beater/auth"
 	"github.com/elastic/apm-server/beater/config"
+	"github.com/elastic/apm-server/beater/otlp"
 	"github.com/elastic/apm-server/beater/ratelimit"
 	"github.com/elastic/apm-server/model"
 	"github.com/elastic/beats/v7/libbeat/beat"
@@ -57,6 +62,8 @@ func TestConsumeTracesHTTP(t *testing.T) {
 	traces := pdata.NewTraces()
 	span := traces.ResourceSpans().AppendEmpty().InstrumentationLibrarySpans().AppendEmpty().Spans().AppendEmpty()
 	span.SetName("operation_name")
+	span.SetTraceID(pdata.NewTraceID([16]byte{1}))
+	span.SetSpanID(pdata.NewSpanID([8]byte{2}))
 
 	tracesRequest := otlpgrpc.NewTracesRequest()
 	tracesRequest.SetTraces(traces)
@@ -81,8 +88,12 @@ func TestConsumeTracesHTTP(t *testing.T) {
 		"response.errors.count":        int64(0),
 		"response.valid.count":         int64(1),
 		"response.errors.ratelimit":    int64(0),
+		"request.too_large":            int64(0),
 		"response.errors.timeout":      int64(0),
 		"response.errors.unauthorized": int64(0),
+		"response.status.2xx":          int64(1),
+		"response.status.4xx":          int64(0),
+		"response.status.5xx":          int64(0),
 	}, actual)
 }
 
@@ -120,15 +131,21 @@ func TestConsumeMetricsHTTP(t *testing.T) {
 		actual[key] = value
 	})
 	assert.Equal(t, map[string]interface{}{
-		"consumer.unsupported_dropped": int64(0),
+		"consumer.unsupported_dropped":         int64(0),
+		"consumer.metrics.unsupported_dropped": int64(0),
+		"consumer.invalid_spans_dropped":       int64(0),
 
 		"request.count":                int64(1),
 		"response.count":               int64(1),
 		"response.errors.count":        int64(0),
 		"response.valid.count":         int64(1),
 		"response.errors.ratelimit":    int64(0),
+		"request.too_large":            int64(0),
 		"response.errors.timeout":      int64(0),
 		"response.errors.unauthorized": int64(0),
+		"response.status.2xx":          int64(1),
+		"response.status.4xx":          int64(0),
+		"response.status.5xx":          int64(0),
 	}, actual)
 }
 
@@ -172,22 +189,215 @@ func TestConsumeLogsHTTP(t *testing.T) {
 		"response.errors.count":        int64(0),
 		"response.valid.count":         int64(1),
 		"response.errors.ratelimit":    int64(0),
+		"request.too_large":            int64(0),
 		"response.errors.timeout":      int64(0),
 		"response.errors.unauthorized": int64(0),
+		"response.status.2xx":          int64(1),
+		"response.status.4xx":          int64(0),
+		"response.status.5xx":          int64(0),
 	}, actual)
 }
 
 func newHTTPServer(t *testing.T, batchProcessor model.BatchProcessor) string {
+	return newHTTPServerConfig(t, config.DefaultConfig(), batchProcessor)
+}
+
+func newHTTPServerConfig(t *testing.T, cfg *config.Config, batchProcessor model.BatchProcessor) string {
 	lis, err := net.Listen("tcp", "localhost:0")
 	require.NoError(t, err)
-	cfg := &config.Config{}
 	auth, _ := auth.NewAuthenticator(cfg.AgentAuth)
 	ratelimitStore, _ := ratelimit.NewStore(1000, 1000, 1000)
-	router, err := api.NewMux(
+	router, _, err := api.NewMux(
 		beat.Info{Version: "1.2.3"}, cfg, batchProcessor, auth, agentcfg.NewFetcher(cfg), ratelimitStore,
-		nil, false, func() bool { return true })
+		nil, false, func() bool { return true }, nil)
 	require.NoError(t, err)
 	srv := http.Server{Handler: router}
 	go srv.Serve(lis)
 	return lis.Addr().String()
 }
+
+func TestConsumeTracesHTTPJSON(t *testing.T) {
+	var batches []model.Batch
+	var batchProcessor model.ProcessBatchFunc = func(ctx context.Context, batch *model.Batch) error {
+		batches = append(batches, *batch)
+		return nil
+	}
+	addr := newHTTPServer(t, batchProcessor)
+
+	traces := pdata.NewTraces()
+	span := traces.ResourceSpans().AppendEmpty().InstrumentationLibrarySpans().AppendEmpty().Spans().AppendEmpty()
+	span.SetName("operation_name")
+	span.SetTraceID(pdata.NewTraceID([16]byte{1}))
+	span.SetSpanID(pdata.NewSpanID([8]byte{2}))
+	tracesRequest := otlpgrpc.NewTracesRequest()
+	tracesRequest.SetTraces(traces)
+	protobufBody, err := tracesRequest.Marshal()
+	require.NoError(t, err)
+	jsonBody, err := tracesRequest.MarshalJSON()
+	require.NoError(t, err)
+
+	// send sends a request, returning the response
+	// and the changes to the monitoring counters.
+	send := func(contentType string, body []byte) (*http.Response, map[string]int64) {
+		counters := func() map[string]int64 {
+			out := make(map[string]int64)
+			monitoring.GetRegistry("apm-server.otlp.http.traces").Do(monitoring.Full, func(key string, value interface{}) {
+				out[key] = value.(int64)
+			})
+			return out
+		}
+		before := counters()
+		resp, err := http.Post(fmt.Sprintf("http://%s/v1/traces", addr), contentType, bytes.NewReader(body))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		after := counters()
+		for k, v := range before {
+			after[k] -= v
+		}
+		return resp, after
+	}
+
+	resp, protobufCounters := send("application/x-protobuf", protobufBody)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/x-protobuf", resp.Header.Get("Content-Type"))
+
+	resp, jsonCounters := send("application/json; charset=utf-8", jsonBody)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	assert.Equal(t, protobufCounters, jsonCounters)
+
+	require.Len(t, batches, 2)
+	assert.Equal(t, batches[0], batches[1])
+
+	// Malformed JSON is rejected with an OTLP status describing the error.
+	resp, err = http.Post(fmt.Sprintf("http://%s/v1/traces", addr), "application/json", strings.NewReader("{"))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	var status struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&status))
+	assert.Equal(t, int(codes.InvalidArgument), status.Code)
+	assert.NotEmpty(t, status.Message)
+	assert.Len(t, batches, 2)
+}
+
+func TestConsumeTracesHTTPRequestTooLarge(t *testing.T) {
+	var batches []model.Batch
+	var batchProcessor model.ProcessBatchFunc = func(ctx context.Context, batch *model.Batch) error {
+		batches = append(batches, *batch)
+		return nil
+	}
+
+	traces := pdata.NewTraces()
+	span := traces.ResourceSpans().AppendEmpty().InstrumentationLibrarySpans().AppendEmpty().Spans().AppendEmpty()
+	span.SetName("operation_name")
+	span.SetTraceID(pdata.NewTraceID([16]byte{1}))
+	span.SetSpanID(pdata.NewSpanID([8]byte{2}))
+	tracesRequest := otlpgrpc.NewTracesRequest()
+	tracesRequest.SetTraces(traces)
+	body, err := tracesRequest.MarshalJSON()
+	require.NoError(t, err)
+
+	cfg := config.DefaultConfig()
+	cfg.MaxOTLPRequestSize = int64(len(body))
+	addr := newHTTPServerConfig(t, cfg, batchProcessor)
+
+	counters := func() map[string]int64 {
+		out := make(map[string]int64)
+		monitoring.GetRegistry("apm-server.otlp.http.traces").Do(monitoring.Full, func(key string, value interface{}) {
+			out[key] = value.(int64)
+		})
+		return out
+	}
+	send := func(body io.Reader, contentLength int64) int {
+		req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("http://%s/v1/traces", addr), body)
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		req.ContentLength = contentLength
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusRequestEntityTooLarge {
+			// The error is encoded as an OTLP Status.
+			assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+			var status struct {
+				Code    int    `json:"code"`
+				Message string `json:"message"`
+			}
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&status))
+			assert.Equal(t, int(codes.Unknown), status.Code)
+			assert.Contains(t, status.Message, "request body too large")
+		}
+		return resp.StatusCode
+	}
+
+	// A request body of exactly the limit is accepted.
+	assert.Equal(t, http.StatusOK, send(bytes.NewReader(body), int64(len(body))))
+	require.Len(t, batches, 1)
+
+	before := counters()
+	oversized := append(body, ' ')
+	// Rejected based on the Content-Length header.
+	assert.Equal(t, http.StatusRequestEntityTooLarge, send(bytes.NewReader(oversized), int64(len(oversized))))
+	// Rejected based on the number of bytes read, for chunked requests.
+	assert.Equal(t, http.StatusRequestEntityTooLarge, send(io.MultiReader(bytes.NewReader(oversized)), -1))
+	after := counters()
+	assert.Equal(t, int64(2), after["request.too_large"]-before["request.too_large"])
+	assert.Equal(t, int64(2), after["response.errors.count"]-before["response.errors.count"])
+	assert.Equal(t, int64(2), after["response.status.4xx"]-before["response.status.4xx"])
+	assert.Len(t, batches, 1)
+}
+
+func TestHTTPReceiverStatus(t *testing.T) {
+	newHTTPServer(t, model.ProcessBatchFunc(func(context.Context, *model.Batch) error { return nil }))
+	status := otlp.HTTPStatus()
+	assert.Equal(t, otlp.HTTPReceiverStatus{Traces: true, Metrics: true, Logs: true}, status)
+	assert.NoError(t, status.Err())
+
+	status.Logs = false
+	assert.EqualError(t, status.Err(), "logs receiver not registered")
+	status.Metrics = false
+	assert.EqualError(t, status.Err(), "metrics, logs receivers not registered")
+}
+
+func TestHTTPSignalsDisabled(t *testing.T) {
+	var batchProcessor model.ProcessBatchFunc = func(context.Context, *model.Batch) error { return nil }
+	cfg := config.DefaultConfig()
+	cfg.OTLP.Metrics.Enabled = false
+	cfg.OTLP.Logs.Enabled = false
+	addr := newHTTPServerConfig(t, cfg, batchProcessor)
+
+	status := otlp.HTTPStatus()
+	assert.Equal(t, true, status.Traces)
+	assert.Equal(t, false, status.Metrics)
+	assert.Equal(t, false, status.Logs)
+	assert.NoError(t, status.Err()) // disabled signals are not reported
+
+	for path, expected := range map[string]int{
+		"/v1/traces":  http.StatusOK,
+		"/v1/metrics": http.StatusNotFound,
+		"/v1/logs":    http.StatusNotFound,
+	} {
+		resp, err := http.Post(fmt.Sprintf("http://%s%s", addr, path), "application/x-protobuf", nil)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, expected, resp.StatusCode, path)
+	}
+
+	// Consumer stats are reported whichever signals are enabled.
+	var consumerKeys []string
+	monitoring.GetRegistry("apm-server.otlp.http").Do(monitoring.Full, func(key string, value interface{}) {
+		if strings.HasPrefix(key, "consumer.") {
+			consumerKeys = append(consumerKeys, key)
+		}
+	})
+	assert.ElementsMatch(t, []string{
+		"consumer.unsupported_dropped",
+		"consumer.metrics.unsupported_dropped",
+		"consumer.invalid_spans_dropped",
+	}, consumerKeys)
+}
@@ -20,12 +20,26 @@ package ratelimit
 import (
 	"context"
 
-	"github.com/pkg/errors"
 	"golang.org/x/time/rate"
 )
 
 // ErrRateLimitExceeded is returned when the rate limit is exceeded.
-var ErrRateLimitExceeded = errors.New("rate limit exceeded")
+//
+// ErrRateLimitExceeded has an ErrorCode method returning "rate_limited",
+// which the stream processor uses to classify errors without depending
+// on this package.
+var ErrRateLimitExceeded error = rateLimitExceededError{}
+
+type rateLimitExceededError struct{}
+
+func (rateLimitExceededError) Error() string {
+	return "rate limit exceeded"
+}
+
+// ErrorCode returns "rate_limited".
+func (rateLimitExceededError) ErrorCode() string {
+	return "rate_limited"
+}
 
 type rateLimiterKey struct{}
 
@@ -0,0 +1,77 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package ratelimit
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrStreamLimitExceeded is returned when the number of concurrent streams
+// for a key is exceeded.
+var ErrStreamLimitExceeded = errors.New("concurrent stream limit exceeded")
+
+// StreamLimiter limits the number of concurrent streams per key.
+//
+// A nil StreamLimiter imposes no limit.
+type StreamLimiter struct {
+	limit int
+
+	mu      sync.Mutex
+	streams map[string]int
+}
+
+// NewStreamLimiter returns a new StreamLimiter allowing up to limit
+// concurrent streams per key. If limit is zero or negative, NewStreamLimiter
+// returns nil.
+func NewStreamLimiter(limit int) *StreamLimiter {
+	if limit <= 0 {
+		return nil
+	}
+	return &StreamLimiter{limit: limit, streams: make(map[string]int)}
+}
+
+// Acquire reserves a stream for key, returning false if the key already has
+// the maximum number of concurrent streams. Each successful call to Acquire
+// must be followed by a call to Release.
+func (l *StreamLimiter) Acquire(key string) bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.streams[key] >= l.limit {
+		return false
+	}
+	l.streams[key]++
+	return true
+}
+
+// Release releases a stream previously reserved for key with Acquire.
+func (l *StreamLimiter) Release(key string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if n := l.streams[key]; n > 1 {
+		l.streams[key] = n - 1
+	} else {
+		delete(l.streams, key)
+	}
+}
@@ -0,0 +1,54 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package ratelimit
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewStreamLimiterUnlimited(t *testing.T) {
+	assert.Nil(t, NewStreamLimiter(0))
+	assert.Nil(t, NewStreamLimiter(-1))
+
+	var l *StreamLimiter
+	for i := 0; i < 10; i++ {
+		assert.True(t, l.Acquire("key"))
+	}
+	l.Release("key")
+}
+
+func TestStreamLimiter(t *testing.T) {
+	l := NewStreamLimiter(2)
+	assert.True(t, l.Acquire("a"))
+	assert.True(t, l.Acquire("a"))
+	assert.False(t, l.Acquire("a"))
+
+	// Other keys are limited independently.
+	assert.True(t, l.Acquire("b"))
+
+	l.Release("a")
+	assert.True(t, l.Acquire("a"))
+	assert.False(t, l.Acquire("a"))
+
+	l.Release("a")
+	l.Release("a")
+	l.Release("b")
+	assert.Empty(t, l.streams)
+}
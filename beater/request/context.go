@@ -18,9 +18,11 @@
 package request
 
 import (
+	"bytes"
 	"encoding/json"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
@@ -37,10 +39,65 @@ const (
 	mimeTypeApplicationJSON = "application/json"
 )
 
+const (
+	charsetUTF8      = "utf-8"
+	charsetUTF8Alias = "utf8"
+)
+
+const (
+	// UserAgentValuesJoin causes Context.Reset to join multiple
+	// User-Agent header values with ", ". This is the default.
+	UserAgentValuesJoin = "join"
+
+	// UserAgentValuesFirst causes Context.Reset to use only
+	// the first User-Agent header value.
+	UserAgentValuesFirst = "first"
+
+	// UserAgentValuesLast causes Context.Reset to use only the last
+	// User-Agent header value, e.g. one appended by a proxy.
+	UserAgentValuesLast = "last"
+)
+
 var (
 	mimeTypesJSON = []string{mimeTypeAny, mimeTypeApplicationJSON}
 )
 
+// Clock is the function used by Context.Reset to record the time at which
+// a request was received. It defaults to time.Now.
+//
+// Clock may be replaced by tests which assert on Context.Timestamp. It must
+// not be replaced while requests are being handled.
+var Clock = time.Now
+
+// ContextConfig holds configuration for extracting request information
+// in Context.Reset.
+type ContextConfig struct {
+	// XForwardedForTrustDepth holds the number of trusted proxies in front
+	// of the server which append themselves to the X-Forwarded-For header.
+	// See netutil.ClientAddrFromHeadersTrustDepth.
+	XForwardedForTrustDepth int
+
+	// UserAgentValues controls how multiple User-Agent header values are
+	// combined into Context.UserAgent. This must be one of UserAgentValuesJoin,
+	// UserAgentValuesFirst or UserAgentValuesLast; if empty, values are joined.
+	UserAgentValues string
+
+	// MaxResponseSize holds the maximum size in bytes of response bodies
+	// written by WriteResult, or zero for no limit. See WriteResult.
+	MaxResponseSize int
+}
+
+// ErrorsTruncator is implemented by response bodies holding a list of
+// errors, which WriteResult truncates to fit ContextConfig.MaxResponseSize.
+type ErrorsTruncator interface {
+	// NumErrors returns the number of errors held by the body.
+	NumErrors() int
+
+	// TruncateErrors returns a copy of the body holding only the first
+	// n errors, followed by a marker noting that errors were omitted.
+	TruncateErrors(n int) interface{}
+}
+
 // Context abstracts request and response information for http requests
 type Context struct {
 	Request        *http.Request
@@ -83,6 +140,10 @@ type Context struct {
 	// An alternate solution would be to implement context.WriteHeaders()
 	ResponseWriter http.ResponseWriter
 	writeAttempts  int
+	bytesWritten   int
+	trailers       bool
+
+	config ContextConfig
 }
 
 // NewContext creates an empty Context struct
@@ -90,6 +151,34 @@ func NewContext() *Context {
 	return &Context{}
 }
 
+// NewContextWithConfig creates an empty Context struct, which will
+// extract request information according to cfg.
+func NewContextWithConfig(cfg ContextConfig) *Context {
+	return &Context{config: cfg}
+}
+
+// NewContextFromConn creates a Context for a request received over conn
+// by a transport other than HTTP. The source and client addresses are set
+// from the connection's remote address, and Timestamp is set to the current
+// time. Request, ResponseWriter and header-derived fields are left empty.
+func NewContextFromConn(conn net.Conn) *Context {
+	c := &Context{}
+	c.Result.Reset()
+	if addr := conn.RemoteAddr(); addr != nil {
+		c.setRemoteAddr(addr.String())
+	}
+	c.Timestamp = Clock()
+	return c
+}
+
+// setRemoteAddr sets the source and client addresses from
+// addr, the address of the network peer.
+func (c *Context) setRemoteAddr(addr string) {
+	ip, port := netutil.ParseIPPort(netutil.MaybeSplitHostPort(addr))
+	c.SourceIP, c.ClientIP = ip, ip
+	c.SourcePort, c.ClientPort = int(port), int(port)
+}
+
 // Reset allows to reuse a context by removing all request specific information.
 //
 // It is valid to call Reset(nil, nil), which will just clear all information.
@@ -109,21 +198,34 @@ func (c *Context) Reset(w http.ResponseWriter, r *http.Request) {
 		Logger:         nil,
 		Authentication: auth.AuthenticationDetails{},
 		ResponseWriter: w,
+		config:         c.config,
 	}
 	c.Result.Reset()
 
 	if r != nil {
-		ip, port := netutil.ParseIPPort(netutil.MaybeSplitHostPort(r.RemoteAddr))
-		c.SourceIP, c.ClientIP = ip, ip
-		c.SourcePort, c.ClientPort = int(port), int(port)
-		if ip, port := netutil.ClientAddrFromHeaders(r.Header); ip != nil {
+		c.setRemoteAddr(r.RemoteAddr)
+		if ip, port := netutil.ClientAddrFromHeadersTrustDepth(r.Header, c.config.XForwardedForTrustDepth); ip != nil {
 			c.SourceNATIP = c.ClientIP
 			c.SourceIP, c.ClientIP = ip, ip
 			c.SourcePort, c.ClientPort = int(port), int(port)
 		}
-		c.UserAgent = strings.Join(r.Header["User-Agent"], ", ")
-		c.Timestamp = time.Now()
+		c.UserAgent = userAgent(r.Header["User-Agent"], c.config.UserAgentValues)
+		c.Timestamp = Clock()
+	}
+}
+
+// userAgent combines the User-Agent header values according to mode.
+func userAgent(values []string, mode string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	switch mode {
+	case UserAgentValuesFirst:
+		return values[0]
+	case UserAgentValuesLast:
+		return values[len(values)-1]
 	}
+	return strings.Join(values, ", ")
 }
 
 // MultipleWriteAttempts returns a boolean set to true if WriteResult() was called multiple times.
@@ -131,22 +233,38 @@ func (c *Context) MultipleWriteAttempts() bool {
 	return c.writeAttempts > 1
 }
 
+// BytesWritten returns the number of response body bytes written by WriteResult.
+func (c *Context) BytesWritten() int {
+	return c.bytesWritten
+}
+
 // WriteResult sets response headers, and writes the body to the response writer.
 // In case body is nil only the headers will be set.
 // In case statusCode indicates an error response, the body is also set as error in the context.
 // Only first call with write to http response.
 // This function wraps c.ResponseWriter.Write() - only one or the other should be used.
+//
+// If ContextConfig.MaxResponseSize is set and the encoded body exceeds it,
+// the errors of an ErrorsTruncator body are truncated until it fits. Other
+// bodies, or bodies which do not fit with no errors, are replaced with a
+// short body noting that the maximum response size was exceeded.
 func (c *Context) WriteResult() {
 	if c.MultipleWriteAttempts() {
 		return
 	}
 	c.writeAttempts++
 
-	c.ResponseWriter.Header().Set(headers.XContentTypeOptions, "nosniff")
+	if c.trailers {
+		defer func() {
+			c.ResponseWriter.Header().Set(headers.APMStatus, strconv.Itoa(c.Result.StatusCode))
+		}()
+	} else {
+		c.ResponseWriter.Header().Set(headers.XContentTypeOptions, "nosniff")
+	}
 
 	body := c.Result.Body
 	if body == nil {
-		c.ResponseWriter.WriteHeader(c.Result.StatusCode)
+		c.writeHeader("")
 		return
 	}
 
@@ -159,12 +277,10 @@ func (c *Context) WriteResult() {
 
 	var err error
 	if c.acceptJSON() {
-		c.ResponseWriter.Header().Set(headers.ContentType, "application/json")
-		c.ResponseWriter.WriteHeader(c.Result.StatusCode)
+		c.writeHeader("application/json")
 		err = c.writeJSON(body, true)
 	} else {
-		c.ResponseWriter.Header().Set(headers.ContentType, "text/plain; charset=utf-8")
-		c.ResponseWriter.WriteHeader(c.Result.StatusCode)
+		c.writeHeader("text/plain; charset=utf-8")
 		err = c.writePlain(body)
 	}
 	if err != nil {
@@ -172,6 +288,70 @@ func (c *Context) WriteResult() {
 	}
 }
 
+// writeHeader sets the Content-Type header, if contentType is non-empty,
+// and writes the result's status code. If the header has already been
+// written by WriteHeaderWithTrailers, writeHeader does nothing.
+func (c *Context) writeHeader(contentType string) {
+	if c.trailers {
+		return
+	}
+	if contentType != "" {
+		c.ResponseWriter.Header().Set(headers.ContentType, contentType)
+	}
+	c.ResponseWriter.WriteHeader(c.Result.StatusCode)
+}
+
+// AcceptsTrailers reports whether the client accepts trailer fields in the
+// response, as indicated by a "TE: trailers" request header. Trailers are
+// only accepted for HTTP/2 and later requests: an HTTP/1.x server closes
+// or discards the unread request body once the response header has been
+// flushed, so the response cannot begin before the body has been read.
+func (c *Context) AcceptsTrailers() bool {
+	if c.Request == nil || c.Request.ProtoMajor < 2 {
+		return false
+	}
+	for _, value := range c.Request.Header.Values(headers.TE) {
+		for _, elem := range strings.Split(value, ",") {
+			coding := strings.TrimSpace(strings.Split(elem, ";")[0])
+			if strings.EqualFold(coding, "trailers") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// WriteHeaderWithTrailers writes a 200 OK response header immediately,
+// declaring headers.APMStatus and the given trailers, so the client can
+// start reading the response before the result is known. The response's
+// Content-Type is chosen as in WriteResult.
+//
+// A subsequent WriteResult writes only the body, and reports the result's
+// status code in the headers.APMStatus trailer. Values for the other
+// declared trailers must be set on ResponseWriter.Header() before the
+// handler returns.
+//
+// WriteHeaderWithTrailers should only be called if AcceptsTrailers
+// returns true, and before anything else has been written.
+func (c *Context) WriteHeaderWithTrailers(trailers ...string) {
+	header := c.ResponseWriter.Header()
+	header.Set(headers.XContentTypeOptions, "nosniff")
+	if c.acceptJSON() {
+		header.Set(headers.ContentType, "application/json")
+	} else {
+		header.Set(headers.ContentType, "text/plain; charset=utf-8")
+	}
+	header.Add(headers.Trailer, headers.APMStatus)
+	for _, trailer := range trailers {
+		header.Add(headers.Trailer, trailer)
+	}
+	c.ResponseWriter.WriteHeader(http.StatusOK)
+	if flusher, ok := c.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	c.trailers = true
+}
+
 func (c *Context) acceptJSON() bool {
 	acceptHeader := c.Request.Header.Get(headers.Accept)
 	for _, s := range mimeTypesJSON {
@@ -182,23 +362,110 @@ func (c *Context) acceptJSON() bool {
 	return false
 }
 
+// AcceptsUTF8 reports whether the request's Accept-Charset header, if any,
+// accepts UTF-8, which all responses are encoded with: either explicitly,
+// as "utf-8" or its "utf8" alias, or through the "*" wildcard when UTF-8
+// is not listed. Charsets with a quality value of 0 are not acceptable.
+func (c *Context) AcceptsUTF8() bool {
+	utf8Quality, wildcardQuality := -1.0, -1.0
+	var present bool
+	for _, value := range c.Request.Header.Values(headers.AcceptCharset) {
+		for _, elem := range strings.Split(value, ",") {
+			params := strings.Split(elem, ";")
+			charset := strings.ToLower(strings.TrimSpace(params[0]))
+			if charset == "" {
+				continue
+			}
+			present = true
+			quality := 1.0
+			for _, param := range params[1:] {
+				param = strings.TrimSpace(param)
+				if strings.HasPrefix(param, "q=") {
+					if q, err := strconv.ParseFloat(param[2:], 64); err == nil {
+						quality = q
+					}
+				}
+			}
+			switch charset {
+			case charsetUTF8, charsetUTF8Alias:
+				if quality > utf8Quality {
+					utf8Quality = quality
+				}
+			case "*":
+				wildcardQuality = quality
+			}
+		}
+	}
+	switch {
+	case !present:
+		return true
+	case utf8Quality >= 0:
+		return utf8Quality > 0
+	default:
+		return wildcardQuality > 0
+	}
+}
+
 func (c *Context) writeJSON(body interface{}, pretty bool) error {
-	enc := json.NewEncoder(c.ResponseWriter)
+	data, err := encodeJSON(body, pretty)
+	if err != nil {
+		return err
+	}
+	if max := c.config.MaxResponseSize; max > 0 && len(data) > max {
+		if truncator, ok := body.(ErrorsTruncator); ok {
+			// Responses hold few errors, and truncation is rare,
+			// so re-encode with one fewer error at a time.
+			for n := truncator.NumErrors() - 1; n >= 0 && len(data) > max; n-- {
+				if data, err = encodeJSON(truncator.TruncateErrors(n), pretty); err != nil {
+					return err
+				}
+			}
+		}
+		if len(data) > max {
+			body := map[string]string{"error": responseTooLargeMessage}
+			if data, err = encodeJSON(body, pretty); err != nil {
+				return err
+			}
+		}
+	}
+	return c.write(data)
+}
+
+// responseTooLargeMessage replaces response bodies which do not fit
+// within ContextConfig.MaxResponseSize, even with their errors truncated,
+// so that clients never receive a body cut mid-way.
+const responseTooLargeMessage = "maximum response size exceeded"
+
+func encodeJSON(body interface{}, pretty bool) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
 	if pretty {
 		enc.SetIndent("", "  ")
 	}
-	return enc.Encode(body)
+	if err := enc.Encode(body); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
 }
 
 func (c *Context) writePlain(body interface{}) error {
 	if b, ok := body.(string); ok {
-		_, err := c.ResponseWriter.Write([]byte(b + "\n"))
-		return err
+		if max := c.config.MaxResponseSize; max > 0 && len(b)+1 > max {
+			b = responseTooLargeMessage
+		}
+		return c.write([]byte(b + "\n"))
 	}
 	// unexpected behavior to return json but changing this would be breaking
 	return c.writeJSON(body, false)
 }
 
+// write writes data to the response writer, recording the bytes written.
+func (c *Context) write(data []byte) error {
+	n, err := c.ResponseWriter.Write(data)
+	c.bytesWritten += n
+	return err
+}
+
 func (c *Context) errOnWrite(err error) {
 	if c.Logger == nil {
 		c.Logger = logp.NewLogger(logs.Response)
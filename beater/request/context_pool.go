@@ -28,11 +28,12 @@ type ContextPool struct {
 	p sync.Pool
 }
 
-// NewContextPool returns a new ContextPool.
-func NewContextPool() *ContextPool {
+// NewContextPool returns a new ContextPool, whose Contexts are
+// configured with cfg.
+func NewContextPool(cfg ContextConfig) *ContextPool {
 	pool := ContextPool{}
 	pool.p.New = func() interface{} {
-		return NewContext()
+		return NewContextWithConfig(cfg)
 	}
 	return &pool
 }
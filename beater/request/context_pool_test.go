@@ -31,7 +31,7 @@ func TestContextPool(t *testing.T) {
 	// Request stored inside a context is always set fresh.
 	// The test is important to avoid mixing up separate requests in a reused context.
 
-	p := NewContextPool()
+	p := NewContextPool(ContextConfig{})
 
 	// mockhHandler adds the context and its request to dedicated slices
 	var contexts, requests []interface{}
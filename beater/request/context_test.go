@@ -19,12 +19,14 @@ package request
 
 import (
 	"bytes"
+	"fmt"
 	"mime/multipart"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -74,7 +76,8 @@ func TestContext_Reset(t *testing.T) {
 	before := time.Now()
 	c := Context{
 		Request: r1, ResponseWriter: w1,
-		Logger: logp.NewLogger(""),
+		Logger:   logp.NewLogger(""),
+		trailers: true,
 		Result: Result{
 			StatusCode: http.StatusServiceUnavailable,
 			Err:        errors.New("foo"),
@@ -100,6 +103,12 @@ func TestContext_Reset(t *testing.T) {
 			assert.Equal(t, w2, c.ResponseWriter)
 		case "writeAttempts":
 			assert.Equal(t, 0, c.writeAttempts)
+		case "bytesWritten":
+			assert.Equal(t, 0, c.bytesWritten)
+		case "trailers":
+			assert.False(t, c.trailers)
+		case "config":
+			assert.Equal(t, ContextConfig{}, c.config)
 		case "Result":
 			assertResultIsEmpty(t, cVal.Field(i).Interface().(Result))
 		case "SourceIP":
@@ -123,6 +132,94 @@ func TestContext_Reset(t *testing.T) {
 	}
 }
 
+func TestContext_ResetClock(t *testing.T) {
+	c := Context{}
+	c.Reset(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.WithinDuration(t, time.Now(), c.Timestamp, time.Minute)
+
+	now := time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC)
+	defer func(clock func() time.Time) { Clock = clock }(Clock)
+	Clock = func() time.Time { return now }
+	c.Reset(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, now, c.Timestamp)
+}
+
+func TestNewContextFromConn(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer lis.Close()
+
+	client, err := net.Dial("tcp", lis.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	server, err := lis.Accept()
+	require.NoError(t, err)
+	defer server.Close()
+
+	c := NewContextFromConn(server)
+	clientAddr := client.LocalAddr().(*net.TCPAddr)
+	assert.Equal(t, clientAddr.IP.To4(), c.SourceIP.To4())
+	assert.Equal(t, clientAddr.IP.To4(), c.ClientIP.To4())
+	assert.Equal(t, clientAddr.Port, c.SourcePort)
+	assert.Equal(t, clientAddr.Port, c.ClientPort)
+	assert.Nil(t, c.SourceNATIP)
+	assert.Nil(t, c.Request)
+	assert.Nil(t, c.ResponseWriter)
+	assert.Empty(t, c.UserAgent)
+	assert.WithinDuration(t, time.Now(), c.Timestamp, time.Minute)
+	assertResultIsEmpty(t, c.Result)
+}
+
+func TestContext_ResetXForwardedForTrustDepth(t *testing.T) {
+	for name, tc := range map[string]struct {
+		xff        string
+		trustDepth int
+		clientIP   string
+	}{
+		"no trust depth":          {xff: "192.168.0.1, 10.0.0.1, 10.0.0.2", trustDepth: 0, clientIP: "192.168.0.1"},
+		"trust one proxy":         {xff: "192.168.0.1, 10.0.0.1, 10.0.0.2", trustDepth: 1, clientIP: "10.0.0.1"},
+		"trust two proxies":       {xff: "192.168.0.1, 10.0.0.1, 10.0.0.2", trustDepth: 2, clientIP: "192.168.0.1"},
+		"list shorter than depth": {xff: "192.168.0.1", trustDepth: 2, clientIP: "192.168.0.1"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = "10.1.2.3:1234"
+			r.Header.Set("X-Forwarded-For", tc.xff)
+
+			c := NewContextWithConfig(ContextConfig{XForwardedForTrustDepth: tc.trustDepth})
+			c.Reset(httptest.NewRecorder(), r)
+			assert.Equal(t, net.ParseIP(tc.clientIP), c.ClientIP)
+			assert.Equal(t, net.ParseIP(tc.clientIP), c.SourceIP)
+			assert.Equal(t, net.ParseIP("10.1.2.3"), c.SourceNATIP)
+
+			// The configuration must survive resetting the context.
+			c.Reset(nil, nil)
+			assert.Equal(t, tc.trustDepth, c.config.XForwardedForTrustDepth)
+		})
+	}
+}
+
+func TestContext_ResetUserAgentValues(t *testing.T) {
+	for mode, expected := range map[string]string{
+		"":                   "agent/1.0, proxy/2.0",
+		UserAgentValuesJoin:  "agent/1.0, proxy/2.0",
+		UserAgentValuesFirst: "agent/1.0",
+		UserAgentValuesLast:  "proxy/2.0",
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Add("User-Agent", "agent/1.0")
+		r.Header.Add("User-Agent", "proxy/2.0")
+
+		c := NewContextWithConfig(ContextConfig{UserAgentValues: mode})
+		c.Reset(httptest.NewRecorder(), r)
+		assert.Equal(t, expected, c.UserAgent, mode)
+
+		r.Header.Del("User-Agent")
+		c.Reset(httptest.NewRecorder(), r)
+		assert.Empty(t, c.UserAgent, mode)
+	}
+}
+
 func TestContext_Header(t *testing.T) {
 	w := httptest.NewRecorder()
 	w.Header().Set(headers.Etag, "abcd")
@@ -246,6 +343,141 @@ func TestContext_Write(t *testing.T) {
 	})
 }
 
+func TestContext_AcceptsUTF8(t *testing.T) {
+	for name, tc := range map[string]struct {
+		acceptCharset string
+		acceptable    bool
+	}{
+		"absent":             {acceptCharset: "", acceptable: true},
+		"utf-8":              {acceptCharset: "utf-8", acceptable: true},
+		"utf8":               {acceptCharset: "utf8", acceptable: true},
+		"case-insensitive":   {acceptCharset: "UTF-8", acceptable: true},
+		"utf-8-listed":       {acceptCharset: "iso-8859-1, utf-8;q=0.7", acceptable: true},
+		"wildcard":           {acceptCharset: "iso-8859-1, *;q=0.5", acceptable: true},
+		"unacceptable":       {acceptCharset: "iso-8859-1", acceptable: false},
+		"utf-8-quality-0":    {acceptCharset: "utf-8;q=0, *", acceptable: false},
+		"utf8-quality-0":     {acceptCharset: "utf8;q=0, utf-8;q=0", acceptable: false},
+		"wildcard-quality-0": {acceptCharset: "iso-8859-1, *;q=0", acceptable: false},
+	} {
+		t.Run(name, func(t *testing.T) {
+			c := NewContext()
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tc.acceptCharset != "" {
+				r.Header.Set(headers.AcceptCharset, tc.acceptCharset)
+			}
+			c.Reset(httptest.NewRecorder(), r)
+			assert.Equal(t, tc.acceptable, c.AcceptsUTF8())
+		})
+	}
+}
+
+func TestContext_WriteMaxResponseSize(t *testing.T) {
+	write := func(maxSize int, body interface{}) (*Context, *httptest.ResponseRecorder) {
+		c := NewContextWithConfig(ContextConfig{MaxResponseSize: maxSize})
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set(headers.Accept, "application/json")
+		c.Reset(w, r)
+		c.Result.Set(IDResponseErrorsValidate, http.StatusBadRequest, "", body, nil)
+		c.WriteResult()
+		return c, w
+	}
+	body := testErrorsBody{Errors: []string{"first", "second", "third"}}
+
+	c, w := write(0, body)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "{\n  \"errors\": [\n    \"first\",\n    \"second\",\n    \"third\"\n  ]\n}\n", w.Body.String())
+	assert.Equal(t, w.Body.Len(), c.BytesWritten())
+
+	// Errors are truncated until the body fits.
+	c, w = write(60, body)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "{\n  \"errors\": [\n    \"first\",\n    \"(2 omitted)\"\n  ]\n}\n", w.Body.String())
+	assert.Equal(t, w.Body.Len(), c.BytesWritten())
+
+	// Bodies which cannot be truncated further are replaced,
+	// rather than cut, so the response is still valid JSON.
+	c, w = write(10, body)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "{\n  \"error\": \"maximum response size exceeded\"\n}\n", w.Body.String())
+	assert.Equal(t, w.Body.Len(), c.BytesWritten())
+
+	c, w = write(10, strings.Repeat("x", 20))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "{\n  \"error\": \"maximum response size exceeded\"\n}\n", w.Body.String())
+	assert.Equal(t, w.Body.Len(), c.BytesWritten())
+
+	c = NewContextWithConfig(ContextConfig{MaxResponseSize: 10})
+	w = httptest.NewRecorder()
+	c.Reset(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	c.Result.Set(IDResponseValidOK, http.StatusOK, "", strings.Repeat("x", 20), nil)
+	c.WriteResult()
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "maximum response size exceeded\n", w.Body.String())
+	assert.Equal(t, w.Body.Len(), c.BytesWritten())
+}
+
+func TestContext_AcceptsTrailers(t *testing.T) {
+	for name, tc := range map[string]struct {
+		proto  string
+		te     []string
+		expect bool
+	}{
+		"none":      {proto: "HTTP/2.0"},
+		"trailers":  {proto: "HTTP/2.0", te: []string{"trailers"}, expect: true},
+		"list":      {proto: "HTTP/2.0", te: []string{"gzip;q=0.5, Trailers"}, expect: true},
+		"values":    {proto: "HTTP/2.0", te: []string{"gzip", "trailers"}, expect: true},
+		"codings":   {proto: "HTTP/2.0", te: []string{"gzip, deflate"}},
+		"http1.1":   {proto: "HTTP/1.1", te: []string{"trailers"}},
+		"http1.0":   {proto: "HTTP/1.0", te: []string{"trailers"}},
+		"substring": {proto: "HTTP/2.0", te: []string{"trailersfoo"}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			c, _ := mockContextAccept("*/*")
+			c.Request.Proto = tc.proto
+			c.Request.ProtoMajor, c.Request.ProtoMinor, _ = http.ParseHTTPVersion(tc.proto)
+			for _, te := range tc.te {
+				c.Request.Header.Add(headers.TE, te)
+			}
+			assert.Equal(t, tc.expect, c.AcceptsTrailers())
+		})
+	}
+}
+
+func TestContext_WriteHeaderWithTrailers(t *testing.T) {
+	c, w := mockContextAccept("*/*")
+	c.WriteHeaderWithTrailers("Foo")
+
+	// The header is written immediately, before the result is known.
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.True(t, w.Flushed)
+	testHeader(t, c, "application/json")
+	assert.Equal(t, []string{headers.APMStatus, "Foo"}, w.Header().Values(headers.Trailer))
+
+	c.ResponseWriter.Header().Set("Foo", "bar")
+	c.Result = Result{StatusCode: http.StatusBadRequest, Body: "oops"}
+	c.WriteResult()
+
+	response := w.Result()
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, "{\n  \"error\": \"oops\"\n}\n", w.Body.String())
+	assert.Equal(t, "400", response.Trailer.Get(headers.APMStatus))
+	assert.Equal(t, "bar", response.Trailer.Get("Foo"))
+}
+
+type testErrorsBody struct {
+	Errors []string `json:"errors"`
+}
+
+func (b testErrorsBody) NumErrors() int {
+	return len(b.Errors)
+}
+
+func (b testErrorsBody) TruncateErrors(n int) interface{} {
+	truncated := append(b.Errors[:n:n], fmt.Sprintf("(%d omitted)", len(b.Errors)-n))
+	return testErrorsBody{Errors: truncated}
+}
+
 func testHeaderXContentTypeOptions(t *testing.T, c *Context) {
 	assert.Equal(t, "nosniff", c.ResponseWriter.Header().Get(headers.XContentTypeOptions))
 }
@@ -32,6 +32,9 @@ const (
 
 	// IDRequestCount identifies all requests
 	IDRequestCount ResultID = "request.count"
+	// IDRequestTooLarge identifies requests rejected before being read,
+	// due to the request body exceeding the maximum size
+	IDRequestTooLarge ResultID = "request.too_large"
 	// IDResponseCount identifies all responses
 	IDResponseCount ResultID = "response.count"
 	// IDResponseErrorsCount identifies all non successful responses
@@ -49,6 +52,9 @@ const (
 	IDResponseValidOK ResultID = "response.valid.ok"
 	// IDResponseValidAccepted identifies responses with status code 202
 	IDResponseValidAccepted ResultID = "response.valid.accepted"
+	// IDResponseValidPartial identifies responses with status code 207,
+	// for requests in which some events were accepted and others rejected
+	IDResponseValidPartial ResultID = "response.valid.partial"
 
 	// IDResponseErrorsForbidden identifies responses for forbidden requests
 	IDResponseErrorsForbidden ResultID = "response.errors.forbidden"
@@ -70,6 +76,8 @@ const (
 	IDResponseErrorsTimeout ResultID = "response.errors.timeout"
 	// IDResponseErrorsMethodNotAllowed identifies responses for requests using a forbidden method
 	IDResponseErrorsMethodNotAllowed ResultID = "response.errors.method"
+	// IDResponseErrorsNotAcceptable identifies responses for requests not accepting a UTF-8 encoded response
+	IDResponseErrorsNotAcceptable ResultID = "response.errors.notacceptable"
 	// IDResponseErrorsFullQueue identifies responses when internal queue was full
 	IDResponseErrorsFullQueue ResultID = "response.errors.queue"
 	// IDResponseErrorsShuttingDown identifies responses requests occuring after channel was closed
@@ -78,6 +86,13 @@ const (
 	IDResponseErrorsServiceUnavailable ResultID = "response.errors.unavailable"
 	// IDResponseErrorsInternal identifies responses where internal errors occured
 	IDResponseErrorsInternal ResultID = "response.errors.internal"
+
+	// IDResponseStatus2xx identifies responses with a 2xx status code
+	IDResponseStatus2xx ResultID = "response.status.2xx"
+	// IDResponseStatus4xx identifies responses with a 4xx status code
+	IDResponseStatus4xx ResultID = "response.status.4xx"
+	// IDResponseStatus5xx identifies responses with a 5xx status code
+	IDResponseStatus5xx ResultID = "response.status.5xx"
 	// IDResponseErrorsServiceUnavailable identifies responses where resource is unavailable
 )
 
@@ -86,6 +101,7 @@ var (
 	MapResultIDToStatus = map[ResultID]Status{
 		IDResponseValidOK:                  {Code: http.StatusOK, Keyword: "request ok"},
 		IDResponseValidAccepted:            {Code: http.StatusAccepted, Keyword: "request accepted"},
+		IDResponseValidPartial:             {Code: http.StatusMultiStatus, Keyword: "request partially accepted"},
 		IDResponseValidNotModified:         {Code: http.StatusNotModified, Keyword: "not modified"},
 		IDResponseErrorsForbidden:          {Code: http.StatusForbidden, Keyword: "forbidden request"},
 		IDResponseErrorsUnauthorized:       {Code: http.StatusUnauthorized, Keyword: "unauthorized"},
@@ -95,6 +111,7 @@ var (
 		IDResponseErrorsDecode:             {Code: http.StatusBadRequest, Keyword: "data decoding error"},
 		IDResponseErrorsValidate:           {Code: http.StatusBadRequest, Keyword: "data validation error"},
 		IDResponseErrorsMethodNotAllowed:   {Code: http.StatusMethodNotAllowed, Keyword: "method not supported"},
+		IDResponseErrorsNotAcceptable:      {Code: http.StatusNotAcceptable, Keyword: "not acceptable"},
 		IDResponseErrorsRateLimit:          {Code: http.StatusTooManyRequests, Keyword: "too many requests"},
 		IDResponseErrorsTimeout:            {Code: http.StatusServiceUnavailable, Keyword: "request timed out"},
 		IDResponseErrorsFullQueue:          {Code: http.StatusServiceUnavailable, Keyword: "queue is full"},
@@ -44,6 +44,7 @@ import (
 	"github.com/elastic/apm-server/elasticsearch"
 	"github.com/elastic/apm-server/model"
 	"github.com/elastic/apm-server/model/modelprocessor"
+	"github.com/elastic/apm-server/processor/stream"
 	"github.com/elastic/apm-server/sourcemap"
 )
 
@@ -97,6 +98,14 @@ type ServerParams struct {
 	// client's transport such that requests will be blocked until data
 	// streams have been initialised.
 	NewElasticsearchClient func(cfg *elasticsearch.Config) (elasticsearch.Client, error)
+
+	// IntakeStatsCallback, if non-nil, is invoked periodically with
+	// statistics about the events received by the intake API, aggregated
+	// over the interval configured by intake.stats_interval.
+	//
+	// IntakeStatsCallback is intended for embedders, which may set it by
+	// wrapping RunServerFunc. It must not block.
+	IntakeStatsCallback func(stream.IntakeStats)
 }
 
 // newBaseRunServer returns the base RunServerFunc.
@@ -115,8 +124,15 @@ type server struct {
 	cfg                   *config.Config
 	agentcfgFetchReporter agentcfg.Reporter
 
+	intakeStats         *stream.IntakeStatsRecorder
+	intakeStatsCallback func(stream.IntakeStats)
+
 	httpServer *httpServer
 	grpcServer *grpc.Server
+
+	// shutdownStreams shuts down the intake stream processors,
+	// draining in-flight streams before the publisher is stopped.
+	shutdownStreams func(context.Context) error
 }
 
 func newServer(args ServerParams, listener net.Listener) (server, error) {
@@ -151,11 +167,16 @@ func newServer(args ServerParams, listener net.Listener) (server, error) {
 		}
 	}
 
+	var intakeStats *stream.IntakeStatsRecorder
+	if args.IntakeStatsCallback != nil {
+		intakeStats = stream.NewIntakeStatsRecorder()
+	}
+
 	// Create an HTTP server for serving Elastic APM agent requests.
-	router, err := api.NewMux(
+	router, shutdownStreams, err := api.NewMux(
 		args.Info, args.Config, batchProcessor,
 		authenticator, agentcfgFetchReporter, ratelimitStore,
-		args.SourcemapFetcher, args.Managed, publishReady,
+		args.SourcemapFetcher, args.Managed, publishReady, intakeStats,
 	)
 	if err != nil {
 		return server{}, err
@@ -180,10 +201,28 @@ func newServer(args ServerParams, listener net.Listener) (server, error) {
 		cfg:                   args.Config,
 		httpServer:            httpServer,
 		grpcServer:            grpcServer,
+		shutdownStreams:       shutdownStreams,
 		agentcfgFetchReporter: agentcfgFetchReporter,
+		intakeStats:           intakeStats,
+		intakeStatsCallback:   args.IntakeStatsCallback,
 	}, nil
 }
 
+// drainStreams stops the intake stream processors from accepting new
+// streams, and waits up to the configured shutdown timeout for in-flight
+// streams to complete.
+func (s server) drainStreams() {
+	ctx := context.Background()
+	if s.cfg.ShutdownTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.cfg.ShutdownTimeout)
+		defer cancel()
+	}
+	if err := s.shutdownStreams(ctx); err != nil {
+		s.logger.Warnf("error draining intake streams: %s", err)
+	}
+}
+
 func newGRPCServer(
 	logger *logp.Logger,
 	cfg *config.Config,
@@ -205,7 +244,7 @@ func newGRPCServer(
 	srv := grpc.NewServer(
 		grpc.ChainUnaryInterceptor(
 			apmInterceptor,
-			interceptors.ClientMetadata(),
+			interceptors.ClientMetadata(cfg.XForwardedForTrustDepth),
 			interceptors.Logging(logger),
 			interceptors.Metrics(logger, otlp.GRPCRegistryMonitoringMaps, jaeger.RegistryMonitoringMaps),
 			interceptors.Timeout(),
@@ -223,7 +262,7 @@ func newGRPCServer(
 	}
 
 	jaeger.RegisterGRPCServices(srv, logger, batchProcessor, agentcfgFetcher)
-	if err := otlp.RegisterGRPCServices(srv, batchProcessor); err != nil {
+	if err := otlp.RegisterGRPCServices(srv, batchProcessor, cfg.OTLP); err != nil {
 		return nil, err
 	}
 	return srv, nil
@@ -235,12 +274,18 @@ func (s server) run(ctx context.Context) error {
 
 	g, ctx := errgroup.WithContext(ctx)
 	g.Go(func() error { return s.agentcfgFetchReporter.Run(ctx) })
+	if s.intakeStats != nil {
+		g.Go(func() error {
+			return s.intakeStats.Run(ctx, s.cfg.Intake.StatsInterval, s.intakeStatsCallback)
+		})
+	}
 	g.Go(s.httpServer.start)
 	g.Go(func() error {
 		return s.grpcServer.Serve(s.httpServer.grpcListener)
 	})
 	g.Go(func() error {
 		<-ctx.Done()
+		s.drainStreams()
 		s.grpcServer.GracefulStop()
 		s.httpServer.stop()
 		return nil
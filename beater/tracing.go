@@ -65,7 +65,7 @@ func newTracerServer(listener net.Listener, logger *logp.Logger) (*tracerServer,
 	if err != nil {
 		return nil, err
 	}
-	mux, err := api.NewMux(
+	mux, _, err := api.NewMux(
 		beat.Info{},
 		cfg,
 		processBatch,
@@ -75,6 +75,7 @@ func newTracerServer(listener net.Listener, logger *logp.Logger) (*tracerServer,
 		nil,                         // no sourcemap store
 		false,                       // not managed
 		func() bool { return true }, // ready for publishing
+		nil,                         // no intake stats
 	)
 	if err != nil {
 		return nil, err
@@ -0,0 +1,115 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package decoder
+
+import (
+	"fmt"
+	"io"
+)
+
+// decompressionRatioMinBytes holds the number of decompressed bytes below
+// which DecompressionLimits.MaxRatio is not enforced, as small, highly
+// repetitive bodies may legitimately have high compression ratios.
+const decompressionRatioMinBytes = 1024 * 1024
+
+// DecompressionLimits holds limits on the decompressed size of request
+// bodies read with CompressedRequestReaderLimits, guarding against small
+// compressed bodies decompressing to far larger streams.
+type DecompressionLimits struct {
+	// MaxRatio holds the maximum ratio of decompressed to compressed
+	// bytes read from the body, enforced once at least 1MiB has been
+	// decompressed. Zero means no limit.
+	MaxRatio float64
+
+	// MaxBytes holds the maximum number of decompressed bytes read
+	// from the body. Zero means no limit.
+	MaxBytes int64
+}
+
+// DecompressionLimitError is returned by the reader returned from
+// CompressedRequestReaderLimits when the decompressed body exceeds
+// its DecompressionLimits.
+type DecompressionLimitError struct {
+	// Compressed and Decompressed hold the number of compressed bytes
+	// read from the body, and decompressed bytes read from the reader,
+	// when the limit was exceeded.
+	Compressed   int64
+	Decompressed int64
+
+	// Ratio is true if the limit exceeded was DecompressionLimits.MaxRatio,
+	// and false if it was DecompressionLimits.MaxBytes.
+	Ratio bool
+}
+
+func (e *DecompressionLimitError) Error() string {
+	if e.Ratio {
+		return fmt.Sprintf(
+			"decompressed body exceeds the maximum compression ratio: read %d bytes from %d compressed bytes",
+			e.Decompressed, e.Compressed,
+		)
+	}
+	return fmt.Sprintf("decompressed body exceeds the maximum size: read %d bytes", e.Decompressed)
+}
+
+// countingReader counts the bytes read from an io.Reader.
+type countingReader struct {
+	io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// decompressionLimitReadCloser wraps a decompressing reader, returning a
+// *DecompressionLimitError once the decompressed bytes exceed limits.
+type decompressionLimitReadCloser struct {
+	io.ReadCloser
+	compressed   *countingReader
+	decompressed int64
+	limits       DecompressionLimits
+	err          error
+}
+
+func (r *decompressionLimitReadCloser) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	n, err := r.ReadCloser.Read(p)
+	r.decompressed += int64(n)
+	if r.limits.MaxBytes > 0 && r.decompressed > r.limits.MaxBytes {
+		r.err = r.limitError(false)
+	} else if r.limits.MaxRatio > 0 && r.decompressed >= decompressionRatioMinBytes &&
+		float64(r.decompressed) > r.limits.MaxRatio*float64(r.compressed.n) {
+		r.err = r.limitError(true)
+	}
+	if r.err != nil {
+		return 0, r.err
+	}
+	return n, err
+}
+
+func (r *decompressionLimitReadCloser) limitError(ratio bool) error {
+	return &DecompressionLimitError{
+		Compressed:   r.compressed.n,
+		Decompressed: r.decompressed,
+		Ratio:        ratio,
+	}
+}
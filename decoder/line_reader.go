@@ -19,7 +19,6 @@ package decoder
 
 import (
 	"bufio"
-	"io"
 
 	"github.com/pkg/errors"
 )
@@ -30,7 +29,20 @@ var ErrLineTooLong = errors.New("Line exceeded permitted length")
 type LineReader struct {
 	br            *bufio.Reader
 	maxLineLength int
-	skip          bool
+
+	// truncated holds a copy of the first maxLineLength bytes of the
+	// latest line exceeding maxLineLength, as the bufio.Reader's buffer
+	// is reused while skipping the remainder of the line.
+	truncated []byte
+
+	// lineLength holds the full length of the latest line read,
+	// including any bytes skipped due to exceeding maxLineLength.
+	lineLength int
+
+	// err holds an error encountered while skipping the remainder
+	// of a line exceeding maxLineLength, to be returned by the next
+	// call to ReadLine.
+	err error
 }
 
 func NewLineReader(reader *bufio.Reader, maxLineLength int) *LineReader {
@@ -40,38 +52,60 @@ func NewLineReader(reader *bufio.Reader, maxLineLength int) *LineReader {
 	}
 }
 
+// SetMaxLineLength sets the maximum length of lines returned by ReadLine.
+// The maximum line length must not exceed the size of the *bufio.Reader's
+// buffer, which otherwise bounds the line length.
+func (lr *LineReader) SetMaxLineLength(maxLineLength int) {
+	lr.maxLineLength = maxLineLength
+}
+
 // Reset sets lr's underlying *bufio.Reader to br, and clears any state.
 func (lr *LineReader) Reset(br *bufio.Reader) {
 	lr.br = br
-	lr.skip = false
+	lr.lineLength = 0
+	lr.err = nil
 }
 
 // ReadLine reads the next line from the given reader.
 // If it encounters a line that is longer than `maxLineLength` it will
-// return the first `maxLineLength` bytes with `ErrLineTooLong`. On the next
-// call it will return the next line.
+// return the first `maxLineLength` bytes with `ErrLineTooLong`, skipping
+// the remainder of the line. On the next call it will return the next line.
 func (lr *LineReader) ReadLine() ([]byte, error) {
-	for {
-		prefix := false
-		line, err := lr.br.ReadSlice('\n')
-		if err == bufio.ErrBufferFull {
-			prefix = true
+	if err := lr.err; err != nil {
+		lr.err = nil
+		lr.lineLength = 0
+		return nil, err
+	}
+	line, err := lr.br.ReadSlice('\n')
+	lr.lineLength = len(line)
+	if err == bufio.ErrBufferFull {
+		lr.truncated = append(lr.truncated[:0], line[:lr.maxLineLength]...)
+		for err == bufio.ErrBufferFull {
+			line, err = lr.br.ReadSlice('\n')
+			lr.lineLength += len(line)
 		}
-
-		if !lr.skip {
-			if prefix {
-				lr.skip = true
-				return line[:lr.maxLineLength], ErrLineTooLong
-			}
-
-			if len(line) > 0 && line[len(line)-1] == '\n' {
-				line = line[:len(line)-1]
-			}
-			return line, err
-		} else if err == io.EOF {
-			return nil, io.EOF
-		} else if !prefix {
-			lr.skip = false
+		if len(line) > 0 && line[len(line)-1] == '\n' {
+			lr.lineLength--
 		}
+		lr.err = err
+		return lr.truncated, ErrLineTooLong
+	}
+	if len(line) > 0 && line[len(line)-1] == '\n' {
+		line = line[:len(line)-1]
+		lr.lineLength--
 	}
+	if len(line) > lr.maxLineLength {
+		// The line fits in the buffer, but exceeds the maximum length.
+		lr.truncated = append(lr.truncated[:0], line[:lr.maxLineLength]...)
+		lr.err = err
+		return lr.truncated, ErrLineTooLong
+	}
+	return line, err
+}
+
+// LineLength returns the full length of the line most recently returned
+// by ReadLine. For lines exceeding `maxLineLength`, this includes the bytes
+// that were skipped.
+func (lr *LineReader) LineLength() int {
+	return lr.lineLength
 }
@@ -122,14 +122,17 @@ func TestLineReaderTwoLongLines(t *testing.T) {
 		buf, err = lr.ReadLine()
 		assert.Equal(t, ErrLineTooLong, err)
 		assert.Equal(t, []byte("long-strin"), buf)
+		assert.Equal(t, len("long-string-with-no-newlines-at-all"), lr.LineLength())
 
 		buf, err = lr.ReadLine()
 		assert.Equal(t, ErrLineTooLong, err)
 		assert.Equal(t, []byte("another-lo"), buf)
+		assert.Equal(t, len("another-long-string-with-no-newlines-at-all"), lr.LineLength())
 
 		buf, err = lr.ReadLine()
 		assert.Equal(t, io.EOF, err)
 		assert.Equal(t, []byte("line2"), buf)
+		assert.Equal(t, len("line2"), lr.LineLength())
 	}
 }
 
@@ -212,3 +215,21 @@ func TestLineReaderShort(t *testing.T) {
 	assert.Equal(t, io.EOF, err)
 	assert.Equal(t, []byte("line2"), buf)
 }
+
+func TestLineReaderSetMaxLineLength(t *testing.T) {
+	readBuf := bytes.NewBufferString("0123456789\n0123456789\nline3")
+	lr := NewLineReader(bufio.NewReaderSize(readBuf, 16), 16)
+
+	buf, err := lr.ReadLine()
+	assert.NoError(t, err)
+	assert.Equal(t, "0123456789", string(buf))
+
+	lr.SetMaxLineLength(5)
+	buf, err = lr.ReadLine()
+	assert.Equal(t, ErrLineTooLong, err)
+	assert.Equal(t, "01234", string(buf))
+
+	buf, err = lr.ReadLine()
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, "line3", string(buf))
+}
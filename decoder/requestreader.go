@@ -20,6 +20,7 @@ package decoder
 import (
 	"compress/gzip"
 	"compress/zlib"
+	"fmt"
 	"io"
 	"net/http"
 
@@ -45,31 +46,60 @@ const (
 	uncompressedContentEncoding
 )
 
+// BodyShorterThanContentLengthError is returned by the reader returned from
+// CompressedRequestReader when the request body ends before the number of
+// bytes given by its Content-Length header have been read.
+type BodyShorterThanContentLengthError struct {
+	ContentLength int64
+	BytesRead     int64
+}
+
+func (e *BodyShorterThanContentLengthError) Error() string {
+	return fmt.Sprintf(
+		"body shorter than Content-Length: read %d of %d bytes",
+		e.BytesRead, e.ContentLength,
+	)
+}
+
 // CompressedRequestReader returns a reader that will decompress the body
 // according to the supplied Content-Encoding request header, or by sniffing
 // the body contents if no header is supplied by looking for magic byte
-// headers.
+// headers. The reader has a RequestBytesRead method, which returns the number
+// of bytes read from the request body, before decompression.
 //
 // Content-Encoding sniffing is implemented to support the RUM agent sending
 // compressed payloads using the Beacon API (https://w3c.github.io/beacon/),
 // which does not support specifying request headers.
 func CompressedRequestReader(req *http.Request) (io.ReadCloser, error) {
+	return CompressedRequestReaderLimits(req, DecompressionLimits{})
+}
+
+// CompressedRequestReaderLimits is like CompressedRequestReader, but the
+// returned reader fails with a *DecompressionLimitError if the body is
+// compressed, and its decompressed size exceeds limits. Uncompressed
+// bodies are not limited.
+func CompressedRequestReaderLimits(req *http.Request, limits DecompressionLimits) (io.ReadCloser, error) {
 	cLen := req.ContentLength
 	knownCLen := cLen > -1
 	if !knownCLen {
 		missingContentLengthCounter.Inc()
 	}
+	body := req.Body
+	if cLen > 0 {
+		body = &contentLengthReadCloser{ReadCloser: body, contentLength: cLen}
+	}
 
+	compressed := &countingReader{Reader: body}
 	var reader io.ReadCloser
 	var err error
 	contentEncoding := unspecifiedContentEncoding
 	switch req.Header.Get("Content-Encoding") {
 	case "deflate":
 		contentEncoding = deflateContentEncoding
-		reader, err = zlib.NewReader(req.Body)
+		reader, err = zlib.NewReader(compressed)
 	case "gzip":
 		contentEncoding = gzipContentEncoding
-		reader, err = gzip.NewReader(req.Body)
+		reader, err = gzip.NewReader(compressed)
 	default:
 		// Sniff encoding from payload by looking at the first two bytes.
 		// This produces much less garbage than opportunistically calling
@@ -81,10 +111,10 @@ func CompressedRequestReader(req *http.Request) (io.ReadCloser, error) {
 			gzipID1     = 0x1f
 			gzipID2     = 0x8b
 		)
-		rc := &compressedRequestReadCloser{reader: req.Body, Closer: req.Body}
-		if _, err := req.Body.Read(rc.magic[:]); err != nil {
+		rc := &compressedRequestReadCloser{reader: compressed, Closer: body}
+		if _, err := compressed.Read(rc.magic[:]); err != nil {
 			if err == io.EOF {
-				return req.Body, nil
+				return &requestBodyReadCloser{ReadCloser: body, body: compressed}, nil
 			}
 			return nil, err
 		}
@@ -121,7 +151,28 @@ func CompressedRequestReader(req *http.Request) (io.ReadCloser, error) {
 		}
 	}
 	readerCounter.Inc()
-	return reader, nil
+	if contentEncoding != uncompressedContentEncoding && (limits.MaxRatio > 0 || limits.MaxBytes > 0) {
+		reader = &decompressionLimitReadCloser{
+			ReadCloser: reader,
+			compressed: compressed,
+			limits:     limits,
+		}
+	}
+	return &requestBodyReadCloser{ReadCloser: reader, body: compressed}, nil
+}
+
+// requestBodyReadCloser wraps the reader returned by
+// CompressedRequestReaderLimits, recording the number of bytes
+// read from the request body.
+type requestBodyReadCloser struct {
+	io.ReadCloser
+	body *countingReader
+}
+
+// RequestBytesRead returns the number of bytes read from the request
+// body, before decompression.
+func (r *requestBodyReadCloser) RequestBytesRead() int64 {
+	return r.body.n
 }
 
 type compressedRequestReadCloser struct {
@@ -140,3 +191,24 @@ func (r *compressedRequestReadCloser) Read(p []byte) (int, error) {
 	n, err := r.reader.Read(p[nmagic:])
 	return n + nmagic, err
 }
+
+// contentLengthReadCloser wraps a request body, returning a
+// *BodyShorterThanContentLengthError if the body ends before
+// contentLength bytes have been read.
+type contentLengthReadCloser struct {
+	io.ReadCloser
+	contentLength int64
+	bytesRead     int64
+}
+
+func (r *contentLengthReadCloser) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.bytesRead += int64(n)
+	if (err == io.EOF || err == io.ErrUnexpectedEOF) && r.bytesRead < r.contentLength {
+		err = &BodyShorterThanContentLengthError{
+			ContentLength: r.contentLength,
+			BytesRead:     r.bytesRead,
+		}
+	}
+	return n, err
+}
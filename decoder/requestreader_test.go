@@ -21,6 +21,7 @@ import (
 	"bytes"
 	"compress/gzip"
 	"compress/zlib"
+	"fmt"
 	"io"
 	"net/http/httptest"
 	"testing"
@@ -86,6 +87,83 @@ func TestCompressedRequestReaderEmpty(t *testing.T) {
 	assert.Empty(t, data)
 }
 
+func TestCompressedRequestReaderBodyShorterThanContentLength(t *testing.T) {
+	uncompressed := "uncompressed input"
+	for name, body := range map[string][]byte{
+		"uncompressed": []byte(uncompressed),
+		"gzip":         gzipCompressString(uncompressed),
+		"deflate":      zlibCompressString(uncompressed),
+	} {
+		t.Run(name, func(t *testing.T) {
+			// Send all but the last 5 bytes of the body.
+			req := httptest.NewRequest("POST", "/", bytes.NewReader(body[:len(body)-5]))
+			req.ContentLength = int64(len(body))
+			reader, err := decoder.CompressedRequestReader(req)
+			require.NoError(t, err)
+
+			_, err = io.ReadAll(reader)
+			var shortBody *decoder.BodyShorterThanContentLengthError
+			require.ErrorAs(t, err, &shortBody)
+			assert.Equal(t, int64(len(body)), shortBody.ContentLength)
+			assert.Equal(t, int64(len(body)-5), shortBody.BytesRead)
+			assert.EqualError(t, err, fmt.Sprintf(
+				"body shorter than Content-Length: read %d of %d bytes",
+				len(body)-5, len(body),
+			))
+		})
+	}
+
+	t.Run("empty", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/", nil)
+		req.ContentLength = 5
+		_, err := decoder.CompressedRequestReader(req)
+		assert.EqualError(t, err, "body shorter than Content-Length: read 0 of 5 bytes")
+	})
+}
+
+func TestCompressedRequestReaderLimits(t *testing.T) {
+	// The highly compressible body exceeds the 1MiB
+	// below which the ratio limit is not enforced.
+	uncompressed := bytes.Repeat([]byte("a"), 2*1024*1024)
+	gzipCompressed := gzipCompressString(string(uncompressed))
+
+	readAll := func(contentEncoding string, body []byte, limits decoder.DecompressionLimits) ([]byte, error) {
+		req := httptest.NewRequest("POST", "/", bytes.NewReader(body))
+		if contentEncoding != "" {
+			req.Header.Set("Content-Encoding", contentEncoding)
+		}
+		reader, err := decoder.CompressedRequestReaderLimits(req, limits)
+		require.NoError(t, err)
+		return io.ReadAll(reader)
+	}
+
+	data, err := readAll("gzip", gzipCompressed, decoder.DecompressionLimits{})
+	assert.NoError(t, err)
+	assert.Equal(t, uncompressed, data)
+
+	_, err = readAll("", gzipCompressed, decoder.DecompressionLimits{MaxBytes: 1024 * 1024})
+	var limitErr *decoder.DecompressionLimitError
+	require.ErrorAs(t, err, &limitErr)
+	assert.False(t, limitErr.Ratio)
+	assert.Greater(t, limitErr.Decompressed, int64(1024*1024))
+
+	_, err = readAll("gzip", gzipCompressed, decoder.DecompressionLimits{MaxRatio: 10})
+	require.ErrorAs(t, err, &limitErr)
+	assert.True(t, limitErr.Ratio)
+	assert.Greater(t, float64(limitErr.Decompressed), 10*float64(limitErr.Compressed))
+
+	data, err = readAll("gzip", gzipCompressed, decoder.DecompressionLimits{
+		MaxRatio: float64(len(uncompressed)), MaxBytes: int64(len(uncompressed)),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, uncompressed, data)
+
+	// Uncompressed bodies are not limited.
+	data, err = readAll("", uncompressed, decoder.DecompressionLimits{MaxRatio: 1, MaxBytes: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, uncompressed, data)
+}
+
 func BenchmarkCompressedRequestReader(b *testing.B) {
 	benchmark := func(b *testing.B, input []byte, contentEncoding string) {
 		req := httptest.NewRequest("GET", "/", bytes.NewReader(input))
@@ -28,11 +28,7 @@ import (
 // NewNDJSONStreamDecoder returns a new NDJSONStreamDecoder which decodes
 // ND-JSON lines from r, with a maximum line length of maxLineLength.
 func NewNDJSONStreamDecoder(r io.Reader, maxLineLength int) *NDJSONStreamDecoder {
-	var dec NDJSONStreamDecoder
-	dec.bufioReader = bufio.NewReaderSize(r, maxLineLength)
-	dec.lineReader = NewLineReader(dec.bufioReader, maxLineLength)
-	dec.resetDecoder()
-	return &dec
+	return NewNDJSONStreamDecoderSize(r, maxLineLength, maxLineLength)
 }
 
 // NDJSONStreamDecoder decodes a stream of ND-JSON lines from an io.Reader.
@@ -47,6 +43,27 @@ type NDJSONStreamDecoder struct {
 	decoder          *jsoniter.Decoder
 }
 
+// NewNDJSONStreamDecoderSize returns a new NDJSONStreamDecoder which decodes
+// ND-JSON lines from r, with a maximum line length of maxLineLength, and a
+// buffer of bufferSize bytes. The maximum line length may be changed with
+// SetMaxLineLength, up to bufferSize.
+func NewNDJSONStreamDecoderSize(r io.Reader, maxLineLength, bufferSize int) *NDJSONStreamDecoder {
+	if bufferSize < maxLineLength {
+		bufferSize = maxLineLength
+	}
+	var dec NDJSONStreamDecoder
+	dec.bufioReader = bufio.NewReaderSize(r, bufferSize)
+	dec.lineReader = NewLineReader(dec.bufioReader, maxLineLength)
+	dec.resetDecoder()
+	return &dec
+}
+
+// SetMaxLineLength sets the maximum length of lines read by dec, which must
+// not exceed the buffer size given to NewNDJSONStreamDecoderSize.
+func (dec *NDJSONStreamDecoder) SetMaxLineLength(maxLineLength int) {
+	dec.lineReader.SetMaxLineLength(maxLineLength)
+}
+
 // Reset sets sr's underlying io.Reader to r, and resets any reading/decoding state.
 func (dec *NDJSONStreamDecoder) Reset(r io.Reader) {
 	dec.bufioReader.Reset(r)
@@ -99,6 +116,10 @@ func (dec *NDJSONStreamDecoder) IsEOF() bool { return dec.isEOF }
 // LatestLine returns the latest line read as []byte
 func (dec *NDJSONStreamDecoder) LatestLine() []byte { return dec.latestLine }
 
+// LatestLineLength returns the full length of the latest line read. This may
+// be greater than len(LatestLine()) if the line exceeded the maximum length.
+func (dec *NDJSONStreamDecoder) LatestLineLength() int { return dec.lineReader.LineLength() }
+
 // JSONDecodeError is a custom error that can occur during JSON decoding
 type JSONDecodeError string
 
@@ -33,18 +33,33 @@ import (
 // function. The result should therefore not necessarily be trusted to be correct;
 // that depends on the presence and configuration of proxies in front of apm-server.
 func ClientAddrFromHeaders(header http.Header) (ip net.IP, port uint16) {
-	for _, parse := range parseHeadersInOrder {
-		if ip, port := parse(header); ip != nil {
-			return ip, port
-		}
-	}
-	return nil, 0
+	return ClientAddrFromHeadersTrustDepth(header, 0)
 }
 
-var parseHeadersInOrder = []func(http.Header) (net.IP, uint16){
-	parseForwardedHeader,
-	parseXRealIP,
-	parseXForwardedFor,
+// ClientAddrFromHeadersTrustDepth is like ClientAddrFromHeaders, but takes the
+// number of trusted proxies which append themselves to the X-Forwarded-For header
+// in front of apm-server.
+//
+// If xffTrustDepth is greater than zero, the rightmost xffTrustDepth entries of
+// X-Forwarded-For are stripped as trusted proxies, and the rightmost remaining
+// entry is taken as the client. If the list has no more than xffTrustDepth
+// entries, the leftmost entry is taken. If xffTrustDepth is zero, the leftmost
+// entry is always taken.
+//
+// If xffTrustDepth is greater than zero, only X-Forwarded-For is considered.
+// The Forwarded and X-Real-IP headers may be set by the client, and would
+// otherwise take precedence over the entries appended by trusted proxies.
+func ClientAddrFromHeadersTrustDepth(header http.Header, xffTrustDepth int) (ip net.IP, port uint16) {
+	if xffTrustDepth > 0 {
+		return parseXForwardedFor(header, xffTrustDepth)
+	}
+	if ip, port := parseForwardedHeader(header); ip != nil {
+		return ip, port
+	}
+	if ip, port := parseXRealIP(header); ip != nil {
+		return ip, port
+	}
+	return parseXForwardedFor(header, xffTrustDepth)
 }
 
 func parseForwardedHeader(header http.Header) (net.IP, uint16) {
@@ -59,7 +74,18 @@ func parseXRealIP(header http.Header) (net.IP, uint16) {
 	return ParseIPPort(MaybeSplitHostPort(getHeader(header, "X-Real-Ip", "x-real-ip")))
 }
 
-func parseXForwardedFor(header http.Header) (net.IP, uint16) {
+func parseXForwardedFor(header http.Header, trustDepth int) (net.IP, uint16) {
+	if trustDepth > 0 {
+		entries := xForwardedForEntries(header)
+		if len(entries) == 0 {
+			return nil, 0
+		}
+		i := len(entries) - 1 - trustDepth
+		if i < 0 {
+			i = 0
+		}
+		return ParseIPPort(MaybeSplitHostPort(entries[i]))
+	}
 	if xff := getHeader(header, "X-Forwarded-For", "x-forwarded-for"); xff != "" {
 		if sep := strings.IndexRune(xff, ','); sep > 0 {
 			xff = xff[:sep]
@@ -69,6 +95,24 @@ func parseXForwardedFor(header http.Header) (net.IP, uint16) {
 	return nil, 0
 }
 
+// xForwardedForEntries returns the non-empty entries of all X-Forwarded-For
+// header values, in the order in which they were appended by proxies.
+func xForwardedForEntries(header http.Header) []string {
+	values := header.Values("X-Forwarded-For")
+	if len(values) == 0 {
+		values = header["x-forwarded-for"]
+	}
+	var entries []string
+	for _, value := range values {
+		for _, entry := range strings.Split(value, ",") {
+			if entry = strings.TrimSpace(entry); entry != "" {
+				entries = append(entries, entry)
+			}
+		}
+	}
+	return entries
+}
+
 func getHeader(header http.Header, key, keyLower string) string {
 	if v := header.Get(key); v != "" {
 		return v
@@ -99,6 +99,106 @@ func TestClientAddrFromHeaders(t *testing.T) {
 	}
 }
 
+func TestClientAddrFromHeadersTrustDepth(t *testing.T) {
+	for name, tc := range map[string]struct {
+		header     http.Header
+		trustDepth int
+		ip         string
+		port       uint16
+	}{
+		"no header": {trustDepth: 1},
+		"depth 0 takes leftmost": {
+			header:     http.Header{headerXForwardedFor: []string{"123.0.0.1, 10.0.0.1, 10.0.0.2"}},
+			trustDepth: 0,
+			ip:         "123.0.0.1",
+		},
+		"depth 1": {
+			header:     http.Header{headerXForwardedFor: []string{"123.0.0.1, 10.0.0.1, 10.0.0.2"}},
+			trustDepth: 1,
+			ip:         "10.0.0.1",
+		},
+		"depth 2": {
+			header:     http.Header{headerXForwardedFor: []string{"123.0.0.1, 10.0.0.1, 10.0.0.2"}},
+			trustDepth: 2,
+			ip:         "123.0.0.1",
+		},
+		"depth equal to list length": {
+			header:     http.Header{headerXForwardedFor: []string{"123.0.0.1, 10.0.0.1"}},
+			trustDepth: 2,
+			ip:         "123.0.0.1",
+		},
+		"depth greater than list length": {
+			header:     http.Header{headerXForwardedFor: []string{"123.0.0.1"}},
+			trustDepth: 3,
+			ip:         "123.0.0.1",
+		},
+		"multiple header values": {
+			header:     http.Header{headerXForwardedFor: []string{"123.0.0.1, 10.0.0.1", "10.0.0.2"}},
+			trustDepth: 1,
+			ip:         "10.0.0.1",
+		},
+		"empty entries ignored": {
+			header:     http.Header{headerXForwardedFor: []string{"123.0.0.1,, 10.0.0.1 ,"}},
+			trustDepth: 1,
+			ip:         "123.0.0.1",
+		},
+		"with port": {
+			header:     http.Header{headerXForwardedFor: []string{"123.0.0.1, [2001:db8:cafe::17]:4711, 10.0.0.1"}},
+			trustDepth: 1,
+			ip:         "2001:db8:cafe::17",
+			port:       4711,
+		},
+		"invalid entry": {
+			header:     http.Header{headerXForwardedFor: []string{"123.0.0.1, client.invalid, 10.0.0.1"}},
+			trustDepth: 1,
+		},
+		"Forwarded takes precedence with depth 0": {
+			header: http.Header{
+				headerForwarded:     []string{"for=182.0.0.9"},
+				headerXForwardedFor: []string{"123.0.0.1, 10.0.0.1"},
+			},
+			trustDepth: 0,
+			ip:         "182.0.0.9",
+		},
+		"Forwarded ignored with depth": {
+			header: http.Header{
+				headerForwarded:     []string{"for=182.0.0.9"},
+				headerXForwardedFor: []string{"123.0.0.1, 10.0.0.1"},
+			},
+			trustDepth: 1,
+			ip:         "123.0.0.1",
+		},
+		"X-Real-Ip ignored with depth": {
+			header: http.Header{
+				headerXRealIP:       []string{"182.0.0.9"},
+				headerXForwardedFor: []string{"123.0.0.1, 10.0.0.1"},
+			},
+			trustDepth: 1,
+			ip:         "123.0.0.1",
+		},
+		"X-Real-Ip without X-Forwarded-For ignored with depth": {
+			header:     http.Header{headerXRealIP: []string{"182.0.0.9"}},
+			trustDepth: 1,
+		},
+		"gRPC Metadata": {
+			header:     http.Header{"x-forwarded-for": []string{"123.0.0.1, 10.0.0.1"}},
+			trustDepth: 1,
+			ip:         "123.0.0.1",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			ip, port := ClientAddrFromHeadersTrustDepth(tc.header, tc.trustDepth)
+			if tc.ip == "" {
+				assert.Nil(t, ip)
+			} else {
+				require.NotNil(t, ip)
+				assert.Equal(t, tc.ip, ip.String())
+			}
+			assert.Equal(t, tc.port, port)
+		})
+	}
+}
+
 func TestParseForwarded(t *testing.T) {
 	type test struct {
 		name   string
@@ -16,6 +16,7 @@ package otlpreceiver
 
 import (
 	"context"
+	"mime"
 	"net/http"
 
 	"go.opentelemetry.io/collector/component/componenterror"
@@ -88,7 +89,7 @@ func TracesHTTPHandler(ctx context.Context, consumer consumer.Traces) (http.Hand
 		return nil, componenterror.ErrNilNextConsumer
 	}
 	return func(w http.ResponseWriter, r *http.Request) {
-		handleTraces(w, r, receiver, pbEncoder)
+		handleTraces(w, r, receiver, requestEncoder(r))
 	}, nil
 }
 
@@ -98,7 +99,7 @@ func MetricsHTTPHandler(ctx context.Context, consumer consumer.Metrics) (http.Ha
 		return nil, componenterror.ErrNilNextConsumer
 	}
 	return func(w http.ResponseWriter, r *http.Request) {
-		handleMetrics(w, r, receiver, pbEncoder)
+		handleMetrics(w, r, receiver, requestEncoder(r))
 	}, nil
 }
 
@@ -108,6 +109,23 @@ func LogsHTTPHandler(ctx context.Context, consumer consumer.Logs) (http.HandlerF
 		return nil, componenterror.ErrNilNextConsumer
 	}
 	return func(w http.ResponseWriter, r *http.Request) {
-		handleLogs(w, r, receiver, pbEncoder)
+		handleLogs(w, r, receiver, requestEncoder(r))
 	}, nil
 }
+
+// requestEncoder returns the encoder for the request's Content-Type:
+// JSON for application/json, and protobuf otherwise.
+func requestEncoder(r *http.Request) encoder {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err == nil && mediaType == jsonContentType {
+		return jsEncoder
+	}
+	return pbEncoder
+}
+
+// WriteHTTPError writes an OTLP/HTTP error response with the given status
+// code, encoding errMsg in a google.rpc.Status message according to the
+// request's Content-Type, as for errors returned by the HTTP handlers.
+func WriteHTTPError(w http.ResponseWriter, r *http.Request, errMsg string, statusCode int) {
+	writeStatusResponse(w, requestEncoder(r), statusCode, errorMsgToStatus(errMsg, statusCode).Proto())
+}
@@ -217,6 +217,22 @@ func TestAPMEventFields(t *testing.T) {
 			// timestamp.us is added for transactions, spans, and errors.
 			"timestamp": mapstr.M{"us": 1546525024908596},
 		},
+	}, {
+		input: APMEvent{
+			Processor: LogProcessor,
+			Log: Log{
+				Level: "info",
+				Body:  mapstr.M{"a.b": "value", "nested": map[string]interface{}{"c": 1}},
+			},
+		},
+		output: mapstr.M{
+			"processor": mapstr.M{"name": "log", "event": "log"},
+			// Structured log bodies are recorded as custom fields.
+			"log": mapstr.M{
+				"level": "info",
+				"body":  mapstr.M{"a_b": "value", "nested": map[string]interface{}{"c": 1}},
+			},
+		},
 	}} {
 		event := test.input.BeatEvent()
 		assert.Equal(t, test.output, event.Fields)
@@ -18,9 +18,29 @@
 package model
 
 import (
+	"net/url"
+	"strings"
+
 	"github.com/elastic/elastic-agent-libs/mapstr"
 )
 
+// RedactedValue replaces the values of headers redacted by RedactHTTP.
+const RedactedValue = "[REDACTED]"
+
+// HTTPRedactionPolicy describes HTTP fields to redact from events,
+// e.g. for compliance with privacy regulations.
+type HTTPRedactionPolicy struct {
+	// QueryParams holds the names of URL query parameters to drop from
+	// the event's URL. Names are matched exactly.
+	QueryParams []string
+
+	// Headers holds the names of HTTP request and response headers whose
+	// values are replaced with RedactedValue. Names are matched without
+	// regard to case. If Headers includes "Cookie", the values of the
+	// request's parsed cookies are also replaced with RedactedValue.
+	Headers []string
+}
+
 // HTTP holds information about an HTTP request and/or response.
 type HTTP struct {
 	Version  string
@@ -95,3 +115,124 @@ func (h *HTTPResponse) fields() mapstr.M {
 	fields.maybeSetFloat64ptr("decoded_body_size", h.DecodedBodySize)
 	return mapstr.M(fields)
 }
+
+// RedactHTTP redacts e's HTTP request and response headers and cookies,
+// and the query of e's URL, according to policy. RedactHTTP must be called
+// before the event is transformed for indexing.
+//
+// Headers and cookies are copied before being modified, as they may be
+// shared with other events.
+func (e *APMEvent) RedactHTTP(policy HTTPRedactionPolicy) {
+	if len(policy.Headers) > 0 {
+		if e.HTTP.Request != nil {
+			e.HTTP.Request.Headers = redactHeaders(e.HTTP.Request.Headers, policy.Headers)
+			if containsFold(policy.Headers, "Cookie") {
+				e.HTTP.Request.Cookies = redactCookies(e.HTTP.Request.Cookies)
+			}
+		}
+		if e.HTTP.Response != nil {
+			e.HTTP.Response.Headers = redactHeaders(e.HTTP.Response.Headers, policy.Headers)
+		}
+	}
+	if len(policy.QueryParams) > 0 && e.URL.Query != "" {
+		e.URL.redactQuery(policy.QueryParams)
+	}
+}
+
+// redactHeaders returns a copy of headers with the values of the headers
+// named in names replaced by RedactedValue, or headers if none match.
+func redactHeaders(headers mapstr.M, names []string) mapstr.M {
+	var out mapstr.M
+	for k, v := range headers {
+		if !containsFold(names, k) {
+			continue
+		}
+		if out == nil {
+			out = headers.Clone()
+		}
+		if values, ok := v.([]string); ok {
+			redacted := make([]string, len(values))
+			for i := range redacted {
+				redacted[i] = RedactedValue
+			}
+			out[k] = redacted
+		} else {
+			out[k] = RedactedValue
+		}
+	}
+	if out == nil {
+		return headers
+	}
+	return out
+}
+
+// redactCookies returns a copy of cookies with all values replaced by
+// RedactedValue, or cookies if there are none.
+func redactCookies(cookies mapstr.M) mapstr.M {
+	if len(cookies) == 0 {
+		return cookies
+	}
+	out := make(mapstr.M, len(cookies))
+	for k := range cookies {
+		out[k] = RedactedValue
+	}
+	return out
+}
+
+// redactQuery drops the query parameters named in names from u's query,
+// updating its Full and Original URLs to match. The order of the remaining
+// parameters is preserved.
+func (u *URL) redactQuery(names []string) {
+	params := strings.Split(u.Query, "&")
+	kept := params[:0]
+	for _, param := range params {
+		name := param
+		if i := strings.IndexByte(name, '='); i >= 0 {
+			name = name[:i]
+		}
+		if unescaped, err := url.QueryUnescape(name); err == nil {
+			name = unescaped
+		}
+		if !containsString(names, name) {
+			kept = append(kept, param)
+		}
+	}
+	query := strings.Join(kept, "&")
+	if query == u.Query {
+		return
+	}
+	u.Full = replaceQuery(u.Full, u.Query, query)
+	u.Original = replaceQuery(u.Original, u.Query, query)
+	u.Query = query
+}
+
+// replaceQuery replaces the query oldQuery in the URL s with newQuery,
+// dropping the "?" if newQuery is empty.
+func replaceQuery(s, oldQuery, newQuery string) string {
+	i := strings.Index(s, "?"+oldQuery)
+	if i == -1 {
+		return s
+	}
+	if newQuery != "" {
+		newQuery = "?" + newQuery
+	}
+	return s[:i] + newQuery + s[i+len(oldQuery)+1:]
+}
+
+func containsFold(values []string, s string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,106 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package model
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/elastic/elastic-agent-libs/mapstr"
+)
+
+func TestRedactHTTP(t *testing.T) {
+	requestHeaders := mapstr.M{
+		"Authorization": []string{"Bearer abc"},
+		"Content-Type":  []string{"application/json"},
+	}
+	event := APMEvent{
+		Processor:   TransactionProcessor,
+		Transaction: &Transaction{ID: "123"},
+		URL:         ParseURL("https://example.com/path?a=1&token=secret&b=2&Token=x#frag", "", ""),
+		HTTP: HTTP{
+			Request: &HTTPRequest{Method: "GET", Headers: requestHeaders},
+			Response: &HTTPResponse{
+				StatusCode: 200,
+				Headers:    mapstr.M{"set-cookie": "c=d", "Content-Length": []string{"10"}},
+			},
+		},
+	}
+	event.RedactHTTP(HTTPRedactionPolicy{
+		QueryParams: []string{"token", "c"},
+		Headers:     []string{"authorization", "Set-Cookie"},
+	})
+
+	assert.Equal(t, URL{
+		Original: "https://example.com/path?a=1&b=2&Token=x#frag",
+		Scheme:   "https",
+		Full:     "https://example.com/path?a=1&b=2&Token=x#frag",
+		Domain:   "example.com",
+		Path:     "/path",
+		Query:    "a=1&b=2&Token=x",
+		Fragment: "frag",
+	}, event.URL)
+	assert.Equal(t, mapstr.M{
+		"Authorization": []string{RedactedValue},
+		"Content-Type":  []string{"application/json"},
+	}, event.HTTP.Request.Headers)
+	assert.Equal(t, mapstr.M{
+		"set-cookie":     RedactedValue,
+		"Content-Length": []string{"10"},
+	}, event.HTTP.Response.Headers)
+
+	// The original headers are not modified.
+	assert.Equal(t, []string{"Bearer abc"}, requestHeaders["Authorization"])
+
+	// The redacted fields are reflected in the transformed event.
+	fields := event.BeatEvent().Fields
+	query, _ := fields.GetValue("url.query")
+	assert.Equal(t, "a=1&b=2&Token=x", query)
+	authorization, _ := fields.GetValue("http.request.headers.Authorization")
+	assert.Equal(t, []string{RedactedValue}, authorization)
+}
+
+func TestRedactHTTPCookies(t *testing.T) {
+	cookies := mapstr.M{"session": "abc", "theme": "dark"}
+	newEvent := func() APMEvent {
+		return APMEvent{HTTP: HTTP{Request: &HTTPRequest{
+			Headers: mapstr.M{"Cookie": []string{"session=abc; theme=dark"}},
+			Cookies: cookies,
+		}}}
+	}
+
+	// Parsed cookies are redacted along with the Cookie header.
+	event := newEvent()
+	event.RedactHTTP(HTTPRedactionPolicy{Headers: []string{"cookie"}})
+	assert.Equal(t, mapstr.M{"Cookie": []string{RedactedValue}}, event.HTTP.Request.Headers)
+	assert.Equal(t, mapstr.M{"session": RedactedValue, "theme": RedactedValue}, event.HTTP.Request.Cookies)
+	assert.Equal(t, mapstr.M{"session": "abc", "theme": "dark"}, cookies)
+
+	event = newEvent()
+	event.RedactHTTP(HTTPRedactionPolicy{Headers: []string{"authorization"}})
+	assert.Equal(t, cookies, event.HTTP.Request.Cookies)
+}
+
+func TestRedactHTTPQueryRemoved(t *testing.T) {
+	event := APMEvent{URL: ParseURL("http://localhost/?token=secret", "", "")}
+	event.RedactHTTP(HTTPRedactionPolicy{QueryParams: []string{"token"}})
+	assert.Equal(t, "", event.URL.Query)
+	assert.Equal(t, "http://localhost/", event.URL.Full)
+	assert.Equal(t, "http://localhost/", event.URL.Original)
+}
@@ -119,6 +119,40 @@ func (l NumericLabels) fields() mapstr.M {
 	return sanitizeLabels(result)
 }
 
+// LabelsWriter provides copy-on-write access to an event's Labels and
+// NumericLabels, which may be shared with other events. Each is cloned
+// the first time it is accessed for writing through the LabelsWriter.
+type LabelsWriter struct {
+	event         *APMEvent
+	labels        bool
+	numericLabels bool
+}
+
+// NewLabelsWriter returns a LabelsWriter for event.
+func NewLabelsWriter(event *APMEvent) LabelsWriter {
+	return LabelsWriter{event: event}
+}
+
+// Labels returns the event's Labels for writing. The first call
+// replaces the event's Labels with a (possibly empty) clone.
+func (w *LabelsWriter) Labels() Labels {
+	if !w.labels {
+		w.event.Labels = w.event.Labels.Clone()
+		w.labels = true
+	}
+	return w.event.Labels
+}
+
+// NumericLabels returns the event's NumericLabels for writing. The first
+// call replaces the event's NumericLabels with a (possibly empty) clone.
+func (w *LabelsWriter) NumericLabels() NumericLabels {
+	if !w.numericLabels {
+		w.event.NumericLabels = w.event.NumericLabels.Clone()
+		w.numericLabels = true
+	}
+	return w.event.NumericLabels
+}
+
 // Label keys are sanitized, replacing the reserved characters '.', '*' and '"'
 // with '_'. Null-valued labels are omitted.
 func sanitizeLabels(labels mapstr.M) mapstr.M {
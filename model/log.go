@@ -34,10 +34,15 @@ var (
 type Log struct {
 	// Level holds the log level of the log event.
 	Level string
+
+	// Body holds the structured body of the log event, if it is
+	// recorded with its structure rather than as Message.
+	Body mapstr.M
 }
 
 func (e Log) fields() mapstr.M {
 	var fields mapStr
 	fields.maybeSetString("level", e.Level)
+	fields.maybeSetMapStr("body", customFields(e.Body))
 	return mapstr.M(fields)
 }
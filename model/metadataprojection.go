@@ -0,0 +1,61 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package model
+
+// MetadataSection identifies a top-level section of event metadata
+// which may be dropped by a MetadataProjectionPolicy.
+type MetadataSection string
+
+const (
+	MetadataSectionHost       MetadataSection = "host"
+	MetadataSectionContainer  MetadataSection = "container"
+	MetadataSectionKubernetes MetadataSection = "kubernetes"
+	MetadataSectionCloud      MetadataSection = "cloud"
+)
+
+// MetadataProjectionPolicy describes top-level sections of metadata to
+// drop from events, e.g. for tenants with minimal retention which do not
+// want full host and container metadata stored.
+type MetadataProjectionPolicy struct {
+	// Drop holds the metadata sections to drop. Unknown sections are
+	// ignored.
+	Drop []MetadataSection
+}
+
+// NoMetadataProjection is the default MetadataProjectionPolicy,
+// which keeps all metadata.
+var NoMetadataProjection = MetadataProjectionPolicy{}
+
+// ProjectMetadata drops the metadata sections of e according to policy.
+//
+// ProjectMetadata is intended to be applied once to the base event of a
+// stream, rather than to each decoded event.
+func (e *APMEvent) ProjectMetadata(policy MetadataProjectionPolicy) {
+	for _, section := range policy.Drop {
+		switch section {
+		case MetadataSectionHost:
+			e.Host = Host{}
+		case MetadataSectionContainer:
+			e.Container = Container{}
+		case MetadataSectionKubernetes:
+			e.Kubernetes = Kubernetes{}
+		case MetadataSectionCloud:
+			e.Cloud = Cloud{}
+		}
+	}
+}
@@ -0,0 +1,53 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package model
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProjectMetadata(t *testing.T) {
+	event := APMEvent{
+		Service:    Service{Name: "svc"},
+		Host:       Host{Hostname: "host", IP: []net.IP{net.ParseIP("192.0.2.1")}},
+		Container:  Container{ID: "container"},
+		Kubernetes: Kubernetes{PodName: "pod"},
+		Cloud:      Cloud{Provider: "aws"},
+	}
+
+	projected := event
+	projected.ProjectMetadata(NoMetadataProjection)
+	assert.Equal(t, event, projected)
+
+	projected.ProjectMetadata(MetadataProjectionPolicy{Drop: []MetadataSection{
+		MetadataSectionHost, MetadataSectionKubernetes, "unknown",
+	}})
+	assert.Equal(t, APMEvent{
+		Service:   Service{Name: "svc"},
+		Container: Container{ID: "container"},
+		Cloud:     Cloud{Provider: "aws"},
+	}, projected)
+
+	projected.ProjectMetadata(MetadataProjectionPolicy{Drop: []MetadataSection{
+		MetadataSectionContainer, MetadataSectionCloud,
+	}})
+	assert.Equal(t, APMEvent{Service: Service{Name: "svc"}}, projected)
+}
@@ -247,6 +247,7 @@ type property struct {
 	Required             []string             `json:"required,omitempty"`
 	Enum                 []*string            `json:"enum,omitempty"`
 	Max                  json.Number          `json:"maximum,omitempty"`
+	MaxItems             json.Number          `json:"maxItems,omitempty"`
 	MaxLength            json.Number          `json:"maxLength,omitempty"`
 	Min                  json.Number          `json:"minimum,omitempty"`
 	MinItems             *int                 `json:"minItems,omitempty"`
@@ -46,6 +46,10 @@ for _, elem := range val.%s{
 		switch rule.name {
 		case tagMinLength, tagMaxLength:
 			err = sliceRuleMinMaxLength(w, f, rule)
+		case tagMaxItems:
+			sliceRuleMaxItems(w, f, rule)
+		case tagPattern:
+			err = sliceRulePattern(w, f, rule)
 		case tagMinVals:
 			err = sliceRuleMinVals(w, f, rule)
 		case tagRequired:
@@ -84,6 +88,34 @@ for _, elem := range val.%s{
 	return fmt.Errorf("unhandled tag rule max for type %s", f.Type().Underlying())
 }
 
+func sliceRuleMaxItems(w io.Writer, f structField, rule validationRule) {
+	fmt.Fprintf(w, `
+if len(val.%s) > %s{
+	return fmt.Errorf("'%s': validation rule '%s(%s)' violated")
+}
+`[1:], f.Name(), rule.value, jsonName(f), rule.name, rule.value)
+}
+
+func sliceRulePattern(w io.Writer, f structField, rule validationRule) error {
+	sliceT, ok := f.Type().Underlying().(*types.Slice)
+	if !ok {
+		return fmt.Errorf("unexpected error handling %s for slice", rule.name)
+	}
+	if basic, ok := sliceT.Elem().Underlying().(*types.Basic); ok {
+		if basic.Kind() == types.String {
+			fmt.Fprintf(w, `
+for _, elem := range val.%s{
+	if !%sRegexp.MatchString(elem){
+		return fmt.Errorf("'%s': validation rule '%s(%s)' violated")
+	}
+}
+`[1:], f.Name(), rule.value, jsonName(f), rule.name, rule.value)
+			return nil
+		}
+	}
+	return fmt.Errorf("unhandled tag rule pattern for type %s", f.Type().Underlying())
+}
+
 func sliceRuleMinVals(w io.Writer, f structField, rule validationRule) error {
 	fmt.Fprintf(w, `
 for _, elem := range val.%s{
@@ -110,6 +142,10 @@ func generateJSONPropertySlice(info *fieldInfo, parent *property, child *propert
 		minItems = 1
 	}
 	child.MinItems = &minItems
+	if maxItems, ok := info.tags[tagMaxItems]; ok {
+		child.MaxItems = json.Number(maxItems)
+		delete(info.tags, tagMaxItems)
+	}
 	parent.Properties[jsonSchemaName(info.field)] = child
 
 	itemType := info.field.Type().Underlying().(*types.Slice).Elem()
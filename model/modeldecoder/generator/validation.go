@@ -30,6 +30,7 @@ const (
 	tagInputTypes     = "inputTypes"
 	tagInputTypesVals = "inputTypesVals"
 	tagMax            = "max"
+	tagMaxItems       = "maxItems"
 	tagMaxLength      = "maxLength"
 	tagMaxLengthVals  = "maxLengthVals"
 	tagMin            = "min"
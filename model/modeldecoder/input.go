@@ -18,6 +18,9 @@
 package modeldecoder
 
 import (
+	"fmt"
+	"strings"
+
 	"github.com/elastic/apm-server/model"
 )
 
@@ -25,4 +28,60 @@ import (
 type Input struct {
 	// Base holds the base for decoding events.
 	Base model.APMEvent
+
+	// DropCookies controls whether HTTP request cookies are dropped
+	// from decoded events.
+	DropCookies bool
+
+	// MaxCookies holds the maximum number of HTTP request cookies to
+	// store per decoded event, if DropCookies is false. Cookies are kept
+	// in lexicographical order of their names. Zero means no limit.
+	MaxCookies int
+
+	// TransactionMarksKeySanitizer, if non-nil, sanitizes the group and
+	// mark keys of decoded transaction marks. If TransactionMarksKeySanitizer
+	// is nil, the characters '.', '*', and '"' are replaced with '_', as for
+	// label keys.
+	TransactionMarksKeySanitizer func(string) string
+
+	// Warn, if non-nil, is called for non-fatal conditions encountered
+	// while decoding an event, such as values being truncated. The code
+	// identifies the kind of condition, e.g. WarningCookiesTruncated.
+	Warn func(code, message string)
+}
+
+// WarningCookiesTruncated is the warning code reported when HTTP request
+// cookies are dropped because an event has more than Input.MaxCookies.
+const WarningCookiesTruncated = "cookies_truncated"
+
+// Warnf calls in.Warn, if non-nil, with the code and formatted message.
+func (in *Input) Warnf(code, format string, args ...interface{}) {
+	if in.Warn != nil {
+		in.Warn(code, fmt.Sprintf(format, args...))
+	}
+}
+
+var markKeyReplacer = strings.NewReplacer(".", "_", "*", "_", `"`, "_")
+
+// SanitizeTransactionMarks sanitizes the group and mark keys of the
+// transaction's marks with in.TransactionMarksKeySanitizer, recording
+// that they have been sanitized.
+func (in *Input) SanitizeTransactionMarks(event *model.Transaction) {
+	if event == nil || len(event.Marks) == 0 {
+		return
+	}
+	sanitize := in.TransactionMarksKeySanitizer
+	if sanitize == nil {
+		sanitize = markKeyReplacer.Replace
+	}
+	marks := make(model.TransactionMarks, len(event.Marks))
+	for group, groupMarks := range event.Marks {
+		sanitized := make(model.TransactionMark, len(groupMarks))
+		for mark, v := range groupMarks {
+			sanitized[sanitize(mark)] = v
+		}
+		marks[sanitize(group)] = sanitized
+	}
+	event.Marks = marks
+	event.MarksSanitized = true
 }
@@ -20,6 +20,7 @@ package modeldecoderutil
 import (
 	"encoding/json"
 	"net/http"
+	"sort"
 
 	"github.com/elastic/elastic-agent-libs/mapstr"
 )
@@ -37,6 +38,25 @@ func HTTPHeadersToMap(h http.Header) mapstr.M {
 	return m
 }
 
+// LimitHTTPRequestCookies returns cookies with at most max entries, keeping
+// those with the lexicographically lowest names. If cookies has no more
+// than max entries, or max is not positive, cookies is returned unchanged.
+func LimitHTTPRequestCookies(cookies mapstr.M, max int) mapstr.M {
+	if max <= 0 || len(cookies) <= max {
+		return cookies
+	}
+	names := make([]string, 0, len(cookies))
+	for k := range cookies {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	limited := make(mapstr.M, max)
+	for _, k := range names[:max] {
+		limited[k] = cookies[k]
+	}
+	return limited
+}
+
 // NormalizeHTTPRequestBody recurses through v, replacing any instance of
 // a json.Number with float64.
 //
@@ -36,25 +36,21 @@ func LabelsFrom(from mapstr.M, to *model.APMEvent) {
 // MergeLabels merges eventLabels into the APMEvent. This is used for
 // combining event-specific labels onto (metadata) global labels.
 //
-// If eventLabels is non-nil, it is first cloned.
+// The APMEvent's labels may be shared with other events, so they are
+// cloned before being modified.
 func MergeLabels(eventLabels mapstr.M, to *model.APMEvent) {
-	if to.NumericLabels == nil {
-		to.NumericLabels = make(model.NumericLabels)
-	}
-	if to.Labels == nil {
-		to.Labels = make(model.Labels)
-	}
+	w := model.NewLabelsWriter(to)
 	for k, v := range eventLabels {
 		switch v := v.(type) {
 		case string:
-			to.Labels.Set(k, v)
+			w.Labels().Set(k, v)
 		case bool:
-			to.Labels.Set(k, strconv.FormatBool(v))
+			w.Labels().Set(k, strconv.FormatBool(v))
 		case float64:
-			to.NumericLabels.Set(k, v)
+			w.NumericLabels().Set(k, v)
 		case json.Number:
 			if floatVal, err := v.Float64(); err == nil {
-				to.NumericLabels.Set(k, floatVal)
+				w.NumericLabels().Set(k, floatVal)
 			}
 		}
 	}
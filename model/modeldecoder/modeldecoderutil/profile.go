@@ -15,7 +15,7 @@
 // specific language governing permissions and limitations
 // under the License.
 
-package profile
+package modeldecoderutil
 
 import (
 	"fmt"
@@ -28,9 +28,9 @@ import (
 	"github.com/elastic/apm-server/model"
 )
 
-// appendProfileSampleBatch converts a pprof profile into a batch of model.ProfileSamples,
+// AppendProfileSampleBatch converts a pprof profile into a batch of model.ProfileSamples,
 // and appends it to out.
-func appendProfileSampleBatch(pp *profile.Profile, baseEvent model.APMEvent, out model.Batch) model.Batch {
+func AppendProfileSampleBatch(pp *profile.Profile, baseEvent model.APMEvent, out model.Batch) model.Batch {
 
 	// Precompute value field names for use in each event.
 	// TODO(axw) limit to well-known value names?
@@ -89,6 +89,14 @@ func appendProfileSampleBatch(pp *profile.Profile, baseEvent model.APMEvent, out
 		event := baseEvent
 		event.Processor = model.ProfileProcessor
 		event.Labels = event.Labels.Clone()
+		if event.NumericLabels != nil {
+			event.NumericLabels = event.NumericLabels.Clone()
+		}
+		if event.Transaction != nil {
+			// Each sample gets its own copy, so samples do not share mutable state.
+			tx := *event.Transaction
+			event.Transaction = &tx
+		}
 		if n := len(sample.Label); n > 0 {
 			for k, v := range sample.Label {
 				event.Labels.SetSlice(k, v)
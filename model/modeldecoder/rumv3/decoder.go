@@ -126,6 +126,7 @@ func DecodeNestedTransaction(d decoder.Decoder, input *modeldecoder.Input, batch
 
 	transaction := input.Base
 	mapToTransactionModel(&root.Transaction, &transaction)
+	input.SanitizeTransactionMarks(transaction.Transaction)
 	*batch = append(*batch, transaction)
 
 	for _, m := range root.Transaction.Metricsets {
@@ -142,6 +142,33 @@ func TestDecodeNestedTransaction(t *testing.T) {
 		assert.Equal(t, marks, batch[0].Transaction.Marks)
 	})
 
+	t.Run("marks", func(t *testing.T) {
+		str := `{"x":{"d":100,"id":"100","tid":"1","t":"request","yc":{"sd":2},"k":{"vendor.group":{"vendor.mark*":1}}}}`
+		for name, tc := range map[string]struct {
+			input modeldecoder.Input
+			marks model.TransactionMarks
+		}{
+			"default": {
+				input: modeldecoder.Input{},
+				marks: model.TransactionMarks{"vendor_group": {"vendor_mark_": 1}},
+			},
+			"sanitizer": {
+				input: modeldecoder.Input{TransactionMarksKeySanitizer: strings.NewReplacer("*", "_").Replace},
+				marks: model.TransactionMarks{"vendor.group": {"vendor.mark_": 1}},
+			},
+		} {
+			t.Run(name, func(t *testing.T) {
+				var batch model.Batch
+				dec := decoder.NewJSONDecoder(strings.NewReader(str))
+				require.NoError(t, DecodeNestedTransaction(dec, &tc.input, &batch))
+				require.NotEmpty(t, batch)
+				require.NotNil(t, batch[0].Transaction)
+				assert.Equal(t, tc.marks, batch[0].Transaction.Marks)
+				assert.True(t, batch[0].Transaction.MarksSanitized)
+			})
+		}
+	})
+
 	t.Run("validate", func(t *testing.T) {
 		var batch model.Batch
 		err := DecodeNestedTransaction(decoder.NewJSONDecoder(strings.NewReader(`{}`)), &modeldecoder.Input{}, &batch)
@@ -191,6 +218,10 @@ func TestDecodeMapToTransactionModel(t *testing.T) {
 			for _, s := range []string{
 				// values not set for RUM v3
 				"Kind", "RepresentativeCount", "Message", "DroppedSpansStats",
+				// Not set by the decoder
+				"IndexRepresentativeCount", "IndexSpanCountDroppedRatio",
+				// Set when decoding, tested in TestDecodeNestedTransaction
+				"MarksSanitized",
 				// Not set for transaction events:
 				"AggregatedDuration",
 				"AggregatedDuration.Count",
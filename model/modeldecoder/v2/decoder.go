@@ -18,6 +18,9 @@
 package v2
 
 import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -29,6 +32,9 @@ import (
 	"sync"
 	"time"
 
+	pprof_profile "github.com/google/pprof/profile"
+	"github.com/pkg/errors"
+
 	"github.com/elastic/apm-server/decoder"
 	"github.com/elastic/apm-server/internal/netutil"
 	"github.com/elastic/apm-server/model"
@@ -56,6 +62,11 @@ var (
 			return &metricsetRoot{}
 		},
 	}
+	profileRootPool = sync.Pool{
+		New: func() interface{} {
+			return &profileRoot{}
+		},
+	}
 	spanRootPool = sync.Pool{
 		New: func() interface{} {
 			return &spanRoot{}
@@ -68,6 +79,10 @@ var (
 	}
 )
 
+// MaxProfileDataSize is the maximum size of uncompressed pprof data
+// accepted within a single profile event.
+const MaxProfileDataSize = 10 * 1024 * 1024
+
 var (
 	// reForServiceTargetExpr regex will capture service target type and name
 	// Service target type comprises of only lowercase alphabets
@@ -102,6 +117,15 @@ func releaseMetricsetRoot(root *metricsetRoot) {
 	metricsetRootPool.Put(root)
 }
 
+func fetchProfileRoot() *profileRoot {
+	return profileRootPool.Get().(*profileRoot)
+}
+
+func releaseProfileRoot(root *profileRoot) {
+	root.Reset()
+	profileRootPool.Put(root)
+}
+
 func fetchSpanRoot() *spanRoot {
 	return spanRootPool.Get().(*spanRoot)
 }
@@ -150,6 +174,7 @@ func DecodeNestedError(d decoder.Decoder, input *modeldecoder.Input, batch *mode
 	}
 	event := input.Base
 	mapToErrorModel(&root.Error, &event)
+	limitRequestCookies(&event, input)
 	*batch = append(*batch, event)
 	return err
 }
@@ -174,6 +199,35 @@ func DecodeNestedMetricset(d decoder.Decoder, input *modeldecoder.Input, batch *
 	return err
 }
 
+// DecodeNestedProfile decodes a profile from d, appending a profile sample
+// event for each sample in the profile to batch.
+//
+// DecodeNestedProfile should be used when the stream in the decoder contains the `profile` key
+func DecodeNestedProfile(d decoder.Decoder, input *modeldecoder.Input, batch *model.Batch) error {
+	root := fetchProfileRoot()
+	defer releaseProfileRoot(root)
+	var err error
+	if err = d.Decode(root); err != nil && err != io.EOF {
+		return modeldecoder.NewDecoderErrFromJSONIter(err)
+	}
+	if err := root.validate(); err != nil {
+		return modeldecoder.NewValidationErr(err)
+	}
+	pp, perr := decodeProfileData(root.Profile.Data.Val)
+	if perr != nil {
+		return modeldecoder.NewValidationErr(perr)
+	}
+	event := input.Base
+	if root.Profile.TraceID.IsSet() {
+		event.Trace.ID = root.Profile.TraceID.Val
+	}
+	if root.Profile.TransactionID.IsSet() {
+		event.Transaction = &model.Transaction{ID: root.Profile.TransactionID.Val}
+	}
+	*batch = modeldecoderutil.AppendProfileSampleBatch(pp, event, *batch)
+	return err
+}
+
 // DecodeNestedSpan decodes a span from d, appending it to batch.
 //
 // DecodeNestedSpan should be used when the stream in the decoder contains the `span` key
@@ -208,10 +262,48 @@ func DecodeNestedTransaction(d decoder.Decoder, input *modeldecoder.Input, batch
 	}
 	event := input.Base
 	mapToTransactionModel(&root.Transaction, &event)
+	input.SanitizeTransactionMarks(event.Transaction)
+	limitRequestCookies(&event, input)
 	*batch = append(*batch, event)
 	return err
 }
 
+// decodeProfileData decodes base64 encoded, optionally gzip compressed,
+// pprof profile data. The uncompressed size of the profile is limited to
+// MaxProfileDataSize, to guard against compression bombs.
+func decodeProfileData(data string) (*pprof_profile.Profile, error) {
+	raw, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decode profile data")
+	}
+	if len(raw) >= 2 && raw[0] == 0x1f && raw[1] == 0x8b {
+		zr, err := gzip.NewReader(bytes.NewReader(raw))
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to decompress profile data")
+		}
+		r := &decoder.LimitedReader{R: zr, N: MaxProfileDataSize}
+		if raw, err = io.ReadAll(r); err != nil {
+			if r.N < 0 {
+				return nil, fmt.Errorf("uncompressed profile data exceeds limit of %d bytes", MaxProfileDataSize)
+			}
+			return nil, errors.Wrap(err, "failed to decompress profile data")
+		}
+	}
+	pp, err := pprof_profile.ParseData(raw)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse profile data")
+	}
+	// Stack frames are aggregated at the function level, using the first
+	// line of each location. pprof permits locations without lines, e.g.
+	// when symbolization is unavailable.
+	for _, loc := range pp.Location {
+		if len(loc.Line) == 0 {
+			return nil, fmt.Errorf("profile location %d has no line information", loc.ID)
+		}
+	}
+	return pp, nil
+}
+
 func decodeMetadata(decFn func(d decoder.Decoder, m *metadataRoot) error, d decoder.Decoder, out *model.APMEvent) error {
 	m := fetchMetadataRoot()
 	defer releaseMetadataRoot(m)
@@ -613,8 +705,36 @@ func mapToMetadataModel(from *metadata, out *model.APMEvent) {
 
 	// Network
 	if from.Network.Connection.Type.IsSet() {
-		out.Network.Connection.Type = from.Network.Connection.Type.Val
+		out.Network.Connection.Type = normalizeNetworkConnectionType(from.Network.Connection.Type.Val)
 	}
+	if from.Network.Connection.Subtype.IsSet() {
+		out.Network.Connection.Subtype = from.Network.Connection.Subtype.Val
+	}
+	if from.Network.Carrier.Name.IsSet() {
+		out.Network.Carrier.Name = from.Network.Carrier.Name.Val
+	}
+	if from.Network.Carrier.MCC.IsSet() {
+		out.Network.Carrier.MCC = from.Network.Carrier.MCC.Val
+	}
+	if from.Network.Carrier.MNC.IsSet() {
+		out.Network.Carrier.MNC = from.Network.Carrier.MNC.Val
+	}
+	if from.Network.Carrier.ICC.IsSet() {
+		out.Network.Carrier.ICC = from.Network.Carrier.ICC.Val
+	}
+}
+
+// normalizeNetworkConnectionType returns the known network connection type
+// matching connectionType, ignoring case and surrounding whitespace. Rather
+// than rejecting events from agents sending other values, such as the
+// effective connection type reported by browsers, unrecognized connection
+// types are recorded as reported.
+func normalizeNetworkConnectionType(connectionType string) string {
+	switch normalized := strings.ToLower(strings.TrimSpace(connectionType)); normalized {
+	case "wifi", "wired", "cell", "unavailable", "unknown":
+		return normalized
+	}
+	return connectionType
 }
 
 func mapToMetricsetModel(from *metricset, event *model.APMEvent) bool {
@@ -708,6 +828,26 @@ func mapToRequestModel(from contextRequest, out *model.HTTPRequest) {
 	}
 }
 
+// limitRequestCookies drops or limits the HTTP request cookies of event,
+// according to input.
+func limitRequestCookies(event *model.APMEvent, input *modeldecoder.Input) {
+	if event.HTTP.Request == nil || len(event.HTTP.Request.Cookies) == 0 {
+		return
+	}
+	if input.DropCookies {
+		event.HTTP.Request.Cookies = nil
+		return
+	}
+	cookies := event.HTTP.Request.Cookies
+	event.HTTP.Request.Cookies = modeldecoderutil.LimitHTTPRequestCookies(cookies, input.MaxCookies)
+	if n := len(event.HTTP.Request.Cookies); n < len(cookies) {
+		input.Warnf(
+			modeldecoder.WarningCookiesTruncated,
+			"HTTP request cookies limited to %d of %d", n, len(cookies),
+		)
+	}
+}
+
 func mapToRequestURLModel(from contextRequestURL, out *model.URL) {
 	if from.Raw.IsSet() {
 		out.Original = from.Raw.Val
@@ -1289,12 +1429,10 @@ func mapOTelAttributesTransaction(from otel, out *model.APMEvent) {
 	if from.SpanKind.IsSet() {
 		out.Span.Kind = from.SpanKind.Val
 	}
-	if out.Labels == nil {
-		out.Labels = make(model.Labels)
-	}
-	if out.NumericLabels == nil {
-		out.NumericLabels = make(model.NumericLabels)
-	}
+	// The labels may be shared with other events,
+	// so clone them before they are modified.
+	out.Labels = out.Labels.Clone()
+	out.NumericLabels = out.NumericLabels.Clone()
 	// TODO: Does this work? Is there a way we can infer the status code,
 	// potentially in the actual attributes map?
 	spanStatus := pdata.NewSpanStatus()
@@ -1317,12 +1455,10 @@ const spanKindStringPrefix = "SPAN_KIND_"
 
 func mapOTelAttributesSpan(from otel, out *model.APMEvent) {
 	m := otelAttributeMap(&from)
-	if out.Labels == nil {
-		out.Labels = make(model.Labels)
-	}
-	if out.NumericLabels == nil {
-		out.NumericLabels = make(model.NumericLabels)
-	}
+	// The labels may be shared with other events,
+	// so clone them before they are modified.
+	out.Labels = out.Labels.Clone()
+	out.NumericLabels = out.NumericLabels.Clone()
 	var spanKind pdata.SpanKind
 	if from.SpanKind.IsSet() {
 		switch from.SpanKind.Val {
@@ -72,6 +72,28 @@ func TestDecodeNestedError(t *testing.T) {
 		assert.Contains(t, err.Error(), "decode")
 	})
 
+	t.Run("cookies", func(t *testing.T) {
+		str := `{"error":{"id":"a-b-c","timestamp":1599996822281000,"log":{"message":"abc"},` +
+			`"context":{"request":{"method":"GET","cookies":{"c":"3","a":"1","b":"2"}}}}}`
+		for name, tc := range map[string]struct {
+			input   modeldecoder.Input
+			cookies mapstr.M
+		}{
+			"unlimited": {input: modeldecoder.Input{}, cookies: mapstr.M{"a": "1", "b": "2", "c": "3"}},
+			"max":       {input: modeldecoder.Input{MaxCookies: 1}, cookies: mapstr.M{"a": "1"}},
+			"drop":      {input: modeldecoder.Input{DropCookies: true}, cookies: nil},
+		} {
+			t.Run(name, func(t *testing.T) {
+				var out model.Batch
+				dec := decoder.NewJSONDecoder(strings.NewReader(str))
+				require.NoError(t, DecodeNestedError(dec, &tc.input, &out))
+				require.Len(t, out, 1)
+				require.NotNil(t, out[0].HTTP.Request)
+				assert.Equal(t, tc.cookies, out[0].HTTP.Request.Cookies)
+			})
+		}
+	})
+
 	t.Run("validate", func(t *testing.T) {
 		var out model.Batch
 		err := DecodeNestedError(decoder.NewJSONDecoder(strings.NewReader(`{}`)), &modeldecoder.Input{}, &out)
@@ -82,14 +82,6 @@ func isUnmappedMetadataField(key string) bool {
 		"HTTP.Response",
 		"HTTP.Version",
 		"Message",
-		"Network",
-		"Network.Connection",
-		"Network.Connection.Subtype",
-		"Network.Carrier",
-		"Network.Carrier.Name",
-		"Network.Carrier.MCC",
-		"Network.Carrier.MNC",
-		"Network.Carrier.ICC",
 		"Observer",
 		"Observer.EphemeralID",
 		"Observer.Hostname",
@@ -120,6 +112,7 @@ func isUnmappedMetadataField(key string) bool {
 		"Event.Action",
 		"Log",
 		"Log.Level",
+		"Log.Body",
 		"Service.Origin",
 		"Service.Origin.ID",
 		"Service.Origin.Name",
@@ -311,4 +304,47 @@ func TestDecodeMapToMetadataModel(t *testing.T) {
 		assert.Empty(t, out.Host.Name)
 		assert.Empty(t, out.Host.Hostname)
 	})
+
+	t.Run("network", func(t *testing.T) {
+		for connectionType, expected := range map[string]string{
+			"wifi":        "wifi",
+			"Cell":        "cell",
+			" WIRED ":     "wired",
+			"unavailable": "unavailable",
+			"unknown":     "unknown",
+			"5G":          "5G",
+			"":            "",
+		} {
+			var input metadata
+			var out model.APMEvent
+			input.Network.Connection.Type.Set(connectionType)
+			mapToMetadataModel(&input, &out)
+			assert.Equal(t, expected, out.Network.Connection.Type, connectionType)
+		}
+	})
+}
+
+func TestDecodeNestedMetadataNetwork(t *testing.T) {
+	input := `{"metadata":{"service":{"name":"mobile-app","agent":{"name":"android/java","version":"0.1.0"}},` +
+		`"network":{"connection":{"type":"CELL","subtype":"LTE"},` +
+		`"carrier":{"name":"Vodafone","mcc":"234","mnc":"15","icc":"GB"}}}}`
+	var out model.APMEvent
+	require.NoError(t, DecodeNestedMetadata(decoder.NewJSONDecoder(strings.NewReader(input)), &out))
+	assert.Equal(t, model.Network{
+		Connection: model.NetworkConnection{Type: "cell", Subtype: "LTE"},
+		Carrier:    model.NetworkCarrier{Name: "Vodafone", MCC: "234", MNC: "15", ICC: "GB"},
+	}, out.Network)
+
+	// An unrecognized connection type does not cause the metadata to be rejected.
+	input = `{"metadata":{"service":{"name":"mobile-app","agent":{"name":"android/java","version":"0.1.0"}},` +
+		`"network":{"connection":{"type":"Satellite"}}}}`
+	out = model.APMEvent{}
+	require.NoError(t, DecodeNestedMetadata(decoder.NewJSONDecoder(strings.NewReader(input)), &out))
+	assert.Equal(t, "Satellite", out.Network.Connection.Type)
+
+	input = `{"metadata":{"service":{"name":"mobile-app","agent":{"name":"android/java","version":"0.1.0"}},` +
+		`"network":{"carrier":{"mcc":"` + strings.Repeat("x", 1025) + `"}}}}`
+	err := DecodeNestedMetadata(decoder.NewJSONDecoder(strings.NewReader(input)), &out)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "validation")
 }
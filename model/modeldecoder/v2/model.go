@@ -27,6 +27,7 @@ import (
 
 var (
 	patternAlphaNumericExt = `^[a-zA-Z0-9 _-]+$`
+	patternHexID           = `^[0-9a-fA-F]+$`
 	patternNoAsteriskQuote = `^[^*"]*$` //do not allow '*' '"'
 
 	enumOutcome = []string{"success", "failure", "unknown"}
@@ -49,6 +50,11 @@ type metricsetRoot struct {
 	Metricset metricset `json:"metricset" validate:"required"`
 }
 
+// profileRoot requires a profile event to be present
+type profileRoot struct {
+	Profile profile `json:"profile" validate:"required"`
+}
+
 // spanRoot requires a span event to be present
 type spanRoot struct {
 	Span span `json:"span" validate:"required"`
@@ -618,11 +624,32 @@ type metadataSystemKubernetesPod struct {
 }
 
 type network struct {
+	// Connection holds information about the network connection.
 	Connection networkConnection `json:"connection"`
+	// Carrier holds information about the connection carrier,
+	// for mobile devices.
+	Carrier networkCarrier `json:"carrier"`
 }
 
 type networkConnection struct {
+	// Type holds the connection type category, e.g. "wifi", "wired", or
+	// "cell". Known types are matched ignoring case; other values are
+	// recorded as reported.
 	Type nullable.String `json:"type" validate:"maxLength=1024"`
+	// Subtype holds details of the connection type, specific to the
+	// connection type category, e.g. "LTE" for cellular connections.
+	Subtype nullable.String `json:"subtype" validate:"maxLength=1024"`
+}
+
+type networkCarrier struct {
+	// Name of the carrier, e.g. "Vodafone".
+	Name nullable.String `json:"name" validate:"maxLength=1024"`
+	// MCC holds the carrier's mobile country code.
+	MCC nullable.String `json:"mcc" validate:"maxLength=1024"`
+	// MNC holds the carrier's mobile network code.
+	MNC nullable.String `json:"mnc" validate:"maxLength=1024"`
+	// ICC holds the carrier's ISO 3166-1 alpha-2 2-character country code.
+	ICC nullable.String `json:"icc" validate:"maxLength=1024"`
 }
 
 type metricset struct {
@@ -705,12 +732,24 @@ type metricsetServiceRef struct {
 	Version nullable.String `json:"version" validate:"maxLength=1024"`
 }
 
+type profile struct {
+	// Data holds the base64 encoded, optionally gzip compressed, profile in
+	// pprof protobuf format.
+	Data nullable.String `json:"data" validate:"required"`
+	// TraceID holds the hex encoded 128 random bits ID of the correlated trace.
+	TraceID nullable.String `json:"trace_id" validate:"requiredIfAny=transaction_id,maxLength=1024"`
+	// TransactionID holds the hex encoded 64 random bits ID of the correlated
+	// transaction.
+	TransactionID nullable.String `json:"transaction_id" validate:"maxLength=1024"`
+}
+
 type span struct {
 	// Action holds the specific kind of event within the sub-type represented
 	// by the span (e.g. query, connect)
 	Action nullable.String `json:"action" validate:"maxLength=1024"`
-	// ChildIDs holds a list of successor transactions and/or spans.
-	ChildIDs []string `json:"child_ids" validate:"maxLength=1024"`
+	// ChildIDs holds a list of successor transactions and/or spans,
+	// identified by their hex-encoded IDs.
+	ChildIDs []string `json:"child_ids" validate:"maxItems=1000,maxLength=1024,pattern=patternHexID"`
 	// Composite holds details on a group of spans represented by a single one.
 	Composite spanComposite `json:"composite"`
 	// Context holds arbitrary contextual information for the event.
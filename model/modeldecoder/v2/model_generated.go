@@ -31,6 +31,7 @@ import (
 
 var (
 	patternAlphaNumericExtRegexp = regexp.MustCompile(patternAlphaNumericExt)
+	patternHexIDRegexp           = regexp.MustCompile(patternHexID)
 	patternNoAsteriskQuoteRegexp = regexp.MustCompile(patternNoAsteriskQuote)
 )
 
@@ -639,11 +640,12 @@ func (val *user) validate() error {
 }
 
 func (val *network) IsSet() bool {
-	return val.Connection.IsSet()
+	return val.Connection.IsSet() || val.Carrier.IsSet()
 }
 
 func (val *network) Reset() {
 	val.Connection.Reset()
+	val.Carrier.Reset()
 }
 
 func (val *network) validate() error {
@@ -653,15 +655,19 @@ func (val *network) validate() error {
 	if err := val.Connection.validate(); err != nil {
 		return errors.Wrapf(err, "connection")
 	}
+	if err := val.Carrier.validate(); err != nil {
+		return errors.Wrapf(err, "carrier")
+	}
 	return nil
 }
 
 func (val *networkConnection) IsSet() bool {
-	return val.Type.IsSet()
+	return val.Type.IsSet() || val.Subtype.IsSet()
 }
 
 func (val *networkConnection) Reset() {
 	val.Type.Reset()
+	val.Subtype.Reset()
 }
 
 func (val *networkConnection) validate() error {
@@ -671,6 +677,39 @@ func (val *networkConnection) validate() error {
 	if val.Type.IsSet() && utf8.RuneCountInString(val.Type.Val) > 1024 {
 		return fmt.Errorf("'type': validation rule 'maxLength(1024)' violated")
 	}
+	if val.Subtype.IsSet() && utf8.RuneCountInString(val.Subtype.Val) > 1024 {
+		return fmt.Errorf("'subtype': validation rule 'maxLength(1024)' violated")
+	}
+	return nil
+}
+
+func (val *networkCarrier) IsSet() bool {
+	return val.Name.IsSet() || val.MCC.IsSet() || val.MNC.IsSet() || val.ICC.IsSet()
+}
+
+func (val *networkCarrier) Reset() {
+	val.Name.Reset()
+	val.MCC.Reset()
+	val.MNC.Reset()
+	val.ICC.Reset()
+}
+
+func (val *networkCarrier) validate() error {
+	if !val.IsSet() {
+		return nil
+	}
+	if val.Name.IsSet() && utf8.RuneCountInString(val.Name.Val) > 1024 {
+		return fmt.Errorf("'name': validation rule 'maxLength(1024)' violated")
+	}
+	if val.MCC.IsSet() && utf8.RuneCountInString(val.MCC.Val) > 1024 {
+		return fmt.Errorf("'mcc': validation rule 'maxLength(1024)' violated")
+	}
+	if val.MNC.IsSet() && utf8.RuneCountInString(val.MNC.Val) > 1024 {
+		return fmt.Errorf("'mnc': validation rule 'maxLength(1024)' violated")
+	}
+	if val.ICC.IsSet() && utf8.RuneCountInString(val.ICC.Val) > 1024 {
+		return fmt.Errorf("'icc': validation rule 'maxLength(1024)' violated")
+	}
 	return nil
 }
 
@@ -1698,6 +1737,55 @@ func (val *trigger) validate() error {
 	return nil
 }
 
+func (val *profileRoot) IsSet() bool {
+	return val.Profile.IsSet()
+}
+
+func (val *profileRoot) Reset() {
+	val.Profile.Reset()
+}
+
+func (val *profileRoot) validate() error {
+	if err := val.Profile.validate(); err != nil {
+		return errors.Wrapf(err, "profile")
+	}
+	if !val.Profile.IsSet() {
+		return fmt.Errorf("'profile' required")
+	}
+	return nil
+}
+
+func (val *profile) IsSet() bool {
+	return val.Data.IsSet() || val.TraceID.IsSet() || val.TransactionID.IsSet()
+}
+
+func (val *profile) Reset() {
+	val.Data.Reset()
+	val.TraceID.Reset()
+	val.TransactionID.Reset()
+}
+
+func (val *profile) validate() error {
+	if !val.IsSet() {
+		return nil
+	}
+	if !val.Data.IsSet() {
+		return fmt.Errorf("'data' required")
+	}
+	if val.TraceID.IsSet() && utf8.RuneCountInString(val.TraceID.Val) > 1024 {
+		return fmt.Errorf("'trace_id': validation rule 'maxLength(1024)' violated")
+	}
+	if !val.TraceID.IsSet() {
+		if val.TransactionID.IsSet() {
+			return fmt.Errorf("'trace_id' required when 'transaction_id' is set")
+		}
+	}
+	if val.TransactionID.IsSet() && utf8.RuneCountInString(val.TransactionID.Val) > 1024 {
+		return fmt.Errorf("'transaction_id': validation rule 'maxLength(1024)' violated")
+	}
+	return nil
+}
+
 func (val *spanRoot) IsSet() bool {
 	return val.Span.IsSet()
 }
@@ -1756,11 +1844,19 @@ func (val *span) validate() error {
 	if val.Action.IsSet() && utf8.RuneCountInString(val.Action.Val) > 1024 {
 		return fmt.Errorf("'action': validation rule 'maxLength(1024)' violated")
 	}
+	if len(val.ChildIDs) > 1000 {
+		return fmt.Errorf("'child_ids': validation rule 'maxItems(1000)' violated")
+	}
 	for _, elem := range val.ChildIDs {
 		if utf8.RuneCountInString(elem) > 1024 {
 			return fmt.Errorf("'child_ids': validation rule 'maxLength(1024)' violated")
 		}
 	}
+	for _, elem := range val.ChildIDs {
+		if !patternHexIDRegexp.MatchString(elem) {
+			return fmt.Errorf("'child_ids': validation rule 'pattern(patternHexID)' violated")
+		}
+	}
 	if err := val.Composite.validate(); err != nil {
 		return errors.Wrapf(err, "composite")
 	}
@@ -91,6 +91,27 @@ func TestSamplesValidationRules(t *testing.T) {
 	testValidation(t, "metricset", testcases, "samples")
 }
 
+func TestChildIDsValidationRules(t *testing.T) {
+	childIDs := func(n int) string {
+		ids := make([]string, n)
+		for i := range ids {
+			ids[i] = fmt.Sprintf(`"%016x"`, i)
+		}
+		return "[" + strings.Join(ids, ",") + "]"
+	}
+	testcases := []testcase{
+		{name: "child-ids", data: `["51234abcdef56789","4AAAAAAAAAAAAAAA"]`},
+		{name: "child-ids-empty", data: `[]`},
+		{name: "child-ids-invalid", errorKey: "patternHexID", data: `["51234abcdef56789","not-a-span-id"]`},
+		{name: "child-ids-empty-id", errorKey: "patternHexID", data: `[""]`},
+		{name: "child-ids-max-items", data: childIDs(1000)},
+		{name: "child-ids-max-items-exceeded", errorKey: "maxItems", data: childIDs(1001)},
+		{name: "child-ids-max-len-exceeded", errorKey: "maxLength",
+			data: `["` + modeldecodertest.BuildStringWith(1025, 'a') + `"]`},
+	}
+	testValidation(t, "span", testcases, "child_ids")
+}
+
 func TestMaxLenValidationRules(t *testing.T) {
 	// this tests an arbitrary field to ensure the `max` rule on strings works as expected
 	testcases := []testcase{
@@ -510,6 +531,8 @@ func TestSpanRequiredValidationRules(t *testing.T) {
 	event.Outcome.Set("failure")
 	// Composite.Count must be > 1
 	event.Composite.Count.Set(2)
+	// ChildIDs must be hex encoded
+	event.ChildIDs = []string{"51234abcdef56789"}
 	// test vanilla struct is valid
 	require.NoError(t, event.validate())
 
@@ -0,0 +1,166 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package v2
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	pprof_profile "github.com/google/pprof/profile"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/apm-server/decoder"
+	"github.com/elastic/apm-server/model"
+	"github.com/elastic/apm-server/model/modeldecoder"
+)
+
+func TestResetProfileOnRelease(t *testing.T) {
+	inp := `{"profile":{"data":"abc","trace_id":"def"}}`
+	root := fetchProfileRoot()
+	require.NoError(t, decoder.NewJSONDecoder(strings.NewReader(inp)).Decode(root))
+	require.True(t, root.IsSet())
+	releaseProfileRoot(root)
+	assert.False(t, root.IsSet())
+}
+
+func TestDecodeNestedProfile(t *testing.T) {
+	encodeProfile := func(t *testing.T, compress bool) string {
+		fn := &pprof_profile.Function{ID: 1, Name: "main.main", Filename: "main.go"}
+		loc := &pprof_profile.Location{ID: 1, Line: []pprof_profile.Line{{Function: fn, Line: 10}}}
+		p := &pprof_profile.Profile{
+			SampleType: []*pprof_profile.ValueType{{Type: "samples", Unit: "count"}},
+			TimeNanos:  time.Unix(1599996822, 0).UnixNano(),
+			Function:   []*pprof_profile.Function{fn},
+			Location:   []*pprof_profile.Location{loc},
+			Sample: []*pprof_profile.Sample{
+				{Location: []*pprof_profile.Location{loc}, Value: []int64{1}},
+				{Location: []*pprof_profile.Location{loc}, Value: []int64{2}},
+			},
+		}
+		var buf bytes.Buffer
+		if compress {
+			require.NoError(t, p.Write(&buf))
+		} else {
+			require.NoError(t, p.WriteUncompressed(&buf))
+		}
+		return base64.StdEncoding.EncodeToString(buf.Bytes())
+	}
+
+	t.Run("decode", func(t *testing.T) {
+		for _, compress := range []bool{false, true} {
+			input := modeldecoder.Input{Base: model.APMEvent{Service: model.Service{Name: "svc"}}}
+			str := fmt.Sprintf(`{"profile":{"data":%q,"trace_id":"trace","transaction_id":"tx"}}`, encodeProfile(t, compress))
+			var batch model.Batch
+			require.NoError(t, DecodeNestedProfile(decoder.NewJSONDecoder(strings.NewReader(str)), &input, &batch))
+			require.Len(t, batch, 2)
+			for i, event := range batch {
+				assert.Equal(t, model.ProfileProcessor, event.Processor)
+				assert.Equal(t, "svc", event.Service.Name)
+				assert.Equal(t, "trace", event.Trace.ID)
+				require.NotNil(t, event.Transaction)
+				assert.Equal(t, "tx", event.Transaction.ID)
+				assert.Equal(t, time.Unix(1599996822, 0).UTC(), event.Timestamp)
+				require.NotNil(t, event.ProfileSample)
+				assert.Equal(t, map[string]int64{"samples.count": int64(i + 1)}, event.ProfileSample.Values)
+			}
+			// Samples must not share mutable state.
+			assert.NotSame(t, batch[0].Transaction, batch[1].Transaction)
+		}
+	})
+
+	t.Run("no-links", func(t *testing.T) {
+		str := fmt.Sprintf(`{"profile":{"data":%q}}`, encodeProfile(t, true))
+		var batch model.Batch
+		require.NoError(t, DecodeNestedProfile(decoder.NewJSONDecoder(strings.NewReader(str)), &modeldecoder.Input{}, &batch))
+		require.Len(t, batch, 2)
+		assert.Empty(t, batch[0].Trace.ID)
+		assert.Nil(t, batch[0].Transaction)
+	})
+
+	t.Run("validate", func(t *testing.T) {
+		var batch model.Batch
+		err := DecodeNestedProfile(decoder.NewJSONDecoder(strings.NewReader(`{}`)), &modeldecoder.Input{}, &batch)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "validation")
+
+		err = DecodeNestedProfile(decoder.NewJSONDecoder(strings.NewReader(`{"profile":{"data":"abc","transaction_id":"tx"}}`)), &modeldecoder.Input{}, &batch)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "trace_id")
+	})
+
+	t.Run("invalid-data", func(t *testing.T) {
+		for name, data := range map[string]string{
+			"base64": "not base64!",
+			"pprof":  base64.StdEncoding.EncodeToString([]byte("not a profile")),
+		} {
+			var batch model.Batch
+			str := fmt.Sprintf(`{"profile":{"data":%q}}`, data)
+			err := DecodeNestedProfile(decoder.NewJSONDecoder(strings.NewReader(str)), &modeldecoder.Input{}, &batch)
+			require.Error(t, err, name)
+			assert.Contains(t, err.Error(), "validation", name)
+			assert.Empty(t, batch, name)
+		}
+	})
+
+	t.Run("location-without-function", func(t *testing.T) {
+		fn := &pprof_profile.Function{ID: 1, Name: "main.main", Filename: "main.go"}
+		for name, loc := range map[string]*pprof_profile.Location{
+			"no-lines":    {ID: 2, Address: 0x1234},
+			"no-function": {ID: 2, Line: []pprof_profile.Line{{Line: 10}}},
+		} {
+			p := &pprof_profile.Profile{
+				SampleType: []*pprof_profile.ValueType{{Type: "samples", Unit: "count"}},
+				Function:   []*pprof_profile.Function{fn},
+				Location: []*pprof_profile.Location{
+					{ID: 1, Line: []pprof_profile.Line{{Function: fn, Line: 10}}},
+					loc,
+				},
+			}
+			p.Sample = []*pprof_profile.Sample{{Location: p.Location, Value: []int64{1}}}
+			var buf bytes.Buffer
+			require.NoError(t, p.Write(&buf), name)
+
+			var batch model.Batch
+			str := fmt.Sprintf(`{"profile":{"data":%q}}`, base64.StdEncoding.EncodeToString(buf.Bytes()))
+			err := DecodeNestedProfile(decoder.NewJSONDecoder(strings.NewReader(str)), &modeldecoder.Input{}, &batch)
+			require.Error(t, err, name)
+			assert.Contains(t, err.Error(), "validation", name)
+			assert.Empty(t, batch, name)
+		}
+	})
+
+	t.Run("too-large", func(t *testing.T) {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		_, err := zw.Write(make([]byte, MaxProfileDataSize+1))
+		require.NoError(t, err)
+		require.NoError(t, zw.Close())
+
+		var batch model.Batch
+		str := fmt.Sprintf(`{"profile":{"data":%q}}`, base64.StdEncoding.EncodeToString(buf.Bytes()))
+		err = DecodeNestedProfile(decoder.NewJSONDecoder(strings.NewReader(str)), &modeldecoder.Input{}, &batch)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "exceeds limit")
+	})
+}
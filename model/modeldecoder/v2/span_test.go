@@ -66,6 +66,21 @@ func TestDecodeNestedSpan(t *testing.T) {
 		assert.Contains(t, err.Error(), "decode")
 	})
 
+	t.Run("child-ids", func(t *testing.T) {
+		str := `{"span":{"duration":100,"id":"a-b-c","name":"s","parent_id":"parent-123","trace_id":"trace-ab","type":"db","start":143,` +
+			`"child_ids":["51234abcdef56789","4aaaaaaaaaaaaaaa","0123456789ABCDEF"]}}`
+		var batch model.Batch
+		require.NoError(t, DecodeNestedSpan(decoder.NewJSONDecoder(strings.NewReader(str)), &modeldecoder.Input{}, &batch))
+		require.Len(t, batch, 1)
+		assert.Equal(t, []string{"51234abcdef56789", "4aaaaaaaaaaaaaaa", "0123456789ABCDEF"}, batch[0].Child.ID)
+
+		str = `{"span":{"duration":100,"id":"a-b-c","name":"s","parent_id":"parent-123","trace_id":"trace-ab","type":"db","start":143,` +
+			`"child_ids":["51234abcdef56789","child-1"]}}`
+		err := DecodeNestedSpan(decoder.NewJSONDecoder(strings.NewReader(str)), &modeldecoder.Input{}, &batch)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "validation rule 'pattern(patternHexID)' violated")
+	})
+
 	t.Run("validate", func(t *testing.T) {
 		var batch model.Batch
 		err := DecodeNestedSpan(decoder.NewJSONDecoder(strings.NewReader(`{}`)), &modeldecoder.Input{}, &batch)
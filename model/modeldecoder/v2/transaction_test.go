@@ -74,6 +74,58 @@ func TestDecodeNestedTransaction(t *testing.T) {
 		assert.Contains(t, err.Error(), "decode")
 	})
 
+	t.Run("cookies", func(t *testing.T) {
+		str := `{"transaction":{"duration":100,"id":"100","trace_id":"1","type":"request","span_count":{"started":2},` +
+			`"context":{"request":{"method":"GET","cookies":{"c":"3","a":"1","b":"2"}}}}}`
+		for name, tc := range map[string]struct {
+			input   modeldecoder.Input
+			cookies mapstr.M
+		}{
+			"unlimited": {input: modeldecoder.Input{}, cookies: mapstr.M{"a": "1", "b": "2", "c": "3"}},
+			"max":       {input: modeldecoder.Input{MaxCookies: 2}, cookies: mapstr.M{"a": "1", "b": "2"}},
+			"max-above": {input: modeldecoder.Input{MaxCookies: 5}, cookies: mapstr.M{"a": "1", "b": "2", "c": "3"}},
+			"drop":      {input: modeldecoder.Input{DropCookies: true, MaxCookies: 2}, cookies: nil},
+		} {
+			t.Run(name, func(t *testing.T) {
+				var batch model.Batch
+				dec := decoder.NewJSONDecoder(strings.NewReader(str))
+				require.NoError(t, DecodeNestedTransaction(dec, &tc.input, &batch))
+				require.Len(t, batch, 1)
+				require.NotNil(t, batch[0].HTTP.Request)
+				assert.Equal(t, "GET", batch[0].HTTP.Request.Method)
+				assert.Equal(t, tc.cookies, batch[0].HTTP.Request.Cookies)
+			})
+		}
+	})
+
+	t.Run("marks", func(t *testing.T) {
+		str := `{"transaction":{"duration":100,"id":"100","trace_id":"1","type":"request","span_count":{"started":2},` +
+			`"marks":{"vendor.group":{"vendor.mark*":1}}}}`
+		for name, tc := range map[string]struct {
+			input modeldecoder.Input
+			marks model.TransactionMarks
+		}{
+			"default": {
+				input: modeldecoder.Input{},
+				marks: model.TransactionMarks{"vendor_group": {"vendor_mark_": 1}},
+			},
+			"sanitizer": {
+				input: modeldecoder.Input{TransactionMarksKeySanitizer: strings.NewReplacer("*", "_").Replace},
+				marks: model.TransactionMarks{"vendor.group": {"vendor.mark_": 1}},
+			},
+		} {
+			t.Run(name, func(t *testing.T) {
+				var batch model.Batch
+				dec := decoder.NewJSONDecoder(strings.NewReader(str))
+				require.NoError(t, DecodeNestedTransaction(dec, &tc.input, &batch))
+				require.NotEmpty(t, batch)
+				require.NotNil(t, batch[0].Transaction)
+				assert.Equal(t, tc.marks, batch[0].Transaction.Marks)
+				assert.True(t, batch[0].Transaction.MarksSanitized)
+			})
+		}
+	})
+
 	t.Run("validate", func(t *testing.T) {
 		var batch model.Batch
 		err := DecodeNestedTransaction(decoder.NewJSONDecoder(strings.NewReader(`{}`)), &modeldecoder.Input{}, &batch)
@@ -264,6 +316,10 @@ func TestDecodeMapToTransactionModel(t *testing.T) {
 			case
 				// Tested separately
 				"RepresentativeCount",
+				// Not set by the decoder
+				"IndexRepresentativeCount", "IndexSpanCountDroppedRatio",
+				// Set when decoding, tested in TestDecodeNestedTransaction
+				"MarksSanitized",
 				// Kind is tested further down
 				"Kind",
 
@@ -0,0 +1,245 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package modelprocessor
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/elastic/elastic-agent-libs/mapstr"
+
+	"github.com/elastic/apm-server/model"
+)
+
+// CustomNumbers identifies a policy for the types of numbers in the
+// "custom" fields of transaction and error documents.
+type CustomNumbers int
+
+const (
+	// CustomNumbersAsDecoded leaves numbers as they were decoded, so the
+	// encoding of a number may depend on the agent or protocol sending it.
+	CustomNumbersAsDecoded CustomNumbers = iota
+
+	// CustomNumbersFloat encodes all numbers as floating point numbers,
+	// e.g. 1, 1.0 and 1e3 are stored as 1.0, 1.0 and 1000.0, so they are
+	// consistently mapped as double.
+	CustomNumbersFloat
+
+	// CustomNumbersPreserveIntegers encodes numbers with integral values as
+	// integers, e.g. 1, 1.0 and 1e3 are stored as 1, 1 and 1000, and other
+	// numbers as floating point numbers.
+	CustomNumbersPreserveIntegers
+)
+
+// truncatedCustomObject replaces objects nested more deeply than
+// NormalizeCustomFields.MaxDepth in custom fields.
+const truncatedCustomObject = "[truncated]"
+
+// NormalizeCustomFields is a model.BatchProcessor that normalizes the custom
+// fields of transaction and error events, shared by events received from all
+// agents and protocols.
+type NormalizeCustomFields struct {
+	// MaxDepth holds the maximum nesting depth of objects in custom fields.
+	// The custom object itself has a depth of 1, and arrays do not add to
+	// the depth of the objects they hold. If MaxDepth is zero or less, the
+	// depth is not limited.
+	//
+	// Objects nested more deeply are replaced with the string "[truncated]",
+	// recording that fields were dropped. For example, with a maximum depth
+	// of 2,
+	//
+	//	{"a": {"b": {"c": 1}}, "d": [{"e": {"f": 2}}]}
+	//
+	// is stored as
+	//
+	//	{"a": {"b": "[truncated]"}, "d": [{"e": "[truncated]"}]}
+	MaxDepth int
+
+	// Numbers holds the policy for the types of numbers in custom fields.
+	// Mixing integers and floating point numbers in a field may otherwise
+	// lead to mapping conflicts between long and double.
+	Numbers CustomNumbers
+}
+
+// ProcessBatch normalizes the custom fields of transaction and error events.
+// Custom fields are copied, rather than modified, if they must be changed.
+func (p *NormalizeCustomFields) ProcessBatch(ctx context.Context, b *model.Batch) error {
+	for i := range *b {
+		event := &(*b)[i]
+		if event.Transaction != nil {
+			event.Transaction.Custom = p.normalize(event.Transaction.Custom)
+		}
+		if event.Error != nil {
+			event.Error.Custom = p.normalize(event.Error.Custom)
+		}
+	}
+	return nil
+}
+
+func (p *NormalizeCustomFields) normalize(custom mapstr.M) mapstr.M {
+	if len(custom) == 0 {
+		return custom
+	}
+	if p.MaxDepth > 0 {
+		if out, ok := p.truncateField(custom, 0).(mapstr.M); ok {
+			custom = out
+		}
+	}
+	if p.Numbers != CustomNumbersAsDecoded {
+		if out, ok := convertCustomNumbers(custom, p.Numbers).(mapstr.M); ok {
+			custom = out
+		}
+	}
+	return custom
+}
+
+// truncateField returns v, held in a custom object at the given depth, with
+// objects nested more deeply than MaxDepth truncated. v is copied only if it
+// must be truncated.
+func (p *NormalizeCustomFields) truncateField(v interface{}, depth int) interface{} {
+	if customFieldDepth(v, depth) <= p.MaxDepth {
+		return v
+	}
+	switch v := v.(type) {
+	case mapstr.M:
+		if out, ok := p.truncateObject(v, depth+1).(map[string]interface{}); ok {
+			return mapstr.M(out)
+		}
+		return truncatedCustomObject
+	case map[string]interface{}:
+		return p.truncateObject(v, depth+1)
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, v := range v {
+			out[i] = p.truncateField(v, depth)
+		}
+		return out
+	}
+	return v
+}
+
+// truncateObject returns a copy of the object m at the given depth,
+// or truncatedCustomObject if depth exceeds MaxDepth.
+func (p *NormalizeCustomFields) truncateObject(m map[string]interface{}, depth int) interface{} {
+	if depth > p.MaxDepth {
+		return truncatedCustomObject
+	}
+	out := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		out[k] = p.truncateField(v, depth)
+	}
+	return out
+}
+
+// customFieldDepth returns the maximum depth of the objects in v, held
+// in a custom object at the given depth.
+func customFieldDepth(v interface{}, depth int) int {
+	max := depth
+	switch v := v.(type) {
+	case mapstr.M:
+		return customFieldDepth(map[string]interface{}(v), depth)
+	case map[string]interface{}:
+		max = depth + 1
+		for _, v := range v {
+			if d := customFieldDepth(v, depth+1); d > max {
+				max = d
+			}
+		}
+	case []interface{}:
+		for _, v := range v {
+			if d := customFieldDepth(v, depth); d > max {
+				max = d
+			}
+		}
+	}
+	return max
+}
+
+// convertCustomNumbers returns a copy of v with numbers converted
+// according to policy.
+func convertCustomNumbers(v interface{}, policy CustomNumbers) interface{} {
+	switch v := v.(type) {
+	case mapstr.M:
+		return mapstr.M(convertCustomObjectNumbers(v, policy))
+	case map[string]interface{}:
+		return convertCustomObjectNumbers(v, policy)
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, v := range v {
+			out[i] = convertCustomNumbers(v, policy)
+		}
+		return out
+	case json.Number:
+		if policy == CustomNumbersPreserveIntegers {
+			// Parse integers directly, as they may not be
+			// exactly representable as float64.
+			if i, err := v.Int64(); err == nil {
+				return i
+			}
+		}
+		if f, err := v.Float64(); err == nil {
+			return convertCustomNumber(f, policy)
+		}
+	case float64:
+		return convertCustomNumber(v, policy)
+	case float32:
+		return convertCustomNumber(float64(v), policy)
+	case int:
+		return convertCustomInt(int64(v), policy)
+	case int32:
+		return convertCustomInt(int64(v), policy)
+	case int64:
+		return convertCustomInt(v, policy)
+	}
+	return v
+}
+
+func convertCustomObjectNumbers(m map[string]interface{}, policy CustomNumbers) map[string]interface{} {
+	out := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		out[k] = convertCustomNumbers(v, policy)
+	}
+	return out
+}
+
+func convertCustomInt(i int64, policy CustomNumbers) interface{} {
+	if policy == CustomNumbersPreserveIntegers {
+		return i
+	}
+	return convertCustomNumber(float64(i), policy)
+}
+
+// convertCustomNumber converts f according to policy. Floating point
+// numbers are returned as json.Number, which is encoded as is, so that
+// integral values are encoded with a decimal point.
+func convertCustomNumber(f float64, policy CustomNumbers) interface{} {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return f
+	}
+	if policy == CustomNumbersPreserveIntegers && f == math.Trunc(f) && math.Abs(f) < 1<<63 {
+		return int64(f)
+	}
+	s := strconv.FormatFloat(f, 'g', -1, 64)
+	if !strings.ContainsAny(s, ".e") {
+		s += ".0"
+	}
+	return json.Number(s)
+}
@@ -0,0 +1,112 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package modelprocessor_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/elastic-agent-libs/mapstr"
+
+	"github.com/elastic/apm-server/model"
+	"github.com/elastic/apm-server/model/modelprocessor"
+)
+
+func TestNormalizeCustomFieldsMaxDepth(t *testing.T) {
+	custom := mapstr.M{
+		"a": map[string]interface{}{"b": map[string]interface{}{"c": 1}},
+		"d": []interface{}{map[string]interface{}{"e": mapstr.M{"f": 2}}},
+		"g": "h",
+	}
+	for depth, expected := range map[int]mapstr.M{
+		0: custom,
+		3: custom,
+		2: {
+			"a": map[string]interface{}{"b": "[truncated]"},
+			"d": []interface{}{map[string]interface{}{"e": "[truncated]"}},
+			"g": "h",
+		},
+		1: {
+			"a": "[truncated]",
+			"d": []interface{}{"[truncated]"},
+			"g": "h",
+		},
+	} {
+		processor := modelprocessor.NormalizeCustomFields{MaxDepth: depth}
+		batch := model.Batch{
+			{Transaction: &model.Transaction{Custom: custom}},
+			{Error: &model.Error{Custom: custom}},
+		}
+		err := processor.ProcessBatch(context.Background(), &batch)
+		require.NoError(t, err)
+		assert.Equal(t, expected, batch[0].Transaction.Custom, "max depth %d", depth)
+		assert.Equal(t, expected, batch[1].Error.Custom, "max depth %d", depth)
+	}
+
+	// The input is not modified by truncation.
+	assert.Equal(t, map[string]interface{}{"b": map[string]interface{}{"c": 1}}, custom["a"])
+}
+
+func TestNormalizeCustomFieldsNumbers(t *testing.T) {
+	custom := mapstr.M{
+		"int":      json.Number("1"),
+		"float":    json.Number("1.0"),
+		"exp":      json.Number("1e3"),
+		"fraction": json.Number("1.5"),
+		"big":      json.Number("9007199254740993"),
+		"decoded":  float64(2),
+		"otlp":     int64(3),
+		"nested":   map[string]interface{}{"a": []interface{}{json.Number("4"), "b"}},
+	}
+	for policy, expected := range map[modelprocessor.CustomNumbers]mapstr.M{
+		modelprocessor.CustomNumbersAsDecoded: custom,
+		modelprocessor.CustomNumbersFloat: {
+			"int":      json.Number("1.0"),
+			"float":    json.Number("1.0"),
+			"exp":      json.Number("1000.0"),
+			"fraction": json.Number("1.5"),
+			"big":      json.Number("9.007199254740992e+15"),
+			"decoded":  json.Number("2.0"),
+			"otlp":     json.Number("3.0"),
+			"nested":   map[string]interface{}{"a": []interface{}{json.Number("4.0"), "b"}},
+		},
+		modelprocessor.CustomNumbersPreserveIntegers: {
+			"int":      int64(1),
+			"float":    int64(1),
+			"exp":      int64(1000),
+			"fraction": json.Number("1.5"),
+			"big":      int64(9007199254740993),
+			"decoded":  int64(2),
+			"otlp":     int64(3),
+			"nested":   map[string]interface{}{"a": []interface{}{int64(4), "b"}},
+		},
+	} {
+		processor := modelprocessor.NormalizeCustomFields{Numbers: policy}
+		batch := model.Batch{{Transaction: &model.Transaction{Custom: custom}}}
+		err := processor.ProcessBatch(context.Background(), &batch)
+		require.NoError(t, err)
+		assert.Equal(t, expected, batch[0].Transaction.Custom, "policy %d", policy)
+	}
+
+	// The input is not modified by conversion.
+	assert.Equal(t, json.Number("4"), custom["nested"].(map[string]interface{})["a"].([]interface{})[0])
+}
@@ -0,0 +1,54 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package modelprocessor_test
+
+import (
+	"testing"
+
+	"github.com/elastic/apm-server/model"
+	"github.com/elastic/apm-server/model/modelprocessor"
+)
+
+func TestRedactHTTP(t *testing.T) {
+	processor := modelprocessor.RedactHTTP{Policy: model.HTTPRedactionPolicy{
+		QueryParams: []string{"token"},
+		Headers:     []string{"authorization"},
+	}}
+	newEvent := func(processor model.Processor, query, authorization string) model.APMEvent {
+		return model.APMEvent{
+			Processor: processor,
+			URL:       model.URL{Query: query, Full: "http://localhost/?" + query},
+			HTTP: model.HTTP{Request: &model.HTTPRequest{
+				Headers: map[string]interface{}{"Authorization": []string{authorization}},
+			}},
+		}
+	}
+	testProcessBatch(t, &processor,
+		newEvent(model.TransactionProcessor, "a=1&token=secret", "Bearer abc"),
+		newEvent(model.TransactionProcessor, "a=1", model.RedactedValue),
+	)
+	// Events of any kind with HTTP or URL data are redacted.
+	testProcessBatch(t, &processor,
+		newEvent(model.SpanProcessor, "a=1&token=secret", "Bearer abc"),
+		newEvent(model.SpanProcessor, "a=1", model.RedactedValue),
+	)
+	testProcessBatch(t, &processor,
+		newEvent(model.ErrorProcessor, "a=1&token=secret", "Bearer abc"),
+		newEvent(model.ErrorProcessor, "a=1", model.RedactedValue),
+	)
+}
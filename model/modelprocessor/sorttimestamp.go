@@ -0,0 +1,43 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package modelprocessor
+
+import (
+	"context"
+	"sort"
+
+	"github.com/elastic/apm-server/model"
+)
+
+// SortByTimestamp is a model.BatchProcessor that sorts events in a batch by
+// @timestamp, in ascending order. Events without a timestamp are placed last.
+// The relative order of events with equal timestamps is preserved.
+type SortByTimestamp struct{}
+
+// ProcessBatch sorts the events in b in place.
+func (SortByTimestamp) ProcessBatch(ctx context.Context, b *model.Batch) error {
+	events := *b
+	sort.SliceStable(events, func(i, j int) bool {
+		ti, tj := events[i].Timestamp, events[j].Timestamp
+		if ti.IsZero() || tj.IsZero() {
+			return !ti.IsZero() && tj.IsZero()
+		}
+		return ti.Before(tj)
+	})
+	return nil
+}
@@ -0,0 +1,61 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package modelprocessor_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/elastic/apm-server/model"
+	"github.com/elastic/apm-server/model/modelprocessor"
+)
+
+func TestSortByTimestamp(t *testing.T) {
+	t0 := time.Unix(1, 0).UTC()
+	event := func(id string, timestamp time.Time) model.APMEvent {
+		return model.APMEvent{Timestamp: timestamp, Trace: model.Trace{ID: id}}
+	}
+	batch := model.Batch{
+		event("missing1", time.Time{}),
+		event("c", t0.Add(2*time.Second)),
+		event("a1", t0),
+		event("missing2", time.Time{}),
+		event("b", t0.Add(time.Millisecond)),
+		event("a2", t0),
+	}
+
+	processor := modelprocessor.SortByTimestamp{}
+	err := processor.ProcessBatch(context.Background(), &batch)
+	assert.NoError(t, err)
+
+	var ids []string
+	for _, event := range batch {
+		ids = append(ids, event.Trace.ID)
+	}
+	assert.Equal(t, []string{"a1", "a2", "b", "c", "missing1", "missing2"}, ids)
+}
+
+func TestSortByTimestampEmpty(t *testing.T) {
+	var batch model.Batch
+	processor := modelprocessor.SortByTimestamp{}
+	assert.NoError(t, processor.ProcessBatch(context.Background(), &batch))
+	assert.Empty(t, batch)
+}
@@ -0,0 +1,48 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package modelprocessor
+
+import (
+	"context"
+
+	"github.com/elastic/apm-server/model"
+)
+
+// TruncateTransactionNames is a model.BatchProcessor that truncates the names
+// and types of transactions received from any source, so that overlong values
+// are truncated before transaction metrics are aggregated. Intake events are
+// already truncated when they are decoded, so that a warning can be reported
+// to the agent.
+type TruncateTransactionNames struct {
+	// NameMaxLength and TypeMaxLength hold the maximum number of characters
+	// in transaction.name and transaction.type. If a maximum is zero or less,
+	// the length is not limited.
+	NameMaxLength int
+	TypeMaxLength int
+}
+
+// ProcessBatch truncates the names and types of transactions.
+func (p *TruncateTransactionNames) ProcessBatch(ctx context.Context, b *model.Batch) error {
+	for i := range *b {
+		event := &(*b)[i]
+		if event.Transaction != nil {
+			event.Transaction.TruncateNameType(p.NameMaxLength, p.TypeMaxLength)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package modelprocessor
+
+import (
+	"context"
+
+	"github.com/elastic/apm-server/model"
+)
+
+// TransactionResultOther replaces transaction results which are not
+// allowed by NormalizeTransactionResults.
+const TransactionResultOther = "other"
+
+// NormalizeTransactionResults is a model.BatchProcessor that limits the
+// cardinality of transaction.result, before transaction metrics are
+// aggregated. HTTP status class results such as "HTTP 2xx" and allowed
+// results are kept; results holding an HTTP status code, such as
+// "HTTP 404", are replaced with their status class, and all other
+// non-empty results are replaced with TransactionResultOther.
+type NormalizeTransactionResults struct {
+	allowed map[string]bool
+}
+
+// NewNormalizeTransactionResults returns a NormalizeTransactionResults
+// which keeps the results in allowed, in addition to HTTP status classes.
+func NewNormalizeTransactionResults(allowed ...string) *NormalizeTransactionResults {
+	p := &NormalizeTransactionResults{allowed: make(map[string]bool, len(allowed))}
+	for _, result := range allowed {
+		p.allowed[result] = true
+	}
+	return p
+}
+
+// ProcessBatch normalizes the results of transactions.
+func (p *NormalizeTransactionResults) ProcessBatch(ctx context.Context, b *model.Batch) error {
+	for i := range *b {
+		event := &(*b)[i]
+		if event.Transaction != nil && event.Transaction.Result != "" {
+			event.Transaction.Result = p.normalize(event.Transaction.Result)
+		}
+	}
+	return nil
+}
+
+func (p *NormalizeTransactionResults) normalize(result string) string {
+	if p.allowed[result] {
+		return result
+	}
+	if class, ok := httpResultStatusClass(result); ok {
+		return class
+	}
+	return TransactionResultOther
+}
+
+// httpResultStatusClass returns the status class result, e.g. "HTTP 4xx",
+// for a result holding an HTTP status class or code, e.g. "HTTP 404".
+func httpResultStatusClass(result string) (string, bool) {
+	const prefix = "HTTP "
+	if len(result) != len(prefix)+3 || result[:len(prefix)] != prefix {
+		return "", false
+	}
+	status := result[len(prefix):]
+	if status[0] < '1' || status[0] > '5' {
+		return "", false
+	}
+	if status[1:] == "xx" {
+		return result, true
+	}
+	if status[1] < '0' || status[1] > '9' || status[2] < '0' || status[2] > '9' {
+		return "", false
+	}
+	return prefix + status[:1] + "xx", true
+}
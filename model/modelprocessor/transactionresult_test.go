@@ -0,0 +1,71 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package modelprocessor_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/apm-server/model"
+	"github.com/elastic/apm-server/model/modelprocessor"
+)
+
+func TestNormalizeTransactionResults(t *testing.T) {
+	results := []string{
+		"HTTP 2xx", "HTTP 404", "HTTP 5xx", "HTTP 600", "HTTP 4x",
+		"success", "failure", "req-0af7651916cd43dd", "",
+	}
+	for name, test := range map[string]struct {
+		processor *modelprocessor.NormalizeTransactionResults
+		expected  []string
+	}{
+		"http": {
+			processor: modelprocessor.NewNormalizeTransactionResults(),
+			expected: []string{
+				"HTTP 2xx", "HTTP 4xx", "HTTP 5xx", "other", "other",
+				"other", "other", "other", "",
+			},
+		},
+		"allowlist": {
+			processor: modelprocessor.NewNormalizeTransactionResults("success", "failure"),
+			expected: []string{
+				"HTTP 2xx", "HTTP 4xx", "HTTP 5xx", "other", "other",
+				"success", "failure", "other", "",
+			},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			batch := make(model.Batch, len(results))
+			for i, result := range results {
+				batch[i].Transaction = &model.Transaction{Result: result}
+			}
+			batch = append(batch, model.APMEvent{})
+			require.NoError(t, test.processor.ProcessBatch(context.Background(), &batch))
+
+			var actual []string
+			for _, event := range batch[:len(results)] {
+				actual = append(actual, event.Transaction.Result)
+			}
+			assert.Equal(t, test.expected, actual)
+			assert.Nil(t, batch[len(results)].Transaction)
+		})
+	}
+}
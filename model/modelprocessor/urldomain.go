@@ -0,0 +1,101 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package modelprocessor
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/elastic/apm-server/model"
+)
+
+// NormalizeURLDomain is a model.BatchProcessor that normalizes url.domain,
+// so that events for the same host are aggregated consistently. Any port is
+// moved into url.port if it is not already set, the domain is lowercased, and
+// a trailing dot is removed.
+type NormalizeURLDomain struct {
+	// RemoveInvalid controls whether url.domain is removed if it is not a
+	// valid hostname or IP address after normalization.
+	RemoveInvalid bool
+}
+
+// ProcessBatch normalizes url.domain for events with a non-empty url.domain.
+func (p *NormalizeURLDomain) ProcessBatch(ctx context.Context, b *model.Batch) error {
+	for i := range *b {
+		event := &(*b)[i]
+		if event.URL.Domain == "" {
+			continue
+		}
+		domain, port := normalizeDomain(event.URL.Domain)
+		if port > 0 && event.URL.Port == 0 {
+			event.URL.Port = port
+		}
+		if p.RemoveInvalid && !validDomain(domain) {
+			domain = ""
+		}
+		event.URL.Domain = domain
+	}
+	return nil
+}
+
+// normalizeDomain splits off any port from domain, lowercases it, and
+// removes a trailing dot. The port is returned if it is valid.
+func normalizeDomain(domain string) (string, int) {
+	var port int
+	if host, portStr, err := net.SplitHostPort(domain); err == nil {
+		domain = host
+		if v, err := strconv.Atoi(portStr); err == nil && v > 0 && v <= 65535 {
+			port = v
+		}
+	} else if strings.HasPrefix(domain, "[") && strings.HasSuffix(domain, "]") {
+		domain = domain[1 : len(domain)-1]
+	}
+	domain = strings.ToLower(domain)
+	domain = strings.TrimSuffix(domain, ".")
+	return domain, port
+}
+
+// validDomain reports whether domain is an IP address or a valid hostname,
+// as defined by RFC 1123. Underscores are permitted in labels, as they are
+// commonly used in service names.
+func validDomain(domain string) bool {
+	if net.ParseIP(domain) != nil {
+		return true
+	}
+	if domain == "" || len(domain) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(domain, ".") {
+		if label == "" || len(label) > 63 {
+			return false
+		}
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, r := range label {
+			switch {
+			case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-', r == '_':
+			default:
+				return false
+			}
+		}
+	}
+	return true
+}
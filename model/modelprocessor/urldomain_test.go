@@ -0,0 +1,102 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package modelprocessor_test
+
+import (
+	"testing"
+
+	"github.com/elastic/apm-server/model"
+	"github.com/elastic/apm-server/model/modelprocessor"
+)
+
+func TestNormalizeURLDomain(t *testing.T) {
+	for name, test := range map[string]struct {
+		in, out       model.URL
+		removeInvalid bool
+	}{
+		"empty": {
+			in:  model.URL{},
+			out: model.URL{},
+		},
+		"unchanged": {
+			in:  model.URL{Domain: "example.com", Port: 443},
+			out: model.URL{Domain: "example.com", Port: 443},
+		},
+		"port": {
+			in:  model.URL{Domain: "example.com:8080"},
+			out: model.URL{Domain: "example.com", Port: 8080},
+		},
+		"port_already_set": {
+			in:  model.URL{Domain: "example.com:8080", Port: 443},
+			out: model.URL{Domain: "example.com", Port: 443},
+		},
+		"invalid_port": {
+			in:  model.URL{Domain: "example.com:99999"},
+			out: model.URL{Domain: "example.com"},
+		},
+		"uppercase": {
+			in:  model.URL{Domain: "WWW.Example.COM"},
+			out: model.URL{Domain: "www.example.com"},
+		},
+		"trailing_dot": {
+			in:  model.URL{Domain: "example.com."},
+			out: model.URL{Domain: "example.com"},
+		},
+		"all": {
+			in:  model.URL{Domain: "Example.COM.:8200"},
+			out: model.URL{Domain: "example.com", Port: 8200},
+		},
+		"ipv6_port": {
+			in:  model.URL{Domain: "[::1]:8200"},
+			out: model.URL{Domain: "::1", Port: 8200},
+		},
+		"ipv6_brackets": {
+			in:  model.URL{Domain: "[::1]"},
+			out: model.URL{Domain: "::1"},
+		},
+		"invalid_kept": {
+			in:  model.URL{Domain: "Not A Domain"},
+			out: model.URL{Domain: "not a domain"},
+		},
+		"invalid_removed": {
+			in:            model.URL{Domain: "Not A Domain:80"},
+			out:           model.URL{Port: 80},
+			removeInvalid: true,
+		},
+		"invalid_label_removed": {
+			in:            model.URL{Domain: "-example.com"},
+			out:           model.URL{},
+			removeInvalid: true,
+		},
+		"valid_strict": {
+			in:            model.URL{Domain: "My_Service.Example.COM."},
+			out:           model.URL{Domain: "my_service.example.com"},
+			removeInvalid: true,
+		},
+		"ip_strict": {
+			in:            model.URL{Domain: "10.0.0.1:80"},
+			out:           model.URL{Domain: "10.0.0.1", Port: 80},
+			removeInvalid: true,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			processor := modelprocessor.NormalizeURLDomain{RemoveInvalid: test.removeInvalid}
+			testProcessBatch(t, &processor, model.APMEvent{URL: test.in}, model.APMEvent{URL: test.out})
+		})
+	}
+}
@@ -0,0 +1,185 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package model
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/elastic/elastic-agent-libs/mapstr"
+)
+
+// jsonSchemaDialect identifies the JSON Schema version of generated schemas.
+const jsonSchemaDialect = "https://json-schema.org/draft/2020-12/schema"
+
+// schemaTransaction is a transaction with all fields set, whose output
+// fields are used for generating the schema returned by TransactionSchema.
+var schemaTransaction = func() Transaction {
+	dropped, started, ageMillis := 1, 2, 3
+	return Transaction{
+		ID:                "abc123",
+		Name:              "GET /",
+		Type:              "request",
+		Result:            "HTTP 2xx",
+		Sampled:           true,
+		DurationHistogram: Histogram{Values: []float64{1.5}, Counts: []int64{1}},
+		Marks:             TransactionMarks{"agent": {"domComplete": 1}},
+		MarksSanitized:    true,
+		Message: &Message{
+			Body:       "body",
+			Headers:    http.Header{"Content-Type": {"text/plain"}},
+			AgeMillis:  &ageMillis,
+			QueueName:  "queue",
+			RoutingKey: "key",
+		},
+		SpanCount: SpanCount{Dropped: &dropped, Started: &started},
+		Custom:    mapstr.M{"key": "value"},
+		UserExperience: &UserExperience{
+			CumulativeLayoutShift: 1,
+			FirstInputDelay:       2,
+			TotalBlockingTime:     3,
+			Longtask:              LongtaskMetrics{Count: 1, Sum: 2, Max: 3},
+		},
+		DroppedSpansStats: []DroppedSpanStats{{
+			DestinationServiceResource: "mysql",
+			ServiceTargetType:          "db",
+			ServiceTargetName:          "mysql",
+			Outcome:                    "success",
+			Duration:                   AggregatedDuration{Count: 1, Sum: time.Millisecond},
+		}},
+		RepresentativeCount:        1,
+		IndexRepresentativeCount:   true,
+		IndexSpanCountDroppedRatio: true,
+		Root:                       true,
+	}
+}()
+
+// transactionSchemaDynamicFields holds the schemas of transaction fields
+// whose keys are defined by agents or users, keyed by their path.
+var transactionSchemaDynamicFields = map[string]map[string]interface{}{
+	"custom":          {"type": "object"},
+	"marks":           objectSchema(nil, objectSchema(nil, typeSchema("number"))),
+	"message.headers": objectSchema(nil, arraySchema(typeSchema("string"))),
+}
+
+// TransactionSchema returns a JSON Schema describing the transaction.*
+// fields of documents produced for transaction events.
+//
+// The schema is generated from the fields produced for a transaction
+// with all fields set, so it stays in sync with the produced documents.
+// Fields with keys defined by agents or users, such as transaction.custom,
+// are described as objects with additional properties. An error is
+// returned if a field has a type which cannot be described.
+func TransactionSchema() (map[string]interface{}, error) {
+	transactionSchema, err := fieldsSchema(schemaTransaction.fields(), "", transactionSchemaDynamicFields)
+	if err != nil {
+		return nil, err
+	}
+	properties := map[string]interface{}{"transaction": transactionSchema}
+	schema := objectSchema(properties, nil)
+	schema["$schema"] = jsonSchemaDialect
+	schema["title"] = "transaction"
+	return schema, nil
+}
+
+// fieldsSchema returns the schema of an object holding fields, found at
+// path. Dotted keys are expanded into nested objects, as they are indexed.
+// Fields whose path is in dynamic are described by the given schema.
+func fieldsSchema(fields mapstr.M, path string, dynamic map[string]map[string]interface{}) (map[string]interface{}, error) {
+	properties := make(map[string]interface{})
+	for k, v := range fields {
+		keys := strings.Split(k, ".")
+		props := properties
+		for _, key := range keys[:len(keys)-1] {
+			parent, ok := props[key].(map[string]interface{})
+			if !ok {
+				parent = objectSchema(make(map[string]interface{}), nil)
+				props[key] = parent
+			}
+			props = parent["properties"].(map[string]interface{})
+		}
+		schema, err := valueSchema(v, joinSchemaPath(path, k), dynamic)
+		if err != nil {
+			return nil, err
+		}
+		props[keys[len(keys)-1]] = schema
+	}
+	return objectSchema(properties, nil), nil
+}
+
+func valueSchema(v interface{}, path string, dynamic map[string]map[string]interface{}) (map[string]interface{}, error) {
+	if schema, ok := dynamic[path]; ok {
+		return schema, nil
+	}
+	switch v := v.(type) {
+	case mapstr.M:
+		return fieldsSchema(v, path, dynamic)
+	case []mapstr.M:
+		items := objectSchema(nil, nil)
+		if len(v) > 0 {
+			var err error
+			if items, err = fieldsSchema(v[0], path, dynamic); err != nil {
+				return nil, err
+			}
+		}
+		return arraySchema(items), nil
+	case string:
+		return typeSchema("string"), nil
+	case bool:
+		return typeSchema("boolean"), nil
+	case int, int64:
+		return typeSchema("integer"), nil
+	case float64:
+		return typeSchema("number"), nil
+	case []int64:
+		return arraySchema(typeSchema("integer")), nil
+	case []float64:
+		return arraySchema(typeSchema("number")), nil
+	}
+	return nil, fmt.Errorf("unsupported type %T for field %q", v, path)
+}
+
+func joinSchemaPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func typeSchema(typ string) map[string]interface{} {
+	return map[string]interface{}{"type": typ}
+}
+
+func arraySchema(items map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{"type": "array", "items": items}
+}
+
+// objectSchema returns the schema of an object with the given properties,
+// and additionalProperties describing any other properties, if non-nil.
+func objectSchema(properties, additionalProperties map[string]interface{}) map[string]interface{} {
+	schema := typeSchema("object")
+	if properties != nil {
+		schema["properties"] = properties
+	}
+	if additionalProperties != nil {
+		schema["additionalProperties"] = additionalProperties
+	}
+	return schema
+}
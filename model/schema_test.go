@@ -0,0 +1,188 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package model
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/elastic-agent-libs/mapstr"
+)
+
+func TestTransactionSchemaSampleComplete(t *testing.T) {
+	// All fields of the sample transaction must be set, so that the
+	// schema covers fields added to Transaction.
+	assertNonZeroFields(t, reflect.ValueOf(schemaTransaction), "Transaction")
+}
+
+func assertNonZeroFields(t *testing.T, v reflect.Value, path string) {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if assert.False(t, v.IsNil(), path) {
+			assertNonZeroFields(t, v.Elem(), path)
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			assertNonZeroFields(t, v.Field(i), path+"."+v.Type().Field(i).Name)
+		}
+	default:
+		assert.False(t, v.IsZero(), path)
+	}
+}
+
+func TestTransactionSchema(t *testing.T) {
+	schema, err := TransactionSchema()
+	require.NoError(t, err)
+	assert.Equal(t, jsonSchemaDialect, schema["$schema"])
+	_, err = json.Marshal(schema)
+	require.NoError(t, err)
+
+	transactionSchema := schema["properties"].(map[string]interface{})["transaction"].(map[string]interface{})
+	for path, expected := range map[string]string{
+		"id":                             "string",
+		"sampled":                        "boolean",
+		"duration.histogram.counts":      "array",
+		"span_count.dropped":             "integer",
+		"span_count.dropped_ratio":       "number",
+		"dropped_spans_stats":            "array",
+		"message.headers":                "object",
+		"experience.longtask.max":        "number",
+		"marks":                          "object",
+		"representative_count":           "number",
+		"message.age.ms":                 "integer",
+		"message.queue.name":             "string",
+		"experience.cls":                 "number",
+		"custom":                         "object",
+		"root":                           "boolean",
+		"messaging":                      "boolean",
+		"result":                         "string",
+		"duration.histogram.values":      "array",
+		"span_count.started":             "integer",
+		"experience.longtask.count":      "integer",
+		"message.routing_key":            "string",
+		"name":                           "string",
+		"type":                           "string",
+		"marks.agent.domComplete":        "",
+		"custom.key":                     "",
+		"message.headers.Content-Type.0": "",
+	} {
+		s := transactionSchema
+		for _, key := range strings.Split(path, ".") {
+			properties, _ := s["properties"].(map[string]interface{})
+			s, _ = properties[key].(map[string]interface{})
+		}
+		if expected == "" {
+			// Fields with dynamic keys are not listed as properties.
+			assert.Nil(t, s, path)
+			continue
+		}
+		require.NotNil(t, s, path)
+		assert.Equal(t, expected, s["type"], path)
+	}
+}
+
+func TestTransactionSchemaMatchesFields(t *testing.T) {
+	schema, err := TransactionSchema()
+	require.NoError(t, err)
+	transactionSchema := schema["properties"].(map[string]interface{})["transaction"].(map[string]interface{})
+	for _, tx := range []Transaction{
+		schemaTransaction,
+		{ID: "abc", Marks: TransactionMarks{"navigationTiming": {"a.b": 1, "c": 2}}},
+		{Custom: mapstr.M{"a": mapstr.M{"b": []interface{}{1, "c"}}}, Message: &Message{Headers: http.Header{"A": {"b", "c"}}}},
+		{UserExperience: &UserExperience{CumulativeLayoutShift: -1, FirstInputDelay: 1, TotalBlockingTime: -1, Longtask: LongtaskMetrics{Count: -1}}},
+	} {
+		assertMatchesSchema(t, transactionSchema, tx.fields(), "transaction")
+	}
+}
+
+func TestFieldsSchemaUnsupportedType(t *testing.T) {
+	_, err := fieldsSchema(mapstr.M{"a": mapstr.M{"b": uint8(1)}}, "transaction", nil)
+	assert.EqualError(t, err, `unsupported type uint8 for field "transaction.a.b"`)
+}
+
+// assertMatchesSchema asserts that value, found at path in a document,
+// matches the subset of JSON Schema produced by TransactionSchema.
+func assertMatchesSchema(t *testing.T, schema map[string]interface{}, value interface{}, path string) {
+	switch schema["type"] {
+	case "object":
+		fields := toObject(t, value, path)
+		properties, _ := schema["properties"].(map[string]interface{})
+		additionalProperties, _ := schema["additionalProperties"].(map[string]interface{})
+		for k, v := range fields {
+			// Dotted keys are expanded into nested objects.
+			if keys := strings.SplitN(k, ".", 2); len(keys) == 2 && properties[keys[0]] != nil {
+				k, v = keys[0], map[string]interface{}{keys[1]: v}
+			}
+			propertySchema, ok := properties[k].(map[string]interface{})
+			if !ok {
+				if additionalProperties == nil {
+					if _, ok := schema["properties"]; ok {
+						t.Errorf("field %s.%s not described by schema", path, k)
+					}
+					continue
+				}
+				propertySchema = additionalProperties
+			}
+			assertMatchesSchema(t, propertySchema, v, path+"."+k)
+		}
+	case "array":
+		items := schema["items"].(map[string]interface{})
+		v := reflect.ValueOf(value)
+		require.Equal(t, reflect.Slice, v.Kind(), path)
+		for i := 0; i < v.Len(); i++ {
+			assertMatchesSchema(t, items, v.Index(i).Interface(), path)
+		}
+	case "string":
+		assert.IsType(t, "", value, path)
+	case "boolean":
+		assert.IsType(t, false, value, path)
+	case "integer":
+		switch value.(type) {
+		case int, int64:
+		default:
+			t.Errorf("field %s: expected integer, got %T", path, value)
+		}
+	case "number":
+		assert.IsType(t, float64(0), value, path)
+	default:
+		t.Errorf("field %s: unexpected schema type %v", path, schema["type"])
+	}
+}
+
+func toObject(t *testing.T, value interface{}, path string) map[string]interface{} {
+	switch value := value.(type) {
+	case mapstr.M:
+		return value
+	case map[string]interface{}:
+		return value
+	case http.Header:
+		out := make(map[string]interface{}, len(value))
+		for k, v := range value {
+			out[k] = v
+		}
+		return out
+	}
+	t.Fatalf("field %s: expected object, got %T", path, value)
+	return nil
+}
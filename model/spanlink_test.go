@@ -61,3 +61,23 @@ func TestSpanLinkFields(t *testing.T) {
 		assert.Equal(t, test.Expected, output)
 	}
 }
+
+func TestTransactionSpanLinks(t *testing.T) {
+	event := APMEvent{
+		Processor:   TransactionProcessor,
+		Transaction: &Transaction{ID: "transaction_id"},
+		Span: &Span{Links: []SpanLink{
+			{Span: Span{ID: "span_id"}, Trace: Trace{ID: "trace_id"}},
+		}},
+	}
+	beatEvent := event.BeatEvent()
+	assert.Equal(t, mapstr.M{"links": []mapstr.M{{
+		"span":  mapstr.M{"id": "span_id"},
+		"trace": mapstr.M{"id": "trace_id"},
+	}}}, beatEvent.Fields["span"])
+
+	// Transactions without links have no span fields.
+	event.Span = &Span{Links: []SpanLink{}}
+	beatEvent = event.BeatEvent()
+	assert.NotContains(t, beatEvent.Fields, "span")
+}
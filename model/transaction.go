@@ -18,6 +18,8 @@
 package model
 
 import (
+	"unicode/utf8"
+
 	"github.com/elastic/elastic-agent-libs/mapstr"
 )
 
@@ -31,6 +33,9 @@ var (
 	TransactionProcessor = Processor{Name: "transaction", Event: "transaction"}
 )
 
+// truncatedStringMarker replaces the last character of truncated strings.
+const truncatedStringMarker = "…"
+
 // Transaction holds values for transaction.* fields. This may be used in
 // transaction, span, and error events (i.e. transaction.id), as well as
 // internal metrics such as breakdowns (i.e. including transaction.name).
@@ -62,6 +67,12 @@ type Transaction struct {
 	Custom         mapstr.M
 	UserExperience *UserExperience
 
+	// MarksSanitized records that the group and mark keys of Marks have
+	// already been sanitized, e.g. by a decoder with a custom policy, and
+	// should be written to the output event as is. Otherwise the characters
+	// '.', '*', and '"' are replaced with '_', as for label keys.
+	MarksSanitized bool
+
 	// DroppedSpanStats holds a list of the spans that were dropped by an
 	// agent; not indexed.
 	DroppedSpansStats []DroppedSpanStats
@@ -69,9 +80,24 @@ type Transaction struct {
 	// RepresentativeCount holds the approximate number of
 	// transactions that this transaction represents for aggregation.
 	//
-	// This may be used for scaling metrics; it is not indexed.
+	// This may be used for scaling metrics; it is not indexed unless
+	// IndexRepresentativeCount is true.
 	RepresentativeCount float64
 
+	// IndexRepresentativeCount controls whether RepresentativeCount is
+	// included in the output event as transaction.representative_count.
+	//
+	// A zero RepresentativeCount is always omitted.
+	IndexRepresentativeCount bool
+
+	// IndexSpanCountDroppedRatio controls whether the ratio of dropped
+	// spans to all spans, dropped/(dropped+started), is included in the
+	// output event as transaction.span_count.dropped_ratio.
+	//
+	// The ratio is only included when both SpanCount.Dropped and
+	// SpanCount.Started are set. If both are zero, the ratio is zero.
+	IndexSpanCountDroppedRatio bool
+
 	// Root indicates whether or not the transaction is the trace root.
 	//
 	// If Root is false, it will be omitted from the output event.
@@ -83,6 +109,43 @@ type SpanCount struct {
 	Started *int
 }
 
+// Negative reports whether the dropped or started span count is set to a
+// negative value, which agents should never report.
+func (c *SpanCount) Negative() bool {
+	return (c.Dropped != nil && *c.Dropped < 0) || (c.Started != nil && *c.Started < 0)
+}
+
+// ClampNegative sets negative dropped and started span counts to zero.
+// Unset counts are left unset.
+func (c *SpanCount) ClampNegative() {
+	if c.Dropped != nil && *c.Dropped < 0 {
+		dropped := 0
+		c.Dropped = &dropped
+	}
+	if c.Started != nil && *c.Started < 0 {
+		started := 0
+		c.Started = &started
+	}
+}
+
+// TruncateNameType truncates the transaction name and type to at most
+// nameMaxLength and typeMaxLength characters respectively, replacing the
+// last character of truncated values with truncatedStringMarker, and
+// reports whether either was truncated. If a maximum is zero or less, the
+// length is not limited.
+func (e *Transaction) TruncateNameType(nameMaxLength, typeMaxLength int) bool {
+	var truncated bool
+	if exceedsMaxLength(e.Name, nameMaxLength) {
+		e.Name = truncateString(e.Name, nameMaxLength)
+		truncated = true
+	}
+	if exceedsMaxLength(e.Type, typeMaxLength) {
+		e.Type = truncateString(e.Type, typeMaxLength)
+		truncated = true
+	}
+	return truncated
+}
+
 func (e *Transaction) fields() mapstr.M {
 	var transaction mapStr
 	transaction.maybeSetString("id", e.ID)
@@ -90,9 +153,17 @@ func (e *Transaction) fields() mapstr.M {
 	transaction.maybeSetMapStr("duration.histogram", e.DurationHistogram.fields())
 	transaction.maybeSetString("name", e.Name)
 	transaction.maybeSetString("result", e.Result)
-	transaction.maybeSetMapStr("marks", e.Marks.fields())
+	transaction.maybeSetMapStr("marks", e.Marks.fields(e.MarksSanitized))
 	transaction.maybeSetMapStr("custom", customFields(e.Custom))
-	transaction.maybeSetMapStr("message", e.Message.Fields())
+	message := e.Message.Fields()
+	transaction.maybeSetMapStr("message", message)
+	_, hasQueue := message["queue"]
+	_, hasRoutingKey := message["routing_key"]
+	if hasQueue || hasRoutingKey {
+		// Mark messaging transactions, so they can be filtered
+		// without checking for nested message fields.
+		transaction.set("messaging", true)
+	}
 	transaction.maybeSetMapStr("experience", e.UserExperience.Fields())
 	if e.SpanCount.Dropped != nil || e.SpanCount.Started != nil {
 		spanCount := mapstr.M{}
@@ -102,6 +173,14 @@ func (e *Transaction) fields() mapstr.M {
 		if e.SpanCount.Started != nil {
 			spanCount["started"] = *e.SpanCount.Started
 		}
+		if e.IndexSpanCountDroppedRatio && e.SpanCount.Dropped != nil && e.SpanCount.Started != nil {
+			var ratio float64
+			dropped, started := *e.SpanCount.Dropped, *e.SpanCount.Started
+			if total := dropped + started; total > 0 {
+				ratio = float64(dropped) / float64(total)
+			}
+			spanCount["dropped_ratio"] = ratio
+		}
 		transaction.set("span_count", spanCount)
 	}
 	if e.Sampled {
@@ -110,6 +189,9 @@ func (e *Transaction) fields() mapstr.M {
 	if e.Root {
 		transaction.set("root", e.Root)
 	}
+	if e.IndexRepresentativeCount && e.RepresentativeCount > 0 {
+		transaction.set("representative_count", e.RepresentativeCount)
+	}
 	var dss []mapstr.M
 	for _, v := range e.DroppedSpansStats {
 		dss = append(dss, v.fields())
@@ -120,28 +202,95 @@ func (e *Transaction) fields() mapstr.M {
 	return mapstr.M(transaction)
 }
 
+// exceedsMaxLength reports whether s has more than maxLength characters.
+// If maxLength is zero or less, the length is not limited.
+func exceedsMaxLength(s string, maxLength int) bool {
+	return maxLength > 0 && len(s) > maxLength && utf8.RuneCountInString(s) > maxLength
+}
+
+// truncateString truncates s to at most maxLength characters, replacing
+// the last character with truncatedStringMarker if s is longer. Truncation
+// happens on rune boundaries, so valid UTF-8 input remains valid.
+func truncateString(s string, maxLength int) string {
+	if !exceedsMaxLength(s, maxLength) {
+		return s
+	}
+	var n int
+	for i := range s {
+		if n == maxLength-1 {
+			return s[:i] + truncatedStringMarker
+		}
+		n++
+	}
+	return s
+}
+
 type TransactionMarks map[string]TransactionMark
 
-func (m TransactionMarks) fields() mapstr.M {
+func (m TransactionMarks) fields(sanitized bool) mapstr.M {
 	if len(m) == 0 {
 		return nil
 	}
 	out := make(mapStr, len(m))
 	for k, v := range m {
-		out.maybeSetMapStr(sanitizeLabelKey(k), v.fields())
+		if !sanitized {
+			k = sanitizeLabelKey(k)
+		}
+		out.maybeSetMapStr(k, v.fields(sanitized))
 	}
 	return mapstr.M(out)
 }
 
+// Agent returns the marks recorded by the agent, in the "agent" group.
+func (m TransactionMarks) Agent() TransactionMark {
+	return m.group("agent")
+}
+
+// Navigation returns the navigation timing marks, in the
+// "navigationTiming" group.
+func (m TransactionMarks) Navigation() TransactionMark {
+	return m.group("navigationTiming")
+}
+
+// Get returns the value of the named mark in the named group, and whether
+// or not it exists.
+//
+// Group and mark names are matched after sanitization, as they are written
+// to the output event by default; e.g. Get("a_b", "c_d") matches the mark
+// "c.d" in the group "a.b".
+func (m TransactionMarks) Get(group, mark string) (float64, bool) {
+	mark = sanitizeLabelKey(mark)
+	for k, v := range m.group(group) {
+		if sanitizeLabelKey(k) == mark {
+			return v, true
+		}
+	}
+	return 0, false
+}
+
+// group returns the marks in the named group, matched after sanitization.
+func (m TransactionMarks) group(name string) TransactionMark {
+	name = sanitizeLabelKey(name)
+	for k, v := range m {
+		if sanitizeLabelKey(k) == name {
+			return v
+		}
+	}
+	return nil
+}
+
 type TransactionMark map[string]float64
 
-func (m TransactionMark) fields() mapstr.M {
+func (m TransactionMark) fields(sanitized bool) mapstr.M {
 	if len(m) == 0 {
 		return nil
 	}
 	out := make(mapstr.M, len(m))
 	for k, v := range m {
-		out[sanitizeLabelKey(k)] = v
+		if !sanitized {
+			k = sanitizeLabelKey(k)
+		}
+		out[k] = v
 	}
 	return out
 }
@@ -21,6 +21,7 @@ import (
 	"fmt"
 	"testing"
 	"time"
+	"unicode/utf8"
 
 	"github.com/stretchr/testify/assert"
 
@@ -36,7 +37,7 @@ func TestTransactionTransformEmpty(t *testing.T) {
 func TestTransactionTransform(t *testing.T) {
 	id := "123"
 	result := "tx result"
-	dropped, startedSpans := 5, 14
+	dropped, startedSpans, zero := 5, 14, 0
 	name := "mytransaction"
 	duration := 65980 * time.Microsecond
 
@@ -154,6 +155,131 @@ func TestTransactionTransform(t *testing.T) {
 			},
 			Msg: "Full Event With Dropped Spans Statistics",
 		},
+		{
+			Transaction: Transaction{
+				ID:                  id,
+				Type:                "tx",
+				RepresentativeCount: 2,
+			},
+			Output: mapstr.M{
+				"id":   id,
+				"type": "tx",
+			},
+			Msg: "RepresentativeCount not indexed by default",
+		},
+		{
+			Transaction: Transaction{
+				ID:                       id,
+				Type:                     "tx",
+				RepresentativeCount:      2,
+				IndexRepresentativeCount: true,
+			},
+			Output: mapstr.M{
+				"id":                   id,
+				"type":                 "tx",
+				"representative_count": float64(2),
+			},
+			Msg: "RepresentativeCount indexed",
+		},
+		{
+			Transaction: Transaction{
+				ID:                       id,
+				Type:                     "tx",
+				IndexRepresentativeCount: true,
+			},
+			Output: mapstr.M{
+				"id":   id,
+				"type": "tx",
+			},
+			Msg: "Zero RepresentativeCount omitted",
+		},
+		{
+			Transaction: Transaction{
+				ID:                         id,
+				Type:                       "tx",
+				SpanCount:                  SpanCount{Started: &startedSpans, Dropped: &dropped},
+				IndexSpanCountDroppedRatio: true,
+			},
+			Output: mapstr.M{
+				"id":   id,
+				"type": "tx",
+				"span_count": mapstr.M{
+					"started":       14,
+					"dropped":       5,
+					"dropped_ratio": float64(5) / float64(19),
+				},
+			},
+			Msg: "SpanCount dropped ratio indexed",
+		},
+		{
+			Transaction: Transaction{
+				ID:                         id,
+				Type:                       "tx",
+				SpanCount:                  SpanCount{Dropped: &dropped},
+				IndexSpanCountDroppedRatio: true,
+			},
+			Output: mapstr.M{
+				"id":         id,
+				"type":       "tx",
+				"span_count": mapstr.M{"dropped": 5},
+			},
+			Msg: "SpanCount dropped ratio omitted without `started`",
+		},
+		{
+			Transaction: Transaction{
+				ID:                         id,
+				Type:                       "tx",
+				SpanCount:                  SpanCount{Started: &zero, Dropped: &zero},
+				IndexSpanCountDroppedRatio: true,
+			},
+			Output: mapstr.M{
+				"id":         id,
+				"type":       "tx",
+				"span_count": mapstr.M{"started": 0, "dropped": 0, "dropped_ratio": float64(0)},
+			},
+			Msg: "SpanCount dropped ratio zero without spans",
+		},
+		{
+			Transaction: Transaction{
+				ID:      id,
+				Type:    "tx",
+				Message: &Message{QueueName: "orders"},
+			},
+			Output: mapstr.M{
+				"id":        id,
+				"type":      "tx",
+				"message":   mapstr.M{"queue": mapstr.M{"name": "orders"}},
+				"messaging": true,
+			},
+			Msg: "Messaging transaction with queue",
+		},
+		{
+			Transaction: Transaction{
+				ID:      id,
+				Type:    "tx",
+				Message: &Message{RoutingKey: "orders.created"},
+			},
+			Output: mapstr.M{
+				"id":        id,
+				"type":      "tx",
+				"message":   mapstr.M{"routing_key": "orders.created"},
+				"messaging": true,
+			},
+			Msg: "Messaging transaction with routing key",
+		},
+		{
+			Transaction: Transaction{
+				ID:      id,
+				Type:    "tx",
+				Message: &Message{Body: "body"},
+			},
+			Output: mapstr.M{
+				"id":      id,
+				"type":    "tx",
+				"message": mapstr.M{"body": "body"},
+			},
+			Msg: "Message without queue or routing key",
+		},
 	}
 
 	for idx, test := range tests {
@@ -220,7 +346,8 @@ func TestEventsTransformWithMetadata(t *testing.T) {
 			"custom": mapstr.M{
 				"foo_bar": "baz",
 			},
-			"message": mapstr.M{"queue": mapstr.M{"name": "routeUser"}},
+			"message":   mapstr.M{"queue": mapstr.M{"name": "routeUser"}},
+			"messaging": true,
 		},
 		"url": mapstr.M{
 			"original": url,
@@ -228,6 +355,36 @@ func TestEventsTransformWithMetadata(t *testing.T) {
 	}, event.Fields)
 }
 
+func TestTransactionTruncateNameType(t *testing.T) {
+	for _, test := range []struct {
+		maxLength int
+		input     string
+		expected  string
+	}{
+		{maxLength: 0, input: "GET /foo", expected: "GET /foo"},
+		{maxLength: 8, input: "GET /foo", expected: "GET /foo"},
+		{maxLength: 5, input: "GET /foo", expected: "GET …"},
+		{maxLength: 1, input: "GET /foo", expected: "…"},
+		// Multibyte runes count as one character, and are never split.
+		{maxLength: 4, input: "日本語", expected: "日本語"},
+		{maxLength: 3, input: "日本語テキスト", expected: "日本…"},
+		{maxLength: 4, input: "ab日本語", expected: "ab日…"},
+	} {
+		transaction := Transaction{Name: test.input, Type: test.input}
+		truncated := transaction.TruncateNameType(test.maxLength, test.maxLength)
+		assert.Equal(t, test.expected, transaction.Name, "max length %d", test.maxLength)
+		assert.Equal(t, test.expected, transaction.Type, "max length %d", test.maxLength)
+		assert.True(t, utf8.ValidString(transaction.Name))
+		assert.Equal(t, test.expected != test.input, truncated)
+	}
+
+	// The limits are independent.
+	transaction := Transaction{Name: "GET /foo", Type: "request"}
+	assert.True(t, transaction.TruncateNameType(3, 0))
+	assert.Equal(t, "GE…", transaction.Name)
+	assert.Equal(t, "request", transaction.Type)
+}
+
 func TestTransactionTransformMarks(t *testing.T) {
 	tests := []struct {
 		Transaction Transaction
@@ -258,3 +415,90 @@ func TestTransactionTransformMarks(t *testing.T) {
 		assert.Equal(t, test.Output, marks, fmt.Sprintf("Failed at idx %v; %s", idx, test.Msg))
 	}
 }
+
+func TestTransactionTransformMarksSanitized(t *testing.T) {
+	marks := TransactionMarks{
+		"vendor.group": TransactionMark{"vendor.mark*": 123},
+	}
+	for name, test := range map[string]struct {
+		sanitized bool
+		output    mapstr.M
+	}{
+		"default": {
+			sanitized: false,
+			output:    mapstr.M{"vendor_group": mapstr.M{"vendor_mark_": float64(123)}},
+		},
+		"sanitized": {
+			sanitized: true,
+			output:    mapstr.M{"vendor.group": mapstr.M{"vendor.mark*": float64(123)}},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			// Check the output fields directly, as a field path
+			// cannot distinguish dotted keys from nested objects.
+			fields := (&Transaction{Marks: marks, MarksSanitized: test.sanitized}).fields()
+			assert.Equal(t, test.output, fields["marks"])
+		})
+	}
+}
+
+func TestTransactionMarksAccessors(t *testing.T) {
+	marks := TransactionMarks{
+		"agent": TransactionMark{
+			"domInteractive":        20,
+			"timeToFirstByte.total": 10,
+		},
+		"navigationTiming": TransactionMark{
+			"domComplete": 30,
+		},
+	}
+	assert.Equal(t, TransactionMark{"domInteractive": 20, "timeToFirstByte.total": 10}, marks.Agent())
+	assert.Equal(t, TransactionMark{"domComplete": 30}, marks.Navigation())
+	assert.Nil(t, TransactionMarks{}.Agent())
+	assert.Nil(t, TransactionMarks(nil).Navigation())
+
+	for _, test := range []struct {
+		group, mark string
+		value       float64
+		ok          bool
+	}{
+		{group: "agent", mark: "domInteractive", value: 20, ok: true},
+		{group: "agent", mark: "timeToFirstByte.total", value: 10, ok: true},
+		{group: "agent", mark: "timeToFirstByte_total", value: 10, ok: true},
+		{group: "navigationTiming", mark: "domComplete", value: 30, ok: true},
+		{group: "agent", mark: "domComplete"},
+		{group: "unknown", mark: "domComplete"},
+	} {
+		value, ok := marks.Get(test.group, test.mark)
+		assert.Equal(t, test.ok, ok, "%s.%s", test.group, test.mark)
+		assert.Equal(t, test.value, value, "%s.%s", test.group, test.mark)
+	}
+
+	// Group names are matched after sanitization too.
+	value, ok := TransactionMarks{"a.b": TransactionMark{"c.d": 123}}.Get("a_b", "c_d")
+	assert.True(t, ok)
+	assert.Equal(t, float64(123), value)
+}
+
+func TestSpanCountNegative(t *testing.T) {
+	intPtr := func(i int) *int { return &i }
+	for name, tc := range map[string]struct {
+		in       SpanCount
+		negative bool
+		clamped  SpanCount
+	}{
+		"nil":              {},
+		"zero":             {in: SpanCount{Dropped: intPtr(0), Started: intPtr(0)}, clamped: SpanCount{Dropped: intPtr(0), Started: intPtr(0)}},
+		"positive":         {in: SpanCount{Dropped: intPtr(1), Started: intPtr(2)}, clamped: SpanCount{Dropped: intPtr(1), Started: intPtr(2)}},
+		"negative_dropped": {in: SpanCount{Dropped: intPtr(-1), Started: intPtr(2)}, negative: true, clamped: SpanCount{Dropped: intPtr(0), Started: intPtr(2)}},
+		"negative_started": {in: SpanCount{Started: intPtr(-3)}, negative: true, clamped: SpanCount{Started: intPtr(0)}},
+		"negative_both":    {in: SpanCount{Dropped: intPtr(-1), Started: intPtr(-2)}, negative: true, clamped: SpanCount{Dropped: intPtr(0), Started: intPtr(0)}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.negative, tc.in.Negative())
+			tc.in.ClampNegative()
+			assert.Equal(t, tc.clamped, tc.in)
+			assert.False(t, tc.in.Negative())
+		})
+	}
+}
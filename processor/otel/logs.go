@@ -59,19 +59,21 @@ func (c *Consumer) ConsumeLogs(ctx context.Context, logs pdata.Logs) error {
 			logger.Debug(string(data))
 		}
 	}
-	resourceLogs := logs.ResourceLogs()
-	batch := make(model.Batch, 0, resourceLogs.Len())
-	for i := 0; i < resourceLogs.Len(); i++ {
-		c.convertResourceLogs(resourceLogs.At(i), receiveTimestamp, &batch)
-	}
-	return c.Processor.ProcessBatch(ctx, &batch)
+	return c.processBatch(ctx, func() *model.Batch {
+		resourceLogs := logs.ResourceLogs()
+		batch := make(model.Batch, 0, resourceLogs.Len())
+		for i := 0; i < resourceLogs.Len(); i++ {
+			c.convertResourceLogs(resourceLogs.At(i), receiveTimestamp, &batch)
+		}
+		return &batch
+	})
 }
 
 func (c *Consumer) convertResourceLogs(resourceLogs pdata.ResourceLogs, receiveTimestamp time.Time, out *model.Batch) {
 	var timeDelta time.Duration
 	resource := resourceLogs.Resource()
 	baseEvent := model.APMEvent{Processor: model.LogProcessor}
-	translateResourceMetadata(resource, &baseEvent)
+	translateResourceMetadata(resource, c.ResourceAttributeLabels, &baseEvent)
 
 	if exportTimestamp, ok := exportTimestamp(resource); ok {
 		timeDelta = receiveTimestamp.Sub(exportTimestamp)
@@ -106,7 +108,9 @@ func (c *Consumer) convertLogRecord(
 	event.Event.Severity = int64(record.SeverityNumber())
 	event.Event.Action = record.Name()
 	event.Log.Level = record.SeverityText()
-	if body := record.Body(); body.Type() != pdata.AttributeValueTypeEmpty {
+	if body := record.Body(); body.Type() == pdata.AttributeValueTypeMap && c.PreserveLogBodies {
+		event.Log.Body = body.MapVal().AsRaw()
+	} else if body.Type() != pdata.AttributeValueTypeEmpty {
 		event.Message = body.AsString()
 		if body.Type() == pdata.AttributeValueTypeMap {
 			setLabels(body.MapVal(), &event)
@@ -40,9 +40,12 @@ import (
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"go.opentelemetry.io/collector/model/pdata"
 	semconv "go.opentelemetry.io/collector/model/semconv/v1.5.0"
 
+	"github.com/elastic/elastic-agent-libs/mapstr"
+
 	"github.com/elastic/apm-server/model"
 	"github.com/elastic/apm-server/processor/otel"
 )
@@ -110,7 +113,48 @@ func TestConsumerConsumeLogs(t *testing.T) {
 	test("int_body", 1234, "1234")
 	test("float_body", 1234.1234, "1234.1234")
 	test("bool_body", true, "true")
-	// TODO(marclop): How to test map body
+}
+
+func TestConsumerConsumeLogsMapBody(t *testing.T) {
+	body := pdata.NewAttributeValueMap()
+	body.MapVal().InsertString("key", "value")
+	body.MapVal().InsertInt("count", 2)
+	nested := pdata.NewAttributeValueMap()
+	nested.MapVal().InsertBool("ok", true)
+	body.MapVal().Insert("nested", nested)
+
+	consume := func(consumer otel.Consumer) model.APMEvent {
+		logs := pdata.NewLogs()
+		resourceLogs := logs.ResourceLogs().AppendEmpty()
+		instrumentationLogs := resourceLogs.InstrumentationLibraryLogs().AppendEmpty()
+		newLogRecord(body).CopyTo(instrumentationLogs.LogRecords().AppendEmpty())
+
+		var processed model.Batch
+		consumer.Processor = model.ProcessBatchFunc(func(_ context.Context, batch *model.Batch) error {
+			processed = *batch
+			return nil
+		})
+		assert.NoError(t, consumer.ConsumeLogs(context.Background(), logs))
+		require.Len(t, processed, 1)
+		return processed[0]
+	}
+
+	// By default, map bodies are stringified, and their entries recorded as labels.
+	event := consume(otel.Consumer{})
+	assert.Equal(t, `{"count":2,"key":"value","nested":{"ok":true}}`, event.Message)
+	assert.Nil(t, event.Log.Body)
+	assert.Equal(t, model.Labels{"key": {Value: "value"}}, event.Labels)
+	assert.Equal(t, model.NumericLabels{"count": {Value: 2}}, event.NumericLabels)
+
+	event = consume(otel.Consumer{PreserveLogBodies: true})
+	assert.Empty(t, event.Message)
+	assert.Equal(t, mapstr.M{
+		"key":    "value",
+		"count":  int64(2),
+		"nested": map[string]interface{}{"ok": true},
+	}, event.Log.Body)
+	assert.Empty(t, event.Labels)
+	assert.Empty(t, event.NumericLabels)
 }
 
 func TestConsumerConsumeLogsLabels(t *testing.T) {
@@ -174,10 +218,8 @@ func newLogRecord(body interface{}) pdata.LogRecord {
 		otelLogRecord.Body().SetDoubleVal(b)
 	case bool:
 		otelLogRecord.Body().SetBoolVal(b)
-		// case map[string]string:
-		// TODO(marclop) figure out how to set the body since it cannot be set
-		// as a map.
-		// otelLogRecord.Body()
+	case pdata.AttributeValue:
+		b.CopyTo(otelLogRecord.Body())
 	}
 	return otelLogRecord
 }
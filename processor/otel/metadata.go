@@ -38,9 +38,20 @@ var (
 	serviceNameInvalidRegexp = regexp.MustCompile("[^a-zA-Z0-9 _-]")
 )
 
-func translateResourceMetadata(resource pdata.Resource, out *model.APMEvent) {
+// translateResourceMetadata translates resource attributes into out.
+//
+// Attributes with a key in attributeLabels are additionally recorded as
+// labels under the mapped label key. Mapped attributes which are not
+// otherwise recognised are recorded only under the mapped key, rather
+// than the default label key.
+func translateResourceMetadata(resource pdata.Resource, attributeLabels map[string]string, out *model.APMEvent) {
 	var exporterVersion string
 	resource.Attributes().Range(func(k string, v pdata.AttributeValue) bool {
+		label, mapped := attributeLabels[k]
+		if mapped {
+			initLabels(out)
+			setLabel(replaceDots(label), out, ifaceAttributeValue(v))
+		}
 		switch k {
 		// service.*
 		case semconv.AttributeServiceName:
@@ -129,13 +140,10 @@ func translateResourceMetadata(resource pdata.Resource, out *model.APMEvent) {
 			exporterVersion = v.StringVal()
 
 		default:
-			if out.Labels == nil {
-				out.Labels = make(model.Labels)
+			if !mapped {
+				initLabels(out)
+				setLabel(replaceDots(k), out, ifaceAttributeValue(v))
 			}
-			if out.NumericLabels == nil {
-				out.NumericLabels = make(model.NumericLabels)
-			}
-			setLabel(replaceDots(k), out, ifaceAttributeValue(v))
 		}
 		return true
 	})
@@ -231,6 +239,15 @@ func initEventLabels(e *model.APMEvent) {
 	e.NumericLabels = e.NumericLabels.Clone()
 }
 
+func initLabels(event *model.APMEvent) {
+	if event.Labels == nil {
+		event.Labels = make(model.Labels)
+	}
+	if event.NumericLabels == nil {
+		event.NumericLabels = make(model.NumericLabels)
+	}
+}
+
 func setLabel(key string, event *model.APMEvent, v interface{}) {
 	switch v := v.(type) {
 	case string:
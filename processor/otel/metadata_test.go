@@ -18,13 +18,16 @@
 package otel_test
 
 import (
+	"context"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"go.opentelemetry.io/collector/model/pdata"
 
 	"github.com/elastic/apm-server/model"
+	"github.com/elastic/apm-server/processor/otel"
 )
 
 func TestResourceConventions(t *testing.T) {
@@ -227,6 +230,46 @@ func TestResourceLabels(t *testing.T) {
 	}, metadata.NumericLabels)
 }
 
+func TestResourceAttributeLabels(t *testing.T) {
+	traces, spans := newTracesSpans()
+	pdata.NewAttributeMapFromMap(map[string]pdata.AttributeValue{
+		"service.name": pdata.NewAttributeValueString("service_name"),
+		"tenant.id":    pdata.NewAttributeValueString("tenant_1"),
+		"tenant.tier":  pdata.NewAttributeValueInt(3),
+		"other.attr":   pdata.NewAttributeValueString("other"),
+	}).CopyTo(traces.ResourceSpans().At(0).Resource().Attributes())
+	otelSpan := spans.Spans().AppendEmpty()
+	otelSpan.SetTraceID(pdata.NewTraceID([16]byte{1}))
+	otelSpan.SetSpanID(pdata.NewSpanID([8]byte{2}))
+
+	var events model.Batch
+	processor := model.ProcessBatchFunc(func(ctx context.Context, batch *model.Batch) error {
+		events = *batch
+		return nil
+	})
+	consumer := &otel.Consumer{
+		Processor: processor,
+		ResourceAttributeLabels: map[string]string{
+			"service.name": "service",
+			"tenant.id":    "tenant",
+			"tenant.tier":  "tier",
+		},
+	}
+	require.NoError(t, consumer.ConsumeTraces(context.Background(), traces))
+	require.Len(t, events, 1)
+
+	// Mapped attributes with a default field mapping are still translated.
+	assert.Equal(t, "service_name", events[0].Service.Name)
+	assert.Equal(t, model.Labels{
+		"service":    {Value: "service_name"},
+		"tenant":     {Value: "tenant_1"},
+		"other_attr": {Value: "other"},
+	}, events[0].Labels)
+	assert.Equal(t, model.NumericLabels{
+		"tier": {Value: 3},
+	}, events[0].NumericLabels)
+}
+
 func transformResourceMetadata(t *testing.T, resourceAttrs map[string]pdata.AttributeValue) model.APMEvent {
 	traces, spans := newTracesSpans()
 	pdata.NewAttributeMapFromMap(resourceAttrs).CopyTo(traces.ResourceSpans().At(0).Resource().Attributes())
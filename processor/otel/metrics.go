@@ -63,8 +63,9 @@ func (c *Consumer) ConsumeMetrics(ctx context.Context, metrics pdata.Metrics) er
 			logger.Debug(string(data))
 		}
 	}
-	batch := c.convertMetrics(metrics, receiveTimestamp)
-	return c.Processor.ProcessBatch(ctx, batch)
+	return c.processBatch(ctx, func() *model.Batch {
+		return c.convertMetrics(metrics, receiveTimestamp)
+	})
 }
 
 func (c *Consumer) convertMetrics(metrics pdata.Metrics, receiveTimestamp time.Time) *model.Batch {
@@ -80,7 +81,7 @@ func (c *Consumer) convertResourceMetrics(resourceMetrics pdata.ResourceMetrics,
 	var baseEvent model.APMEvent
 	var timeDelta time.Duration
 	resource := resourceMetrics.Resource()
-	translateResourceMetadata(resource, &baseEvent)
+	translateResourceMetadata(resource, c.ResourceAttributeLabels, &baseEvent)
 	if exportTimestamp, ok := exportTimestamp(resource); ok {
 		timeDelta = receiveTimestamp.Sub(exportTimestamp)
 	}
@@ -87,26 +87,66 @@ type Consumer struct {
 	stats consumerStats
 
 	Processor model.BatchProcessor
+
+	// Semaphore, if non-nil, is used to limit the number of concurrent
+	// requests being converted and processed. It may be shared with the
+	// intake stream processor to impose a global concurrency limit.
+	Semaphore chan struct{}
+
+	// ResourceAttributeLabels, if non-nil, maps OTLP resource attribute
+	// keys to label keys. Mapped resource attributes are recorded as labels
+	// under the given key; unmapped attributes are translated as usual.
+	ResourceAttributeLabels map[string]string
+
+	// PreserveLogBodies, if true, records the map bodies of OTLP log
+	// records in the log.body field, keeping their structure. Otherwise,
+	// map bodies are stringified as the event message, and their entries
+	// recorded as labels, as for other bodies.
+	PreserveLogBodies bool
 }
 
 // ConsumerStats holds a snapshot of statistics about data consumption.
+//
+// All trace and log data is supported, so only metrics are counted as
+// unsupported data items.
 type ConsumerStats struct {
 	// UnsupportedMetricsDropped records the number of unsupported metrics
 	// that have been dropped by the consumer.
 	UnsupportedMetricsDropped int64
+
+	// InvalidSpansDropped records the number of spans that have been
+	// dropped by the consumer due to an empty trace or span ID.
+	InvalidSpansDropped int64
 }
 
 // consumerStats holds the current statistics, which must be accessed and
 // modified using atomic operations.
 type consumerStats struct {
 	unsupportedMetricsDropped int64
+	invalidSpansDropped       int64
 }
 
 // Stats returns a snapshot of the current statistics about data consumption.
 func (c *Consumer) Stats() ConsumerStats {
 	return ConsumerStats{
 		UnsupportedMetricsDropped: atomic.LoadInt64(&c.stats.unsupportedMetricsDropped),
+		InvalidSpansDropped:       atomic.LoadInt64(&c.stats.invalidSpansDropped),
+	}
+}
+
+// processBatch acquires c.Semaphore, calls convert, and passes the
+// resulting batch to c.Processor. If ctx is cancelled while waiting
+// for the semaphore, processBatch returns ctx.Err().
+func (c *Consumer) processBatch(ctx context.Context, convert func() *model.Batch) error {
+	if c.Semaphore != nil {
+		select {
+		case c.Semaphore <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		defer func() { <-c.Semaphore }()
 	}
+	return c.Processor.ProcessBatch(ctx, convert())
 }
 
 // Capabilities is part of the consumer interfaces.
@@ -129,8 +169,9 @@ func (c *Consumer) ConsumeTraces(ctx context.Context, traces pdata.Traces) error
 			logger.Debug(string(data))
 		}
 	}
-	batch := c.convert(traces, receiveTimestamp, logger)
-	return c.Processor.ProcessBatch(ctx, batch)
+	return c.processBatch(ctx, func() *model.Batch {
+		return c.convert(traces, receiveTimestamp, logger)
+	})
 }
 
 func (c *Consumer) convert(td pdata.Traces, receiveTimestamp time.Time, logger *logp.Logger) *model.Batch {
@@ -151,7 +192,7 @@ func (c *Consumer) convertResourceSpans(
 	var baseEvent model.APMEvent
 	var timeDelta time.Duration
 	resource := resourceSpans.Resource()
-	translateResourceMetadata(resource, &baseEvent)
+	translateResourceMetadata(resource, c.ResourceAttributeLabels, &baseEvent)
 	if exportTimestamp, ok := exportTimestamp(resource); ok {
 		timeDelta = receiveTimestamp.Sub(exportTimestamp)
 	}
@@ -184,6 +225,14 @@ func (c *Consumer) convertSpan(
 	logger *logp.Logger,
 	out *model.Batch,
 ) {
+	// Trace and span IDs must be 16 and 8 bytes respectively. IDs of any
+	// other non-zero length are rejected when decoding OTLP payloads, while
+	// zero-length IDs are decoded as empty.
+	if otelSpan.TraceID().IsEmpty() || otelSpan.SpanID().IsEmpty() {
+		atomic.AddInt64(&c.stats.invalidSpansDropped, 1)
+		return
+	}
+
 	root := otelSpan.ParentSpanID().IsEmpty()
 	var parentID string
 	if !root {
@@ -216,6 +265,11 @@ func (c *Consumer) convertSpan(
 			Sampled: true,
 		}
 		TranslateTransaction(otelSpan.Attributes(), otelSpan.Status(), otelLibrary, &event)
+		if probability, ok := traceStateSamplingProbability(otelSpan.TraceState()); ok {
+			// The tracestate records the sampling probability, which takes
+			// precedence over any sampler attributes.
+			event.Transaction.RepresentativeCount = 1 / probability
+		}
 	} else {
 		event.Processor = model.SpanProcessor
 		event.Span = &model.Span{
@@ -47,6 +47,7 @@ import (
 	jaegertranslator "github.com/open-telemetry/opentelemetry-collector-contrib/pkg/translator/jaeger"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/collector/model/otlp"
 	"go.opentelemetry.io/collector/model/pdata"
 	semconv "go.opentelemetry.io/collector/model/semconv/v1.5.0"
 	"google.golang.org/grpc/codes"
@@ -70,6 +71,90 @@ func TestConsumer_ConsumeTraces_Empty(t *testing.T) {
 	assert.NoError(t, consumer.ConsumeTraces(context.Background(), traces))
 }
 
+func TestConsumer_Semaphore(t *testing.T) {
+	var processed int
+	var processor model.ProcessBatchFunc = func(ctx context.Context, batch *model.Batch) error {
+		processed++
+		return nil
+	}
+
+	sem := make(chan struct{}, 1)
+	consumer := otel.Consumer{Processor: processor, Semaphore: sem}
+	assert.NoError(t, consumer.ConsumeTraces(context.Background(), pdata.NewTraces()))
+	assert.Equal(t, 1, processed)
+	assert.Len(t, sem, 0) // released
+
+	// Fill the semaphore, as if it were shared with another in-flight request.
+	// Consumers should block until the request context is cancelled.
+	sem <- struct{}{}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, consumer.ConsumeTraces(ctx, pdata.NewTraces()))
+	assert.Equal(t, context.DeadlineExceeded, consumer.ConsumeMetrics(ctx, pdata.NewMetrics()))
+	assert.Equal(t, context.DeadlineExceeded, consumer.ConsumeLogs(ctx, pdata.NewLogs()))
+	assert.Equal(t, 1, processed)
+}
+
+func TestConsumer_ConsumeTraces_InvalidIDs(t *testing.T) {
+	traces, spans := newTracesSpans()
+	for _, ids := range []struct {
+		traceID pdata.TraceID
+		spanID  pdata.SpanID
+	}{
+		{traceID: pdata.NewTraceID([16]byte{1}), spanID: pdata.NewSpanID([8]byte{1})}, // valid
+		{traceID: pdata.InvalidTraceID(), spanID: pdata.NewSpanID([8]byte{2})},
+		{traceID: pdata.NewTraceID([16]byte{1}), spanID: pdata.InvalidSpanID()},
+		{traceID: pdata.InvalidTraceID(), spanID: pdata.InvalidSpanID()},
+	} {
+		otelSpan := spans.Spans().AppendEmpty()
+		otelSpan.SetTraceID(ids.traceID)
+		otelSpan.SetSpanID(ids.spanID)
+	}
+
+	var batches []*model.Batch
+	consumer := otel.Consumer{Processor: batchRecorderBatchProcessor(&batches)}
+	require.NoError(t, consumer.ConsumeTraces(context.Background(), traces))
+	require.Len(t, batches, 1)
+	require.Len(t, *batches[0], 1)
+	assert.Equal(t, "01000000000000000000000000000000", (*batches[0])[0].Trace.ID)
+	assert.Equal(t, "0100000000000000", (*batches[0])[0].Transaction.ID)
+	assert.Equal(t, int64(3), consumer.Stats().InvalidSpansDropped)
+}
+
+func TestConsumer_ConsumeTraces_InvalidIDLengths(t *testing.T) {
+	unmarshaler := otlp.NewJSONTracesUnmarshaler()
+	tracesJSON := func(traceID, spanID string) []byte {
+		return []byte(fmt.Sprintf(
+			`{"resourceSpans":[{"instrumentationLibrarySpans":[{"spans":[{"traceId":%q,"spanId":%q}]}]}]}`,
+			traceID, spanID,
+		))
+	}
+
+	// IDs of the wrong length are rejected when decoding.
+	_, err := unmarshaler.UnmarshalTraces(tracesJSON("0102", "0102030405060708"))
+	assert.Error(t, err)
+	_, err = unmarshaler.UnmarshalTraces(tracesJSON("01020304050607080102030405060708", "0102"))
+	assert.Error(t, err)
+
+	// Zero-length IDs are decoded as empty, and dropped by the consumer.
+	var batches []*model.Batch
+	consumer := otel.Consumer{Processor: batchRecorderBatchProcessor(&batches)}
+	for _, ids := range [][2]string{
+		{"01020304050607080102030405060708", "0102030405060708"},
+		{"", "0102030405060708"},
+		{"01020304050607080102030405060708", ""},
+	} {
+		traces, err := unmarshaler.UnmarshalTraces(tracesJSON(ids[0], ids[1]))
+		require.NoError(t, err)
+		require.NoError(t, consumer.ConsumeTraces(context.Background(), traces))
+	}
+	require.Len(t, batches, 3)
+	assert.Len(t, *batches[0], 1)
+	assert.Empty(t, *batches[1])
+	assert.Empty(t, *batches[2])
+	assert.Equal(t, int64(2), consumer.Stats().InvalidSpansDropped)
+}
+
 func TestOutcome(t *testing.T) {
 	test := func(t *testing.T, expectedOutcome, expectedResult string, statusCode pdata.StatusCode) {
 		t.Helper()
@@ -773,6 +858,44 @@ func TestSpanLinks(t *testing.T) {
 	}
 }
 
+func TestTransactionTraceStateRepresentativeCount(t *testing.T) {
+	for _, test := range []struct {
+		traceState string
+		expected   float64
+	}{
+		{traceState: "", expected: 1},
+		{traceState: "es=s:1", expected: 1},
+		{traceState: "es=s:0.5", expected: 2},
+		{traceState: "es=s:0.01", expected: 100},
+		{traceState: "vendor=xyz, es=s:0.25", expected: 4},
+		{traceState: "ot=p:0", expected: 1},
+		{traceState: "ot=p:3;r:62", expected: 8},
+		{traceState: "ot=th:8", expected: 2},
+		{traceState: "ot=th:c", expected: 4},
+		{traceState: "ot=th:0", expected: 1},
+		{traceState: "es=s:0.5,ot=p:3", expected: 2}, // es takes precedence
+
+		// Malformed tracestate values are ignored.
+		{traceState: "es=s:abc", expected: 1},
+		{traceState: "es=s:0", expected: 1},
+		{traceState: "es=s:1.5", expected: 1},
+		{traceState: "es=s:-0.5", expected: 1},
+		{traceState: "es=x:0.5", expected: 1},
+		{traceState: "ot=p:63", expected: 1},
+		{traceState: "ot=p:-1", expected: 1},
+		{traceState: "ot=th:zz", expected: 1},
+		{traceState: "ot=th:", expected: 1},
+		{traceState: "ot=th:123456789abcdef", expected: 1},
+		{traceState: "es=s:abc,ot=p:1", expected: 2}, // falls back to ot
+		{traceState: "=,,es", expected: 1},
+	} {
+		event := transformTransactionWithAttributes(t, map[string]pdata.AttributeValue{}, func(span pdata.Span) {
+			span.SetTraceState(pdata.TraceState(test.traceState))
+		})
+		assert.Equal(t, test.expected, event.Transaction.RepresentativeCount, test.traceState)
+	}
+}
+
 func TestConsumer_JaegerMetadata(t *testing.T) {
 	jaegerBatch := jaegermodel.Batch{
 		Spans: []*jaegermodel.Span{{
@@ -830,6 +953,8 @@ func TestConsumer_JaegerSampleRate(t *testing.T) {
 		Spans: []*jaegermodel.Span{{
 			StartTime: testStartTime(),
 			Duration:  testDuration(),
+			TraceID:   jaegermodel.NewTraceID(1, 1),
+			SpanID:    1,
 			Tags: []jaegermodel.KeyValue{
 				jaegerKeyValue("span.kind", "server"),
 				jaegerKeyValue("sampler.type", "probabilistic"),
@@ -839,6 +964,7 @@ func TestConsumer_JaegerSampleRate(t *testing.T) {
 			StartTime: testStartTime(),
 			Duration:  testDuration(),
 			TraceID:   jaegermodel.NewTraceID(1, 1),
+			SpanID:    2,
 			References: []jaegermodel.SpanRef{{
 				RefType: jaegermodel.SpanRefType_CHILD_OF,
 				TraceID: jaegermodel.NewTraceID(1, 1),
@@ -852,6 +978,8 @@ func TestConsumer_JaegerSampleRate(t *testing.T) {
 		}, {
 			StartTime: testStartTime(),
 			Duration:  testDuration(),
+			TraceID:   jaegermodel.NewTraceID(1, 2),
+			SpanID:    3,
 			Tags: []jaegermodel.KeyValue{
 				jaegerKeyValue("span.kind", "server"),
 				jaegerKeyValue("sampler.type", "ratelimiting"),
@@ -934,8 +1062,11 @@ func TestConsumer_JaegerTransaction(t *testing.T) {
 			name: "jaeger_type_request",
 			spans: []*jaegermodel.Span{{
 				StartTime: testStartTime(),
+				TraceID:   jaegermodel.NewTraceID(0, 0x46467830),
+				SpanID:    0x41414646,
 				References: []jaegermodel.SpanRef{{
 					RefType: jaegermodel.SpanRefType_CHILD_OF,
+					TraceID: jaegermodel.NewTraceID(0, 0x46467830),
 					SpanID:  0x61626364,
 				}},
 				Tags: []jaegermodel.KeyValue{
@@ -950,8 +1081,11 @@ func TestConsumer_JaegerTransaction(t *testing.T) {
 			name: "jaeger_type_request_result",
 			spans: []*jaegermodel.Span{{
 				StartTime: testStartTime(),
+				TraceID:   jaegermodel.NewTraceID(0, 0x46467830),
+				SpanID:    0x41414646,
 				References: []jaegermodel.SpanRef{{
 					RefType: jaegermodel.SpanRefType_CHILD_OF,
+					TraceID: jaegermodel.NewTraceID(0, 0x46467830),
 					SpanID:  0x61626364,
 				}},
 				Tags: []jaegermodel.KeyValue{
@@ -965,8 +1099,11 @@ func TestConsumer_JaegerTransaction(t *testing.T) {
 			name: "jaeger_type_messaging",
 			spans: []*jaegermodel.Span{{
 				StartTime: testStartTime(),
+				TraceID:   jaegermodel.NewTraceID(0, 0x46467830),
+				SpanID:    0x41414646,
 				References: []jaegermodel.SpanRef{{
 					RefType: jaegermodel.SpanRefType_CHILD_OF,
+					TraceID: jaegermodel.NewTraceID(0, 0x46467830),
 					SpanID:  0x61626364,
 				}},
 				Tags: []jaegermodel.KeyValue{
@@ -979,6 +1116,8 @@ func TestConsumer_JaegerTransaction(t *testing.T) {
 			name: "jaeger_type_component",
 			spans: []*jaegermodel.Span{{
 				StartTime: testStartTime(),
+				TraceID:   jaegermodel.NewTraceID(0, 0x46467830),
+				SpanID:    0x41414646,
 				Tags: []jaegermodel.KeyValue{
 					jaegerKeyValue("component", "amqp"),
 				},
@@ -988,6 +1127,8 @@ func TestConsumer_JaegerTransaction(t *testing.T) {
 			name: "jaeger_custom",
 			spans: []*jaegermodel.Span{{
 				StartTime: testStartTime(),
+				TraceID:   jaegermodel.NewTraceID(0, 0x46467830),
+				SpanID:    0x41414646,
 				Tags: []jaegermodel.KeyValue{
 					jaegerKeyValue("a.b", "foo"),
 				},
@@ -997,6 +1138,8 @@ func TestConsumer_JaegerTransaction(t *testing.T) {
 			name: "jaeger_no_attrs",
 			spans: []*jaegermodel.Span{{
 				StartTime: testStartTime(),
+				TraceID:   jaegermodel.NewTraceID(0, 0x46467830),
+				SpanID:    0x41414646,
 				Duration:  testDuration(),
 				Tags: []jaegermodel.KeyValue{
 					jaegerKeyValue("span.kind", "server"),
@@ -0,0 +1,113 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package otel
+
+import (
+	"math"
+	"strconv"
+	"strings"
+
+	"go.opentelemetry.io/collector/model/pdata"
+)
+
+const (
+	// maxOTelPValue is the maximum valid OpenTelemetry p-value. A p-value
+	// of 63 indicates zero adjusted count, which is ignored.
+	maxOTelPValue = 62
+
+	// otelThresholdDigits is the maximum number of hex digits in an
+	// OpenTelemetry sampling threshold, which has 56 bits of precision.
+	otelThresholdDigits = 14
+)
+
+// traceStateSamplingProbability returns the sampling probability recorded
+// in the W3C tracestate, and a boolean indicating whether one was found.
+//
+// The Elastic ("es") "s" entry takes precedence over the OpenTelemetry
+// ("ot") "th" or "p" entries. Malformed or out of range values are ignored.
+func traceStateSamplingProbability(traceState pdata.TraceState) (float64, bool) {
+	var esValue, otValue string
+	for _, member := range strings.Split(string(traceState), ",") {
+		member = strings.TrimSpace(member)
+		sep := strings.IndexByte(member, '=')
+		if sep <= 0 {
+			continue
+		}
+		switch member[:sep] {
+		case "es":
+			esValue = member[sep+1:]
+		case "ot":
+			otValue = member[sep+1:]
+		}
+	}
+	if probability, ok := esSamplingProbability(esValue); ok {
+		return probability, true
+	}
+	return otSamplingProbability(otValue)
+}
+
+// esSamplingProbability parses the sample rate from an Elastic tracestate
+// value, e.g. "s:0.5".
+func esSamplingProbability(value string) (float64, bool) {
+	s, ok := traceStateEntry(value, "s")
+	if !ok {
+		return 0, false
+	}
+	probability, err := strconv.ParseFloat(s, 64)
+	if err != nil || !(probability > 0 && probability <= 1) {
+		return 0, false
+	}
+	return probability, true
+}
+
+// otSamplingProbability parses the sampling probability from an
+// OpenTelemetry tracestate value, using either the rejection threshold
+// ("th:8") or the legacy p-value ("p:2;r:62").
+func otSamplingProbability(value string) (float64, bool) {
+	if th, ok := traceStateEntry(value, "th"); ok {
+		if len(th) == 0 || len(th) > otelThresholdDigits {
+			return 0, false
+		}
+		threshold, err := strconv.ParseUint(th, 16, 64)
+		if err != nil {
+			return 0, false
+		}
+		threshold <<= 4 * uint(otelThresholdDigits-len(th))
+		return 1 - float64(threshold)/(1<<56), true
+	}
+	if p, ok := traceStateEntry(value, "p"); ok {
+		pValue, err := strconv.Atoi(p)
+		if err != nil || pValue < 0 || pValue > maxOTelPValue {
+			return 0, false
+		}
+		return math.Pow(2, -float64(pValue)), true
+	}
+	return 0, false
+}
+
+// traceStateEntry returns the value of the given key from a tracestate
+// vendor value made up of semicolon-separated "key:value" entries.
+func traceStateEntry(value, key string) (string, bool) {
+	for _, entry := range strings.Split(value, ";") {
+		sep := strings.IndexByte(entry, ':')
+		if sep > 0 && entry[:sep] == key {
+			return entry[sep+1:], true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,39 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package stream
+
+import "bytes"
+
+// unaliasEventType returns the event type for which eventType, the root key
+// of line, is an alias in p.EventTypeAliases, along with a copy of line with
+// the alias replaced by that event type. If eventType is not an alias, it is
+// returned along with a nil line.
+func (p *Processor) unaliasEventType(line, eventType []byte) ([]byte, []byte) {
+	target, ok := p.EventTypeAliases[string(eventType)]
+	if !ok {
+		return eventType, nil
+	}
+	// identifyEventType returns the key following the first quote.
+	start := bytes.IndexAny(line, `"'`) + 1
+	end := start + len(eventType)
+	unaliased := make([]byte, 0, len(line)-len(eventType)+len(target))
+	unaliased = append(unaliased, line[:start]...)
+	unaliased = append(unaliased, target...)
+	unaliased = append(unaliased, line[end:]...)
+	return unaliased[start : start+len(target)], unaliased
+}
@@ -32,14 +32,14 @@ import (
 
 func BenchmarkBackendProcessor(b *testing.B) {
 	cfg := config.DefaultConfig()
-	processor := BackendProcessor(cfg, make(chan struct{}, cfg.MaxConcurrentDecoders))
+	processor := BackendProcessor(cfg, make(chan struct{}, cfg.MaxConcurrentDecoders), nil)
 	files, _ := filepath.Glob(filepath.FromSlash("../../testdata/intake-v2/*.ndjson"))
 	benchmarkStreamProcessor(b, processor, files)
 }
 
 func BenchmarkRUMV3Processor(b *testing.B) {
 	cfg := config.DefaultConfig()
-	processor := RUMV3Processor(cfg, make(chan struct{}, cfg.MaxConcurrentDecoders))
+	processor := RUMV3Processor(cfg, make(chan struct{}, cfg.MaxConcurrentDecoders), nil)
 	files, _ := filepath.Glob(filepath.FromSlash("../../testdata/intake-v3/rum_*.ndjson"))
 	benchmarkStreamProcessor(b, processor, files)
 }
@@ -73,6 +73,26 @@ func benchmarkStreamProcessor(b *testing.B, processor *Processor, files []string
 	}
 }
 
+func BenchmarkBackendProcessorTrusted(b *testing.B) {
+	const batchSize = 10
+	cfg := config.DefaultConfig()
+	processor := BackendProcessor(cfg, make(chan struct{}, cfg.MaxConcurrentDecoders), nil)
+	for _, name := range []string{"errors.ndjson", "events.ndjson", "spans.ndjson", "transactions.ndjson"} {
+		b.Run(name, func(b *testing.B) {
+			data, err := os.ReadFile(filepath.Join("../../testdata/intake-v2", name))
+			if err != nil {
+				b.Error(err)
+			}
+			b.ReportAllocs()
+			b.SetBytes(int64(len(data)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				processor.HandleTrustedStream(context.Background(), model.APMEvent{}, data, batchSize, nopBatchProcessor{})
+			}
+		})
+	}
+}
+
 func BenchmarkBackendProcessorParallel(b *testing.B) {
 	for _, max := range []uint{0, 2, 4, 8} { // 0 is for default size.
 		b.Run(fmt.Sprint(b.Name(), max), func(b *testing.B) {
@@ -80,7 +100,7 @@ func BenchmarkBackendProcessorParallel(b *testing.B) {
 			if max > 0 {
 				cfg.MaxConcurrentDecoders = max
 			}
-			processor := BackendProcessor(cfg, make(chan struct{}, cfg.MaxConcurrentDecoders))
+			processor := BackendProcessor(cfg, make(chan struct{}, cfg.MaxConcurrentDecoders), nil)
 			files, _ := filepath.Glob(filepath.FromSlash("../../testdata/intake-v2/*.ndjson"))
 			benchmarkStreamProcessorParallel(b, processor, files)
 		})
@@ -0,0 +1,61 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package stream
+
+import (
+	"bufio"
+	"context"
+	"io"
+)
+
+type captureKey struct{}
+
+// ContextWithCapture returns a copy of parent associated with capture, to
+// which HandleStream copies the raw bytes of the stream, through a buffer,
+// as they are read. This includes lines which fail to decode. Errors
+// writing to capture do not affect stream processing; capturing stops at
+// the first write error.
+func ContextWithCapture(parent context.Context, capture io.Writer) context.Context {
+	return context.WithValue(parent, captureKey{}, capture)
+}
+
+func captureFromContext(ctx context.Context) io.Writer {
+	capture, _ := ctx.Value(captureKey{}).(io.Writer)
+	return capture
+}
+
+// captureWriter buffers writes to an underlying capture writer, discarding
+// all writes after the first error so that the stream being captured is not
+// interrupted.
+type captureWriter struct {
+	w   *bufio.Writer
+	err error
+}
+
+func (cw *captureWriter) Write(p []byte) (int, error) {
+	if cw.err == nil {
+		_, cw.err = cw.w.Write(p)
+	}
+	return len(p), nil
+}
+
+func (cw *captureWriter) flush() {
+	if cw.err == nil {
+		cw.err = cw.w.Flush()
+	}
+}
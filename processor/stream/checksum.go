@@ -0,0 +1,102 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package stream
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+)
+
+const (
+	// checksumEventType identifies the optional final line of a stream
+	// holding the checksum of the preceding lines, when the processor's
+	// VerifyChecksum field is true.
+	checksumEventType = "checksum"
+
+	// maxChecksumLineLength holds the maximum length of the checksum line,
+	// excluding the trailing newline.
+	maxChecksumLineLength = 256
+)
+
+// streamChecksum computes the SHA-256 checksum of the raw bytes of a stream
+// preceding its final line, which is expected to hold the checksum.
+//
+// As the final line of the stream is not known until the stream ends, the
+// most recently written bytes are held back from the hash until verify is
+// called.
+type streamChecksum struct {
+	hash     hash.Hash
+	held     []byte
+	expected []byte
+
+	// reserved holds the in-flight bytes reserved for the stream's events,
+	// which are held along with the events until the checksum is verified.
+	reserved int
+}
+
+func newStreamChecksum() *streamChecksum {
+	return &streamChecksum{hash: sha256.New()}
+}
+
+// Write adds p to the bytes of the stream.
+func (c *streamChecksum) Write(p []byte) (int, error) {
+	c.held = append(c.held, p...)
+	// Hold back enough bytes for the checksum line, the newline
+	// preceding it, and any trailing newlines.
+	if n := len(c.held) - 2*maxChecksumLineLength; n > 0 {
+		c.hash.Write(c.held[:n])
+		c.held = append(c.held[:0], c.held[n:]...)
+	}
+	return len(p), nil
+}
+
+// setExpected records the checksum held in the checksum line, encoded as
+// a hex string. Invalid checksums are recorded in the returned error's
+// Document as returned by document.
+func (c *streamChecksum) setExpected(checksum string, document func([]byte) string) error {
+	expected, err := hex.DecodeString(checksum)
+	if err != nil || len(expected) != sha256.Size {
+		return &InvalidInputError{
+			Message:  "invalid checksum: expected hex-encoded SHA-256 checksum",
+			Document: document([]byte(checksum)),
+		}
+	}
+	c.expected = expected
+	return nil
+}
+
+// verify verifies that the checksum of the stream, preceding its final line,
+// matches the expected checksum. verify must be called once the stream has
+// been read to the end, and after setExpected.
+func (c *streamChecksum) verify() error {
+	held := bytes.TrimRight(c.held, "\r\n")
+	i := bytes.LastIndexByte(held, '\n')
+	if i == -1 {
+		return &InvalidInputError{Message: "invalid checksum: checksum line too long"}
+	}
+	c.hash.Write(held[:i+1])
+	if actual := c.hash.Sum(nil); !bytes.Equal(actual, c.expected) {
+		return &InvalidInputError{
+			Message: "checksum mismatch: expected " + hex.EncodeToString(c.expected) +
+				", computed " + hex.EncodeToString(actual),
+		}
+	}
+	return nil
+}
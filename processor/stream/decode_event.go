@@ -0,0 +1,83 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package stream
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/elastic/apm-server/decoder"
+	"github.com/elastic/apm-server/model"
+	"github.com/elastic/apm-server/model/modeldecoder"
+)
+
+// DecodeEvent decodes a single ND-JSON event line, such as a line of an
+// intake stream following its metadata, on top of base. DecodeEvent is
+// intended for tests and validation tools which need to decode events
+// without handling a whole stream.
+//
+// Lines are decoded as by HandleStream, including the processor's default
+// labels, but per-request options associated with a context are not
+// applied. Lines which cannot be decoded are reported with an
+// *InvalidInputError, as are lines which decode to more than one event,
+// such as profiles. Metadata lines are reported as unrecognized objects.
+func (p *Processor) DecodeEvent(base model.APMEvent, line []byte) (model.APMEvent, error) {
+	line = bytes.TrimRight(line, "\r\n")
+	if len(bytes.TrimSpace(line)) == 0 {
+		return model.APMEvent{}, &InvalidInputError{Message: "invalid event: empty line"}
+	}
+	if p.MaxEventSize > 0 && len(line) > p.MaxEventSize {
+		// As for streams, only the permitted size of the line is recorded.
+		return model.APMEvent{}, &InvalidInputError{
+			TooLarge: true,
+			Message:  "event exceeded the permitted size.",
+			Document: truncateDocument(line[:p.MaxEventSize], p.maxDocumentLength()),
+		}
+	}
+	document := truncateDocument(line, p.maxDocumentLength())
+	if encodingErr := checkEncoding(line, p.maxDocumentLength()); encodingErr != nil {
+		return model.APMEvent{}, encodingErr
+	}
+
+	eventType := p.identifyEventType(line)
+	if canonical, aliased := p.unaliasEventType(line, eventType); aliased != nil {
+		eventType, line = canonical, aliased
+	}
+	input := modeldecoder.Input{
+		Base:                         base,
+		DropCookies:                  p.cookies.Drop,
+		MaxCookies:                   p.cookies.Max,
+		TransactionMarksKeySanitizer: p.TransactionMarksKeySanitizer,
+	}
+	var batch model.Batch
+	d := lineDecoder{decoder.NewJSONDecoder(bytes.NewReader(line))}
+	if err := p.decodeEvent(eventType, d, &input, &batch); err != nil {
+		return model.APMEvent{}, &InvalidInputError{Message: err.Error(), Document: document}
+	}
+	if len(batch) != 1 {
+		return model.APMEvent{}, &InvalidInputError{
+			Message:  fmt.Sprintf("invalid event: decoded %d events, expected 1", len(batch)),
+			Document: document,
+		}
+	}
+	event := batch[0]
+	if len(p.defaultLabels) > 0 {
+		p.addDefaultLabels(string(eventType), &event)
+	}
+	return event, nil
+}
@@ -0,0 +1,66 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+//go:build go1.18
+// +build go1.18
+
+package stream
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/elastic/apm-server/beater/config"
+)
+
+func FuzzIdentifyEventType(f *testing.F) {
+	for _, seed := range []string{
+		`{"transaction": {}}`,
+		`{'span': {}}`,
+		`{"tra\"nsaction": {}}`,
+		`{"error\`,
+		`"`,
+		``,
+	} {
+		f.Add([]byte(seed))
+	}
+	p := BackendProcessor(&config.Config{MaxEventSize: 100 * 1024}, make(chan struct{}, 1), nil)
+	f.Fuzz(func(t *testing.T, body []byte) {
+		key := p.identifyEventType(body)
+		if key == nil {
+			return
+		}
+		// The key must be found within the quotes that delimit it.
+		start := bytes.IndexAny(body, `"'`)
+		if start == -1 || start+1+len(key) >= len(body) {
+			t.Fatalf("key %q out of bounds of %q", key, body)
+		}
+		quote := body[start]
+		if !bytes.Equal(key, body[start+1:start+1+len(key)]) || body[start+1+len(key)] != quote {
+			t.Fatalf("key %q not delimited by quotes in %q", key, body)
+		}
+		// An unescaped quote must not occur within the key.
+		for i := 0; i < len(key); i++ {
+			switch key[i] {
+			case '\\':
+				i++
+			case quote:
+				t.Fatalf("key %q contains an unescaped quote", key)
+			}
+		}
+	})
+}
@@ -0,0 +1,136 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package stream
+
+import (
+	"fmt"
+
+	"github.com/elastic/apm-server/beater/config"
+	"github.com/elastic/apm-server/model"
+	"github.com/elastic/apm-server/model/modeldecoder"
+)
+
+// resolveLabelConflicts resolves conflicts between the labels of events
+// decoded on top of input.Base and the labels it holds from the stream's
+// metadata, according to policy, one of the config.IntakeLabelConflicts*
+// values. An empty policy is treated as config.IntakeLabelConflictsEventWins,
+// leaving the events' labels unchanged. Conflicts are counted in the
+// "label_conflicts" metric.
+//
+// A label conflicts if an event changed its value or type. Events setting a
+// label to the value defined in the metadata do not conflict. If policy is
+// config.IntakeLabelConflictsError, resolveLabelConflicts returns an error
+// describing the first conflicting label. If policy is
+// config.IntakeLabelConflictsMetadataWins, the events' conflicting values
+// are dropped, with a warning.
+//
+// The events' labels may be shared with other events, and are cloned
+// before being modified.
+func resolveLabelConflicts(policy string, input *modeldecoder.Input, events model.Batch) error {
+	base := &input.Base
+	if len(base.Labels) == 0 && len(base.NumericLabels) == 0 {
+		return nil
+	}
+	for i := range events {
+		event := &events[i]
+		w := model.NewLabelsWriter(event)
+		for k, v := range base.Labels {
+			_, numeric := event.NumericLabels[k]
+			if labelValueEqual(v, event.Labels[k]) && (!numeric || hasNumericLabel(base, k)) {
+				continue
+			}
+			if err := labelConflict(policy, k); err != nil {
+				return err
+			}
+			if policy == config.IntakeLabelConflictsMetadataWins {
+				w.Labels()[k] = v
+				if numeric && !hasNumericLabel(base, k) {
+					delete(w.NumericLabels(), k)
+				}
+				warnLabelDropped(input, k)
+			}
+		}
+		for k, v := range base.NumericLabels {
+			_, str := event.Labels[k]
+			if numericLabelValueEqual(v, event.NumericLabels[k]) && (!str || hasLabel(base, k)) {
+				continue
+			}
+			if err := labelConflict(policy, k); err != nil {
+				return err
+			}
+			if policy == config.IntakeLabelConflictsMetadataWins {
+				w.NumericLabels()[k] = v
+				if str && !hasLabel(base, k) {
+					delete(w.Labels(), k)
+				}
+				warnLabelDropped(input, k)
+			}
+		}
+	}
+	return nil
+}
+
+// labelConflict records a conflict for the label k, returning an error
+// if policy is config.IntakeLabelConflictsError.
+func labelConflict(policy, k string) error {
+	mLabelConflicts.Inc()
+	if policy == config.IntakeLabelConflictsError {
+		return fmt.Errorf("label conflict: event overrides metadata label %q", k)
+	}
+	return nil
+}
+
+// warnLabelDropped records a warning for the event label k, whose value
+// was dropped in favour of the metadata label's.
+func warnLabelDropped(input *modeldecoder.Input, k string) {
+	input.Warnf(WarningLabelDropped, "event label %q conflicts with a metadata label and was dropped", k)
+}
+
+func hasLabel(event *model.APMEvent, k string) bool {
+	_, ok := event.Labels[k]
+	return ok
+}
+
+func hasNumericLabel(event *model.APMEvent, k string) bool {
+	_, ok := event.NumericLabels[k]
+	return ok
+}
+
+func labelValueEqual(a, b model.LabelValue) bool {
+	if a.Value != b.Value || len(a.Values) != len(b.Values) {
+		return false
+	}
+	for i := range a.Values {
+		if a.Values[i] != b.Values[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func numericLabelValueEqual(a, b model.NumericLabelValue) bool {
+	if a.Value != b.Value || len(a.Values) != len(b.Values) {
+		return false
+	}
+	for i := range a.Values {
+		if a.Values[i] != b.Values[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,168 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package stream
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/time/rate"
+)
+
+// ErrInFlightLimitExceeded is returned by HandleStream when a new stream is
+// rejected due to the total size of in-flight events having reached the limit
+// configured for the processor's InFlightLimiter. It is also recorded as a
+// per-event error for events which alone exceed the limit.
+var ErrInFlightLimitExceeded = errors.New("in-flight batch bytes limit exceeded")
+
+// InFlightLimiter is a hard cap on the total size in bytes of the events
+// read by all processors sharing it, which have not yet been processed.
+//
+// Bytes are reserved for each event before it is decoded, and released once
+// the batch containing the event has been processed. When a reservation
+// cannot be made, the stream processes the events it has already read and
+// then blocks until enough bytes have been released by other streams. New
+// streams are rejected while the limit is reached.
+//
+// A nil *InFlightLimiter imposes no limit.
+type InFlightLimiter struct {
+	inflight int64 // accessed atomically
+	limit    int64
+
+	// released is closed and replaced each time in-flight bytes
+	// are released, to wake up streams blocked in reserve.
+	mu       sync.Mutex
+	released chan struct{}
+}
+
+// NewInFlightLimiter returns a new InFlightLimiter which limits the total
+// size of in-flight events to limit bytes. If limit is zero or less,
+// NewInFlightLimiter returns nil, disabling the limit.
+func NewInFlightLimiter(limit int64) *InFlightLimiter {
+	if limit <= 0 {
+		return nil
+	}
+	return &InFlightLimiter{limit: limit, released: make(chan struct{})}
+}
+
+// InFlight returns the total size in bytes of in-flight events.
+func (l *InFlightLimiter) InFlight() int64 {
+	if l == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&l.inflight)
+}
+
+// exceeded reports whether the total size of in-flight events has
+// reached the limit.
+func (l *InFlightLimiter) exceeded() bool {
+	if l == nil {
+		return false
+	}
+	return atomic.LoadInt64(&l.inflight) >= l.limit
+}
+
+// tryReserve attempts to record n bytes as being in flight, without
+// exceeding the limit. tryReserve reports whether the bytes were reserved.
+func (l *InFlightLimiter) tryReserve(n int) bool {
+	if l == nil || n == 0 {
+		return true
+	}
+	for {
+		inflight := atomic.LoadInt64(&l.inflight)
+		if inflight+int64(n) > l.limit {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&l.inflight, inflight, inflight+int64(n)) {
+			mInFlightBytes.Set(inflight + int64(n))
+			return true
+		}
+	}
+}
+
+// reserve records n bytes as being in flight, blocking until they can be
+// reserved without exceeding the limit, or ctx is done. If n alone exceeds
+// the limit, reserve returns ErrInFlightLimitExceeded immediately.
+func (l *InFlightLimiter) reserve(ctx context.Context, n int) error {
+	if l == nil {
+		return nil
+	}
+	if int64(n) > l.limit {
+		return ErrInFlightLimitExceeded
+	}
+	for {
+		// Fetch the channel before attempting the reservation,
+		// so a concurrent release cannot be missed.
+		l.mu.Lock()
+		released := l.released
+		l.mu.Unlock()
+		if l.tryReserve(n) {
+			return nil
+		}
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// release records n bytes as no longer being in flight, waking up any
+// streams blocked in reserve.
+func (l *InFlightLimiter) release(n int) {
+	if l == nil || n == 0 {
+		return
+	}
+	mInFlightBytes.Set(atomic.AddInt64(&l.inflight, -int64(n)))
+	l.mu.Lock()
+	close(l.released)
+	l.released = make(chan struct{})
+	l.mu.Unlock()
+}
+
+type eventRateLimiterKey struct{}
+
+// ContextWithEventRateLimiter returns a copy of parent associated with
+// limiter, which HandleStream uses to limit the rate at which events are
+// decoded within the stream. HandleStream waits for the limiter before
+// decoding each event; events which cannot be decoded before ctx is done
+// are skipped, and recorded as ErrEventRateLimitExceeded errors.
+func ContextWithEventRateLimiter(parent context.Context, limiter *rate.Limiter) context.Context {
+	return context.WithValue(parent, eventRateLimiterKey{}, limiter)
+}
+
+// waitEventRateLimiter waits for the event rate limiter in ctx, if any,
+// returning ErrEventRateLimitExceeded if ctx is done first or would
+// be done before the limiter permits an event.
+//
+// The stream's semaphore is released while waiting, so that other streams
+// can be read in the meantime, and re-acquired before returning.
+func (p *Processor) waitEventRateLimiter(ctx context.Context) error {
+	limiter, ok := ctx.Value(eventRateLimiterKey{}).(*rate.Limiter)
+	if !ok || limiter == nil || limiter.Allow() {
+		return nil
+	}
+	var err error
+	p.withoutSemaphore(func() { err = limiter.Wait(ctx) })
+	if err != nil {
+		return ErrEventRateLimitExceeded
+	}
+	return nil
+}
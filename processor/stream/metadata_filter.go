@@ -0,0 +1,84 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package stream
+
+import (
+	"context"
+
+	"github.com/elastic/apm-server/model"
+)
+
+// MetadataFilter is called by HandleStream with the base event holding a
+// stream's decoded metadata, e.g. the service name and agent version,
+// before any of its events are decoded. If MetadataFilter returns a
+// non-nil error, the stream is rejected with a *StreamRejectedError
+// wrapping the error.
+type MetadataFilter func(model.APMEvent) error
+
+type metadataFilterKey struct{}
+
+// ContextWithMetadataFilter returns a copy of parent associated with
+// filter, which HandleStream calls after decoding each metadata line of
+// a stream, including those accepted by Processor.AcceptMetadataUpdates.
+// Streams may then be rejected as a whole, without the cost of decoding
+// their events.
+func ContextWithMetadataFilter(parent context.Context, filter MetadataFilter) context.Context {
+	return context.WithValue(parent, metadataFilterKey{}, filter)
+}
+
+// filterMetadata calls the MetadataFilter associated with ctx, if any,
+// returning a *StreamRejectedError if it rejects the stream.
+func filterMetadata(ctx context.Context, event model.APMEvent) error {
+	filter, _ := ctx.Value(metadataFilterKey{}).(MetadataFilter)
+	if filter == nil {
+		return nil
+	}
+	if err := filter(event); err != nil {
+		return &StreamRejectedError{Err: err}
+	}
+	return nil
+}
+
+// ErrorCodeStreamRejected is the error code of a *StreamRejectedError
+// wrapping an error which has no more specific code.
+const ErrorCodeStreamRejected = "stream_rejected"
+
+// StreamRejectedError is returned by HandleStream when the stream is
+// rejected by the MetadataFilter associated with its context.
+type StreamRejectedError struct {
+	// Err holds the error returned by the MetadataFilter.
+	Err error
+}
+
+func (e *StreamRejectedError) Error() string {
+	return "stream rejected: " + e.Err.Error()
+}
+
+// Unwrap returns e.Err.
+func (e *StreamRejectedError) Unwrap() error {
+	return e.Err
+}
+
+// ErrorCode returns the code of e.Err, or ErrorCodeStreamRejected if
+// e.Err is not classified by ErrorCode.
+func (e *StreamRejectedError) ErrorCode() string {
+	if code := ErrorCode(e.Err); code != ErrorCodeInternal {
+		return code
+	}
+	return ErrorCodeStreamRejected
+}
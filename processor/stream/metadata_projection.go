@@ -0,0 +1,45 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package stream
+
+import (
+	"context"
+
+	"github.com/elastic/apm-server/model"
+)
+
+type metadataProjectionKey struct{}
+
+// ContextWithMetadataProjection returns a copy of parent associated with
+// policy, which HandleStream applies to the stream's base event once its
+// metadata has been decoded, and again for each metadata update accepted
+// by Processor.AcceptMetadataUpdates. Events decoded from the stream
+// share the projected metadata, so the policy is not applied per event.
+//
+// Without a policy, model.NoMetadataProjection is used, keeping all
+// metadata.
+func ContextWithMetadataProjection(parent context.Context, policy model.MetadataProjectionPolicy) context.Context {
+	return context.WithValue(parent, metadataProjectionKey{}, policy)
+}
+
+func metadataProjectionFromContext(ctx context.Context) model.MetadataProjectionPolicy {
+	if policy, ok := ctx.Value(metadataProjectionKey{}).(model.MetadataProjectionPolicy); ok {
+		return policy
+	}
+	return model.NoMetadataProjection
+}
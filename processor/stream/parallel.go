@@ -0,0 +1,148 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package stream
+
+import (
+	"bytes"
+	"sync"
+	"sync/atomic"
+
+	"github.com/elastic/apm-server/decoder"
+	"github.com/elastic/apm-server/model"
+	"github.com/elastic/apm-server/model/modeldecoder"
+)
+
+// pendingEvent holds an event line read by readBatch, to be decoded
+// by a parallelDecoder.
+type pendingEvent struct {
+	eventType []byte
+	line      []byte
+	size      int
+	input     modeldecoder.Input
+
+	// truncated holds the error to report if the event fails to be
+	// decoded because the stream ended in the middle of its line.
+	truncated *InvalidInputError
+
+	// events, warnings and err hold the results of decoding the event.
+	events   model.Batch
+	warnings []Warning
+	err      error
+}
+
+// decode decodes the event's line, recording the results in e.
+func (e *pendingEvent) decode(p *Processor) {
+	e.input.Warn = func(code, message string) {
+		e.warnings = append(e.warnings, Warning{Code: code, Message: message})
+	}
+	d := lineDecoder{decoder.NewJSONDecoder(bytes.NewReader(e.line))}
+	e.err = p.decodeEvent(e.eventType, d, &e.input, &e.events)
+}
+
+// lineDecoder decodes a single line, returning errors as
+// decoder.NDJSONStreamDecoder does.
+type lineDecoder struct {
+	decoder decoder.JSONDecoder
+}
+
+func (d lineDecoder) Decode(v interface{}) error {
+	if err := d.decoder.Decode(v); err != nil {
+		return decoder.JSONDecodeError("data read error: " + err.Error())
+	}
+	return nil
+}
+
+// parallelDecoder decodes the event lines read into a batch across
+// the processor's DecodeParallelism goroutines.
+type parallelDecoder struct {
+	processor *Processor
+	pending   []pendingEvent
+}
+
+// add adds an event line to be decoded on top of input. The line and
+// event type are copied, so the stream may be read further before the
+// event is decoded.
+func (d *parallelDecoder) add(eventType, line []byte, size int, input modeldecoder.Input, truncated *InvalidInputError) {
+	d.pending = append(d.pending, pendingEvent{
+		eventType: append([]byte(nil), eventType...),
+		line:      append([]byte(nil), line...),
+		size:      size,
+		input:     input,
+		truncated: truncated,
+	})
+}
+
+// decode decodes the pending events, appending them to batch in the
+// order they were read. decode returns the number of events appended,
+// and the number of reserved bytes released for events which failed
+// to be decoded.
+//
+// Warnings and errors are recorded in result in the order the events
+// were read, after any recorded while reading the batch.
+func (d *parallelDecoder) decode(batch *model.Batch, samplingOverride SamplingOverride, result *Result) (int, int) {
+	p := d.processor
+	workers := p.DecodeParallelism
+	if workers > len(d.pending) {
+		workers = len(d.pending)
+	}
+	var wg sync.WaitGroup
+	next := int64(-1)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				i := int(atomic.AddInt64(&next, 1))
+				if i >= len(d.pending) {
+					return
+				}
+				d.pending[i].decode(p)
+			}
+		}()
+	}
+	wg.Wait()
+
+	origLen := len(*batch)
+	var released int
+	for i := range d.pending {
+		e := &d.pending[i]
+		for _, w := range e.warnings {
+			result.AddWarning(w.Code, w.Message)
+		}
+		if e.err != nil {
+			p.limiter.release(e.size)
+			released += e.size
+			mRejectedSizes.record(string(e.eventType), rejectedReasonValidation, len(e.line))
+			p.Stats.recordRejected(string(e.eventType))
+			if e.truncated != nil {
+				result.LimitedAdd(e.truncated)
+				continue
+			}
+			result.LimitedAdd(&InvalidInputError{
+				Message:  e.err.Error(),
+				Document: truncateDocument(e.line, p.maxDocumentLength()),
+			})
+			continue
+		}
+		decodedLen := len(*batch)
+		*batch = append(*batch, e.events...)
+		p.finishEvents(string(e.eventType), (*batch)[decodedLen:], samplingOverride)
+	}
+	d.pending = d.pending[:0]
+	return len(*batch) - origLen, released
+}
@@ -18,10 +18,15 @@
 package stream
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"encoding/json"
+	"fmt"
 	"io"
 	"sync"
+	"time"
+	"unicode/utf8"
 
 	"go.elastic.co/apm/v2"
 
@@ -37,62 +42,285 @@ import (
 
 var (
 	errUnrecognizedObject = errors.New("did not recognize object type")
+
+	// ErrServiceDisabled is returned by HandleStream when ingestion is
+	// disabled for the service identified in the stream's metadata.
+	ErrServiceDisabled = errors.New("ingestion is disabled for the service")
+
+	// ErrShuttingDown is returned by HandleStream once Shutdown
+	// has been called.
+	ErrShuttingDown = errors.New("stream processor is shutting down")
+
+	// ErrEventRateLimitExceeded is recorded for events which are skipped
+	// because the stream's event rate limiter would not permit them
+	// before the stream's context is done.
+	ErrEventRateLimitExceeded = errors.New("event rate limit exceeded")
 )
 
 const (
 	errorEventType            = "error"
+	metadataEventType         = "metadata"
 	metricsetEventType        = "metricset"
+	profileEventType          = "profile"
 	spanEventType             = "span"
 	transactionEventType      = "transaction"
 	rumv3ErrorEventType       = "e"
+	rumv3MetadataEventType    = "m"
 	rumv3TransactionEventType = "x"
 )
 
+// semaphoreWaitLabel is the label of the "Stream" span recording the
+// number of milliseconds HandleStream waited for the decoder semaphore.
+const semaphoreWaitLabel = "semaphore_wait_ms"
+
 type decodeMetadataFunc func(decoder.Decoder, *model.APMEvent) error
 
+// StreamDecoder reads and decodes the lines of a stream, one event or
+// metadata object per line. *decoder.NDJSONStreamDecoder implements
+// StreamDecoder.
+type StreamDecoder interface {
+	// Decode decodes the latest line read by ReadAhead into v, reading
+	// the next line first if the latest line has already been decoded.
+	Decode(v interface{}) error
+
+	// ReadAhead reads the next line, to be decoded by a subsequent call
+	// to Decode. Lines longer than the maximum line length are truncated,
+	// with decoder.ErrLineTooLong returned. io.EOF may be returned along
+	// with the final line.
+	ReadAhead() ([]byte, error)
+
+	// IsEOF reports whether the end of the stream has been reached.
+	IsEOF() bool
+
+	// LatestLine returns the latest line read, which may be truncated.
+	LatestLine() []byte
+
+	// LatestLineLength returns the full length of the latest line read.
+	LatestLineLength() int
+
+	// SetMaxLineLength sets the maximum length of lines.
+	SetMaxLineLength(maxLineLength int)
+
+	// Reset resets the decoder to read from r, clearing any state.
+	Reset(r io.Reader)
+}
+
+// NewStreamDecoderFunc is the type of functions returning a StreamDecoder
+// reading from r, with lines up to maxLineLength bytes. The maximum line
+// length may be changed with SetMaxLineLength, up to bufferSize bytes.
+type NewStreamDecoderFunc func(r io.Reader, maxLineLength, bufferSize int) StreamDecoder
+
+// newNDJSONStreamDecoder is the default NewStreamDecoderFunc.
+func newNDJSONStreamDecoder(r io.Reader, maxLineLength, bufferSize int) StreamDecoder {
+	return decoder.NewNDJSONStreamDecoderSize(r, maxLineLength, bufferSize)
+}
+
+// ServiceDenylist reports whether ingestion is disabled for a service.
+type ServiceDenylist interface {
+	Denied(ctx context.Context, name, environment string) bool
+}
+
 // Processor decodes a streams and is safe for concurrent use. The processor
 // accepts a channel that is used as a semaphore to control the maximum
 // concurrent number of stream decode operations that can happen at any time.
 // The buffered channel is meant to be shared between all the processors so
-// the concurrency limit is shared between all the intake endpoints.
+// the concurrency limit is shared between all the intake endpoints. Likewise,
+// the optional InFlightLimiter is meant to be shared between all processors,
+// bounding the total size of batches read but not yet processed.
 type Processor struct {
 	streamReaderPool sync.Pool
 	decodeMetadata   decodeMetadataFunc
 	sem              chan struct{}
+	limiter          *InFlightLimiter
+	acceptProfiles   bool
+	defaultLabels    []config.DefaultLabelsConfig
+	cookies          config.CookiesConfig
+	rejectBlank      bool
+	labelConflicts   string
+	negativeSpans    string
+	timestampWindow  time.Duration
+	timestampPolicy  string
+	maxBuffered      int
+	maxNameLength    int
+	maxTypeLength    int
 	MaxEventSize     int
+
+	// shutdownMu guards closed, and is held for reading while
+	// adding to streams so it does not race with Shutdown.
+	shutdownMu sync.RWMutex
+	closed     bool
+	streams    sync.WaitGroup
+
+	// ServiceDenylist, if non-nil, is consulted after reading the metadata
+	// of each stream. Streams for denied services are rejected with
+	// ErrServiceDisabled.
+	ServiceDenylist ServiceDenylist
+
+	// Stats, if non-nil, records statistics about the streams handled.
+	Stats *IntakeStatsRecorder
+
+	// AcceptMetadataUpdates, if true, accepts metadata lines following
+	// the first line of a stream. Each metadata line replaces the metadata
+	// of the events that follow it in the stream. Otherwise, additional
+	// metadata lines are reported as unrecognized objects.
+	AcceptMetadataUpdates bool
+
+	// MaxMetadataSize holds the maximum size in bytes of the metadata line
+	// at the start of each stream, and MaxEventSize that of event lines.
+	// If MaxMetadataSize is zero or less, MaxEventSize is used. Metadata
+	// lines accepted by AcceptMetadataUpdates are limited by MaxEventSize.
+	MaxMetadataSize int
+
+	// MaxDocumentLength holds the maximum length in bytes of the offending
+	// line recorded in InvalidInputError.Document. Longer documents are cut
+	// at a UTF-8 character boundary, and documentTruncatedMarker appended.
+	// If MaxDocumentLength is zero, DefaultMaxDocumentLength is used, and
+	// if it is negative, documents are not truncated.
+	MaxDocumentLength int
+
+	// VerifyChecksum, if true, accepts a final line holding the SHA-256
+	// checksum of the preceding bytes of the stream, hex-encoded, as in
+	// {"checksum": "<checksum>"}. HandleStream holds the stream's events
+	// until the stream ends, and returns an error without processing any
+	// of them if the checksum does not match, or a terminal error occurs.
+	// The in-flight bytes of held events are reserved until the stream
+	// ends, so streams whose held events reach the InFlightLimiter's limit
+	// fail with ErrInFlightLimitExceeded.
+	// The events of streams without a checksum line are processed once
+	// the stream ends. Otherwise, checksum lines are reported as
+	// unrecognized objects.
+	VerifyChecksum bool
+
+	// RecordBatchEvents, if true, records the number of events read into
+	// each batch by HandleStream in a histogram, in the
+	// "apm-server.processor.stream.batch_events" monitoring registry.
+	// Batches are often smaller than batchSize, e.g. at the end of the
+	// stream, or when the in-flight limit is reached. Reads returning no
+	// events are not recorded.
+	RecordBatchEvents bool
+
+	// EventTypeAliases maps event type keys to the event types they are
+	// decoded as, e.g. "txn" to "transaction", so agents using renamed
+	// event types can be rolled out before the server recognizes them.
+	// Aliased lines are decoded, and reported, as if their root key were
+	// the event type. Metadata and checksum lines cannot be aliased.
+	// Keys which are neither event types nor aliases are reported as
+	// unrecognized objects.
+	EventTypeAliases map[string]string
+
+	// DecodeParallelism holds the maximum number of goroutines decoding
+	// the events of each batch read from a stream. The events are decoded
+	// in parallel once the batch's lines have been read, and are returned
+	// in the order they were read. If DecodeParallelism is 1 or less,
+	// events are decoded one at a time as they are read.
+	DecodeParallelism int
+
+	// NewStreamDecoder, if non-nil, is called to create the StreamDecoder
+	// reading streams, e.g. to substitute implementations for testing or
+	// alternative line framing. Otherwise, streams are read as ND-JSON
+	// with decoder.NewNDJSONStreamDecoderSize. Decoders are reset and
+	// reused for subsequent streams.
+	NewStreamDecoder NewStreamDecoderFunc
+
+	// TransactionMarksKeySanitizer, if non-nil, sanitizes the group and
+	// mark keys of decoded transaction marks, e.g. to preserve dots for a
+	// vendor's marks. Otherwise, the characters '.', '*', and '"' are
+	// replaced with '_', as for label keys.
+	TransactionMarksKeySanitizer func(string) string
 }
 
-func BackendProcessor(cfg *config.Config, sem chan struct{}) *Processor {
+func BackendProcessor(cfg *config.Config, sem chan struct{}, limiter *InFlightLimiter) *Processor {
 	return &Processor{
-		MaxEventSize:   cfg.MaxEventSize,
-		decodeMetadata: v2.DecodeNestedMetadata,
-		sem:            sem,
+		MaxEventSize:      cfg.MaxEventSize,
+		MaxMetadataSize:   cfg.MaxMetadataSize,
+		MaxDocumentLength: cfg.MaxDocumentLength,
+		decodeMetadata:    v2.DecodeNestedMetadata,
+		sem:               sem,
+		limiter:           limiter,
+		defaultLabels:     cfg.DefaultLabels,
+		cookies:           cfg.Cookies,
+		rejectBlank:       cfg.Intake.WhitespaceLines == config.IntakeWhitespaceLinesReject,
+		labelConflicts:    cfg.Intake.LabelConflicts,
+		negativeSpans:     cfg.Intake.NegativeSpanCount,
+		timestampWindow:   cfg.Intake.TimestampWindow,
+		timestampPolicy:   cfg.Intake.TimestampOutOfWindow,
+		maxBuffered:       cfg.Intake.MaxBufferedEvents,
+		maxNameLength:     cfg.Transaction.MaxNameLength,
+		maxTypeLength:     cfg.Transaction.MaxTypeLength,
+		// Profiles are only accepted from backend agents, as they
+		// may decompress to far more than the maximum event size.
+		acceptProfiles: true,
 	}
 }
 
-func RUMV2Processor(cfg *config.Config, sem chan struct{}) *Processor {
+func RUMV2Processor(cfg *config.Config, sem chan struct{}, limiter *InFlightLimiter) *Processor {
 	return &Processor{
-		MaxEventSize:   cfg.MaxEventSize,
-		decodeMetadata: v2.DecodeNestedMetadata,
-		sem:            sem,
+		MaxEventSize:      cfg.MaxEventSize,
+		MaxMetadataSize:   cfg.MaxMetadataSize,
+		MaxDocumentLength: cfg.MaxDocumentLength,
+		decodeMetadata:    v2.DecodeNestedMetadata,
+		sem:               sem,
+		limiter:           limiter,
+		defaultLabels:     cfg.DefaultLabels,
+		cookies:           cfg.Cookies,
+		rejectBlank:       cfg.Intake.WhitespaceLines == config.IntakeWhitespaceLinesReject,
+		labelConflicts:    cfg.Intake.LabelConflicts,
+		negativeSpans:     cfg.Intake.NegativeSpanCount,
+		timestampWindow:   cfg.Intake.TimestampWindow,
+		timestampPolicy:   cfg.Intake.TimestampOutOfWindow,
+		maxBuffered:       cfg.Intake.MaxBufferedEvents,
+		maxNameLength:     cfg.Transaction.MaxNameLength,
+		maxTypeLength:     cfg.Transaction.MaxTypeLength,
 	}
 }
 
-func RUMV3Processor(cfg *config.Config, sem chan struct{}) *Processor {
+func RUMV3Processor(cfg *config.Config, sem chan struct{}, limiter *InFlightLimiter) *Processor {
 	return &Processor{
-		MaxEventSize:   cfg.MaxEventSize,
-		decodeMetadata: rumv3.DecodeNestedMetadata,
-		sem:            sem,
+		MaxEventSize:      cfg.MaxEventSize,
+		MaxMetadataSize:   cfg.MaxMetadataSize,
+		MaxDocumentLength: cfg.MaxDocumentLength,
+		decodeMetadata:    rumv3.DecodeNestedMetadata,
+		sem:               sem,
+		limiter:           limiter,
+		defaultLabels:     cfg.DefaultLabels,
+		cookies:           cfg.Cookies,
+		rejectBlank:       cfg.Intake.WhitespaceLines == config.IntakeWhitespaceLinesReject,
+		labelConflicts:    cfg.Intake.LabelConflicts,
+		negativeSpans:     cfg.Intake.NegativeSpanCount,
+		timestampWindow:   cfg.Intake.TimestampWindow,
+		timestampPolicy:   cfg.Intake.TimestampOutOfWindow,
+		maxBuffered:       cfg.Intake.MaxBufferedEvents,
+		maxNameLength:     cfg.Transaction.MaxNameLength,
+		maxTypeLength:     cfg.Transaction.MaxTypeLength,
 	}
 }
 
-func (p *Processor) readMetadata(reader *streamReader, out *model.APMEvent) error {
-	if err := p.decodeMetadata(reader, out); err != nil {
+func (p *Processor) readMetadata(ctx context.Context, reader *streamReader, out *model.APMEvent, result *Result) error {
+	err := p.decodeMetadata(reader, out)
+	if n := reader.LatestLineLength(); n > 0 || err == nil {
+		result.addLine(n)
+	}
+	if err != nil {
+		if limitErr := decompressionLimitError(err); limitErr != nil {
+			return newTerminalError(limitErr)
+		}
+		// Some agents send keep-alive streams holding only newlines,
+		// which are accepted as streams without events. Streams with
+		// no bytes at all are still reported as missing metadata.
+		empty := reader.IsEOF() && len(reader.LatestLine()) == 0
+		if !empty && reader.isBlank(result) {
+			return nil
+		}
+		// Report misencoded streams, e.g. UTF-16, rather than the
+		// less helpful decoding error they produce.
+		if encodingErr := checkEncoding(reader.LatestLine(), p.maxDocumentLength()); encodingErr != nil {
+			return encodingErr
+		}
 		err = reader.wrapError(err)
 		if err == io.EOF {
 			return &InvalidInputError{
 				Message:  "EOF while reading metadata",
-				Document: string(reader.LatestLine()),
+				Document: reader.document(reader.LatestLine()),
 			}
 		}
 		if _, ok := err.(*InvalidInputError); ok {
@@ -100,97 +328,519 @@ func (p *Processor) readMetadata(reader *streamReader, out *model.APMEvent) erro
 		}
 		return &InvalidInputError{
 			Message:  err.Error(),
-			Document: string(reader.LatestLine()),
+			Document: reader.document(reader.LatestLine()),
 		}
 	}
+	if p.ServiceDenylist != nil && p.ServiceDenylist.Denied(ctx, out.Service.Name, out.Service.Environment) {
+		return ErrServiceDisabled
+	}
+	return filterMetadata(ctx, *out)
+}
+
+// updateMetadata decodes a metadata line read after the first line of the
+// stream, replacing out with requestBase updated with the decoded metadata.
+// Invalid metadata is recorded in result, leaving out unchanged.
+func (p *Processor) updateMetadata(
+	ctx context.Context,
+	reader *streamReader,
+	requestBase model.APMEvent,
+	out *model.APMEvent,
+	result *Result,
+) error {
+	err := p.decodeMetadata(reader, &requestBase)
+	if err != nil && err != io.EOF {
+		mRejectedSizes.record(metadataEventType, rejectedReasonValidation, len(reader.LatestLine()))
+		p.Stats.recordRejected(metadataEventType)
+		if truncated := reader.truncatedError(); truncated != nil {
+			result.LimitedAdd(truncated)
+			return nil
+		}
+		result.LimitedAdd(&InvalidInputError{
+			Message:  err.Error(),
+			Document: reader.document(reader.LatestLine()),
+		})
+		return nil
+	}
+	if p.ServiceDenylist != nil && p.ServiceDenylist.Denied(ctx, requestBase.Service.Name, requestBase.Service.Environment) {
+		return ErrServiceDisabled
+	}
+	if err := filterMetadata(ctx, requestBase); err != nil {
+		return err
+	}
+	requestBase.ProjectMetadata(metadataProjectionFromContext(ctx))
+	*out = requestBase
 	return nil
 }
 
+// readChecksum decodes the checksum line of the stream, recording the
+// expected checksum in reader.checksum.
+func (p *Processor) readChecksum(reader *streamReader, result *Result) error {
+	var line struct {
+		Checksum string `json:"checksum"`
+	}
+	if err := reader.Decode(&line); err != nil && err != io.EOF {
+		if err := reader.wrapError(err); errors.As(err, new(*InvalidInputError)) {
+			return err
+		}
+		return &InvalidInputError{
+			Message:  err.Error(),
+			Document: reader.document(reader.LatestLine()),
+		}
+	}
+	return reader.checksum.setExpected(line.Checksum, reader.document)
+}
+
+// DefaultMaxDocumentLength holds the maximum length in bytes of documents
+// recorded in InvalidInputError, when Processor.MaxDocumentLength is zero.
+const DefaultMaxDocumentLength = 4 * 1024
+
+// maxDocumentLength returns the maximum length in bytes of documents
+// recorded in InvalidInputError: p.MaxDocumentLength, or
+// DefaultMaxDocumentLength if that is zero.
+func (p *Processor) maxDocumentLength() int {
+	if p.MaxDocumentLength == 0 {
+		return DefaultMaxDocumentLength
+	}
+	return p.MaxDocumentLength
+}
+
+// documentTruncatedMarker is appended to documents truncated to the
+// maximum document length.
+const documentTruncatedMarker = "...(truncated)"
+
+// truncateDocument returns line as a string, truncated to at most
+// maxLength bytes followed by documentTruncatedMarker if it is longer,
+// without splitting multi-byte UTF-8 characters. If maxLength is
+// negative, line is not truncated.
+func truncateDocument(line []byte, maxLength int) string {
+	if maxLength < 0 || len(line) <= maxLength {
+		return string(line)
+	}
+	n := maxLength
+	for n > 0 && !utf8.RuneStart(line[n]) {
+		n--
+	}
+	return string(line[:n]) + documentTruncatedMarker
+}
+
+// encodingPrefixLength is the number of leading bytes of
+// a stream inspected by checkEncoding.
+const encodingPrefixLength = 64
+
+// checkEncoding returns an InvalidInputError describing the problem if the
+// first bytes of line indicate that the stream is not UTF-8 encoded JSON,
+// and otherwise nil.
+func checkEncoding(line []byte, maxDocumentLength int) *InvalidInputError {
+	prefix := line
+	if len(prefix) > encodingPrefixLength {
+		prefix = prefix[:encodingPrefixLength]
+	}
+	var message string
+	switch {
+	case bytes.HasPrefix(prefix, []byte{0xFE, 0xFF}), bytes.HasPrefix(prefix, []byte{0xFF, 0xFE}):
+		message = "invalid input encoding: found a UTF-16 byte order mark, events must be UTF-8 encoded"
+	case bytes.HasPrefix(prefix, []byte{0xEF, 0xBB, 0xBF}):
+		message = "invalid input encoding: found a UTF-8 byte order mark, which is not permitted"
+	case bytes.IndexByte(prefix, 0) != -1:
+		message = "invalid input encoding: found null bytes, events must be UTF-8 encoded"
+	default:
+		for len(prefix) > 0 && utf8.FullRune(prefix) {
+			r, size := utf8.DecodeRune(prefix)
+			if r == utf8.RuneError && size == 1 {
+				message = "invalid input encoding: events must be UTF-8 encoded"
+				break
+			}
+			prefix = prefix[size:]
+		}
+	}
+	if message == "" {
+		return nil
+	}
+	return &InvalidInputError{Message: message, Document: truncateDocument(line, maxDocumentLength)}
+}
+
 // identifyEventType takes a reader and reads ahead the first key of the
 // underlying json input. This method makes some assumptions met by the
 // input format:
 // - the input is in JSON format
 // - every valid ndjson line only has one root key
 // - the bytes that we must match on are ASCII
+//
+// Escaped quotes do not terminate the key, and the key is returned with
+// its escape sequences intact. nil is returned if the key is not closed.
 func (p *Processor) identifyEventType(body []byte) []byte {
 	// find event type, trim spaces and account for single and double quotes
-	var quote byte
-	var key []byte
-	for i, r := range body {
-		if r == '"' || r == '\'' {
-			quote = r
-			key = body[i+1:]
-			break
-		}
-	}
-	end := bytes.IndexByte(key, quote)
-	if end == -1 {
+	start := bytes.IndexAny(body, `"'`)
+	if start == -1 {
 		return nil
 	}
-	return key[:end]
+	quote := body[start]
+	key := body[start+1:]
+	for i := 0; i < len(key); i++ {
+		switch key[i] {
+		case '\\':
+			i++ // skip the escaped byte
+		case quote:
+			return key[:i]
+		}
+	}
+	return nil
 }
 
 // readBatch reads up to `batchSize` events from the ndjson stream into
-// batch, returning the number of events read and any error encountered.
-// Callers should always process the n > 0 events returned before considering
-// the error err.
+// batch, stopping early once the processor's maximum number of buffered
+// events have been decoded. readBatch returns the number of events read,
+// the number of bytes reserved with the processor's InFlightLimiter, and
+// any error encountered. Callers
+// should always process the n > 0 events returned before considering the
+// error err, and must release the reserved bytes once they have done so.
+//
+// Events are decoded on top of baseEvent. If p.AcceptMetadataUpdates is
+// true, metadata lines update baseEvent from requestBase, the base event
+// before the stream's metadata was decoded.
+//
+// If labels is non-nil, the goroutine's pprof labels are set to include
+// the type of each event while it is decoded.
+//
+// If p.DecodeParallelism is greater than 1, the event lines are read
+// first, and then decoded in parallel before readBatch returns.
 func (p *Processor) readBatch(
 	ctx context.Context,
-	baseEvent model.APMEvent,
+	requestBase model.APMEvent,
+	baseEvent *model.APMEvent,
 	batchSize int,
 	batch *model.Batch,
 	reader *streamReader,
 	result *Result,
-) (int, error) {
+	labels *profilerLabels,
+) (n int, reserved int, err error) {
 
 	// input events are decoded and appended to the batch
 	origLen := len(*batch)
-	for i := 0; i < batchSize && !reader.IsEOF(); i++ {
-		body, err := reader.ReadAhead()
+	samplingOverride := samplingOverrideFromContext(ctx)
+	var parallel *parallelDecoder
+	if p.DecodeParallelism > 1 {
+		parallel = &parallelDecoder{processor: p}
+		defer func() {
+			decoded, released := parallel.decode(batch, samplingOverride, result)
+			n += decoded
+			reserved -= released
+		}()
+	}
+	for i := 0; i < batchSize && !reader.isEOF(); i++ {
+		body, err := reader.readAhead(result)
 		if err != nil && err != io.EOF {
+			if errors.As(err, new(*decoder.BodyShorterThanContentLengthError)) {
+				// The body ended early, so no more events can be read.
+				return len(*batch) - origLen, reserved, reader.wrapError(err)
+			}
 			err := reader.wrapError(err)
 			var invalidInput *InvalidInputError
 			if errors.As(err, &invalidInput) {
+				if invalidInput.TooLarge {
+					eventType := string(p.identifyEventType(body))
+					mRejectedSizes.record(eventType, rejectedReasonTooLarge, reader.LatestLineLength())
+					p.Stats.recordRejected(eventType)
+				}
 				result.LimitedAdd(err)
 				continue
 			}
 			// return early, we assume we can only recover from a input error types
-			return len(*batch) - origLen, err
+			return len(*batch) - origLen, reserved, err
+		}
+		if len(body) > 0 && reader.checksum != nil && reader.checksum.expected != nil {
+			return len(*batch) - origLen, reserved, &InvalidInputError{
+				Message:  "invalid checksum: checksum line must be the final line",
+				Document: reader.document(body),
+			}
 		}
 		if len(body) == 0 {
-			// required for backwards compatibility - sending empty lines was permitted in previous versions
+			// required for backwards compatibility - sending empty lines was permitted in previous versions.
+			// The end of the stream is never reported.
+			if p.rejectBlank && err == nil {
+				mRejectedSizes.record(unknownEventType, rejectedReasonValidation, 0)
+				p.Stats.recordRejected(unknownEventType)
+				result.LimitedAdd(&InvalidInputError{Message: "invalid event: empty line"})
+			}
+			continue
+		}
+		if len(bytes.TrimSpace(body)) == 0 {
+			if p.rejectBlank {
+				mRejectedSizes.record(unknownEventType, rejectedReasonValidation, len(body))
+				p.Stats.recordRejected(unknownEventType)
+				result.LimitedAdd(&InvalidInputError{
+					Message:  "invalid event: line holds only whitespace",
+					Document: reader.document(body),
+				})
+			}
+			continue
+		}
+		eventType := p.identifyEventType(body)
+		labels.setEventType(eventType)
+		if p.AcceptMetadataUpdates {
+			switch string(eventType) {
+			case metadataEventType, rumv3MetadataEventType:
+				if err := p.updateMetadata(ctx, reader, requestBase, baseEvent, result); err != nil {
+					return len(*batch) - origLen, reserved, err
+				}
+				continue
+			}
+		}
+
+		if reader.checksum != nil && string(eventType) == checksumEventType {
+			if err := p.readChecksum(reader, result); err != nil {
+				return len(*batch) - origLen, reserved, err
+			}
 			continue
 		}
-		// We copy the event for each iteration of the batch, as to avoid
-		// shallow copies of Labels and NumericLabels.
-		input := modeldecoder.Input{Base: copyEvent(baseEvent)}
-		switch eventType := p.identifyEventType(body); string(eventType) {
-		case errorEventType:
-			err = v2.DecodeNestedError(reader, &input, batch)
-		case metricsetEventType:
-			err = v2.DecodeNestedMetricset(reader, &input, batch)
-		case spanEventType:
-			err = v2.DecodeNestedSpan(reader, &input, batch)
-		case transactionEventType:
-			err = v2.DecodeNestedTransaction(reader, &input, batch)
-		case rumv3ErrorEventType:
-			err = rumv3.DecodeNestedError(reader, &input, batch)
-		case rumv3TransactionEventType:
-			err = rumv3.DecodeNestedTransaction(reader, &input, batch)
-		default:
-			err = errors.Wrap(errUnrecognizedObject, string(eventType))
+
+		var d decoder.Decoder = reader
+		if canonical, aliased := p.unaliasEventType(body, eventType); aliased != nil {
+			eventType, body = canonical, aliased
+			d = lineDecoder{decoder.NewJSONDecoder(bytes.NewReader(aliased))}
+		}
+
+		if err := p.waitEventRateLimiter(ctx); err != nil {
+			p.Stats.recordRejected(string(eventType))
+			result.LimitedAdd(err)
+			continue
+		}
+
+		// Reserve in-flight bytes for the event before decoding it. If the
+		// bytes cannot be reserved right away, the events read so far are
+		// returned to be processed, releasing their bytes, and the line is
+		// read again by the next call.
+		size := p.eventSize(eventType, body)
+		if !p.limiter.tryReserve(size) {
+			if reserved > 0 {
+				reader.unreadLine()
+				break
+			}
+			if reader.checksum != nil && reader.checksum.reserved > 0 {
+				// The bytes of the events held until the checksum is
+				// verified are only released once the stream ends, so
+				// waiting for bytes to be released could wait forever.
+				return len(*batch) - origLen, reserved, ErrInFlightLimitExceeded
+			}
+			if err := p.limiter.reserve(ctx, size); err != nil {
+				if err != ErrInFlightLimitExceeded {
+					return len(*batch) - origLen, reserved, err
+				}
+				p.Stats.recordRejected(string(eventType))
+				result.LimitedAdd(err)
+				continue
+			}
+		}
+
+		// The decoded events share baseEvent's Labels and NumericLabels,
+		// which are cloned by the decoders only when they are modified.
+		input := modeldecoder.Input{
+			Base:                         *baseEvent,
+			DropCookies:                  p.cookies.Drop,
+			MaxCookies:                   p.cookies.Max,
+			TransactionMarksKeySanitizer: p.TransactionMarksKeySanitizer,
+			Warn:                         reader.warn,
+		}
+		if parallel != nil {
+			parallel.add(eventType, body, size, input, reader.truncatedError())
+			reserved += size
+			if p.maxBuffered > 0 && len(*batch)-origLen+len(parallel.pending) >= p.maxBuffered {
+				break
+			}
+			continue
 		}
+		decodedLen := len(*batch)
+		err = p.decodeEvent(eventType, d, &input, batch)
 		if err != nil && err != io.EOF {
+			p.limiter.release(size)
+			mRejectedSizes.record(string(eventType), rejectedReasonValidation, len(body))
+			p.Stats.recordRejected(string(eventType))
+			if truncated := reader.truncatedError(); truncated != nil {
+				result.LimitedAdd(truncated)
+				continue
+			}
 			result.LimitedAdd(&InvalidInputError{
 				Message:  err.Error(),
-				Document: string(reader.LatestLine()),
+				Document: reader.document(reader.LatestLine()),
 			})
+			continue
+		}
+		p.finishEvents(string(eventType), (*batch)[decodedLen:], samplingOverride)
+		reserved += size
+		if p.maxBuffered > 0 && len(*batch)-origLen >= p.maxBuffered {
+			// Flush the buffered events without waiting for the
+			// rest of the batch to be read.
+			break
 		}
 	}
-	if reader.IsEOF() {
-		return len(*batch) - origLen, io.EOF
+	if reader.isEOF() {
+		return len(*batch) - origLen, reserved, io.EOF
+	}
+	return len(*batch) - origLen, reserved, nil
+}
+
+// finishEvents applies the processor's default labels and the sampling
+// override, if non-nil, to events decoded from an event of the given type.
+func (p *Processor) finishEvents(
+	eventType string,
+	events model.Batch,
+	samplingOverride SamplingOverride,
+) {
+	for i := range events {
+		event := &events[i]
+		if len(p.defaultLabels) > 0 {
+			p.addDefaultLabels(eventType, event)
+		}
+		if samplingOverride != nil {
+			overrideSampled(samplingOverride, event)
+		}
 	}
-	return len(*batch) - origLen, nil
+}
+
+// decodeEvent decodes an event of the given type from d, appending the
+// decoded events to batch, and resolving conflicts between their labels
+// and those of input.Base, negative span counts, timestamps outside the
+// accepted window, and overlong transaction names and types, according
+// to the processor's configuration.
+func (p *Processor) decodeEvent(
+	eventType []byte,
+	d decoder.Decoder,
+	input *modeldecoder.Input,
+	batch *model.Batch,
+) error {
+	origLen := len(*batch)
+	err := p.decodeEventType(eventType, d, input, batch)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if conflictErr := resolveLabelConflicts(p.labelConflicts, input, (*batch)[origLen:]); conflictErr != nil {
+		*batch = (*batch)[:origLen]
+		return conflictErr
+	}
+	if spanCountErr := checkSpanCounts(p.negativeSpans, input, (*batch)[origLen:]); spanCountErr != nil {
+		*batch = (*batch)[:origLen]
+		return spanCountErr
+	}
+	if timestampErr := checkTimestamps(p.timestampWindow, p.timestampPolicy, input, (*batch)[origLen:]); timestampErr != nil {
+		*batch = (*batch)[:origLen]
+		return timestampErr
+	}
+	truncateTransactions(p.maxNameLength, p.maxTypeLength, input, (*batch)[origLen:])
+	return err
+}
+
+func (p *Processor) decodeEventType(
+	eventType []byte,
+	d decoder.Decoder,
+	input *modeldecoder.Input,
+	batch *model.Batch,
+) error {
+	switch string(eventType) {
+	case errorEventType:
+		return v2.DecodeNestedError(d, input, batch)
+	case metricsetEventType:
+		return v2.DecodeNestedMetricset(d, input, batch)
+	case profileEventType:
+		if p.acceptProfiles {
+			return v2.DecodeNestedProfile(d, input, batch)
+		}
+	case spanEventType:
+		return v2.DecodeNestedSpan(d, input, batch)
+	case transactionEventType:
+		return v2.DecodeNestedTransaction(d, input, batch)
+	case rumv3ErrorEventType:
+		return rumv3.DecodeNestedError(d, input, batch)
+	case rumv3TransactionEventType:
+		return rumv3.DecodeNestedTransaction(d, input, batch)
+	default:
+		mUnrecognized.inc(eventType)
+	}
+	return errors.Wrap(errUnrecognizedObject, string(eventType))
+}
+
+// addDefaultLabels adds the labels of the configured default labels
+// matching event, decoded from an event of the given type, without
+// overriding labels already set on the event.
+//
+// The event's labels may be shared with other events, and are cloned
+// before being modified.
+func (p *Processor) addDefaultLabels(eventType string, event *model.APMEvent) {
+	switch eventType {
+	case rumv3ErrorEventType:
+		eventType = errorEventType
+	case rumv3TransactionEventType:
+		eventType = transactionEventType
+	}
+	labels := model.NewLabelsWriter(event)
+	for _, cfg := range p.defaultLabels {
+		if cfg.Event != eventType {
+			continue
+		}
+		if cfg.Type != "" || cfg.Subtype != "" {
+			var typ, subtype string
+			switch {
+			case event.Span != nil:
+				typ, subtype = event.Span.Type, event.Span.Subtype
+			case event.Transaction != nil:
+				typ = event.Transaction.Type
+			}
+			if (cfg.Type != "" && cfg.Type != typ) || (cfg.Subtype != "" && cfg.Subtype != subtype) {
+				continue
+			}
+		}
+		for k, v := range cfg.Labels {
+			if _, ok := event.Labels[k]; ok {
+				continue
+			}
+			if _, ok := event.NumericLabels[k]; ok {
+				continue
+			}
+			labels.Labels().Set(k, v)
+		}
+	}
+}
+
+// eventSize returns the number of in-flight bytes to reserve for an event
+// of the given type, encoded in body. Profile events hold pprof data which
+// may decompress to at most v2.MaxProfileDataSize bytes.
+func (p *Processor) eventSize(eventType, body []byte) int {
+	if p.acceptProfiles && string(eventType) == profileEventType {
+		return len(body) + v2.MaxProfileDataSize
+	}
+	return len(body)
+}
+
+// Shutdown stops the processor from accepting new streams, and waits for
+// in-flight calls to HandleStream to complete. If ctx is done before then,
+// Shutdown returns ctx.Err(); the in-flight streams continue to completion.
+func (p *Processor) Shutdown(ctx context.Context) error {
+	p.shutdownMu.Lock()
+	p.closed = true
+	p.shutdownMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.streams.Wait()
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// beginStream records the start of a call to HandleStream, returning
+// false if the processor has been shut down.
+func (p *Processor) beginStream() bool {
+	p.shutdownMu.RLock()
+	defer p.shutdownMu.RUnlock()
+	if p.closed {
+		return false
+	}
+	p.streams.Add(1)
+	return true
 }
 
 // HandleStream processes a stream of events in batches of batchSize at a time,
@@ -200,6 +850,38 @@ func (p *Processor) readBatch(
 // such as the rate limit being exceeded, or due to authorization errors. In
 // this case the result will only cover the subset of events accepted.
 //
+// HandleStream returns ErrShuttingDown if Shutdown has been called.
+//
+// Streams holding only whitespace, such as the newlines agents may send to
+// keep connections alive, are accepted without events. Streams without any
+// bytes, and other streams without a valid metadata line, are rejected.
+//
+// Errors processing batches of events, the context being done while
+// waiting to decode the stream, or reader failing with a
+// *decoder.DecompressionLimitError, are returned as a *TerminalError
+// which classifies the error and wraps the original.
+//
+// Streams may be rejected after their metadata is decoded, before any of
+// their events are read, by the MetadataFilter associated with ctx by
+// ContextWithMetadataFilter, if any.
+//
+// The stream's metadata is projected according to the policy associated
+// with ctx by ContextWithMetadataProjection, if any.
+//
+// Batches are transformed by the BatchTransform associated with ctx by
+// ContextWithBatchTransform, if any, before being processed.
+//
+// Batches which fail to be published are retried by the publisher according
+// to the retry policy associated with ctx by ContextWithRetryPolicy, if any.
+//
+// If HandleStream returns an error after it has started reading the stream,
+// result.BytesRead is set to the number of bytes read from reader, or from
+// the request body if reader has a RequestBytesRead method, as the readers
+// returned by decoder.CompressedRequestReader do.
+//
+// The raw bytes of the stream are copied to the writer associated with ctx
+// by ContextWithCapture, if any.
+//
 // Callers must not access result concurrently with HandleStream.
 func (p *Processor) HandleStream(
 	ctx context.Context,
@@ -208,7 +890,12 @@ func (p *Processor) HandleStream(
 	batchSize int,
 	processor model.BatchProcessor,
 	result *Result,
-) error {
+) (err error) {
+	if !p.beginStream() {
+		return ErrShuttingDown
+	}
+	defer p.streams.Done()
+
 	// Since processor.ProcessBatch can block for some time until all the batch
 	// is added to the modelindexer's cache and there isn't a fail-fast rejection,
 	// we want to cap how many in-flight requests are read at any time.
@@ -216,83 +903,328 @@ func (p *Processor) HandleStream(
 	// (determined by batchSize) from the batch, effectively limitting the decoding
 	// concurrency to N batches at any time, which should be a good ceiling. The
 	// ceiling also reduces the contention on the modelindexer.activeMu.
+	//
+	// The time spent waiting is recorded on the "Stream" span, so queueing
+	// can be told apart from decoding. It is only measured when the
+	// request is traced.
+	var semWaitStart time.Time
+	traced := apm.TransactionFromContext(ctx) != nil
+	if traced {
+		semWaitStart = time.Now()
+	}
 	select {
 	case p.sem <- struct{}{}:
 	case <-ctx.Done():
-		return ctx.Err()
+		return newTerminalError(ctx.Err())
+	}
+	var semWait time.Duration
+	if traced {
+		semWait = time.Since(semWaitStart)
+	}
+
+	// If the reader reports the number of bytes read from the request
+	// body, e.g. before decompression, that is recorded in BytesRead.
+	requestReader, _ := reader.(requestBytesReader)
+
+	if capture := captureFromContext(ctx); capture != nil {
+		cw := &captureWriter{w: bufio.NewWriter(capture)}
+		reader = io.TeeReader(reader, cw)
+		defer cw.flush()
+	}
+
+	var checksum *streamChecksum
+	if p.VerifyChecksum {
+		checksum = newStreamChecksum()
+		reader = io.TeeReader(reader, checksum)
+		defer func() { p.limiter.release(checksum.reserved) }()
+	}
+
+	counter := &countingReader{Reader: reader}
+	reader = counter
+	defer func() {
+		if err != nil {
+			result.BytesRead = counter.n
+			if requestReader != nil {
+				result.BytesRead = requestReader.RequestBytesRead()
+			}
+		}
+	}()
+	if p.Stats != nil {
+		start := time.Now()
+		defer func() {
+			p.Stats.recordStream(counter.n, time.Since(start))
+		}()
 	}
 
 	sr := p.getStreamReader(reader)
+	sr.checksum = checksum
+	sr.warn = result.AddWarning
 	defer func() {
 		sr.release()
 		<-p.sem
 	}()
 
+	// Reject new streams while the in-flight limit is reached;
+	// existing streams block in readBatch until bytes are released.
+	if p.limiter.exceeded() {
+		return ErrInFlightLimitExceeded
+	}
+
+	labels := newProfilerLabels(ctx)
+	if labels != nil {
+		labels.set()
+		defer labels.restore()
+	}
+
 	// first item is the metadata object
-	if err := p.readMetadata(sr, &baseEvent); err != nil {
+	requestBase := baseEvent
+	sr.SetMaxLineLength(p.maxMetadataSize())
+	err = p.readMetadata(ctx, sr, &baseEvent, result)
+	sr.SetMaxLineLength(p.MaxEventSize)
+	if err != nil {
 		// no point in continuing if we couldn't read the metadata
 		return err
 	}
+	baseEvent.ProjectMetadata(metadataProjectionFromContext(ctx))
 
 	sp, ctx := apm.StartSpan(ctx, "Stream", "Reporter")
 	defer sp.End()
+	if !sp.Dropped() {
+		sp.Context.SetLabel(semaphoreWaitLabel, float64(semWait)/float64(time.Millisecond))
+	}
 
+	var pending []model.Batch
 	for {
 		var batch model.Batch
-		n, readErr := p.readBatch(ctx, baseEvent, batchSize, &batch, sr, result)
-		if n > 0 {
-			// NOTE(axw) ProcessBatch takes ownership of batch, which means we cannot reuse
-			// the slice memory. We should investigate alternative interfaces between the
-			// processor and publisher which would enable better memory reuse, e.g. by using
-			// a sync.Pool for creating batches, and having the publisher (terminal processor)
-			// release batches back into the pool.
-			if err := processor.ProcessBatch(ctx, &batch); err != nil {
+		n, reserved, readErr := p.readBatch(ctx, requestBase, &baseEvent, batchSize, &batch, sr, result, labels)
+		labels.set()
+		if n > 0 && p.RecordBatchEvents {
+			mBatchEvents.record(n)
+		}
+		if checksum != nil {
+			// The events of streams with checksums are held, along with
+			// their in-flight bytes, until the checksum has been verified.
+			if n > 0 {
+				pending = append(pending, batch)
+			}
+			checksum.reserved += reserved
+		} else if n > 0 {
+			err := p.processBatch(ctx, processor, &batch, result)
+			p.limiter.release(reserved)
+			if err != nil {
 				return err
 			}
-			result.AddAccepted(len(batch))
+		} else {
+			p.limiter.release(reserved)
 		}
 		if readErr == io.EOF {
 			break
+		} else if limitErr := decompressionLimitError(readErr); limitErr != nil {
+			return newTerminalError(limitErr)
 		} else if readErr != nil {
 			return readErr
 		}
 	}
+	if checksum != nil {
+		if checksum.expected != nil {
+			if err := checksum.verify(); err != nil {
+				return err
+			}
+		}
+		for i := range pending {
+			if err := p.processBatch(ctx, processor, &pending[i], result); err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
 
-// getStreamReader returns a streamReader that reads ND-JSON lines from r.
+// withoutSemaphore calls f with the semaphore held by the calling stream
+// released, so that other streams can be read while f waits, re-acquiring
+// it before returning. The semaphore is re-acquired even if the stream's
+// context is done, as it is released when HandleStream returns.
+func (p *Processor) withoutSemaphore(f func()) {
+	<-p.sem
+	defer func() { p.sem <- struct{}{} }()
+	f()
+}
+
+// processBatch processes the events of batch, recording them in result
+// as accepted if successful, and reporting progress to HandleStreamChan's
+// caller.
+func (p *Processor) processBatch(ctx context.Context, processor model.BatchProcessor, batch *model.Batch, result *Result) error {
+	// NOTE(axw) ProcessBatch takes ownership of batch, which means we cannot reuse
+	// the slice memory. We should investigate alternative interfaces between the
+	// processor and publisher which would enable better memory reuse, e.g. by using
+	// a sync.Pool for creating batches, and having the publisher (terminal processor)
+	// release batches back into the pool.
+	if transform := batchTransformFromContext(ctx); transform != nil {
+		transform(batch)
+		if len(*batch) == 0 {
+			return nil
+		}
+	}
+	accepted := p.Stats.countEventTypes(*batch)
+	if policy, ok := retryPolicyFromContext(ctx); ok {
+		ctx = p.contextWithRetry(ctx, policy)
+	}
+	if err := processor.ProcessBatch(ctx, batch); err != nil {
+		return newTerminalError(err)
+	}
+	result.AddAccepted(len(*batch))
+	p.Stats.recordAccepted(accepted)
+	reportProgress(ctx, result)
+	return nil
+}
+
+// getStreamReader returns a streamReader that reads lines from r.
 func (p *Processor) getStreamReader(r io.Reader) *streamReader {
 	if sr, ok := p.streamReaderPool.Get().(*streamReader); ok {
 		sr.Reset(r)
 		return sr
 	}
+	bufferSize := p.MaxEventSize
+	if n := p.maxMetadataSize(); n > bufferSize {
+		bufferSize = n
+	}
+	newStreamDecoder := p.NewStreamDecoder
+	if newStreamDecoder == nil {
+		newStreamDecoder = newNDJSONStreamDecoder
+	}
 	return &streamReader{
-		processor:           p,
-		NDJSONStreamDecoder: decoder.NewNDJSONStreamDecoder(r, p.MaxEventSize),
+		processor:     p,
+		StreamDecoder: newStreamDecoder(r, p.MaxEventSize, bufferSize),
+	}
+}
+
+// maxMetadataSize returns the maximum size of the metadata line.
+func (p *Processor) maxMetadataSize() int {
+	if p.MaxMetadataSize > 0 {
+		return p.MaxMetadataSize
 	}
+	return p.MaxEventSize
 }
 
-// streamReader wraps NDJSONStreamReader, converting errors to stream errors.
+// decompressionLimitError returns the *decoder.DecompressionLimitError in
+// err's chain, which may be wrapped in a modeldecoder.DecoderError, or nil.
+func decompressionLimitError(err error) error {
+	if decoderErr, ok := err.(modeldecoder.DecoderError); ok {
+		err = decoderErr.Unwrap()
+	}
+	var limitErr *decoder.DecompressionLimitError
+	if errors.As(err, &limitErr) {
+		return limitErr
+	}
+	return nil
+}
+
+// requestBytesReader is implemented by readers which report the number of
+// bytes read from an underlying request body, such as the decompressing
+// readers returned by decoder.CompressedRequestReader.
+type requestBytesReader interface {
+	RequestBytesRead() int64
+}
+
+// streamReader wraps a StreamDecoder, converting errors to stream errors.
 type streamReader struct {
 	processor *Processor
-	*decoder.NDJSONStreamDecoder
+	StreamDecoder
+
+	// checksum is set when the processor's VerifyChecksum field is true.
+	checksum *streamChecksum
+
+	// warn records warnings in the stream's result. It is set once
+	// per stream, and shared by the decoder input of each event.
+	warn func(code, message string)
+
+	// unread is set when the latest line has been read ahead,
+	// but must be returned again by the next call to readAhead.
+	unread bool
 }
 
 // release releases the streamReader, adding it to its Processor's sync.Pool.
 // The streamReader must not be used after release returns.
 func (sr *streamReader) release() {
 	sr.Reset(nil)
+	sr.unread = false
+	sr.checksum = nil
+	sr.warn = nil
 	sr.processor.streamReaderPool.Put(sr)
 }
 
+// readAhead returns the latest line if it was unread, and otherwise
+// reads the next line and records it in result.
+func (sr *streamReader) readAhead(result *Result) ([]byte, error) {
+	if sr.unread {
+		sr.unread = false
+		return sr.LatestLine(), nil
+	}
+	line, err := sr.ReadAhead()
+	if n := sr.LatestLineLength(); n > 0 || err == nil {
+		// Reaching the end of the stream, or failing
+		// to read from it, does not constitute a line.
+		result.addLine(n)
+	}
+	return line, err
+}
+
+// isBlank reads the remaining lines of the stream, reporting whether they,
+// and the latest line, hold only whitespace. Reading stops at the first
+// line holding anything else.
+func (sr *streamReader) isBlank(result *Result) bool {
+	for {
+		line := sr.LatestLine()
+		if len(line) != sr.LatestLineLength() || len(bytes.TrimSpace(line)) != 0 {
+			return false
+		}
+		if sr.IsEOF() {
+			return true
+		}
+		if _, err := sr.readAhead(result); err != nil && err != io.EOF {
+			return false
+		}
+	}
+}
+
+// unreadLine causes the next call to readAhead to return the latest line.
+// The line must not have been decoded.
+func (sr *streamReader) unreadLine() {
+	sr.unread = true
+}
+
+// isEOF reports whether the underlying reader reached the end, and
+// there is no unread line remaining.
+func (sr *streamReader) isEOF() bool {
+	return !sr.unread && sr.IsEOF()
+}
+
+// document returns line as an InvalidInputError.Document, truncated
+// according to the processor's MaxDocumentLength.
+func (sr *streamReader) document(line []byte) string {
+	return truncateDocument(line, sr.processor.maxDocumentLength())
+}
+
 func (sr *streamReader) wrapError(err error) error {
 	if err == nil {
 		return nil
 	}
+	if !errors.Is(err, decoder.ErrLineTooLong) {
+		if truncated := sr.truncatedError(); truncated != nil {
+			return truncated
+		}
+	}
+	var shortBody *decoder.BodyShorterThanContentLengthError
+	if errors.As(err, &shortBody) {
+		return &InvalidInputError{
+			Message:  shortBody.Error(),
+			Document: sr.document(sr.LatestLine()),
+		}
+	}
 	if _, ok := err.(decoder.JSONDecodeError); ok {
 		return &InvalidInputError{
 			Message:  err.Error(),
-			Document: string(sr.LatestLine()),
+			Document: sr.document(sr.LatestLine()),
 		}
 	}
 
@@ -304,21 +1236,30 @@ func (sr *streamReader) wrapError(err error) error {
 		return &InvalidInputError{
 			TooLarge: true,
 			Message:  "event exceeded the permitted size.",
-			Document: string(sr.LatestLine()),
+			Document: sr.document(sr.LatestLine()),
 		}
 	}
 	return err
 }
 
-// copyEvent returns a shallow copy of the APMEvent with a deep copy of the
-// labels and numeric labels.
-func copyEvent(e model.APMEvent) model.APMEvent {
-	var out = e
-	if out.Labels != nil {
-		out.Labels = out.Labels.Clone()
+// truncatedError returns an InvalidInputError describing a truncated event
+// if the stream ended in the middle of the latest line, and otherwise nil.
+// The stream is considered to have ended mid-event if the latest line has no
+// terminating newline and holds incomplete JSON; a line that is complete but
+// malformed is not considered truncated.
+func (sr *streamReader) truncatedError() *InvalidInputError {
+	line := sr.LatestLine()
+	if !sr.isEOF() || len(line) == 0 {
+		return nil
+	}
+	var raw json.RawMessage
+	if err := json.NewDecoder(bytes.NewReader(line)).Decode(&raw); err != io.ErrUnexpectedEOF {
+		return nil
 	}
-	if out.NumericLabels != nil {
-		out.NumericLabels = out.NumericLabels.Clone()
+	return &InvalidInputError{
+		Message:   fmt.Sprintf("event truncated: unexpected EOF after reading %d bytes", len(line)),
+		Document:  sr.document(line),
+		Truncated: true,
+		BytesRead: len(line),
 	}
-	return out
 }
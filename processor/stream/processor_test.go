@@ -19,23 +19,41 @@ package stream
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"reflect"
+	"runtime/pprof"
 	"strings"
+	"sync"
 	"testing"
 	"testing/iotest"
 	"time"
+	"unicode/utf8"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.elastic.co/apm/v2/apmtest"
+	apmmodel "go.elastic.co/apm/v2/model"
+	"golang.org/x/time/rate"
 
 	"github.com/elastic/apm-server/approvaltest"
+	"github.com/elastic/apm-server/beater/auth"
 	"github.com/elastic/apm-server/beater/config"
+	"github.com/elastic/apm-server/beater/ratelimit"
+	"github.com/elastic/apm-server/decoder"
 	"github.com/elastic/apm-server/model"
 	"github.com/elastic/apm-server/model/modelindexer/modelindexertest"
+	"github.com/elastic/apm-server/model/modelprocessor"
 	"github.com/elastic/apm-server/publish"
 )
 
@@ -51,12 +69,15 @@ func TestHandlerReadStreamError(t *testing.T) {
 	require.NoError(t, err)
 	timeoutReader := iotest.TimeoutReader(bytes.NewReader(payload))
 
-	sp := BackendProcessor(&config.Config{MaxEventSize: 100 * 1024}, make(chan struct{}, 1))
+	sp := BackendProcessor(&config.Config{MaxEventSize: 100 * 1024}, make(chan struct{}, 1), nil)
 
 	var actualResult Result
 	err = sp.HandleStream(context.Background(), model.APMEvent{}, timeoutReader, 10, processor, &actualResult)
 	assert.EqualError(t, err, "timeout")
-	assert.Equal(t, Result{Accepted: accepted}, actualResult)
+	expected := lineResult(string(payload))
+	expected.Accepted = accepted
+	expected.BytesRead = int64(len(payload))
+	assert.Equal(t, expected, actualResult)
 }
 
 func TestHandlerReportingStreamError(t *testing.T) {
@@ -73,7 +94,7 @@ func TestHandlerReportingStreamError(t *testing.T) {
 		name: "QueueFull",
 		err:  publish.ErrFull,
 	}} {
-		sp := BackendProcessor(&config.Config{MaxEventSize: 100 * 1024}, make(chan struct{}, 1))
+		sp := BackendProcessor(&config.Config{MaxEventSize: 100 * 1024}, make(chan struct{}, 1), nil)
 		processor := model.ProcessBatchFunc(func(context.Context, *model.Batch) error {
 			return test.err
 		})
@@ -83,8 +104,11 @@ func TestHandlerReportingStreamError(t *testing.T) {
 			context.Background(), model.APMEvent{},
 			bytes.NewReader(payload), 10, processor, &actualResult,
 		)
-		assert.Equal(t, test.err, err)
-		assert.Zero(t, actualResult)
+		assert.Equal(t, &TerminalError{Kind: TerminalErrorInternal, Err: test.err}, err)
+		assert.ErrorIs(t, err, test.err)
+		expected := lineResult(string(payload))
+		expected.BytesRead = int64(len(payload))
+		assert.Equal(t, expected, actualResult)
 	}
 }
 
@@ -112,6 +136,9 @@ func TestIntegrationESOutput(t *testing.T) {
 	}, {
 		name: "Events",
 		path: "events.ndjson",
+	}, {
+		name: "Profiles",
+		path: "profile.ndjson",
 	}, {
 		name: "MinimalService",
 		path: "minimal-service.ndjson",
@@ -127,6 +154,9 @@ func TestIntegrationESOutput(t *testing.T) {
 	}, {
 		name: "SpanLinks",
 		path: "span-links.ndjson",
+	}, {
+		name: "MobileNetwork",
+		path: "metadata-mobile.ndjson",
 	}, {
 		name: "InvalidEvent",
 		path: "invalid-event.ndjson",
@@ -190,15 +220,22 @@ func TestIntegrationESOutput(t *testing.T) {
 				Timestamp: reqTimestamp,
 			}
 
-			p := BackendProcessor(&config.Config{MaxEventSize: 100 * 1024}, make(chan struct{}, 1))
+			p := BackendProcessor(&config.Config{MaxEventSize: 100 * 1024}, make(chan struct{}, 1), nil)
 			var actualResult Result
 			err = p.HandleStream(context.Background(), baseEvent, bytes.NewReader(payload), 10, batchProcessor, &actualResult)
+			var expected Result
 			if test.err != nil {
 				assert.Equal(t, test.err, err)
+				// Only the metadata line is read.
+				expected = lineResult(strings.SplitN(string(payload), "\n", 2)[0])
+				// The small payload is read in full by the buffered reader.
+				expected.BytesRead = int64(len(payload))
 			} else {
 				require.NoError(t, err)
+				expected = lineResult(string(payload))
 			}
-			assert.Equal(t, Result{Accepted: accepted, Errors: test.errors}, actualResult)
+			expected.Accepted, expected.Errors = accepted, test.errors
+			assert.Equal(t, expected, actualResult)
 		})
 	}
 }
@@ -227,11 +264,13 @@ func TestIntegrationRum(t *testing.T) {
 				Timestamp: reqTimestamp,
 			}
 
-			p := RUMV2Processor(&config.Config{MaxEventSize: 100 * 1024}, make(chan struct{}, 1))
+			p := RUMV2Processor(&config.Config{MaxEventSize: 100 * 1024}, make(chan struct{}, 1), nil)
 			var actualResult Result
 			err = p.HandleStream(context.Background(), baseEvent, bytes.NewReader(payload), 10, batchProcessor, &actualResult)
 			require.NoError(t, err)
-			assert.Equal(t, Result{Accepted: accepted}, actualResult)
+			expected := lineResult(string(payload))
+			expected.Accepted = accepted
+			assert.Equal(t, expected, actualResult)
 		})
 	}
 }
@@ -260,15 +299,377 @@ func TestRUMV3(t *testing.T) {
 				Timestamp: reqTimestamp,
 			}
 
-			p := RUMV3Processor(&config.Config{MaxEventSize: 100 * 1024}, make(chan struct{}, 1))
+			p := RUMV3Processor(&config.Config{MaxEventSize: 100 * 1024}, make(chan struct{}, 1), nil)
 			var actualResult Result
 			err = p.HandleStream(context.Background(), baseEvent, bytes.NewReader(payload), 10, batchProcessor, &actualResult)
 			require.NoError(t, err)
-			assert.Equal(t, Result{Accepted: accepted}, actualResult)
+			expected := lineResult(string(payload))
+			expected.Accepted = accepted
+			assert.Equal(t, expected, actualResult)
+		})
+	}
+}
+
+func TestRUMRejectsProfiles(t *testing.T) {
+	payload, err := os.ReadFile("../../testdata/intake-v2/profile.ndjson")
+	require.NoError(t, err)
+	lines := strings.SplitN(string(payload), "\n", 2)
+	profiles := lines[1]
+
+	for name, test := range map[string]struct {
+		newProcessor func(*config.Config, chan struct{}, *InFlightLimiter) *Processor
+		metadata     string
+	}{
+		"RUMV2": {newProcessor: RUMV2Processor, metadata: lines[0]},
+		"RUMV3": {newProcessor: RUMV3Processor, metadata: `{"m": {"se": {"n": "svc", "a": {"n": "js-base", "ve": "4.8.1"}}}}`},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var processed int
+			batchProcessor := model.ProcessBatchFunc(func(_ context.Context, b *model.Batch) error {
+				processed += len(*b)
+				return nil
+			})
+			p := test.newProcessor(&config.Config{MaxEventSize: 100 * 1024}, make(chan struct{}, 1), nil)
+			var result Result
+			err := p.HandleStream(context.Background(), model.APMEvent{}, strings.NewReader(test.metadata+"\n"+profiles), 10, batchProcessor, &result)
+			require.NoError(t, err)
+			assert.Zero(t, processed)
+			assert.Zero(t, result.Accepted)
+			require.Len(t, result.Errors, 2)
+			for _, err := range result.Errors {
+				assert.Contains(t, err.Error(), "did not recognize object type")
+			}
 		})
 	}
 }
 
+func TestTruncatedEvent(t *testing.T) {
+	const metadata = `{"metadata": {"service": {"name": "svc", "agent": {"name": "go", "version": "2.0.0"}}}}`
+	const transaction = `{"transaction": {"id": "88dee29a6571b948", "trace_id": "ba7f5d18ac4c7f39d1ff070c79b2bea5", "type": "request", "duration": 1, "span_count": {"started": 0}}}`
+
+	for name, test := range map[string]struct {
+		payload   string
+		accepted  int
+		truncated string
+	}{
+		"mid_string": {
+			payload:   metadata + "\n" + transaction + "\n" + `{"transaction": {"id": "88dee29a65`,
+			accepted:  1,
+			truncated: `{"transaction": {"id": "88dee29a65`,
+		},
+		"after_field": {
+			payload:   metadata + "\n" + `{"span": {"id": "88dee29a6571b948",`,
+			truncated: `{"span": {"id": "88dee29a6571b948",`,
+		},
+		"metadata": {
+			payload:   `{"metadata": {"service": {"name": "svc", "agent": {"na`,
+			truncated: `{"metadata": {"service": {"name": "svc", "agent": {"na`,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			p := BackendProcessor(&config.Config{MaxEventSize: 100 * 1024}, make(chan struct{}, 1), nil)
+			var result Result
+			err := p.HandleStream(context.Background(), model.APMEvent{}, strings.NewReader(test.payload), 10, modelprocessor.Nop{}, &result)
+			if err != nil {
+				result.Add(err)
+			}
+			assert.Equal(t, test.accepted, result.Accepted)
+			require.Len(t, result.Errors, 1)
+			var invalid *InvalidInputError
+			require.ErrorAs(t, result.Errors[0], &invalid)
+			assert.Equal(t, &InvalidInputError{
+				Message:   fmt.Sprintf("event truncated: unexpected EOF after reading %d bytes", len(test.truncated)),
+				Document:  test.truncated,
+				Truncated: true,
+				BytesRead: len(test.truncated),
+			}, invalid)
+		})
+	}
+
+	// Malformed events are not considered truncated, even
+	// if they are not followed by a newline.
+	for name, payload := range map[string]string{
+		"malformed_last_line":     metadata + "\n" + `{"transaction": {"id": "88dee29a65" "trace_id": "ba"}}`,
+		"incomplete_with_newline": metadata + "\n" + `{"transaction": {"id": "88dee29a65` + "\n" + transaction,
+	} {
+		t.Run(name, func(t *testing.T) {
+			p := BackendProcessor(&config.Config{MaxEventSize: 100 * 1024}, make(chan struct{}, 1), nil)
+			var result Result
+			err := p.HandleStream(context.Background(), model.APMEvent{}, strings.NewReader(payload), 10, modelprocessor.Nop{}, &result)
+			require.NoError(t, err)
+			require.Len(t, result.Errors, 1)
+			var invalid *InvalidInputError
+			require.ErrorAs(t, result.Errors[0], &invalid)
+			assert.False(t, invalid.Truncated)
+			assert.NotContains(t, invalid.Message, "truncated")
+		})
+	}
+}
+
+func TestServiceDenylist(t *testing.T) {
+	payload := `{"metadata": {"service": {"name": "svc", "environment": "prod", "agent": {"name": "go", "version": "2.0.0"}}}}
+{"transaction": {"id": "88dee29a6571b948", "trace_id": "ba7f5d18ac4c7f39d1ff070c79b2bea5", "type": "request", "duration": 1, "span_count": {"started": 0}}}`
+
+	denylist := &testServiceDenylist{}
+	p := BackendProcessor(&config.Config{MaxEventSize: 100 * 1024}, make(chan struct{}, 1), nil)
+	p.ServiceDenylist = denylist
+
+	// Disable and re-enable the service, as would be done
+	// dynamically through agent configuration.
+	for _, disabled := range []bool{false, true, false} {
+		denylist.disabled = disabled
+		var processed int
+		batchProcessor := model.ProcessBatchFunc(func(_ context.Context, b *model.Batch) error {
+			processed += len(*b)
+			return nil
+		})
+		var result Result
+		err := p.HandleStream(context.Background(), model.APMEvent{}, strings.NewReader(payload), 10, batchProcessor, &result)
+		assert.Equal(t, model.Service{Name: "svc", Environment: "prod"}, denylist.service)
+		if disabled {
+			assert.Equal(t, ErrServiceDisabled, err)
+			assert.Zero(t, processed)
+		} else {
+			assert.NoError(t, err)
+			assert.Equal(t, 1, processed)
+			assert.Equal(t, 1, result.Accepted)
+		}
+	}
+}
+
+type testServiceDenylist struct {
+	disabled bool
+	service  model.Service
+}
+
+func (d *testServiceDenylist) Denied(_ context.Context, name, environment string) bool {
+	d.service = model.Service{Name: name, Environment: environment}
+	return d.disabled
+}
+
+func TestDefaultLabels(t *testing.T) {
+	payload := `{"metadata": {"service": {"name": "svc", "agent": {"name": "go", "version": "2.0.0"}}, "labels": {"region": "eu", "owner": 1}}}
+{"span": {"id": "0000000000000001", "trace_id": "ba7f5d18ac4c7f39d1ff070c79b2bea5", "transaction_id": "88dee29a6571b948", "parent_id": "88dee29a6571b948", "name": "SELECT", "type": "db", "subtype": "postgresql", "duration": 1, "start": 0}}
+{"span": {"id": "0000000000000002", "trace_id": "ba7f5d18ac4c7f39d1ff070c79b2bea5", "transaction_id": "88dee29a6571b948", "parent_id": "88dee29a6571b948", "name": "SELECT", "type": "db", "subtype": "mysql", "duration": 1, "start": 0, "context": {"tags": {"owner": "agent"}}}}
+{"span": {"id": "0000000000000003", "trace_id": "ba7f5d18ac4c7f39d1ff070c79b2bea5", "transaction_id": "88dee29a6571b948", "parent_id": "88dee29a6571b948", "name": "GET", "type": "external", "subtype": "http", "duration": 1, "start": 0}}
+{"transaction": {"id": "88dee29a6571b948", "trace_id": "ba7f5d18ac4c7f39d1ff070c79b2bea5", "type": "db", "duration": 1, "span_count": {"started": 0}}}`
+
+	cfg := &config.Config{
+		MaxEventSize: 100 * 1024,
+		DefaultLabels: []config.DefaultLabelsConfig{{
+			Event:  "span",
+			Type:   "db",
+			Labels: map[string]string{"team": "data", "owner": "dba"},
+		}, {
+			Event:   "span",
+			Type:    "db",
+			Subtype: "postgresql",
+			Labels:  map[string]string{"database": "postgres"},
+		}},
+	}
+	p := BackendProcessor(cfg, make(chan struct{}, 1), nil)
+	var labels []model.Labels
+	batchProcessor := model.ProcessBatchFunc(func(_ context.Context, b *model.Batch) error {
+		for _, event := range *b {
+			labels = append(labels, event.Labels)
+		}
+		return nil
+	})
+	var result Result
+	err := p.HandleStream(context.Background(), model.APMEvent{}, strings.NewReader(payload), 10, batchProcessor, &result)
+	require.NoError(t, err)
+	// Labels set by the agent, including numeric labels, take precedence.
+	assert.Equal(t, []model.Labels{{
+		"region":   {Value: "eu"},
+		"team":     {Value: "data"},
+		"database": {Value: "postgres"},
+	}, {
+		"region": {Value: "eu"},
+		"team":   {Value: "data"},
+		"owner":  {Value: "agent"},
+	}, {
+		"region": {Value: "eu"},
+	}, {
+		"region": {Value: "eu"},
+	}}, labels)
+}
+
+func TestIntakeStats(t *testing.T) {
+	payload := `{"metadata": {"service": {"name": "svc", "agent": {"name": "go", "version": "2.0.0"}}}}
+{"span": {"id": "0000000000000001", "trace_id": "ba7f5d18ac4c7f39d1ff070c79b2bea5", "transaction_id": "88dee29a6571b948", "parent_id": "88dee29a6571b948", "name": "SELECT", "type": "db", "duration": 1, "start": 0}}
+{"span": {"id": "0000000000000002", "trace_id": "ba7f5d18ac4c7f39d1ff070c79b2bea5", "transaction_id": "88dee29a6571b948", "parent_id": "88dee29a6571b948", "name": "SELECT", "type": "db", "duration": 1, "start": 0}}
+{"span": {"id": "0000000000000003"}}
+{"transaction": {"id": "88dee29a6571b948", "trace_id": "ba7f5d18ac4c7f39d1ff070c79b2bea5", "type": "db", "duration": 1, "span_count": {"started": 0}}}
+{"unknown": {}}
+`
+	p := BackendProcessor(&config.Config{MaxEventSize: 100 * 1024}, make(chan struct{}, 1), nil)
+	p.Stats = NewIntakeStatsRecorder()
+	for i := 0; i < 2; i++ {
+		var result Result
+		err := p.HandleStream(context.Background(), model.APMEvent{}, strings.NewReader(payload), 10, modelprocessor.Nop{}, &result)
+		require.NoError(t, err)
+		require.Len(t, result.Errors, 2)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	statsCh := make(chan IntakeStats)
+	go p.Stats.Run(ctx, 10*time.Millisecond, func(stats IntakeStats) {
+		select {
+		case statsCh <- stats:
+		case <-ctx.Done():
+		}
+	})
+
+	stats := <-statsCh
+	assert.Greater(t, stats.Interval, time.Duration(0))
+	assert.Equal(t, map[string]int64{"span": 4, "transaction": 2}, stats.Accepted)
+	assert.Equal(t, map[string]int64{"span": 2, "unknown": 2}, stats.Rejected)
+	assert.Equal(t, int64(2*len(payload)), stats.Bytes)
+	assert.Equal(t, int64(2), stats.Streams)
+	assert.Greater(t, stats.Latency.P50, time.Duration(0))
+	assert.GreaterOrEqual(t, stats.Latency.P95, stats.Latency.P50)
+	assert.GreaterOrEqual(t, stats.Latency.P99, stats.Latency.P95)
+
+	// Statistics are reset after each invocation of the callback.
+	stats = <-statsCh
+	assert.Empty(t, stats.Accepted)
+	assert.Empty(t, stats.Rejected)
+	assert.Zero(t, stats.Bytes)
+	assert.Zero(t, stats.Streams)
+	assert.Zero(t, stats.Latency)
+}
+
+func TestWhitespaceLines(t *testing.T) {
+	payload := "{\"metadata\": {\"service\": {\"name\": \"svc\", \"agent\": {\"name\": \"go\", \"version\": \"2.0.0\"}}}}\n" +
+		"\n" +
+		" \t \r\n" +
+		`{"transaction": {"id": "88dee29a6571b948", "trace_id": "ba7f5d18ac4c7f39d1ff070c79b2bea5", "type": "request", "duration": 1, "span_count": {"started": 0}}}` + "\n" +
+		"    \n"
+
+	for policy, expectedErrors := range map[string][]error{
+		config.IntakeWhitespaceLinesSkip: nil,
+		config.IntakeWhitespaceLinesReject: {
+			&InvalidInputError{Message: "invalid event: empty line"},
+			&InvalidInputError{Message: "invalid event: line holds only whitespace", Document: " \t \r"},
+			&InvalidInputError{Message: "invalid event: line holds only whitespace", Document: "    "},
+		},
+	} {
+		t.Run(policy, func(t *testing.T) {
+			cfg := &config.Config{
+				MaxEventSize: 100 * 1024,
+				Intake:       config.IntakeConfig{WhitespaceLines: policy},
+			}
+			p := BackendProcessor(cfg, make(chan struct{}, 1), nil)
+			var result Result
+			err := p.HandleStream(context.Background(), model.APMEvent{}, strings.NewReader(payload), 10, modelprocessor.Nop{}, &result)
+			require.NoError(t, err)
+			assert.Equal(t, 1, result.Accepted)
+			assert.Equal(t, expectedErrors, result.Errors)
+
+			// Empty and whitespace-only lines are always counted as seen.
+			lines, size := countLines(payload)
+			assert.Equal(t, 5, lines)
+			assert.Equal(t, lines, result.LinesSeen)
+			assert.Equal(t, size, result.BytesSeen)
+		})
+	}
+}
+
+func TestMaxBufferedEvents(t *testing.T) {
+	for maxBuffered, expectedBatchSizes := range map[int][]int{
+		0:  {5},
+		2:  {2, 2, 1},
+		5:  {5},
+		10: {5},
+	} {
+		cfg := &config.Config{
+			MaxEventSize: 100 * 1024,
+			Intake:       config.IntakeConfig{MaxBufferedEvents: maxBuffered},
+		}
+		p := BackendProcessor(cfg, make(chan struct{}, 1), nil)
+
+		var batchSizes []int
+		batchProcessor := model.ProcessBatchFunc(func(ctx context.Context, b *model.Batch) error {
+			batchSizes = append(batchSizes, len(*b))
+			return nil
+		})
+		var result Result
+		err := p.HandleStream(context.Background(), model.APMEvent{}, strings.NewReader(limiterTestPayload(5)), 10, batchProcessor, &result)
+		require.NoError(t, err)
+		expected := lineResult(limiterTestPayload(5))
+		expected.Accepted = 5
+		assert.Equal(t, expected, result)
+		assert.Equal(t, expectedBatchSizes, batchSizes, "max buffered events %d", maxBuffered)
+	}
+}
+
+func TestMaxBufferedEventsMultipleEventsPerLine(t *testing.T) {
+	payload, err := os.ReadFile("../../testdata/intake-v2/profile.ndjson")
+	require.NoError(t, err)
+
+	// Each profile line decodes to many samples, so the batch
+	// is flushed after each line once the mark is reached.
+	cfg := &config.Config{
+		MaxEventSize: 100 * 1024,
+		Intake:       config.IntakeConfig{MaxBufferedEvents: 1},
+	}
+	p := BackendProcessor(cfg, make(chan struct{}, 1), nil)
+
+	var batchSizes []int
+	batchProcessor := model.ProcessBatchFunc(func(ctx context.Context, b *model.Batch) error {
+		batchSizes = append(batchSizes, len(*b))
+		return nil
+	})
+	var result Result
+	err = p.HandleStream(context.Background(), model.APMEvent{}, bytes.NewReader(payload), 10, batchProcessor, &result)
+	require.NoError(t, err)
+	assert.Len(t, batchSizes, bytes.Count(bytes.TrimSpace(payload), []byte("\n")))
+	for _, n := range batchSizes {
+		assert.Greater(t, n, 1)
+	}
+}
+
+func TestWarnings(t *testing.T) {
+	payload := `{"metadata": {"service": {"name": "svc", "agent": {"name": "go", "version": "2.0.0"}}}}
+{"transaction": {"id": "88dee29a6571b948", "trace_id": "ba7f5d18ac4c7f39d1ff070c79b2bea5", "name": "GET /foo", "type": "request", "duration": 1, "span_count": {"started": 0}, "context": {"request": {"method": "GET", "cookies": {"a": "1", "b": "2", "c": "3"}}}}}
+{"transaction": {"id": "88dee29a6571b949", "trace_id": "ba7f5d18ac4c7f39d1ff070c79b2bea5", "name": "GET /bar", "type": "request", "duration": 1, "span_count": {"started": 0}}}
+{"transaction": {"id": "88dee29a6571b950", "trace_id": "ba7f5d18ac4c7f39d1ff070c79b2bea5", "name": "GET", "type": "request", "duration": 1, "span_count": {"started": 0}}}
+`
+	cfg := &config.Config{
+		MaxEventSize: 100 * 1024,
+		Cookies:      config.CookiesConfig{Max: 2},
+		Transaction:  config.TransactionConfig{MaxNameLength: 5},
+	}
+	p := BackendProcessor(cfg, make(chan struct{}, 1), nil)
+	var names []string
+	batchProcessor := model.ProcessBatchFunc(func(ctx context.Context, b *model.Batch) error {
+		for _, event := range *b {
+			names = append(names, event.Transaction.Name)
+		}
+		return nil
+	})
+	var result Result
+	err := p.HandleStream(context.Background(), model.APMEvent{}, strings.NewReader(payload), 10, batchProcessor, &result)
+	require.NoError(t, err)
+
+	// Names are truncated before the events are processed.
+	assert.Equal(t, []string{"GET …", "GET …", "GET"}, names)
+
+	// Warnings do not cause events to be rejected.
+	assert.Equal(t, 3, result.Accepted)
+	assert.Empty(t, result.Errors)
+	assert.Equal(t, []Warning{{
+		Code:    "cookies_truncated",
+		Message: "HTTP request cookies limited to 2 of 3",
+		Count:   1,
+	}, {
+		Code:    WarningTransactionTruncated,
+		Message: "transaction name or type exceeds the maximum length and was truncated",
+		Count:   2,
+	}}, result.Warnings)
+}
+
 func TestLabelLeak(t *testing.T) {
 	payload := `{"metadata": {"service": {"name": "testsvc", "environment": "staging", "version": null, "agent": {"name": "python", "version": "6.9.1"}, "language": {"name": "python", "version": "3.10.4"}, "runtime": {"name": "CPython", "version": "3.10.4"}, "framework": {"name": "flask", "version": "2.1.1"}}, "process": {"pid": 2112739, "ppid": 2112738, "argv": ["/home/stuart/workspace/sdh/581/venv/lib/python3.10/site-packages/flask/__main__.py", "run"], "title": null}, "system": {"hostname": "slaptop", "architecture": "x86_64", "platform": "linux"}, "labels": {"ci_commit": "unknown", "numeric": 1}}}
 {"transaction": {"id": "88dee29a6571b948", "trace_id": "ba7f5d18ac4c7f39d1ff070c79b2bea5", "name": "GET /withlabels", "type": "request", "duration": 1.6199999999999999, "result": "HTTP 2xx", "timestamp": 1652185276804681, "outcome": "success", "sampled": true, "span_count": {"started": 0, "dropped": 0}, "sample_rate": 1.0, "context": {"request": {"env": {"REMOTE_ADDR": "127.0.0.1", "SERVER_NAME": "127.0.0.1", "SERVER_PORT": "5000"}, "method": "GET", "socket": {"remote_address": "127.0.0.1"}, "cookies": {}, "headers": {"host": "localhost:5000", "user-agent": "curl/7.81.0", "accept": "*/*", "app-os": "Android", "content-type": "application/json; charset=utf-8", "content-length": "29"}, "url": {"full": "http://localhost:5000/withlabels?second_with_labels", "protocol": "http:", "hostname": "localhost", "pathname": "/withlabels", "port": "5000", "search": "?second_with_labels"}}, "response": {"status_code": 200, "headers": {"Content-Type": "application/json", "Content-Length": "14"}}, "tags": {"appOs": "Android", "email_set": "hello@hello.com", "time_set": 1652185276}}}}
@@ -284,7 +685,7 @@ func TestLabelLeak(t *testing.T) {
 		return nil
 	})
 
-	p := BackendProcessor(&config.Config{MaxEventSize: 100 * 1024}, make(chan struct{}, 1))
+	p := BackendProcessor(&config.Config{MaxEventSize: 100 * 1024}, make(chan struct{}, 1), nil)
 	var actualResult Result
 	err := p.HandleStream(context.Background(), baseEvent, strings.NewReader(payload), 10, batchProcessor, &actualResult)
 	require.NoError(t, err)
@@ -307,17 +708,1734 @@ func TestLabelLeak(t *testing.T) {
 	assert.Equal(t, model.Labels{"ci_commit": {Value: "unknown"}}, txs[1].Labels)
 }
 
+func TestLabelsCopyOnWrite(t *testing.T) {
+	payload := `{"metadata": {"service": {"name": "svc", "agent": {"name": "go", "version": "2.0.0"}}, "labels": {"region": "eu", "owner": 1}}}
+{"span": {"id": "0000000000000001", "trace_id": "ba7f5d18ac4c7f39d1ff070c79b2bea5", "transaction_id": "88dee29a6571b948", "parent_id": "88dee29a6571b948", "name": "SELECT", "type": "db", "duration": 1, "start": 0}}
+{"span": {"id": "0000000000000002", "trace_id": "ba7f5d18ac4c7f39d1ff070c79b2bea5", "transaction_id": "88dee29a6571b948", "parent_id": "88dee29a6571b948", "name": "SELECT", "type": "db", "duration": 1, "start": 0, "context": {"tags": {"owner": "agent"}}}}
+{"span": {"id": "0000000000000003", "trace_id": "ba7f5d18ac4c7f39d1ff070c79b2bea5", "transaction_id": "88dee29a6571b948", "parent_id": "88dee29a6571b948", "name": "SELECT", "type": "db", "duration": 1, "start": 0}}`
+
+	var processed model.Batch
+	batchProcessor := model.ProcessBatchFunc(func(_ context.Context, b *model.Batch) error {
+		processed = append(processed, *b...)
+		return nil
+	})
+	p := BackendProcessor(&config.Config{MaxEventSize: 100 * 1024}, make(chan struct{}, 1), nil)
+	var result Result
+	err := p.HandleStream(context.Background(), model.APMEvent{}, strings.NewReader(payload), 10, batchProcessor, &result)
+	require.NoError(t, err)
+	require.Len(t, processed, 3)
+
+	// Events which do not modify the metadata labels share them.
+	assert.Equal(t, model.Labels{"region": {Value: "eu"}}, processed[0].Labels)
+	assert.Equal(t, reflect.ValueOf(processed[0].Labels).Pointer(), reflect.ValueOf(processed[2].Labels).Pointer())
+	assert.Equal(t, reflect.ValueOf(processed[0].NumericLabels).Pointer(), reflect.ValueOf(processed[2].NumericLabels).Pointer())
+
+	// Events which modify labels get their own copy.
+	assert.Equal(t, model.Labels{"region": {Value: "eu"}, "owner": {Value: "agent"}}, processed[1].Labels)
+	assert.NotEqual(t, reflect.ValueOf(processed[0].Labels).Pointer(), reflect.ValueOf(processed[1].Labels).Pointer())
+	assert.Equal(t, model.NumericLabels{"owner": {Value: 1}}, processed[1].NumericLabels)
+}
+
+func TestRejectedSizeMonitoring(t *testing.T) {
+	tooLarge := mRejectedSizes[transactionEventType][rejectedReasonTooLarge]
+	validation := mRejectedSizes[spanEventType][rejectedReasonValidation]
+	unknown := mRejectedSizes[unknownEventType][rejectedReasonValidation]
+	initialTooLargeCount, initialTooLargeBytes := tooLarge.count.Get(), tooLarge.sum.Get()
+	initialTooLargeBucket := tooLarge.buckets[1].Get() // le_10240
+	initialValidationCount, initialValidationBytes := validation.count.Get(), validation.sum.Get()
+	initialValidationBucket := validation.buckets[0].Get() // le_1024
+	initialUnknownCount := unknown.count.Get()
+
+	const maxEventSize = 5000
+	invalidSpan := `{"span": {"id": 12345}}`
+	unknownEvent := `{"tennis-court": {"name": "Centre Court, Wimbledon"}}`
+	tooLargeTransaction := `{"transaction": {"name": "` + strings.Repeat("x", 2*maxEventSize) + `"}}`
+	payload := strings.Join([]string{
+		`{"metadata": {"service": {"name": "testsvc", "agent": {"name": "go", "version": "1.0.0"}}}}`,
+		tooLargeTransaction,
+		invalidSpan,
+		unknownEvent,
+	}, "\n")
+
+	p := BackendProcessor(&config.Config{MaxEventSize: maxEventSize}, make(chan struct{}, 1), nil)
+	var actualResult Result
+	err := p.HandleStream(context.Background(), model.APMEvent{}, strings.NewReader(payload), 10, nopBatchProcessor{}, &actualResult)
+	require.NoError(t, err)
+	assert.Len(t, actualResult.Errors, 3)
+
+	assert.Equal(t, int64(1), tooLarge.count.Get()-initialTooLargeCount)
+	// The full size of the line is recorded, not just the bytes read before
+	// the line was found to exceed the maximum event size.
+	assert.Equal(t, int64(len(tooLargeTransaction)), tooLarge.sum.Get()-initialTooLargeBytes)
+	assert.Equal(t, int64(1), tooLarge.buckets[1].Get()-initialTooLargeBucket)
+
+	assert.Equal(t, int64(1), validation.count.Get()-initialValidationCount)
+	assert.Equal(t, int64(len(invalidSpan)), validation.sum.Get()-initialValidationBytes)
+	assert.Equal(t, int64(1), validation.buckets[0].Get()-initialValidationBucket)
+
+	assert.Equal(t, int64(1), unknown.count.Get()-initialUnknownCount)
+}
+
+const (
+	limiterTestMetadata    = `{"metadata": {"service": {"name": "testsvc", "agent": {"name": "go", "version": "1.0.0"}}}}`
+	limiterTestTransaction = `{"transaction": {"id": "0123456789abcdef", "trace_id": "0123456789abcdef0123456789abcdef", "name": "GET /", "type": "request", "duration": 1, "span_count": {"started": 0}}}`
+)
+
+// countLines returns the number of lines in payload, and their total
+// length excluding newlines, as recorded by Result.
+func countLines(payload string) (lines, size int) {
+	payload = strings.TrimSuffix(payload, "\n")
+	lines = strings.Count(payload, "\n") + 1
+	return lines, len(payload) - (lines - 1)
+}
+
+// lineResult returns a Result recording the lines of payload as read.
+func lineResult(payload string) Result {
+	var result Result
+	for _, line := range strings.Split(strings.TrimSuffix(payload, "\n"), "\n") {
+		result.addLine(len(line))
+	}
+	return result
+}
+
+func limiterTestPayload(numEvents int) string {
+	lines := []string{limiterTestMetadata}
+	for i := 0; i < numEvents; i++ {
+		lines = append(lines, limiterTestTransaction)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func TestInFlightLimiterManyStreams(t *testing.T) {
+	const (
+		numStreams = 50
+		numEvents  = 20
+		batchSize  = 5
+		limit      = 4 * len(limiterTestTransaction)
+	)
+	payload := limiterTestPayload(numEvents)
+
+	limiter := NewInFlightLimiter(int64(limit))
+	var maxInFlight int64
+	var mu sync.Mutex
+	batchProcessor := model.ProcessBatchFunc(func(ctx context.Context, b *model.Batch) error {
+		mu.Lock()
+		if n := limiter.InFlight(); n > maxInFlight {
+			maxInFlight = n
+		}
+		mu.Unlock()
+		time.Sleep(time.Millisecond)
+		return nil
+	})
+	p := BackendProcessor(&config.Config{MaxEventSize: 100 * 1024}, make(chan struct{}, numStreams), limiter)
+
+	var accepted, rejected int
+	var wg sync.WaitGroup
+	for i := 0; i < numStreams; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var result Result
+			err := p.HandleStream(context.Background(), model.APMEvent{}, strings.NewReader(payload), batchSize, batchProcessor, &result)
+			mu.Lock()
+			defer mu.Unlock()
+			if errors.Is(err, ErrInFlightLimitExceeded) {
+				assert.Zero(t, result.Accepted)
+				rejected++
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, numEvents, result.Accepted)
+			accepted++
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, numStreams, accepted+rejected)
+	assert.NotZero(t, accepted)
+	assert.NotZero(t, maxInFlight)
+	assert.LessOrEqual(t, maxInFlight, int64(limit))
+	assert.Zero(t, limiter.InFlight())
+}
+
+func TestInFlightLimiterSplitsBatch(t *testing.T) {
+	limiter := NewInFlightLimiter(int64(2 * len(limiterTestTransaction)))
+	p := BackendProcessor(&config.Config{MaxEventSize: 100 * 1024}, make(chan struct{}, 1), limiter)
+
+	var batchSizes []int
+	batchProcessor := model.ProcessBatchFunc(func(ctx context.Context, b *model.Batch) error {
+		batchSizes = append(batchSizes, len(*b))
+		return nil
+	})
+	var result Result
+	err := p.HandleStream(context.Background(), model.APMEvent{}, strings.NewReader(limiterTestPayload(5)), 10, batchProcessor, &result)
+	require.NoError(t, err)
+	// Lines read again after the limiter splits the batch are counted once.
+	expected := lineResult(limiterTestPayload(5))
+	expected.Accepted = 5
+	assert.Equal(t, expected, result)
+	assert.Equal(t, []int{2, 2, 1}, batchSizes)
+	assert.Zero(t, limiter.InFlight())
+}
+
+func TestInFlightLimiterEventTooLarge(t *testing.T) {
+	limiter := NewInFlightLimiter(int64(len(limiterTestTransaction) - 1))
+	p := BackendProcessor(&config.Config{MaxEventSize: 100 * 1024}, make(chan struct{}, 1), limiter)
+
+	var result Result
+	err := p.HandleStream(context.Background(), model.APMEvent{}, strings.NewReader(limiterTestPayload(2)), 10, nopBatchProcessor{}, &result)
+	require.NoError(t, err)
+	expected := lineResult(limiterTestPayload(2))
+	expected.Errors = []error{ErrInFlightLimitExceeded, ErrInFlightLimitExceeded}
+	assert.Equal(t, expected, result)
+	assert.Zero(t, limiter.InFlight())
+}
+
+func TestInFlightLimiterBlocksAndRejects(t *testing.T) {
+	limiter := NewInFlightLimiter(int64(len(limiterTestTransaction)))
+	p := BackendProcessor(&config.Config{MaxEventSize: 100 * 1024}, make(chan struct{}, 3), limiter)
+
+	processing := make(chan string, 2)
+	unblock := make(chan struct{})
+	defer close(unblock) // don't leave streams blocked if the test fails
+	batchProcessor := model.ProcessBatchFunc(func(ctx context.Context, b *model.Batch) error {
+		processing <- (*b)[0].Service.Name
+		<-unblock
+		return nil
+	})
+	handleStream := func(r io.Reader) <-chan error {
+		errs := make(chan error, 1)
+		go func() {
+			var result Result
+			errs <- p.HandleStream(context.Background(), model.APMEvent{}, r, 10, batchProcessor, &result)
+		}()
+		return errs
+	}
+	receive := func(t *testing.T, ch <-chan string) string {
+		t.Helper()
+		select {
+		case v := <-ch:
+			return v
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out waiting for batch to be processed")
+		}
+		panic("unreachable")
+	}
+	receiveErr := func(t *testing.T, ch <-chan error) error {
+		t.Helper()
+		select {
+		case err := <-ch:
+			return err
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out waiting for stream to be handled")
+		}
+		panic("unreachable")
+	}
+
+	// Start a stream, and wait for it to start reading its metadata. At
+	// this point it has passed the in-flight limit check for new streams,
+	// and will block reading until we write to the pipe.
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	reading := make(chan struct{})
+	var readingOnce sync.Once
+	blockedErrs := handleStream(readerFunc(func(b []byte) (int, error) {
+		readingOnce.Do(func() { close(reading) })
+		return pr.Read(b)
+	}))
+	select {
+	case <-reading:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for stream to start reading")
+	}
+
+	// Start another stream which reaches the in-flight limit,
+	// and blocks while its batch is being processed.
+	firstErrs := handleStream(strings.NewReader(limiterTestPayload(1)))
+	assert.Equal(t, "testsvc", receive(t, processing))
+	assert.Equal(t, int64(len(limiterTestTransaction)), limiter.InFlight())
+
+	// New streams are rejected while the limit is reached.
+	assert.Equal(t, ErrInFlightLimitExceeded, receiveErr(t, handleStream(strings.NewReader(limiterTestPayload(1)))))
+
+	// Already accepted streams block until the in-flight bytes are released.
+	go func() {
+		pw.Write([]byte(strings.Replace(limiterTestPayload(1), "testsvc", "blocked", 1)))
+		pw.Close()
+	}()
+	select {
+	case name := <-processing:
+		t.Fatalf("unexpected batch processed for %q", name)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	unblock <- struct{}{}
+	assert.NoError(t, receiveErr(t, firstErrs))
+	assert.Equal(t, "blocked", receive(t, processing))
+	unblock <- struct{}{}
+	assert.NoError(t, receiveErr(t, blockedErrs))
+	assert.Zero(t, limiter.InFlight())
+}
+
 func makeApproveEventsBatchProcessor(t *testing.T, name string, count *int) model.BatchProcessor {
 	return model.ProcessBatchFunc(func(ctx context.Context, b *model.Batch) error {
 		docs := modelindexertest.AppendEncodedBatch(t, nil, *b)
 		*count += len(docs)
-		approvaltest.ApproveEventDocs(t, name, docs)
+		// profile.id is a randomly generated UUID.
+		approvaltest.ApproveEventDocs(t, name, docs, "profile.id")
 		return nil
 	})
 }
 
+type readerFunc func([]byte) (int, error)
+
+func (f readerFunc) Read(b []byte) (int, error) {
+	return f(b)
+}
+
 type nopBatchProcessor struct{}
 
 func (nopBatchProcessor) ProcessBatch(context.Context, *model.Batch) error {
 	return nil
 }
+
+func TestShutdown(t *testing.T) {
+	processing := make(chan struct{})
+	release := make(chan struct{})
+	batchProcessor := model.ProcessBatchFunc(func(ctx context.Context, b *model.Batch) error {
+		close(processing)
+		<-release
+		return nil
+	})
+	p := BackendProcessor(&config.Config{MaxEventSize: 100 * 1024}, make(chan struct{}, 1), nil)
+
+	errs := make(chan error, 1)
+	go func() {
+		var result Result
+		errs <- p.HandleStream(context.Background(), model.APMEvent{}, strings.NewReader(limiterTestPayload(1)), 10, batchProcessor, &result)
+	}()
+	<-processing
+
+	// Shutdown waits for the in-flight stream until the context is done.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, p.Shutdown(ctx))
+
+	// New streams are rejected once Shutdown has been called.
+	var result Result
+	err := p.HandleStream(context.Background(), model.APMEvent{}, strings.NewReader(limiterTestPayload(1)), 10, batchProcessor, &result)
+	assert.Equal(t, ErrShuttingDown, err)
+	assert.Zero(t, result)
+
+	// The in-flight stream is allowed to complete.
+	close(release)
+	assert.NoError(t, p.Shutdown(context.Background()))
+	assert.NoError(t, <-errs)
+}
+
+func TestCapture(t *testing.T) {
+	payload := limiterTestPayload(2) + "\n{\"invalid-event\": {}}\n" + "not json\n"
+	p := BackendProcessor(&config.Config{MaxEventSize: 100 * 1024}, make(chan struct{}, 1), nil)
+
+	var capture bytes.Buffer
+	var result Result
+	ctx := ContextWithCapture(context.Background(), &capture)
+	err := p.HandleStream(ctx, model.APMEvent{}, strings.NewReader(payload), 10, modelprocessor.Nop{}, &result)
+	require.NoError(t, err)
+	assert.Equal(t, 2, result.Accepted)
+	assert.Len(t, result.Errors, 2)
+	assert.Equal(t, payload, capture.String())
+
+	// Write errors stop capturing, but do not affect stream processing.
+	result = Result{}
+	ctx = ContextWithCapture(context.Background(), errorWriter{})
+	err = p.HandleStream(ctx, model.APMEvent{}, strings.NewReader(payload), 10, modelprocessor.Nop{}, &result)
+	require.NoError(t, err)
+	assert.Equal(t, 2, result.Accepted)
+	assert.Len(t, result.Errors, 2)
+}
+
+type errorWriter struct{}
+
+func (errorWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("write failed")
+}
+
+func TestRejectEmptyLines(t *testing.T) {
+	payload := limiterTestMetadata + "\n\n" + limiterTestTransaction + "\n\n\n" + limiterTestTransaction + "\n"
+	for policy, expectedErrors := range map[string][]error{
+		config.IntakeWhitespaceLinesSkip: nil,
+		config.IntakeWhitespaceLinesReject: {
+			&InvalidInputError{Message: "invalid event: empty line"},
+			&InvalidInputError{Message: "invalid event: empty line"},
+			&InvalidInputError{Message: "invalid event: empty line"},
+		},
+	} {
+		cfg := &config.Config{
+			MaxEventSize: 100 * 1024,
+			Intake:       config.IntakeConfig{WhitespaceLines: policy},
+		}
+		p := BackendProcessor(cfg, make(chan struct{}, 1), nil)
+		var result Result
+		err := p.HandleStream(context.Background(), model.APMEvent{}, strings.NewReader(payload), 10, modelprocessor.Nop{}, &result)
+		require.NoError(t, err)
+		assert.Equal(t, 2, result.Accepted)
+		assert.Equal(t, expectedErrors, result.Errors)
+	}
+}
+
+func TestAcceptMetadataUpdates(t *testing.T) {
+	const metadata2 = `{"metadata": {"service": {"name": "svc2", "agent": {"name": "go", "version": "2.0.0"}}, "labels": {"b": "2"}}}`
+	payload := strings.Join([]string{
+		`{"metadata": {"service": {"name": "svc1", "agent": {"name": "go", "version": "2.0.0"}}, "labels": {"a": "1"}}}`,
+		limiterTestTransaction,
+		metadata2,
+		limiterTestTransaction,
+		`{"metadata": {"service": {}}}`,
+		limiterTestTransaction,
+	}, "\n")
+
+	t.Run("rejected", func(t *testing.T) {
+		p := BackendProcessor(&config.Config{MaxEventSize: 100 * 1024}, make(chan struct{}, 1), nil)
+		var result Result
+		err := p.HandleStream(context.Background(), model.APMEvent{}, strings.NewReader(payload), 10, modelprocessor.Nop{}, &result)
+		require.NoError(t, err)
+		assert.Equal(t, 3, result.Accepted)
+		require.Len(t, result.Errors, 2)
+		assert.Contains(t, result.Errors[0].Error(), errUnrecognizedObject.Error())
+	})
+
+	t.Run("accepted", func(t *testing.T) {
+		var events []model.APMEvent
+		batchProcessor := model.ProcessBatchFunc(func(ctx context.Context, batch *model.Batch) error {
+			events = append(events, *batch...)
+			return nil
+		})
+		p := BackendProcessor(&config.Config{MaxEventSize: 100 * 1024}, make(chan struct{}, 1), nil)
+		p.AcceptMetadataUpdates = true
+		baseEvent := model.APMEvent{Host: model.Host{IP: []net.IP{net.ParseIP("192.0.2.1")}}}
+		var result Result
+		err := p.HandleStream(context.Background(), baseEvent, strings.NewReader(payload), 2, batchProcessor, &result)
+		require.NoError(t, err)
+		assert.Equal(t, 3, result.Accepted)
+
+		// Invalid metadata is reported, leaving the previous metadata in place.
+		require.Len(t, result.Errors, 1)
+		assert.Contains(t, result.Errors[0].Error(), "validation error")
+
+		require.Len(t, events, 3)
+		for i, expected := range []struct {
+			service string
+			labels  model.Labels
+		}{
+			{service: "svc1", labels: model.Labels{"a": {Value: "1"}}},
+			{service: "svc2", labels: model.Labels{"b": {Value: "2"}}},
+			{service: "svc2", labels: model.Labels{"b": {Value: "2"}}},
+		} {
+			assert.Equal(t, expected.service, events[i].Service.Name)
+			assert.Equal(t, expected.labels, events[i].Labels)
+			assert.Equal(t, baseEvent.Host.IP, events[i].Host.IP)
+		}
+	})
+}
+
+func TestIdentifyEventType(t *testing.T) {
+	p := BackendProcessor(&config.Config{MaxEventSize: 100 * 1024}, make(chan struct{}, 1), nil)
+	for body, expected := range map[string]string{
+		`{"transaction": {}}`:     "transaction",
+		`{ 'span' : {}}`:          "span",
+		`{"tra\"nsaction": {}}`:   `tra\"nsaction`,
+		`{"tra\\": {}}`:           `tra\\`,
+		`{"span\": {}}`:           "",
+		`{"error`:                 "",
+		`{"error\`:                "",
+		`"`:                       "",
+		`{}`:                      "",
+		`{"": {}}`:                "",
+		"{\"metricset\xff\": {}}": "metricset\xff",
+	} {
+		assert.Equal(t, expected, string(p.identifyEventType([]byte(body))), body)
+	}
+}
+
+func TestMetadataEncoding(t *testing.T) {
+	utf16 := func(s string, bom bool) string {
+		var out []byte
+		if bom {
+			out = append(out, 0xFF, 0xFE)
+		}
+		for _, r := range s {
+			out = append(out, byte(r), 0)
+		}
+		return string(out)
+	}
+	for name, test := range map[string]struct {
+		payload string
+		message string
+	}{
+		"utf16_bom": {
+			payload: utf16(limiterTestMetadata, true),
+			message: "invalid input encoding: found a UTF-16 byte order mark, events must be UTF-8 encoded",
+		},
+		"utf16": {
+			payload: utf16(limiterTestMetadata, false),
+			message: "invalid input encoding: found null bytes, events must be UTF-8 encoded",
+		},
+		"utf8_bom": {
+			payload: "\xEF\xBB\xBF" + limiterTestMetadata,
+			message: "invalid input encoding: found a UTF-8 byte order mark, which is not permitted",
+		},
+		"latin1": {
+			payload: "{\"metadata\": {\"service\": {\"name\": \"caf\xe9\"}}}",
+			message: "invalid input encoding: events must be UTF-8 encoded",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			p := BackendProcessor(&config.Config{MaxEventSize: 100 * 1024}, make(chan struct{}, 1), nil)
+			var result Result
+			err := p.HandleStream(context.Background(), model.APMEvent{}, strings.NewReader(test.payload), 10, modelprocessor.Nop{}, &result)
+			var invalid *InvalidInputError
+			require.ErrorAs(t, err, &invalid)
+			assert.Equal(t, test.message, invalid.Message)
+		})
+	}
+
+	// Invalid UTF-8 beyond the inspected prefix is left to the decoder.
+	assert.Nil(t, checkEncoding([]byte(strings.Repeat(" ", encodingPrefixLength)+"\xe9"), DefaultMaxDocumentLength))
+	// A multi-byte character cut off by the end of the prefix is valid.
+	assert.Nil(t, checkEncoding([]byte(strings.Repeat(" ", encodingPrefixLength-1)+"é"), DefaultMaxDocumentLength))
+}
+
+func TestEventRateLimiter(t *testing.T) {
+	payload := limiterTestPayload(5)
+
+	t.Run("wait", func(t *testing.T) {
+		limiter := rate.NewLimiter(rate.Every(10*time.Millisecond), 1)
+		ctx := ContextWithEventRateLimiter(context.Background(), limiter)
+		p := BackendProcessor(&config.Config{MaxEventSize: 100 * 1024}, make(chan struct{}, 1), nil)
+		var result Result
+		start := time.Now()
+		err := p.HandleStream(ctx, model.APMEvent{}, strings.NewReader(payload), 10, modelprocessor.Nop{}, &result)
+		require.NoError(t, err)
+		assert.Equal(t, 5, result.Accepted)
+		assert.Empty(t, result.Errors)
+		assert.GreaterOrEqual(t, time.Since(start), 40*time.Millisecond)
+	})
+
+	t.Run("deadline", func(t *testing.T) {
+		limiter := rate.NewLimiter(rate.Every(time.Hour), 2)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		ctx = ContextWithEventRateLimiter(ctx, limiter)
+		p := BackendProcessor(&config.Config{MaxEventSize: 100 * 1024}, make(chan struct{}, 1), nil)
+		var result Result
+		err := p.HandleStream(ctx, model.APMEvent{}, strings.NewReader(payload), 10, modelprocessor.Nop{}, &result)
+		require.NoError(t, err)
+		assert.Equal(t, 2, result.Accepted)
+		assert.Equal(t, []error{
+			ErrEventRateLimitExceeded,
+			ErrEventRateLimitExceeded,
+			ErrEventRateLimitExceeded,
+		}, result.Errors)
+	})
+
+	t.Run("semaphore", func(t *testing.T) {
+		// Streams waiting for the limiter do not hold the semaphore,
+		// so other streams can be handled in the meantime.
+		sem := make(chan struct{}, 1)
+		p := BackendProcessor(&config.Config{MaxEventSize: 100 * 1024}, sem, nil)
+		limiter := rate.NewLimiter(rate.Every(time.Hour), 1)
+		ctx, cancel := context.WithCancel(ContextWithEventRateLimiter(context.Background(), limiter))
+		defer cancel()
+		processed := make(chan struct{}, len(payload))
+		batchProcessor := model.ProcessBatchFunc(func(context.Context, *model.Batch) error {
+			processed <- struct{}{}
+			return nil
+		})
+		done := make(chan Result, 1)
+		go func() {
+			var result Result
+			p.HandleStream(ctx, model.APMEvent{}, strings.NewReader(payload), 1, batchProcessor, &result)
+			done <- result
+		}()
+		// The first event is permitted, the second waits for the limiter.
+		<-processed
+		assert.Eventually(t, func() bool { return len(sem) == 0 }, 10*time.Second, time.Millisecond)
+
+		otherCtx, otherCancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer otherCancel()
+		var result Result
+		err := p.HandleStream(otherCtx, model.APMEvent{}, strings.NewReader(payload), 10, modelprocessor.Nop{}, &result)
+		require.NoError(t, err)
+		assert.Equal(t, 5, result.Accepted)
+
+		cancel()
+		result = <-done
+		assert.Equal(t, 1, result.Accepted)
+		assert.Empty(t, sem)
+	})
+}
+
+func TestBytesReadOnAbort(t *testing.T) {
+	payload := limiterTestPayload(1000)
+	processErr := errors.New("process failed")
+	batchProcessor := model.ProcessBatchFunc(func(context.Context, *model.Batch) error {
+		return processErr
+	})
+	p := BackendProcessor(&config.Config{MaxEventSize: 100 * 1024}, make(chan struct{}, 1), nil)
+	var result Result
+	err := p.HandleStream(context.Background(), model.APMEvent{}, strings.NewReader(payload), 1, batchProcessor, &result)
+	assert.ErrorIs(t, err, processErr)
+
+	// BytesRead covers at least the lines seen, including newlines,
+	// but not the whole payload.
+	assert.Equal(t, 2, result.LinesSeen)
+	assert.GreaterOrEqual(t, result.BytesRead, int64(result.BytesSeen+result.LinesSeen))
+	assert.Less(t, result.BytesRead, int64(len(payload)))
+
+	// For compressed request bodies, BytesRead counts the compressed
+	// bytes read from the request body.
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	zw.Write([]byte(payload))
+	zw.Close()
+	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(compressed.Bytes()))
+	req.Header.Set("Content-Encoding", "gzip")
+	reader, err := decoder.CompressedRequestReader(req)
+	require.NoError(t, err)
+	result = Result{}
+	err = p.HandleStream(context.Background(), model.APMEvent{}, reader, 1, batchProcessor, &result)
+	assert.ErrorIs(t, err, processErr)
+	assert.Equal(t, 2, result.LinesSeen)
+	assert.Greater(t, result.BytesRead, int64(0))
+	assert.LessOrEqual(t, result.BytesRead, int64(compressed.Len()))
+}
+
+func TestSamplingOverride(t *testing.T) {
+	payload := strings.Join([]string{
+		limiterTestMetadata,
+		`{"transaction": {"id": "88dee29a6571b948", "trace_id": "ba7f5d18ac4c7f39d1ff070c79b2bea5", "type": "request", "duration": 1, "span_count": {"started": 0}, "sampled": false, "sample_rate": 0.1}}`,
+		`{"transaction": {"id": "88dee29a6571b949", "trace_id": "ba7f5d18ac4c7f39d1ff070c79b2bea5", "type": "request", "duration": 1, "span_count": {"started": 0}, "sample_rate": 0.5}}`,
+		`{"span": {"id": "0aaaaaaaaaaaaaaa", "trace_id": "ba7f5d18ac4c7f39d1ff070c79b2bea5", "parent_id": "88dee29a6571b949", "transaction_id": "88dee29a6571b949", "name": "s", "type": "db", "start": 0, "duration": 1}}`,
+	}, "\n")
+
+	type sampling struct {
+		sampled             bool
+		representativeCount float64
+	}
+	for name, test := range map[string]struct {
+		override SamplingOverride
+		expected []sampling
+	}{
+		"none": {
+			expected: []sampling{{false, 10}, {true, 2}},
+		},
+		"force_sampled": {
+			override: SamplingOverrideFunc(func(*model.APMEvent) bool { return true }),
+			expected: []sampling{{true, 1}, {true, 2}},
+		},
+		"force_unsampled": {
+			override: SamplingOverrideFunc(func(*model.APMEvent) bool { return false }),
+			expected: []sampling{{false, 10}, {false, 2}},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var events []model.APMEvent
+			batchProcessor := model.ProcessBatchFunc(func(ctx context.Context, batch *model.Batch) error {
+				events = append(events, *batch...)
+				return nil
+			})
+			ctx := context.Background()
+			if test.override != nil {
+				ctx = ContextWithSamplingOverride(ctx, test.override)
+			}
+			p := BackendProcessor(&config.Config{MaxEventSize: 100 * 1024}, make(chan struct{}, 1), nil)
+			var result Result
+			err := p.HandleStream(ctx, model.APMEvent{}, strings.NewReader(payload), 10, batchProcessor, &result)
+			require.NoError(t, err)
+			require.Empty(t, result.Errors)
+
+			var actual []sampling
+			for _, event := range events {
+				if event.Processor == model.TransactionProcessor {
+					actual = append(actual, sampling{event.Transaction.Sampled, event.Transaction.RepresentativeCount})
+				} else {
+					// Only transaction events are affected.
+					assert.Equal(t, model.Transaction{ID: "88dee29a6571b949"}, *event.Transaction)
+				}
+			}
+			assert.Equal(t, test.expected, actual)
+		})
+	}
+}
+
+func TestMaxMetadataSize(t *testing.T) {
+	largeMetadata := `{"metadata": {"service": {"name": "svc", "agent": {"name": "go", "version": "2.0.0"}}, "labels": {"a": "` + strings.Repeat("x", 500) + `"}}}`
+	largeTransaction := `{"transaction": {"id": "88dee29a6571b948", "trace_id": "ba7f5d18ac4c7f39d1ff070c79b2bea5", "type": "` + strings.Repeat("x", 500) + `", "duration": 1, "span_count": {"started": 0}}}`
+
+	handle := func(maxEventSize, maxMetadataSize int, payload string) (Result, error) {
+		p := BackendProcessor(&config.Config{
+			MaxEventSize:    maxEventSize,
+			MaxMetadataSize: maxMetadataSize,
+		}, make(chan struct{}, 1), nil)
+		var result Result
+		err := p.HandleStream(context.Background(), model.APMEvent{}, strings.NewReader(payload), 10, modelprocessor.Nop{}, &result)
+		return result, err
+	}
+
+	t.Run("large_metadata", func(t *testing.T) {
+		payload := strings.Join([]string{largeMetadata, limiterTestTransaction, largeTransaction}, "\n")
+		result, err := handle(400, 1024, payload)
+		require.NoError(t, err)
+		assert.Equal(t, 1, result.Accepted)
+		require.Len(t, result.Errors, 1)
+		var invalidInput *InvalidInputError
+		require.True(t, errors.As(result.Errors[0], &invalidInput))
+		assert.True(t, invalidInput.TooLarge)
+	})
+
+	t.Run("metadata_too_large", func(t *testing.T) {
+		payload := strings.Join([]string{largeMetadata, largeTransaction}, "\n")
+		_, err := handle(1024, 400, payload)
+		var invalidInput *InvalidInputError
+		require.True(t, errors.As(err, &invalidInput))
+		assert.True(t, invalidInput.TooLarge)
+	})
+
+	t.Run("default", func(t *testing.T) {
+		payload := strings.Join([]string{largeMetadata, largeTransaction}, "\n")
+		result, err := handle(1024, 0, payload)
+		require.NoError(t, err)
+		assert.Equal(t, 1, result.Accepted)
+	})
+}
+
+func TestProfilerLabels(t *testing.T) {
+	goroutineLabels := func() string {
+		var buf bytes.Buffer
+		require.NoError(t, pprof.Lookup("goroutine").WriteTo(&buf, 1))
+		return buf.String()
+	}
+
+	var processLabels string
+	batchProcessor := model.ProcessBatchFunc(func(context.Context, *model.Batch) error {
+		processLabels = goroutineLabels()
+		return nil
+	})
+	ctx := ContextWithProfilerLabels(context.Background(), map[string]string{"tenant": "t1"})
+	p := BackendProcessor(&config.Config{MaxEventSize: 100 * 1024}, make(chan struct{}, 1), nil)
+	var result Result
+	err := p.HandleStream(ctx, model.APMEvent{}, strings.NewReader(limiterTestPayload(2)), 10, batchProcessor, &result)
+	require.NoError(t, err)
+	assert.Equal(t, 2, result.Accepted)
+
+	// The event type label is only set while decoding events.
+	assert.Contains(t, processLabels, `"tenant":"t1"`)
+	assert.NotContains(t, processLabels, `"event_type"`)
+	assert.NotContains(t, goroutineLabels(), `"tenant":"t1"`)
+
+	labels := newProfilerLabels(ctx)
+	require.NotNil(t, labels)
+	for eventType, expected := range map[string]string{
+		"transaction": "transaction",
+		"x":           "x",
+		"foo":         "unknown",
+	} {
+		labels.setEventType([]byte(eventType))
+		assert.Contains(t, goroutineLabels(), `"event_type":"`+expected+`"`)
+	}
+	labels.restore()
+	assert.NotContains(t, goroutineLabels(), `"tenant":"t1"`)
+
+	assert.Nil(t, newProfilerLabels(context.Background()))
+	assert.Nil(t, newProfilerLabels(ContextWithProfilerLabels(context.Background(), nil)))
+}
+
+func TestHandleTrustedStream(t *testing.T) {
+	collect := func(batches *[]model.Batch) model.BatchProcessor {
+		return model.ProcessBatchFunc(func(ctx context.Context, batch *model.Batch) error {
+			*batches = append(*batches, *batch)
+			return nil
+		})
+	}
+	for _, path := range []string{"errors.ndjson", "events.ndjson", "metricsets.ndjson", "spans.ndjson"} {
+		t.Run(path, func(t *testing.T) {
+			payload, err := os.ReadFile(filepath.Join("../../testdata/intake-v2", path))
+			require.NoError(t, err)
+			p := BackendProcessor(&config.Config{MaxEventSize: 300 * 1024}, make(chan struct{}, 1), nil)
+
+			var expected, actual []model.Batch
+			var result Result
+			err = p.HandleStream(context.Background(), model.APMEvent{}, bytes.NewReader(payload), 2, collect(&expected), &result)
+			require.NoError(t, err)
+			require.Empty(t, result.Errors)
+
+			err = p.HandleTrustedStream(context.Background(), model.APMEvent{}, payload, 2, collect(&actual))
+			require.NoError(t, err)
+			assert.Equal(t, expected, actual)
+		})
+	}
+}
+
+func TestHandleTrustedStreamInvalid(t *testing.T) {
+	p := BackendProcessor(&config.Config{MaxEventSize: 100 * 1024}, make(chan struct{}, 1), nil)
+	var batches int
+	batchProcessor := model.ProcessBatchFunc(func(context.Context, *model.Batch) error {
+		batches++
+		return nil
+	})
+	handle := func(payload string) error {
+		return p.HandleTrustedStream(context.Background(), model.APMEvent{}, []byte(payload), 1, batchProcessor)
+	}
+
+	assert.EqualError(t, handle(""), "EOF while reading metadata")
+	assert.Error(t, handle(`{"metadata": {}}`))
+	assert.Equal(t, 0, batches)
+
+	err := handle(strings.Join([]string{limiterTestMetadata, limiterTestTransaction, `{"foo": {}}`, limiterTestTransaction}, "\n"))
+	assert.EqualError(t, err, "failed to decode event: foo: did not recognize object type")
+	assert.Equal(t, 1, batches)
+}
+
+func TestVerifyChecksum(t *testing.T) {
+	payload := limiterTestPayload(3) + "\n"
+	checksum := func(s string) string {
+		sum := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(sum[:])
+	}
+	checksumLine := func(checksum string) string {
+		return fmt.Sprintf(`{"checksum": %q}`, checksum)
+	}
+	handle := func(verify bool, payload string) (Result, int, error) {
+		var processed int
+		batchProcessor := model.ProcessBatchFunc(func(ctx context.Context, batch *model.Batch) error {
+			processed += len(*batch)
+			return nil
+		})
+		p := BackendProcessor(&config.Config{MaxEventSize: 100 * 1024}, make(chan struct{}, 1), nil)
+		p.VerifyChecksum = verify
+		var result Result
+		err := p.HandleStream(context.Background(), model.APMEvent{}, strings.NewReader(payload), 1, batchProcessor, &result)
+		return result, processed, err
+	}
+
+	for name, payload := range map[string]string{
+		"valid":            payload + checksumLine(checksum(payload)),
+		"trailing_newline": payload + checksumLine(checksum(payload)) + "\n",
+		"no_checksum":      payload,
+	} {
+		t.Run(name, func(t *testing.T) {
+			result, processed, err := handle(true, payload)
+			require.NoError(t, err)
+			assert.Empty(t, result.Errors)
+			assert.Equal(t, 3, result.Accepted)
+			assert.Equal(t, 3, processed)
+		})
+	}
+
+	t.Run("mismatch", func(t *testing.T) {
+		result, processed, err := handle(true, payload+checksumLine(checksum("foo")))
+		var invalidInput *InvalidInputError
+		require.True(t, errors.As(err, &invalidInput))
+		assert.Contains(t, invalidInput.Message, "checksum mismatch")
+		assert.Equal(t, 0, result.Accepted)
+		assert.Equal(t, 0, processed)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, processed, err := handle(true, payload+checksumLine("foo"))
+		assert.EqualError(t, err, "invalid checksum: expected hex-encoded SHA-256 checksum")
+		assert.Equal(t, 0, processed)
+	})
+
+	t.Run("not_final", func(t *testing.T) {
+		_, processed, err := handle(true, payload+checksumLine(checksum(payload))+"\n"+limiterTestTransaction)
+		assert.EqualError(t, err, "invalid checksum: checksum line must be the final line")
+		assert.Equal(t, 0, processed)
+	})
+
+	t.Run("in_flight_limit", func(t *testing.T) {
+		// The bytes of held events stay reserved until they are processed.
+		limit := int64(3 * len(limiterTestTransaction))
+		limiter := NewInFlightLimiter(limit)
+		p := BackendProcessor(&config.Config{MaxEventSize: 100 * 1024}, make(chan struct{}, 1), limiter)
+		p.VerifyChecksum = true
+		var inFlight []int64
+		batchProcessor := model.ProcessBatchFunc(func(ctx context.Context, batch *model.Batch) error {
+			inFlight = append(inFlight, limiter.InFlight())
+			return nil
+		})
+		var result Result
+		err := p.HandleStream(context.Background(), model.APMEvent{}, strings.NewReader(payload+checksumLine(checksum(payload))), 1, batchProcessor, &result)
+		require.NoError(t, err)
+		assert.Equal(t, 3, result.Accepted)
+		assert.Equal(t, []int64{limit, limit, limit}, inFlight)
+		assert.Zero(t, limiter.InFlight())
+
+		// Streams whose held events reach the limit are rejected,
+		// rather than waiting for their own bytes to be released.
+		payload := limiterTestPayload(4) + "\n"
+		result = Result{}
+		err = p.HandleStream(context.Background(), model.APMEvent{}, strings.NewReader(payload+checksumLine(checksum(payload))), 1, batchProcessor, &result)
+		assert.Equal(t, ErrInFlightLimitExceeded, err)
+		assert.Equal(t, 0, result.Accepted)
+		assert.Len(t, inFlight, 3)
+		assert.Zero(t, limiter.InFlight())
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		result, processed, err := handle(false, payload+checksumLine(checksum(payload)))
+		require.NoError(t, err)
+		assert.Equal(t, 3, processed)
+		require.Len(t, result.Errors, 1)
+		assert.Contains(t, result.Errors[0].Error(), "did not recognize object type")
+	})
+}
+
+func TestRecordBatchEvents(t *testing.T) {
+	getBuckets := func() []int64 {
+		buckets := make([]int64, len(mBatchEvents.buckets))
+		for i, bucket := range mBatchEvents.buckets {
+			buckets[i] = bucket.Get()
+		}
+		return buckets
+	}
+	for _, recordBatchEvents := range []bool{false, true} {
+		initialCount, initialSum := mBatchEvents.count.Get(), mBatchEvents.sum.Get()
+		initialBuckets := getBuckets()
+
+		p := BackendProcessor(&config.Config{MaxEventSize: 100 * 1024}, make(chan struct{}, 1), nil)
+		p.RecordBatchEvents = recordBatchEvents
+		var result Result
+		err := p.HandleStream(context.Background(), model.APMEvent{}, strings.NewReader(limiterTestPayload(23)), 10, nopBatchProcessor{}, &result)
+		require.NoError(t, err)
+		require.Equal(t, 23, result.Accepted)
+
+		if !recordBatchEvents {
+			assert.Equal(t, initialCount, mBatchEvents.count.Get())
+			assert.Equal(t, initialBuckets, getBuckets())
+			continue
+		}
+		// Two full batches of 10 events, and one of 3.
+		assert.Equal(t, int64(3), mBatchEvents.count.Get()-initialCount)
+		assert.Equal(t, int64(23), mBatchEvents.sum.Get()-initialSum)
+		buckets := getBuckets()
+		assert.Equal(t, int64(1), buckets[1]-initialBuckets[1]) // le_5
+		assert.Equal(t, int64(2), buckets[2]-initialBuckets[2]) // le_10
+	}
+}
+
+func TestTerminalError(t *testing.T) {
+	timeoutErr := &net.OpError{Op: "write", Err: os.ErrDeadlineExceeded}
+	for _, test := range []struct {
+		err  error
+		kind TerminalErrorKind
+	}{
+		{err: errors.New("storage failure"), kind: TerminalErrorInternal},
+		{err: publish.ErrFull, kind: TerminalErrorInternal},
+		{err: ratelimit.ErrRateLimitExceeded, kind: TerminalErrorRateLimited},
+		{err: ErrEventRateLimitExceeded, kind: TerminalErrorRateLimited},
+		{err: fmt.Errorf("wrapped: %w", auth.ErrUnauthorized), kind: TerminalErrorUnauthorized},
+		{err: context.DeadlineExceeded, kind: TerminalErrorTimeout},
+		{err: timeoutErr, kind: TerminalErrorTimeout},
+	} {
+		batchProcessor := model.ProcessBatchFunc(func(context.Context, *model.Batch) error {
+			return test.err
+		})
+		p := BackendProcessor(&config.Config{MaxEventSize: 100 * 1024}, make(chan struct{}, 1), nil)
+		var result Result
+		err := p.HandleStream(context.Background(), model.APMEvent{}, strings.NewReader(limiterTestPayload(1)), 10, batchProcessor, &result)
+
+		var terminal *TerminalError
+		require.True(t, errors.As(err, &terminal), test.err)
+		assert.Equal(t, test.kind, terminal.Kind, test.err)
+		assert.Equal(t, test.err, errors.Unwrap(err))
+		assert.EqualError(t, err, test.err.Error())
+	}
+
+	t.Run("context_done", func(t *testing.T) {
+		p := BackendProcessor(&config.Config{MaxEventSize: 100 * 1024}, make(chan struct{}), nil)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+		defer cancel()
+		var result Result
+		err := p.HandleStream(ctx, model.APMEvent{}, strings.NewReader(limiterTestPayload(1)), 10, nopBatchProcessor{}, &result)
+		assert.Equal(t, &TerminalError{Kind: TerminalErrorTimeout, Err: context.DeadlineExceeded}, err)
+	})
+
+	t.Run("decompression_limit", func(t *testing.T) {
+		limitErr := &decoder.DecompressionLimitError{Decompressed: 100}
+		for _, reader := range []io.Reader{
+			iotest.ErrReader(limitErr),
+			io.MultiReader(strings.NewReader(limiterTestPayload(100)), iotest.ErrReader(limitErr)),
+		} {
+			p := BackendProcessor(&config.Config{MaxEventSize: 100 * 1024}, make(chan struct{}, 1), nil)
+			var result Result
+			err := p.HandleStream(context.Background(), model.APMEvent{}, reader, 10, nopBatchProcessor{}, &result)
+			assert.Equal(t, &TerminalError{Kind: TerminalErrorTooLarge, Err: limitErr}, err)
+			assert.Equal(t, ErrorCodeTooLarge, ErrorCode(err))
+		}
+	})
+}
+
+func TestResultLineSizes(t *testing.T) {
+	var result Result
+	for _, length := range []int{0, 1024, 1025, 300 * 1024, 2 * 1024 * 1024} {
+		result.addLine(length)
+	}
+	assert.Equal(t, 2*1024*1024, result.MaxLineLength)
+	assert.Equal(t, [len(LineSizeBounds) + 1]int{2, 1, 0, 1, 0, 1}, result.LineSizes)
+
+	const maxEventSize = 1000
+	payload := limiterTestMetadata + "\n" + limiterTestTransaction + "\n" + `{"transaction": {"name": "` + strings.Repeat("x", 2000) + `"}}`
+	p := BackendProcessor(&config.Config{MaxEventSize: maxEventSize}, make(chan struct{}, 1), nil)
+	result = Result{}
+	err := p.HandleStream(context.Background(), model.APMEvent{}, strings.NewReader(payload), 10, nopBatchProcessor{}, &result)
+	require.NoError(t, err)
+	// The line exceeding the maximum event size is recorded with its full length.
+	assert.Equal(t, 2000+len(`{"transaction": {"name": ""}}`), result.MaxLineLength)
+	assert.Equal(t, [len(LineSizeBounds) + 1]int{2, 1}, result.LineSizes)
+}
+
+func TestBlankStream(t *testing.T) {
+	handle := func(payload string) (Result, error) {
+		p := BackendProcessor(&config.Config{MaxEventSize: 100 * 1024}, make(chan struct{}, 1), nil)
+		var result Result
+		err := p.HandleStream(context.Background(), model.APMEvent{}, strings.NewReader(payload), 10, nopBatchProcessor{}, &result)
+		return result, err
+	}
+	for _, payload := range []string{"\n", "\n\n\n", "  \n\t\n", " ", "\r\n"} {
+		result, err := handle(payload)
+		assert.NoError(t, err, "%q", payload)
+		assert.Zero(t, result.Accepted)
+		assert.Empty(t, result.Errors)
+	}
+	for _, payload := range []string{
+		"",
+		"\n\n{}",
+		"\n" + limiterTestMetadata + "\n" + limiterTestTransaction,
+		"  \nfoo\n",
+	} {
+		_, err := handle(payload)
+		var invalidInput *InvalidInputError
+		assert.True(t, errors.As(err, &invalidInput), "%q: %v", payload, err)
+	}
+}
+
+// errorStreamDecoder wraps a StreamDecoder, returning errors[i] from the
+// i'th call to ReadAhead, if non-nil.
+type errorStreamDecoder struct {
+	StreamDecoder
+	errors []error
+	reads  int
+}
+
+func (d *errorStreamDecoder) ReadAhead() ([]byte, error) {
+	line, err := d.StreamDecoder.ReadAhead()
+	if d.reads < len(d.errors) && d.errors[d.reads] != nil {
+		err = d.errors[d.reads]
+	}
+	d.reads++
+	return line, err
+}
+
+func TestNewStreamDecoder(t *testing.T) {
+	readErr := errors.New("read failed")
+	handle := func(errs ...error) (Result, error) {
+		p := BackendProcessor(&config.Config{MaxEventSize: 100 * 1024}, make(chan struct{}, 1), nil)
+		p.NewStreamDecoder = func(r io.Reader, maxLineLength, bufferSize int) StreamDecoder {
+			assert.Equal(t, 100*1024, maxLineLength)
+			return &errorStreamDecoder{
+				StreamDecoder: decoder.NewNDJSONStreamDecoderSize(r, maxLineLength, bufferSize),
+				errors:        errs,
+			}
+		}
+		var result Result
+		err := p.HandleStream(context.Background(), model.APMEvent{}, strings.NewReader(limiterTestPayload(3)), 10, nopBatchProcessor{}, &result)
+		return result, err
+	}
+
+	// The metadata line is read by Decode, so the first call
+	// to ReadAhead is for the first event.
+	result, err := handle(nil, decoder.ErrLineTooLong)
+	require.NoError(t, err)
+	assert.Equal(t, 2, result.Accepted)
+	require.Len(t, result.Errors, 1)
+	var invalidInput *InvalidInputError
+	require.True(t, errors.As(result.Errors[0], &invalidInput))
+	assert.True(t, invalidInput.TooLarge)
+
+	result, err = handle(nil, nil, readErr)
+	assert.Equal(t, readErr, err)
+	assert.Equal(t, 2, result.Accepted)
+}
+
+func TestRetryPolicy(t *testing.T) {
+	handle := func(ctx context.Context, errs ...error) (Result, int, error) {
+		var processed, attempts int
+		batchProcessor := model.ProcessBatchFunc(func(ctx context.Context, batch *model.Batch) error {
+			processed++
+			// Only the terminal processor, standing in for the publisher,
+			// retries the batch; preceding processors are called once.
+			return publish.Retry(ctx, func() error {
+				attempts++
+				if len(*batch) != 3 {
+					return fmt.Errorf("expected 3 events, got %d", len(*batch))
+				}
+				if attempts > len(errs) {
+					return nil
+				}
+				return errs[attempts-1]
+			})
+		})
+		p := BackendProcessor(&config.Config{MaxEventSize: 100 * 1024}, make(chan struct{}, 1), nil)
+		var result Result
+		err := p.HandleStream(ctx, model.APMEvent{}, strings.NewReader(limiterTestPayload(3)), 10, batchProcessor, &result)
+		assert.Equal(t, 1, processed)
+		return result, attempts, err
+	}
+	policy := RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond}
+	ctx := ContextWithRetryPolicy(context.Background(), policy)
+
+	// Transient errors are retried.
+	result, attempts, err := handle(ctx, publish.ErrFull, publish.ErrFull)
+	require.NoError(t, err)
+	assert.Equal(t, 3, attempts)
+	assert.Equal(t, 3, result.Accepted)
+
+	// Retries are limited to MaxAttempts.
+	_, attempts, err = handle(ctx, publish.ErrFull, publish.ErrFull, publish.ErrFull)
+	assert.Equal(t, publish.ErrFull, errors.Unwrap(err))
+	assert.Equal(t, 3, attempts)
+
+	// Other errors fail fast.
+	_, attempts, err = handle(ctx, auth.ErrUnauthorized)
+	var terminal *TerminalError
+	require.True(t, errors.As(err, &terminal))
+	assert.Equal(t, TerminalErrorUnauthorized, terminal.Kind)
+	assert.Equal(t, 1, attempts)
+
+	// Without a retry policy, transient errors are not retried.
+	_, attempts, err = handle(context.Background(), publish.ErrFull)
+	assert.Equal(t, publish.ErrFull, errors.Unwrap(err))
+	assert.Equal(t, 1, attempts)
+
+	// Transient classifies the errors rejecting batches when set.
+	policy.Transient = func(err error) bool { return false }
+	_, attempts, err = handle(ContextWithRetryPolicy(context.Background(), policy), publish.ErrFull)
+	assert.Equal(t, publish.ErrFull, errors.Unwrap(err))
+	assert.Equal(t, 1, attempts)
+
+	// Retrying stops when the context is done.
+	policy = RetryPolicy{MaxAttempts: 3, Backoff: time.Hour}
+	ctx, cancel := context.WithTimeout(ContextWithRetryPolicy(context.Background(), policy), 10*time.Millisecond)
+	defer cancel()
+	_, attempts, err = handle(ctx, publish.ErrFull)
+	assert.Equal(t, publish.ErrFull, errors.Unwrap(err))
+	assert.Equal(t, 1, attempts)
+}
+
+func TestRetryPolicyReleasesSemaphore(t *testing.T) {
+	// Streams waiting to retry do not hold the semaphore,
+	// so other streams can be handled in the meantime.
+	sem := make(chan struct{}, 1)
+	p := BackendProcessor(&config.Config{MaxEventSize: 100 * 1024}, sem, nil)
+	rejected := make(chan struct{})
+	var attempts int
+	batchProcessor := model.ProcessBatchFunc(func(ctx context.Context, batch *model.Batch) error {
+		return publish.Retry(ctx, func() error {
+			attempts++
+			if attempts == 1 {
+				close(rejected)
+				return publish.ErrFull
+			}
+			return nil
+		})
+	})
+	policy := RetryPolicy{MaxAttempts: 2, Backoff: time.Hour}
+	ctx, cancel := context.WithCancel(ContextWithRetryPolicy(context.Background(), policy))
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		var result Result
+		done <- p.HandleStream(ctx, model.APMEvent{}, strings.NewReader(limiterTestPayload(1)), 10, batchProcessor, &result)
+	}()
+	<-rejected
+
+	var result Result
+	err := p.HandleStream(context.Background(), model.APMEvent{}, strings.NewReader(limiterTestPayload(1)), 10, nopBatchProcessor{}, &result)
+	require.NoError(t, err)
+	assert.Equal(t, 1, result.Accepted)
+
+	// The semaphore is re-acquired before the first stream returns.
+	cancel()
+	assert.Error(t, <-done)
+	assert.Empty(t, sem)
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := RetryPolicy{Backoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond}
+	var backoffs []time.Duration
+	for retry := 1; retry <= 5; retry++ {
+		backoffs = append(backoffs, policy.backoff(retry))
+	}
+	assert.Equal(t, []time.Duration{
+		10 * time.Millisecond,
+		20 * time.Millisecond,
+		40 * time.Millisecond,
+		50 * time.Millisecond,
+		50 * time.Millisecond,
+	}, backoffs)
+
+	policy.MaxBackoff = 0
+	assert.Equal(t, 80*time.Millisecond, policy.backoff(4))
+}
+
+func TestTruncateDocument(t *testing.T) {
+	assert.Equal(t, "abc", truncateDocument([]byte("abc"), 3))
+	assert.Equal(t, "ab"+documentTruncatedMarker, truncateDocument([]byte("abc"), 2))
+	assert.Equal(t, documentTruncatedMarker, truncateDocument([]byte("abc"), 0))
+	assert.Equal(t, "abc", truncateDocument([]byte("abc"), -1))
+
+	// Multi-byte characters are not split.
+	assert.Equal(t, "a"+documentTruncatedMarker, truncateDocument([]byte("aéb"), 2))
+	assert.Equal(t, "aé"+documentTruncatedMarker, truncateDocument([]byte("aéb"), 3))
+	assert.Equal(t, documentTruncatedMarker, truncateDocument([]byte("世界"), 2))
+	assert.True(t, utf8.ValidString(truncateDocument([]byte(strings.Repeat("世", 100)), 100)))
+}
+
+func TestMaxDocumentLength(t *testing.T) {
+	invalidEvent := `{"transaction": {"id": 123, "name": "` + strings.Repeat("世", 2000) + `"}}`
+	payload := limiterTestMetadata + "\n" + invalidEvent + "\n"
+	handle := func(maxDocumentLength int) *InvalidInputError {
+		p := BackendProcessor(&config.Config{MaxEventSize: 100 * 1024, MaxDocumentLength: maxDocumentLength}, make(chan struct{}, 1), nil)
+		var result Result
+		err := p.HandleStream(context.Background(), model.APMEvent{}, strings.NewReader(payload), 10, nopBatchProcessor{}, &result)
+		require.NoError(t, err)
+		require.Len(t, result.Errors, 1)
+		var invalidInput *InvalidInputError
+		require.True(t, errors.As(result.Errors[0], &invalidInput))
+		return invalidInput
+	}
+
+	document := handle(0).Document
+	assert.True(t, strings.HasSuffix(document, documentTruncatedMarker))
+	assert.LessOrEqual(t, len(document), DefaultMaxDocumentLength+len(documentTruncatedMarker))
+	assert.True(t, strings.HasPrefix(invalidEvent, strings.TrimSuffix(document, documentTruncatedMarker)))
+	assert.True(t, utf8.ValidString(document))
+
+	document = handle(100).Document
+	assert.LessOrEqual(t, len(document), 100+len(documentTruncatedMarker))
+	assert.True(t, utf8.ValidString(document))
+
+	assert.Equal(t, invalidEvent, handle(-1).Document)
+}
+
+func TestDecodeParallelism(t *testing.T) {
+	handle := func(t *testing.T, payload []byte, decodeParallelism int) ([]model.APMEvent, Result) {
+		var events []model.APMEvent
+		batchProcessor := model.ProcessBatchFunc(func(ctx context.Context, batch *model.Batch) error {
+			events = append(events, *batch...)
+			return nil
+		})
+		baseEvent := model.APMEvent{
+			Host:      model.Host{IP: []net.IP{net.ParseIP("192.0.0.1")}},
+			Timestamp: time.Date(2018, 8, 1, 10, 0, 0, 0, time.UTC),
+		}
+		p := BackendProcessor(&config.Config{MaxEventSize: 100 * 1024}, make(chan struct{}, 1), nil)
+		p.AcceptMetadataUpdates = true
+		p.DecodeParallelism = decodeParallelism
+		var result Result
+		err := p.HandleStream(context.Background(), baseEvent, bytes.NewReader(payload), 10, batchProcessor, &result)
+		require.NoError(t, err)
+		return events, result
+	}
+
+	metadataUpdates := strings.Join([]string{
+		`{"metadata": {"service": {"name": "svc1", "agent": {"name": "go", "version": "2.0.0"}}, "labels": {"a": "1"}}}`,
+		limiterTestTransaction,
+		`{"metadata": {"service": {"name": "svc2", "agent": {"name": "go", "version": "2.0.0"}}, "labels": {"b": "2"}}}`,
+		limiterTestTransaction,
+		`{"transaction": {"id": 123}}`,
+		limiterTestTransaction,
+	}, "\n")
+	for name, payload := range map[string]func() ([]byte, error){
+		"events.ndjson":            func() ([]byte, error) { return os.ReadFile("../../testdata/intake-v2/events.ndjson") },
+		"spans.ndjson":             func() ([]byte, error) { return os.ReadFile("../../testdata/intake-v2/spans.ndjson") },
+		"invalid-event.ndjson":     func() ([]byte, error) { return os.ReadFile("../../testdata/intake-v2/invalid-event.ndjson") },
+		"invalid-event-type":       func() ([]byte, error) { return os.ReadFile("../../testdata/intake-v2/invalid-event-type.ndjson") },
+		"metadata updates":         func() ([]byte, error) { return []byte(metadataUpdates), nil },
+		"truncated":                func() ([]byte, error) { return []byte(limiterTestMetadata + "\n" + `{"transaction": {"id": "1`), nil },
+		"transactions-huge_traces": func() ([]byte, error) { return os.ReadFile("../../testdata/intake-v2/transactions-huge_traces.ndjson") },
+	} {
+		t.Run(name, func(t *testing.T) {
+			payload, err := payload()
+			require.NoError(t, err)
+			expectedEvents, expectedResult := handle(t, payload, 1)
+			for _, decodeParallelism := range []int{2, 4, 100} {
+				events, result := handle(t, payload, decodeParallelism)
+				assert.Equal(t, expectedEvents, events)
+				assert.Equal(t, expectedResult, result)
+			}
+		})
+	}
+}
+
+func TestMetadataFilter(t *testing.T) {
+	payload := strings.Join([]string{
+		`{"metadata": {"service": {"name": "svc1", "agent": {"name": "go", "version": "2.0.0"}}}}`,
+		limiterTestTransaction,
+		`{"metadata": {"service": {"name": "svc2", "agent": {"name": "go", "version": "2.0.0"}}}}`,
+		limiterTestTransaction,
+	}, "\n")
+	errQuota := errors.New("quota exceeded")
+	handle := func(rejected string) (int, Result, error) {
+		var services []string
+		ctx := ContextWithMetadataFilter(context.Background(), func(event model.APMEvent) error {
+			services = append(services, event.Service.Name)
+			if event.Service.Name == rejected {
+				return errQuota
+			}
+			return nil
+		})
+		var processed int
+		batchProcessor := model.ProcessBatchFunc(func(_ context.Context, b *model.Batch) error {
+			processed += len(*b)
+			return nil
+		})
+		p := BackendProcessor(&config.Config{MaxEventSize: 100 * 1024}, make(chan struct{}, 1), nil)
+		p.AcceptMetadataUpdates = true
+		var result Result
+		err := p.HandleStream(ctx, model.APMEvent{}, strings.NewReader(payload), 1, batchProcessor, &result)
+		assert.Equal(t, []string{"svc1", "svc2"}[:len(services)], services)
+		return processed, result, err
+	}
+
+	processed, result, err := handle("")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, processed)
+	assert.Equal(t, 2, result.Accepted)
+
+	// Streams rejected by their first metadata line have no events decoded.
+	processed, _, err = handle("svc1")
+	var rejected *StreamRejectedError
+	require.True(t, errors.As(err, &rejected))
+	assert.Equal(t, errQuota, rejected.Err)
+	assert.Equal(t, ErrorCodeStreamRejected, ErrorCode(err))
+	assert.Zero(t, processed)
+
+	// Metadata updates are also filtered, after earlier events are processed.
+	processed, _, err = handle("svc2")
+	assert.True(t, errors.As(err, &rejected))
+	assert.Equal(t, 1, processed)
+}
+
+func TestMetadataProjection(t *testing.T) {
+	payload := strings.Join([]string{
+		`{"metadata": {"service": {"name": "svc1", "agent": {"name": "go", "version": "2.0.0"}}, "system": {"hostname": "host1", "container": {"id": "c1"}}, "cloud": {"provider": "aws"}}}`,
+		limiterTestTransaction,
+		`{"metadata": {"service": {"name": "svc2", "agent": {"name": "go", "version": "2.0.0"}}, "system": {"hostname": "host2", "container": {"id": "c2"}}, "cloud": {"provider": "gcp"}}}`,
+		limiterTestTransaction,
+	}, "\n")
+	handle := func(ctx context.Context) []model.APMEvent {
+		var events []model.APMEvent
+		batchProcessor := model.ProcessBatchFunc(func(_ context.Context, b *model.Batch) error {
+			events = append(events, *b...)
+			return nil
+		})
+		p := BackendProcessor(&config.Config{MaxEventSize: 100 * 1024}, make(chan struct{}, 1), nil)
+		p.AcceptMetadataUpdates = true
+		var result Result
+		err := p.HandleStream(ctx, model.APMEvent{}, strings.NewReader(payload), 10, batchProcessor, &result)
+		require.NoError(t, err)
+		require.Len(t, events, 2)
+		return events
+	}
+
+	events := handle(context.Background())
+	assert.Equal(t, "host1", events[0].Host.Hostname)
+	assert.Equal(t, "c2", events[1].Container.ID)
+
+	ctx := ContextWithMetadataProjection(context.Background(), model.MetadataProjectionPolicy{
+		Drop: []model.MetadataSection{model.MetadataSectionHost, model.MetadataSectionContainer},
+	})
+	for i, event := range handle(ctx) {
+		assert.Equal(t, fmt.Sprintf("svc%d", i+1), event.Service.Name)
+		assert.Zero(t, event.Host)
+		assert.Zero(t, event.Container)
+		assert.NotZero(t, event.Cloud)
+	}
+}
+
+func TestBatchTransform(t *testing.T) {
+	var batches int
+	batchProcessor := model.ProcessBatchFunc(func(_ context.Context, b *model.Batch) error {
+		batches++
+		for _, event := range *b {
+			assert.NotEqual(t, "GET /healthz", event.Transaction.Name)
+		}
+		return nil
+	})
+	transform := func(b *model.Batch) {
+		out := (*b)[:0]
+		for _, event := range *b {
+			if event.Transaction.Name != "GET /healthz" {
+				out = append(out, event)
+			}
+		}
+		*b = out
+	}
+	healthcheck := strings.Replace(limiterTestTransaction, `"GET /"`, `"GET /healthz"`, 1)
+	payload := strings.Join([]string{
+		limiterTestMetadata,
+		healthcheck, healthcheck, // first batch, dropped
+		limiterTestTransaction, healthcheck, // second batch
+	}, "\n")
+
+	ctx := ContextWithBatchTransform(context.Background(), transform)
+	p := BackendProcessor(&config.Config{MaxEventSize: 100 * 1024}, make(chan struct{}, 1), nil)
+	var result Result
+	err := p.HandleStream(ctx, model.APMEvent{}, strings.NewReader(payload), 2, batchProcessor, &result)
+	require.NoError(t, err)
+	assert.Equal(t, 1, batches)
+	assert.Equal(t, 1, result.Accepted)
+}
+
+func TestDecodeEvent(t *testing.T) {
+	p := BackendProcessor(&config.Config{MaxEventSize: 1024}, make(chan struct{}, 1), nil)
+	base := model.APMEvent{Service: model.Service{Name: "svc"}}
+
+	event, err := p.DecodeEvent(base, []byte(limiterTestTransaction+"\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "svc", event.Service.Name)
+	assert.Equal(t, model.TransactionProcessor, event.Processor)
+	assert.Equal(t, "GET /", event.Transaction.Name)
+
+	// Errors match those recorded by HandleStream.
+	for _, line := range []string{
+		`{"transaction": {"id": 123}}`,
+		`{"tennis-court": {"name": "Centre Court, Wimbledon"}}`,
+		`{"transaction": {"name": "` + strings.Repeat("x", 1024) + `"}}`,
+	} {
+		var result Result
+		err := p.HandleStream(context.Background(), base, strings.NewReader(limiterTestMetadata+"\n"+line), 10, nopBatchProcessor{}, &result)
+		require.NoError(t, err)
+		require.Len(t, result.Errors, 1)
+
+		_, err = p.DecodeEvent(base, []byte(line))
+		assert.Equal(t, result.Errors[0], err)
+	}
+
+	_, err = p.DecodeEvent(base, []byte(" \n"))
+	assert.Equal(t, &InvalidInputError{Message: "invalid event: empty line"}, err)
+
+	p.MaxEventSize = 100 * 1024
+	profile, err := os.ReadFile("../../testdata/intake-v2/profile.ndjson")
+	require.NoError(t, err)
+	profileLine := bytes.SplitN(profile, []byte("\n"), 3)[1]
+	_, err = p.DecodeEvent(base, profileLine)
+	var invalidInput *InvalidInputError
+	require.True(t, errors.As(err, &invalidInput))
+	assert.Regexp(t, `invalid event: decoded \d+ events, expected 1`, invalidInput.Message)
+}
+
+func TestTransactionMarksKeySanitizer(t *testing.T) {
+	p := BackendProcessor(&config.Config{MaxEventSize: 1024}, make(chan struct{}, 1), nil)
+	line := `{"transaction":{"id":"1","trace_id":"2","type":"page-load","duration":1,"span_count":{"started":0},"marks":{"vendor.group":{"vendor.mark*":1}}}}`
+
+	event, err := p.DecodeEvent(model.APMEvent{}, []byte(line))
+	require.NoError(t, err)
+	assert.Equal(t, model.TransactionMarks{"vendor_group": {"vendor_mark_": 1}}, event.Transaction.Marks)
+
+	p.TransactionMarksKeySanitizer = strings.NewReplacer("*", "_").Replace
+	event, err = p.DecodeEvent(model.APMEvent{}, []byte(line))
+	require.NoError(t, err)
+	assert.Equal(t, model.TransactionMarks{"vendor.group": {"vendor.mark_": 1}}, event.Transaction.Marks)
+}
+
+func TestLabelConflicts(t *testing.T) {
+	payload := strings.Join([]string{
+		`{"metadata": {"service": {"name": "svc", "agent": {"name": "go", "version": "2.0.0"}}, "labels": {"a": "1", "n": 1, "same": "x"}}}`,
+		`{"transaction": {"id": "0123456789abcdef", "trace_id": "0123456789abcdef0123456789abcdef", "type": "request", "duration": 1, "span_count": {"started": 0}, "context": {"tags": {"a": "2", "n": "one", "same": "x", "b": "3"}}}}`,
+		limiterTestTransaction,
+	}, "\n")
+	handle := func(policy string) ([]model.APMEvent, Result) {
+		var events []model.APMEvent
+		batchProcessor := model.ProcessBatchFunc(func(_ context.Context, b *model.Batch) error {
+			events = append(events, *b...)
+			return nil
+		})
+		cfg := &config.Config{MaxEventSize: 100 * 1024, Intake: config.IntakeConfig{LabelConflicts: policy}}
+		p := BackendProcessor(cfg, make(chan struct{}, 1), nil)
+		var result Result
+		err := p.HandleStream(context.Background(), model.APMEvent{}, strings.NewReader(payload), 10, batchProcessor, &result)
+		require.NoError(t, err)
+		return events, result
+	}
+	metadataLabels := model.Labels{"a": {Value: "1"}, "same": {Value: "x"}}
+	metadataNumericLabels := model.NumericLabels{"n": {Value: 1}}
+
+	before := mLabelConflicts.Get()
+	events, _ := handle(config.IntakeLabelConflictsEventWins)
+	require.Len(t, events, 2)
+	assert.Equal(t, model.Labels{"a": {Value: "2"}, "n": {Value: "one"}, "same": {Value: "x"}, "b": {Value: "3"}}, events[0].Labels)
+	assert.Equal(t, metadataNumericLabels, events[0].NumericLabels)
+	assert.Equal(t, metadataLabels, events[1].Labels)
+	assert.Equal(t, metadataNumericLabels, events[1].NumericLabels)
+	assert.Equal(t, int64(2), mLabelConflicts.Get()-before)
+
+	events, _ = handle("") // defaults to event_wins
+	assert.Equal(t, "2", events[0].Labels["a"].Value)
+
+	events, result := handle(config.IntakeLabelConflictsMetadataWins)
+	require.Len(t, events, 2)
+	assert.Equal(t, model.Labels{"a": {Value: "1"}, "same": {Value: "x"}, "b": {Value: "3"}}, events[0].Labels)
+	assert.Equal(t, metadataNumericLabels, events[0].NumericLabels)
+	assert.Equal(t, metadataLabels, events[1].Labels)
+	// Dropped event labels are reported as a warning, and the
+	// events are still accepted.
+	assert.Equal(t, 2, result.Accepted)
+	require.Len(t, result.Warnings, 1)
+	assert.Equal(t, WarningLabelDropped, result.Warnings[0].Code)
+	assert.Equal(t, 2, result.Warnings[0].Count)
+
+	events, result = handle(config.IntakeLabelConflictsError)
+	require.Len(t, events, 1)
+	assert.Equal(t, metadataLabels, events[0].Labels)
+	require.Len(t, result.Errors, 1)
+	assert.Contains(t, result.Errors[0].Error(), "label conflict: event overrides metadata label")
+}
+
+func TestSemaphoreWaitLabel(t *testing.T) {
+	sem := make(chan struct{}, 1)
+	sem <- struct{}{}
+
+	p := BackendProcessor(&config.Config{MaxEventSize: 100 * 1024}, sem, nil)
+	payload := limiterTestPayload(1)
+	_, spans, _ := apmtest.WithTransaction(func(ctx context.Context) {
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			<-sem
+		}()
+		var result Result
+		err := p.HandleStream(ctx, model.APMEvent{}, strings.NewReader(payload), 10, nopBatchProcessor{}, &result)
+		require.NoError(t, err)
+	})
+
+	var streamSpan *apmmodel.Span
+	for i := range spans {
+		if spans[i].Name == "Stream" {
+			streamSpan = &spans[i]
+		}
+	}
+	require.NotNil(t, streamSpan)
+	require.NotNil(t, streamSpan.Context)
+	var wait interface{}
+	for _, tag := range streamSpan.Context.Tags {
+		if tag.Key == semaphoreWaitLabel {
+			wait = tag.Value
+		}
+	}
+	require.IsType(t, float64(0), wait)
+	// The wait is measured from shortly after the sleep starts.
+	assert.GreaterOrEqual(t, wait.(float64), float64(25))
+}
+
+func TestEventTypeAliases(t *testing.T) {
+	aliased := strings.Replace(limiterTestTransaction, `"transaction"`, `"txn"`, 1)
+	payload := strings.Join([]string{
+		limiterTestMetadata,
+		aliased,
+		limiterTestTransaction,
+		`{"tennis-court": {"name": "Centre Court, Wimbledon"}}`,
+	}, "\n")
+
+	for _, parallelism := range []int{1, 2} {
+		t.Run(fmt.Sprintf("parallelism_%d", parallelism), func(t *testing.T) {
+			var events model.Batch
+			batchProcessor := model.ProcessBatchFunc(func(_ context.Context, b *model.Batch) error {
+				events = append(events, *b...)
+				return nil
+			})
+			p := BackendProcessor(&config.Config{MaxEventSize: 100 * 1024}, make(chan struct{}, 1), nil)
+			p.EventTypeAliases = map[string]string{"txn": transactionEventType}
+			p.DecodeParallelism = parallelism
+
+			var result Result
+			err := p.HandleStream(context.Background(), model.APMEvent{}, strings.NewReader(payload), 10, batchProcessor, &result)
+			require.NoError(t, err)
+			assert.Equal(t, 2, result.Accepted)
+			require.Len(t, events, 2)
+			for _, event := range events {
+				assert.Equal(t, model.TransactionProcessor, event.Processor)
+				assert.Equal(t, "GET /", event.Transaction.Name)
+			}
+
+			// Keys without an alias are still unrecognized.
+			require.Len(t, result.Errors, 1)
+			assert.Contains(t, result.Errors[0].Error(), "did not recognize object type")
+		})
+	}
+
+	p := BackendProcessor(&config.Config{MaxEventSize: 1024}, make(chan struct{}, 1), nil)
+	p.EventTypeAliases = map[string]string{"txn": transactionEventType}
+	event, err := p.DecodeEvent(model.APMEvent{}, []byte(aliased))
+	require.NoError(t, err)
+	assert.Equal(t, "GET /", event.Transaction.Name)
+}
+
+func TestNegativeSpanCount(t *testing.T) {
+	negative := strings.Replace(limiterTestTransaction, `"span_count": {"started": 0}`, `"span_count": {"started": -2, "dropped": 1}`, 1)
+	payload := strings.Join([]string{limiterTestMetadata, negative, limiterTestTransaction}, "\n")
+	handle := func(policy string) ([]model.APMEvent, Result) {
+		var events []model.APMEvent
+		batchProcessor := model.ProcessBatchFunc(func(_ context.Context, b *model.Batch) error {
+			events = append(events, *b...)
+			return nil
+		})
+		cfg := &config.Config{MaxEventSize: 100 * 1024, Intake: config.IntakeConfig{NegativeSpanCount: policy}}
+		p := BackendProcessor(cfg, make(chan struct{}, 1), nil)
+		var result Result
+		err := p.HandleStream(context.Background(), model.APMEvent{}, strings.NewReader(payload), 10, batchProcessor, &result)
+		require.NoError(t, err)
+		return events, result
+	}
+
+	before := mNegativeSpanCounts.Get()
+	events, result := handle(config.IntakeNegativeSpanCountClamp)
+	require.Len(t, events, 2)
+	assert.Equal(t, 0, *events[0].Transaction.SpanCount.Started)
+	assert.Equal(t, 1, *events[0].Transaction.SpanCount.Dropped)
+	assert.Empty(t, result.Errors)
+	require.Len(t, result.Warnings, 1)
+	assert.Equal(t, WarningSpanCountNegative, result.Warnings[0].Code)
+	assert.Equal(t, int64(1), mNegativeSpanCounts.Get()-before)
+
+	// An unset dropped count is left unset.
+	require.NotNil(t, events[1].Transaction.SpanCount.Started)
+	assert.Nil(t, events[1].Transaction.SpanCount.Dropped)
+
+	events, result = handle(config.IntakeNegativeSpanCountReject)
+	require.Len(t, events, 1)
+	assert.Equal(t, 1, result.Accepted)
+	assert.Empty(t, result.Warnings)
+	require.Len(t, result.Errors, 1)
+	assert.Contains(t, result.Errors[0].Error(), "invalid transaction: negative span count")
+	assert.Equal(t, int64(2), mNegativeSpanCounts.Get()-before)
+}
+
+func TestHandleStreamChan(t *testing.T) {
+	p := BackendProcessor(&config.Config{MaxEventSize: 100 * 1024}, make(chan struct{}, 1), nil)
+	handle := func(payload string) ([]int, Result, error) {
+		progress := make(chan Result)
+		var accepted []int
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for snapshot := range progress {
+				accepted = append(accepted, snapshot.Accepted)
+			}
+		}()
+		var result Result
+		err := p.HandleStreamChan(context.Background(), model.APMEvent{}, strings.NewReader(payload), 2, nopBatchProcessor{}, &result, progress)
+		<-done
+		return accepted, result, err
+	}
+
+	// Stale snapshots may be replaced before they are received,
+	// but the latest snapshot is always received.
+	accepted, result, err := handle(limiterTestPayload(5))
+	require.NoError(t, err)
+	assert.Subset(t, []int{2, 4, 5}, accepted)
+	assert.IsIncreasing(t, accepted)
+	assert.Equal(t, 5, accepted[len(accepted)-1])
+	assert.Equal(t, 5, result.Accepted)
+
+	// Errors are returned as by HandleStream, and the channel is closed.
+	accepted, result, err = handle(`{"metadata": "invalid"}`)
+	assert.Error(t, err)
+	assert.Empty(t, accepted)
+	assert.Zero(t, result.Accepted)
+}
+
+func TestHandleStreamChanNotReceiving(t *testing.T) {
+	// The stream is not blocked by a caller which is not receiving.
+	p := BackendProcessor(&config.Config{MaxEventSize: 100 * 1024}, make(chan struct{}, 1), nil)
+	processed := make(chan struct{}, 3)
+	batchProcessor := model.ProcessBatchFunc(func(context.Context, *model.Batch) error {
+		processed <- struct{}{}
+		return nil
+	})
+	progress := make(chan Result)
+	var result Result
+	done := make(chan error, 1)
+	go func() {
+		done <- p.HandleStreamChan(context.Background(), model.APMEvent{}, strings.NewReader(limiterTestPayload(5)), 2, batchProcessor, &result, progress)
+	}()
+	for i := 0; i < 3; i++ {
+		<-processed
+	}
+
+	var accepted []int
+	for snapshot := range progress {
+		accepted = append(accepted, snapshot.Accepted)
+	}
+	require.NoError(t, <-done)
+	assert.Equal(t, 5, accepted[len(accepted)-1])
+	assert.Equal(t, 5, result.Accepted)
+}
+
+func TestTimestampWindow(t *testing.T) {
+	received := time.Date(2022, 1, 1, 12, 0, 0, 0, time.UTC)
+	withTimestamp := func(ts time.Time) string {
+		return strings.Replace(limiterTestTransaction, `"duration": 1`, fmt.Sprintf(`"duration": 1, "timestamp": %d`, ts.UnixNano()/1000), 1)
+	}
+	future := received.Add(10 * 365 * 24 * time.Hour)
+	payload := strings.Join([]string{
+		limiterTestMetadata,
+		withTimestamp(received.Add(-time.Minute)),
+		withTimestamp(future),
+		limiterTestTransaction, // no timestamp, so the request time is used
+	}, "\n")
+	handle := func(window time.Duration, policy string) ([]model.APMEvent, Result) {
+		var events []model.APMEvent
+		batchProcessor := model.ProcessBatchFunc(func(_ context.Context, b *model.Batch) error {
+			events = append(events, *b...)
+			return nil
+		})
+		cfg := &config.Config{MaxEventSize: 100 * 1024, Intake: config.IntakeConfig{
+			TimestampWindow:      window,
+			TimestampOutOfWindow: policy,
+		}}
+		p := BackendProcessor(cfg, make(chan struct{}, 1), nil)
+		var result Result
+		base := model.APMEvent{Timestamp: received}
+		err := p.HandleStream(context.Background(), base, strings.NewReader(payload), 10, batchProcessor, &result)
+		require.NoError(t, err)
+		return events, result
+	}
+
+	// Timestamps are not checked by default.
+	events, result := handle(0, config.IntakeTimestampOutOfWindowClamp)
+	require.Len(t, events, 3)
+	assert.True(t, future.Equal(events[1].Timestamp))
+	assert.Empty(t, result.Warnings)
+
+	before := mTimestampsOutOfWindow.Get()
+	events, result = handle(time.Hour, config.IntakeTimestampOutOfWindowClamp)
+	require.Len(t, events, 3)
+	assert.True(t, received.Add(-time.Minute).Equal(events[0].Timestamp))
+	assert.True(t, received.Equal(events[1].Timestamp))
+	assert.True(t, received.Equal(events[2].Timestamp))
+	assert.Empty(t, result.Errors)
+	require.Len(t, result.Warnings, 1)
+	assert.Equal(t, WarningTimestampClamped, result.Warnings[0].Code)
+	assert.Equal(t, int64(1), mTimestampsOutOfWindow.Get()-before)
+
+	events, result = handle(time.Hour, config.IntakeTimestampOutOfWindowDrop)
+	require.Len(t, events, 2)
+	assert.Equal(t, 2, result.Accepted)
+	assert.Empty(t, result.Warnings)
+	require.Len(t, result.Errors, 1)
+	assert.Contains(t, result.Errors[0].Error(), "invalid event: timestamp 2031-12-30T12:00:00Z is more than 1h0m0s from the request time 2022-01-01T12:00:00Z")
+	assert.Equal(t, int64(2), mTimestampsOutOfWindow.Get()-before)
+}
@@ -0,0 +1,113 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package stream
+
+import (
+	"context"
+	"runtime/pprof"
+)
+
+// profilerEventTypeLabel is the pprof label set to the type of the event
+// being decoded, when profiler labels are associated with the context.
+const profilerEventTypeLabel = "event_type"
+
+// profilerLabelEventTypes holds the event types for which the
+// event_type label is set; other event types are labelled "unknown".
+var profilerLabelEventTypes = []string{
+	errorEventType,
+	metadataEventType,
+	metricsetEventType,
+	profileEventType,
+	spanEventType,
+	transactionEventType,
+	rumv3ErrorEventType,
+	rumv3MetadataEventType,
+	rumv3TransactionEventType,
+}
+
+type profilerLabelsKey struct{}
+
+// ContextWithProfilerLabels returns a copy of parent associated with
+// labels, which HandleStream sets as pprof labels on the goroutine while
+// reading and decoding the stream, so CPU profiles attribute decoding to
+// e.g. the tenant sending the stream. The type of the event being decoded
+// is additionally recorded in the "event_type" label.
+//
+// Without labels, HandleStream does not modify the goroutine's labels.
+func ContextWithProfilerLabels(parent context.Context, labels map[string]string) context.Context {
+	return context.WithValue(parent, profilerLabelsKey{}, labels)
+}
+
+// profilerLabels holds the contexts carrying the pprof labels set on the
+// goroutine by HandleStream. A nil *profilerLabels sets no labels.
+type profilerLabels struct {
+	parent     context.Context
+	base       context.Context
+	eventTypes map[string]context.Context
+	unknown    context.Context
+}
+
+// newProfilerLabels returns a *profilerLabels for the labels associated
+// with ctx, or nil if there are none.
+func newProfilerLabels(ctx context.Context) *profilerLabels {
+	labels, _ := ctx.Value(profilerLabelsKey{}).(map[string]string)
+	if len(labels) == 0 {
+		return nil
+	}
+	args := make([]string, 0, len(labels)*2)
+	for k, v := range labels {
+		args = append(args, k, v)
+	}
+	base := pprof.WithLabels(ctx, pprof.Labels(args...))
+	eventTypes := make(map[string]context.Context, len(profilerLabelEventTypes))
+	for _, eventType := range profilerLabelEventTypes {
+		eventTypes[eventType] = pprof.WithLabels(base, pprof.Labels(profilerEventTypeLabel, eventType))
+	}
+	return &profilerLabels{
+		parent:     ctx,
+		base:       base,
+		eventTypes: eventTypes,
+		unknown:    pprof.WithLabels(base, pprof.Labels(profilerEventTypeLabel, unknownEventType)),
+	}
+}
+
+// set sets the labels, without an event type, on the current goroutine.
+func (l *profilerLabels) set() {
+	if l != nil {
+		pprof.SetGoroutineLabels(l.base)
+	}
+}
+
+// setEventType sets the labels, including eventType, on the current goroutine.
+func (l *profilerLabels) setEventType(eventType []byte) {
+	if l == nil {
+		return
+	}
+	ctx, ok := l.eventTypes[string(eventType)]
+	if !ok {
+		ctx = l.unknown
+	}
+	pprof.SetGoroutineLabels(ctx)
+}
+
+// restore restores the goroutine's labels to those of the parent context.
+func (l *profilerLabels) restore() {
+	if l != nil {
+		pprof.SetGoroutineLabels(l.parent)
+	}
+}
@@ -0,0 +1,91 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package stream
+
+import (
+	"context"
+	"io"
+
+	"github.com/elastic/apm-server/model"
+)
+
+type progressKey struct{}
+
+// HandleStreamChan is like HandleStream, but additionally sends a snapshot
+// of result on progress each time a batch of events has been processed, so
+// callers can report the progress of long-running streams, e.g. imports.
+// progress is closed when HandleStreamChan returns. The final outcome of the
+// stream is recorded in result and the returned error, as for HandleStream.
+//
+// Snapshots are sent without blocking the stream: if the caller has not
+// received the previous snapshot when a batch has been processed, it is
+// replaced by the newer one, so only the latest snapshot is kept. Once the
+// stream ends, HandleStreamChan waits for the latest snapshot, if any, to be
+// received, or for ctx to be done, so callers should receive from progress
+// until it is closed. Snapshots are independent copies of result, which may
+// be retained by the caller.
+func (p *Processor) HandleStreamChan(
+	ctx context.Context,
+	baseEvent model.APMEvent,
+	reader io.Reader,
+	batchSize int,
+	processor model.BatchProcessor,
+	result *Result,
+	progress chan<- Result,
+) error {
+	latest := make(chan Result, 1)
+	forwarded := make(chan struct{})
+	go func() {
+		defer close(forwarded)
+		defer close(progress)
+		for snapshot := range latest {
+			select {
+			case progress <- snapshot:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	defer func() {
+		close(latest)
+		<-forwarded
+	}()
+	ctx = context.WithValue(ctx, progressKey{}, latest)
+	return p.HandleStream(ctx, baseEvent, reader, batchSize, processor, result)
+}
+
+// reportProgress records a snapshot of result as the latest snapshot for
+// the HandleStreamChan associated with ctx, if any, replacing a previous
+// snapshot which has not yet been forwarded to the caller.
+func reportProgress(ctx context.Context, result *Result) {
+	latest, _ := ctx.Value(progressKey{}).(chan Result)
+	if latest == nil {
+		return
+	}
+	snapshot := *result
+	snapshot.Errors = append([]error(nil), result.Errors...)
+	snapshot.Warnings = append([]Warning(nil), result.Warnings...)
+	// The stream is the only sender, so after discarding a stale
+	// snapshot, if one has not been received meanwhile, the send
+	// cannot block.
+	select {
+	case <-latest:
+	default:
+	}
+	latest <- snapshot
+}
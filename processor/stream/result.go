@@ -18,13 +18,41 @@
 package stream
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"strconv"
+	"sync"
 
 	"github.com/elastic/elastic-agent-libs/monitoring"
+
+	"github.com/elastic/apm-server/decoder"
+	"github.com/elastic/apm-server/publish"
 )
 
 const (
-	errorsLimit = 5
+	errorsLimit   = 5
+	warningsLimit = 5
+)
+
+const (
+	// WarningTransactionTruncated is the warning code reported when the
+	// name or type of a transaction is truncated.
+	WarningTransactionTruncated = "transaction_truncated"
+
+	// WarningSpanCountNegative is the warning code reported when a
+	// negative transaction span count is set to zero.
+	WarningSpanCountNegative = "span_count_negative"
+
+	// WarningTimestampClamped is the warning code reported when an event
+	// timestamp outside the accepted window is set to the request time.
+	WarningTimestampClamped = "timestamp_clamped"
+
+	// WarningLabelDropped is the warning code reported when an event label
+	// conflicting with a metadata label is dropped in favour of the
+	// metadata label.
+	WarningLabelDropped = "label_dropped"
 )
 
 var (
@@ -32,15 +60,176 @@ var (
 	mAccepted = monitoring.NewInt(m, "accepted")
 	mInvalid  = monitoring.NewInt(m, "errors.invalid")
 	mTooLarge = monitoring.NewInt(m, "errors.toolarge")
+
+	// mLabelConflicts counts labels set by events which were already
+	// defined with another value in the stream's metadata.
+	mLabelConflicts = monitoring.NewInt(m, "label_conflicts")
+
+	// mNegativeSpanCounts counts transactions decoded with a negative
+	// dropped or started span count.
+	mNegativeSpanCounts = monitoring.NewInt(m, "negative_span_counts")
+
+	// mTimestampsOutOfWindow counts events decoded with a timestamp
+	// outside the accepted window around the request time.
+	mTimestampsOutOfWindow = monitoring.NewInt(m, "timestamps_out_of_window")
+
+	// mInFlightBytes holds the total size of in-flight batches,
+	// as recorded by an InFlightLimiter.
+	mInFlightBytes = monitoring.NewInt(m, "inflight.bytes")
+
+	// mRejectedSizes holds histograms of rejected event document sizes,
+	// keyed by event type and then by rejection reason.
+	mRejectedSizes = newRejectedSizeHistograms(m.NewRegistry("rejected"))
+
+	// mBatchEvents holds a histogram of the number of events read into
+	// each batch, recorded by processors with RecordBatchEvents set.
+	mBatchEvents = newHistogram(m.NewRegistry("batch_events"), "sum", "", batchEventsBuckets)
+
+	// mUnrecognized counts events with unrecognized event types,
+	// keyed by the sanitized event type.
+	mUnrecognized = newUnrecognizedCounters(m.NewRegistry("unrecognized"), unrecognizedTypesLimit)
+)
+
+const (
+	rejectedReasonTooLarge   = "too_large"
+	rejectedReasonValidation = "validation"
+
+	unknownEventType = "unknown"
 )
 
+const (
+	// unrecognizedTypesLimit holds the maximum number of distinct event
+	// types counted by mUnrecognized. Further types are counted as
+	// unrecognizedOtherType, to bound the number of metrics.
+	unrecognizedTypesLimit = 50
+	unrecognizedOtherType  = "other"
+
+	// unrecognizedTypeMaxLength holds the maximum length of event
+	// types counted by mUnrecognized. Longer types are truncated.
+	unrecognizedTypeMaxLength = 32
+)
+
+// LineSizeBounds holds the inclusive upper bounds, in bytes, of the
+// buckets of Result.LineSizes. It must not be modified.
+var LineSizeBounds = [...]int{
+	1024,
+	10 * 1024,
+	100 * 1024,
+	300 * 1024,
+	1024 * 1024,
+}
+
+// rejectedSizeBuckets holds the inclusive upper bounds, in bytes, of the
+// buckets used for recording rejected event document sizes. Sizes greater
+// than the last bound are recorded in an additional "le_inf" bucket.
+var rejectedSizeBuckets = LineSizeBounds[:]
+
+// batchEventsBuckets holds the inclusive upper bounds of the buckets used
+// for recording the number of events read into each batch.
+var batchEventsBuckets = []int{1, 5, 10, 50, 100, 500, 1000}
+
+// Result describes the outcome of processing a stream. Its JSON encoding,
+// as returned by MarshalJSON, is described there.
 type Result struct {
 	Accepted int
 	Errors   []error
+
+	// ErrorsOmitted holds the number of per-event errors which were not
+	// recorded in Errors, as the limit of recorded errors was reached.
+	ErrorsOmitted int
+
+	// LinesSeen holds the number of lines read from the stream, including
+	// the metadata line, and empty or rejected lines.
+	LinesSeen int
+
+	// BytesSeen holds the total length in bytes of the lines read from
+	// the stream, excluding newlines.
+	BytesSeen int
+
+	// MaxLineLength holds the length in bytes of the longest line read
+	// from the stream, excluding newlines. Lines exceeding the maximum
+	// event size are recorded with their full length.
+	MaxLineLength int
+
+	// LineSizes holds the number of lines read from the stream by length:
+	// LineSizes[i] counts the lines no longer than LineSizeBounds[i], and
+	// not counted by LineSizes[i-1]. The last element counts the lines
+	// longer than all of LineSizeBounds.
+	LineSizes [len(LineSizeBounds) + 1]int
+
+	// BytesRead holds the number of bytes read from the stream's reader
+	// when HandleStream returns early with an error, and is zero otherwise.
+	// If the reader reads from a request body, e.g. decompressing it, and
+	// has a RequestBytesRead method, BytesRead holds the number of bytes
+	// read from the request body instead.
+	//
+	// The reader is read through a buffer, so BytesRead is approximate:
+	// it includes bytes read ahead of the last line processed, and is
+	// aligned to the buffer size. Callers which know the total length of
+	// the stream, e.g. its Content-Length, may use it to determine how many
+	// bytes remained unread.
+	BytesRead int64
+
+	// Warnings holds non-fatal conditions encountered while processing
+	// accepted events, such as fields being truncated.
+	Warnings []Warning
+}
+
+// Warning describes a non-fatal condition encountered while processing
+// events. Warnings do not cause events to be rejected.
+type Warning struct {
+	// Code identifies the kind of condition, e.g. "transaction_truncated".
+	Code string
+
+	// Message describes the first occurrence of the condition.
+	Message string
+
+	// Count holds the number of times the condition occurred.
+	Count int
+}
+
+// AddWarning records a warning. Warnings are deduplicated by code, keeping
+// the first message and counting occurrences, and at most warningsLimit
+// distinct warnings are recorded.
+func (r *Result) AddWarning(code, message string) {
+	for i := range r.Warnings {
+		if r.Warnings[i].Code == code {
+			r.Warnings[i].Count++
+			return
+		}
+	}
+	if len(r.Warnings) < warningsLimit {
+		r.Warnings = append(r.Warnings, Warning{Code: code, Message: message, Count: 1})
+	}
+}
+
+// Reset resets r to its zero value, so it may be reused.
+func (r *Result) Reset() {
+	*r = Result{}
+}
+
+// addLine records a line of the given length as having been read.
+func (r *Result) addLine(length int) {
+	r.LinesSeen++
+	r.BytesSeen += length
+	if length > r.MaxLineLength {
+		r.MaxLineLength = length
+	}
+	for i, le := range LineSizeBounds {
+		if length <= le {
+			r.LineSizes[i]++
+			return
+		}
+	}
+	r.LineSizes[len(LineSizeBounds)]++
 }
 
 func (r *Result) LimitedAdd(err error) {
-	r.add(err, len(r.Errors) < errorsLimit)
+	add := len(r.Errors) < errorsLimit
+	if !add {
+		r.ErrorsOmitted++
+	}
+	r.add(err, add)
 }
 
 func (r *Result) Add(err error) {
@@ -66,12 +255,417 @@ func (r *Result) add(err error, add bool) {
 	}
 }
 
+// ResultSchemaVersion holds the version of the JSON encoding of Result,
+// described by Result.MarshalJSON. The version is incremented when fields
+// are removed or their meaning changes; fields may be added to the encoding
+// without changing the version.
+const ResultSchemaVersion = 1
+
+// Error codes identifying the kind of each error in the JSON encoding of
+// Result. Errors may implement ErrorCoder to describe their own code.
+const (
+	ErrorCodeInternal        = "internal"
+	ErrorCodeValidation      = "validation"
+	ErrorCodeTooLarge        = "too_large"
+	ErrorCodeRateLimited     = "rate_limited"
+	ErrorCodeUnauthorized    = "unauthorized"
+	ErrorCodeTimeout         = "timeout"
+	ErrorCodeQueueFull       = "queue_full"
+	ErrorCodeShuttingDown    = "shutting_down"
+	ErrorCodeUnavailable     = "unavailable"
+	ErrorCodeServiceDisabled = "service_disabled"
+)
+
+// ErrorCoder may be implemented by errors recorded in a Result to describe
+// their own error code, taking precedence over the code ErrorCode would
+// otherwise return.
+type ErrorCoder interface {
+	ErrorCode() string
+}
+
+// ErrorCode returns the code identifying the kind of err in the JSON
+// encoding of Result, or ErrorCodeInternal for unclassified errors.
+func ErrorCode(err error) string {
+	var coder ErrorCoder
+	var invalid *InvalidInputError
+	var terminal *TerminalError
+	switch {
+	case errors.As(err, &coder):
+		return coder.ErrorCode()
+	case errors.As(err, &invalid):
+		if invalid.TooLarge {
+			return ErrorCodeTooLarge
+		}
+		return ErrorCodeValidation
+	case errors.Is(err, ErrShuttingDown), errors.Is(err, publish.ErrChannelClosed):
+		return ErrorCodeShuttingDown
+	case errors.Is(err, publish.ErrFull):
+		return ErrorCodeQueueFull
+	case errors.Is(err, ErrInFlightLimitExceeded):
+		return ErrorCodeUnavailable
+	case errors.Is(err, ErrServiceDisabled):
+		return ErrorCodeServiceDisabled
+	case errors.Is(err, ErrEventRateLimitExceeded):
+		return ErrorCodeRateLimited
+	case errors.As(err, &terminal):
+		return terminal.Kind.String()
+	}
+	return ErrorCodeInternal
+}
+
+// MarshalJSON returns the JSON encoding of r, which is used for intake
+// responses, and may be used to record results elsewhere in the same form:
+//
+//	{
+//	  "version": 1,          // ResultSchemaVersion
+//	  "accepted": 2,         // Accepted
+//	  "lines_seen": 4,       // LinesSeen, omitted if zero
+//	  "bytes_seen": 512,     // BytesSeen, omitted if zero
+//	  "errors": [{           // Errors, omitted if empty
+//	    "code": "validation",  // ErrorCode of the error
+//	    "message": "...",      // the error's message
+//	    "document": "..."      // InvalidInputError.Document, omitted if empty
+//	  }],
+//	  "omitted": 1,          // ErrorsOmitted, omitted if zero
+//	  "warnings": [{         // Warnings, omitted if empty
+//	    "code": "...",
+//	    "message": "...",
+//	    "count": 1
+//	  }]
+//	}
+//
+// Other fields of r are not encoded. MarshalJSON has a value receiver so
+// that Result values, as well as pointers, are encoded in this form.
+func (r Result) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.jsonResult())
+}
+
+// NumErrors returns the number of errors in r.
+func (r *Result) NumErrors() int {
+	return len(r.Errors)
+}
+
+// TruncateErrors returns a copy of r holding only the first n errors,
+// followed by an error noting how many errors were omitted, which are
+// also counted in ErrorsOmitted. It is used to limit the size of
+// intake responses.
+func (r *Result) TruncateErrors(n int) interface{} {
+	truncated := *r
+	omitted := len(r.Errors) - n
+	truncated.Errors = append(r.Errors[:n:n], fmt.Errorf(
+		"%d more errors omitted: maximum response size exceeded", omitted,
+	))
+	truncated.ErrorsOmitted += omitted
+	return &truncated
+}
+
+func (r *Result) jsonResult() jsonResult {
+	out := jsonResult{
+		Version:   ResultSchemaVersion,
+		Accepted:  r.Accepted,
+		LinesSeen: r.LinesSeen,
+		BytesSeen: r.BytesSeen,
+		Omitted:   r.ErrorsOmitted,
+	}
+	if len(r.Errors) > 0 {
+		out.Errors = make([]jsonError, len(r.Errors))
+		for i, err := range r.Errors {
+			out.Errors[i] = jsonError{Code: ErrorCode(err), Message: err.Error()}
+			var invalid *InvalidInputError
+			if errors.As(err, &invalid) {
+				out.Errors[i].Message = invalid.Message
+				out.Errors[i].Document = invalid.Document
+			}
+		}
+	}
+	for _, w := range r.Warnings {
+		out.Warnings = append(out.Warnings, jsonWarning{
+			Code:    w.Code,
+			Message: w.Message,
+			Count:   w.Count,
+		})
+	}
+	return out
+}
+
+type jsonResult struct {
+	Version   int           `json:"version"`
+	Accepted  int           `json:"accepted"`
+	LinesSeen int           `json:"lines_seen,omitempty"`
+	BytesSeen int           `json:"bytes_seen,omitempty"`
+	Errors    []jsonError   `json:"errors,omitempty"`
+	Omitted   int           `json:"omitted,omitempty"`
+	Warnings  []jsonWarning `json:"warnings,omitempty"`
+}
+
+type jsonError struct {
+	Code     string `json:"code"`
+	Message  string `json:"message"`
+	Document string `json:"document,omitempty"`
+}
+
+type jsonWarning struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Count   int    `json:"count"`
+}
+
 type InvalidInputError struct {
 	TooLarge bool
 	Message  string
 	Document string
+
+	// Truncated is set when the stream ended in the middle of an event,
+	// indicating that the upload was cut off rather than malformed.
+	// BytesRead then holds the number of bytes of the event read
+	// before the end of the stream.
+	Truncated bool
+	BytesRead int
 }
 
 func (e *InvalidInputError) Error() string {
 	return e.Message
 }
+
+// TerminalErrorKind classifies the terminal errors returned by HandleStream
+// when processing a batch of events fails, or the stream cannot be read.
+type TerminalErrorKind int
+
+const (
+	// TerminalErrorInternal classifies errors not covered by other kinds,
+	// such as failures to store events.
+	TerminalErrorInternal TerminalErrorKind = iota
+
+	// TerminalErrorRateLimited classifies errors caused by rate limiting,
+	// wrapping ErrEventRateLimitExceeded or an ErrorCoder whose code is
+	// ErrorCodeRateLimited, such as ratelimit.ErrRateLimitExceeded.
+	TerminalErrorRateLimited
+
+	// TerminalErrorUnauthorized classifies errors caused by the stream not
+	// being authorized to send events, wrapping an ErrorCoder whose code
+	// is ErrorCodeUnauthorized, such as auth.ErrUnauthorized.
+	TerminalErrorUnauthorized
+
+	// TerminalErrorTimeout classifies errors caused by timeouts, wrapping
+	// context.DeadlineExceeded or errors with a Timeout method returning
+	// true.
+	TerminalErrorTimeout
+
+	// TerminalErrorTooLarge classifies errors caused by the stream's
+	// decompressed body exceeding its limits, wrapping
+	// *decoder.DecompressionLimitError.
+	TerminalErrorTooLarge
+)
+
+// String returns the name of the kind.
+func (k TerminalErrorKind) String() string {
+	switch k {
+	case TerminalErrorRateLimited:
+		return "rate_limited"
+	case TerminalErrorUnauthorized:
+		return "unauthorized"
+	case TerminalErrorTimeout:
+		return "timeout"
+	case TerminalErrorTooLarge:
+		return "too_large"
+	}
+	return "internal"
+}
+
+// TerminalError is returned by HandleStream when processing a batch of
+// events fails, the stream's context is done while waiting to decode, or
+// the stream's decompressed body exceeds its limits.
+// Err holds the original error, which is returned by Unwrap, so errors.Is
+// and errors.As may still be used to identify it.
+type TerminalError struct {
+	Kind TerminalErrorKind
+	Err  error
+}
+
+func (e *TerminalError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns e.Err.
+func (e *TerminalError) Unwrap() error {
+	return e.Err
+}
+
+// newTerminalError returns a *TerminalError wrapping err, classified by
+// the kind of error founds in err's chain. If err is already a
+// *TerminalError, it is returned unchanged.
+func newTerminalError(err error) error {
+	var terminal *TerminalError
+	if errors.As(err, &terminal) {
+		return err
+	}
+	kind := TerminalErrorInternal
+	var coder ErrorCoder
+	var timeout interface{ Timeout() bool }
+	switch {
+	case errors.Is(err, ErrEventRateLimitExceeded):
+		kind = TerminalErrorRateLimited
+	case errors.As(err, &coder) && coder.ErrorCode() == ErrorCodeRateLimited:
+		kind = TerminalErrorRateLimited
+	case errors.As(err, &coder) && coder.ErrorCode() == ErrorCodeUnauthorized:
+		kind = TerminalErrorUnauthorized
+	case errors.Is(err, context.DeadlineExceeded):
+		kind = TerminalErrorTimeout
+	case errors.As(err, &timeout) && timeout.Timeout():
+		kind = TerminalErrorTimeout
+	case errors.As(err, new(*decoder.DecompressionLimitError)):
+		kind = TerminalErrorTooLarge
+	}
+	return &TerminalError{Kind: kind, Err: err}
+}
+
+// histogram records values in buckets with the given inclusive upper
+// bounds, along with a total count and sum of values. Values greater
+// than the last bound are recorded in an additional "le_inf" bucket.
+type histogram struct {
+	count   *monitoring.Int
+	sum     *monitoring.Int
+	bounds  []int
+	buckets []*monitoring.Int
+}
+
+// newHistogram returns a histogram registering its metrics in r, with the
+// sum of values named sumName, and buckets named bucketPrefix followed by
+// "le_" and their upper bound.
+func newHistogram(r *monitoring.Registry, sumName, bucketPrefix string, bounds []int) *histogram {
+	h := &histogram{
+		count:   monitoring.NewInt(r, "count"),
+		sum:     monitoring.NewInt(r, sumName),
+		bounds:  bounds,
+		buckets: make([]*monitoring.Int, len(bounds)+1),
+	}
+	for i, le := range bounds {
+		h.buckets[i] = monitoring.NewInt(r, bucketPrefix+"le_"+strconv.Itoa(le))
+	}
+	h.buckets[len(bounds)] = monitoring.NewInt(r, bucketPrefix+"le_inf")
+	return h
+}
+
+// newSizeHistogram returns a histogram recording document sizes in the
+// buckets defined by rejectedSizeBuckets.
+func newSizeHistogram(r *monitoring.Registry) *histogram {
+	return newHistogram(r, "bytes", "size.", rejectedSizeBuckets)
+}
+
+func (h *histogram) record(v int) {
+	h.count.Inc()
+	h.sum.Add(int64(v))
+	for i, le := range h.bounds {
+		if v <= le {
+			h.buckets[i].Inc()
+			return
+		}
+	}
+	h.buckets[len(h.bounds)].Inc()
+}
+
+type rejectedSizeHistograms map[string]map[string]*histogram
+
+func newRejectedSizeHistograms(r *monitoring.Registry) rejectedSizeHistograms {
+	eventTypes := []string{
+		errorEventType,
+		metricsetEventType,
+		profileEventType,
+		spanEventType,
+		transactionEventType,
+		rumv3ErrorEventType,
+		rumv3TransactionEventType,
+		unknownEventType,
+	}
+	reasons := []string{rejectedReasonTooLarge, rejectedReasonValidation}
+	out := make(rejectedSizeHistograms, len(eventTypes))
+	for _, eventType := range eventTypes {
+		eventTypeRegistry := r.NewRegistry(eventType)
+		out[eventType] = make(map[string]*histogram, len(reasons))
+		for _, reason := range reasons {
+			out[eventType][reason] = newSizeHistogram(eventTypeRegistry.NewRegistry(reason))
+		}
+	}
+	return out
+}
+
+// record records the size of a rejected event document for the given event
+// type and rejection reason. Unrecognized event types are recorded as
+// "unknown".
+func (h rejectedSizeHistograms) record(eventType, reason string, size int) {
+	byReason, ok := h[eventType]
+	if !ok {
+		byReason = h[unknownEventType]
+	}
+	if hist, ok := byReason[reason]; ok {
+		hist.record(size)
+	}
+}
+
+// unrecognizedCounters counts events with unrecognized event types, keyed
+// by the sanitized event type, registering counters as types are seen.
+type unrecognizedCounters struct {
+	registry *monitoring.Registry
+	limit    int
+	other    *monitoring.Int
+
+	mu sync.Mutex
+	// counters holds the counters of distinct event types, excluding
+	// the unrecognizedOtherType counter.
+	counters map[string]*monitoring.Int
+}
+
+func newUnrecognizedCounters(r *monitoring.Registry, limit int) *unrecognizedCounters {
+	return &unrecognizedCounters{
+		registry: r,
+		limit:    limit,
+		other:    monitoring.NewInt(r, unrecognizedOtherType),
+		counters: make(map[string]*monitoring.Int),
+	}
+}
+
+// inc increments the counter for eventType. Once the limit of distinct
+// event types has been reached, new event types are counted as
+// unrecognizedOtherType.
+func (c *unrecognizedCounters) inc(eventType []byte) {
+	key := sanitizeUnrecognizedType(eventType)
+	if key == unrecognizedOtherType {
+		c.other.Inc()
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	counter, ok := c.counters[key]
+	if !ok {
+		if len(c.counters) >= c.limit {
+			counter = c.other
+		} else {
+			counter = monitoring.NewInt(c.registry, key)
+			c.counters[key] = counter
+		}
+	}
+	counter.Inc()
+}
+
+// sanitizeUnrecognizedType returns eventType truncated to at most
+// unrecognizedTypeMaxLength bytes, with all bytes other than ASCII
+// letters, digits, '-' and '_' replaced by '_', for use as a metric name.
+// An empty event type is returned as unknownEventType.
+func sanitizeUnrecognizedType(eventType []byte) string {
+	if len(eventType) == 0 {
+		return unknownEventType
+	}
+	if len(eventType) > unrecognizedTypeMaxLength {
+		eventType = eventType[:unrecognizedTypeMaxLength]
+	}
+	out := make([]byte, len(eventType))
+	for i, b := range eventType {
+		switch {
+		case b >= 'a' && b <= 'z', b >= 'A' && b <= 'Z', b >= '0' && b <= '9', b == '-', b == '_':
+			out[i] = b
+		default:
+			out[i] = '_'
+		}
+	}
+	return string(out)
+}
@@ -18,10 +18,20 @@
 package stream
 
 import (
+	"encoding/json"
+	"fmt"
+	"strings"
 	"testing"
 
 	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/elastic-agent-libs/monitoring"
+
+	"github.com/elastic/apm-server/beater/auth"
+	"github.com/elastic/apm-server/beater/ratelimit"
+	"github.com/elastic/apm-server/publish"
 )
 
 func TestResultAdd(t *testing.T) {
@@ -45,6 +55,113 @@ func TestResultAdd(t *testing.T) {
 
 	assert.Len(t, result.Errors, 6)
 	assert.Equal(t, []error{err1, err2, err3, err4, err5, err7}, result.Errors)
+	assert.Equal(t, 2, result.ErrorsOmitted)
+}
+
+func TestResultMarshalJSON(t *testing.T) {
+	var result Result
+	data, err := json.Marshal(&result)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"version":1,"accepted":0}`, string(data))
+
+	result = Result{
+		Accepted:      2,
+		LinesSeen:     6,
+		BytesSeen:     100,
+		MaxLineLength: 50, // not encoded
+		Errors: []error{
+			&InvalidInputError{Message: "invalid", Document: "{}"},
+			errors.Wrap(&InvalidInputError{Message: "too large", TooLarge: true}, "wrapped"),
+			&TerminalError{Kind: TerminalErrorRateLimited, Err: ratelimit.ErrRateLimitExceeded},
+		},
+		ErrorsOmitted: 1,
+		Warnings:      []Warning{{Code: "a", Message: "warning", Count: 2}},
+	}
+	data, err = json.Marshal(&result)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{
+		"version": 1,
+		"accepted": 2,
+		"lines_seen": 6,
+		"bytes_seen": 100,
+		"errors": [
+			{"code": "validation", "message": "invalid", "document": "{}"},
+			{"code": "too_large", "message": "too large"},
+			{"code": "rate_limited", "message": "rate limit exceeded"}
+		],
+		"omitted": 1,
+		"warnings": [{"code": "a", "message": "warning", "count": 2}]
+	}`, string(data))
+
+	// Results are encoded the same way when embedded in other values.
+	embedded, err := json.Marshal(struct{ Result Result }{result})
+	require.NoError(t, err)
+	assert.Equal(t, `{"Result":`+string(data)+`}`, string(embedded))
+}
+
+func TestResultTruncateErrors(t *testing.T) {
+	errA := errors.New("a")
+	result := Result{
+		Errors:        []error{errA, errors.New("b"), errors.New("c")},
+		ErrorsOmitted: 1,
+	}
+	assert.Equal(t, 3, result.NumErrors())
+	truncated := result.TruncateErrors(1).(*Result)
+	require.Len(t, truncated.Errors, 2)
+	assert.Equal(t, errA, truncated.Errors[0])
+	assert.EqualError(t, truncated.Errors[1], "2 more errors omitted: maximum response size exceeded")
+	assert.Equal(t, 3, truncated.ErrorsOmitted)
+	assert.Len(t, result.Errors, 3) // unmodified
+	assert.Equal(t, 1, result.ErrorsOmitted)
+}
+
+type codedTestError struct{}
+
+func (codedTestError) Error() string     { return "coded" }
+func (codedTestError) ErrorCode() string { return "custom" }
+
+func TestErrorCode(t *testing.T) {
+	for _, test := range []struct {
+		err  error
+		code string
+	}{
+		{err: errors.New("boom"), code: ErrorCodeInternal},
+		{err: &InvalidInputError{}, code: ErrorCodeValidation},
+		{err: &InvalidInputError{TooLarge: true}, code: ErrorCodeTooLarge},
+		{err: ErrShuttingDown, code: ErrorCodeShuttingDown},
+		{err: publish.ErrChannelClosed, code: ErrorCodeShuttingDown},
+		{err: &TerminalError{Err: publish.ErrFull}, code: ErrorCodeQueueFull},
+		{err: ErrInFlightLimitExceeded, code: ErrorCodeUnavailable},
+		{err: ErrServiceDisabled, code: ErrorCodeServiceDisabled},
+		{err: ratelimit.ErrRateLimitExceeded, code: ErrorCodeRateLimited},
+		{err: ErrEventRateLimitExceeded, code: ErrorCodeRateLimited},
+		{err: auth.ErrUnauthorized, code: ErrorCodeUnauthorized},
+		{err: &TerminalError{Kind: TerminalErrorTimeout, Err: errors.New("timeout")}, code: ErrorCodeTimeout},
+		{err: errors.Wrap(codedTestError{}, "wrapped"), code: "custom"},
+		{err: &StreamRejectedError{Err: errors.New("boom")}, code: ErrorCodeStreamRejected},
+		{err: &StreamRejectedError{Err: ratelimit.ErrRateLimitExceeded}, code: ErrorCodeRateLimited},
+	} {
+		assert.Equal(t, test.code, ErrorCode(test.err), test.err.Error())
+	}
+}
+
+func TestResultAddWarning(t *testing.T) {
+	var result Result
+	result.AddWarning("a", "first a")
+	result.AddWarning("b", "first b")
+	result.AddWarning("a", "second a")
+	for i := 0; i < 10; i++ {
+		result.AddWarning(fmt.Sprintf("c%d", i), "c") // limited, not added beyond warningsLimit
+	}
+	result.AddWarning("b", "second b")
+
+	assert.Equal(t, []Warning{
+		{Code: "a", Message: "first a", Count: 2},
+		{Code: "b", Message: "first b", Count: 2},
+		{Code: "c0", Message: "c", Count: 1},
+		{Code: "c1", Message: "c", Count: 1},
+		{Code: "c2", Message: "c", Count: 1},
+	}, result.Warnings)
 }
 
 func TestMonitoring(t *testing.T) {
@@ -66,3 +183,34 @@ func TestMonitoring(t *testing.T) {
 	assert.Equal(t, int64(10), mInvalid.Get()-initialInvalid)
 	assert.Equal(t, int64(2), mTooLarge.Get()-initialTooLarge)
 }
+
+func TestResultReset(t *testing.T) {
+	result := Result{Accepted: 1}
+	result.Add(errors.New("err"))
+	result.AddWarning("a", "first a")
+	result.addLine(10)
+	result.addLine(0)
+	assert.Equal(t, 2, result.LinesSeen)
+	assert.Equal(t, 10, result.BytesSeen)
+
+	result.Reset()
+	assert.Zero(t, result)
+}
+
+func TestUnrecognizedCounters(t *testing.T) {
+	registry := monitoring.NewRegistry()
+	counters := newUnrecognizedCounters(registry, 2)
+	for _, eventType := range []string{
+		"spam", "spam", "", "eggs.ham", strings.Repeat("x", 40), "bacon", "other",
+	} {
+		counters.inc([]byte(eventType))
+	}
+	assert.Equal(t, map[string]int64{
+		"spam":    2,
+		"unknown": 1,
+		"other":   4, // limit reached, or sent as "other"
+	}, monitoring.CollectFlatSnapshot(registry, monitoring.Full, false).Ints)
+
+	assert.Equal(t, "eggs_ham_", sanitizeUnrecognizedType([]byte("eggs.ham\xff")))
+	assert.Equal(t, strings.Repeat("x", 32), sanitizeUnrecognizedType([]byte(strings.Repeat("x", 40))))
+}
@@ -0,0 +1,123 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package stream
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/elastic/apm-server/publish"
+)
+
+// RetryPolicy controls the retrying of batches which fail to be published
+// with a transient error, such as the publisher's queue being full.
+//
+// Batches are retried by the publisher, which rejects them as a whole, with
+// publish.Retry: processors preceding the publisher are not called again.
+type RetryPolicy struct {
+	// MaxAttempts holds the maximum number of times publishing a batch is
+	// attempted, including the first attempt. Values less than 2 disable
+	// retries.
+	MaxAttempts int
+
+	// Backoff holds the time to wait before the first retry. The wait is
+	// doubled for each subsequent retry, up to MaxBackoff if non-zero.
+	Backoff time.Duration
+
+	// MaxBackoff, if non-zero, holds the maximum time to wait between
+	// retries.
+	MaxBackoff time.Duration
+
+	// Transient, if non-nil, reports whether a batch which the publisher
+	// rejected with err may be retried.
+	//
+	// If Transient is nil, IsTransientError is used.
+	Transient func(err error) bool
+}
+
+// IsTransientError reports whether err is a transient error, after which
+// publishing a batch may be retried: the publisher's queue being full,
+// which rejects the batch as a whole.
+func IsTransientError(err error) bool {
+	return errors.Is(err, publish.ErrFull)
+}
+
+type retryPolicyKey struct{}
+
+// ContextWithRetryPolicy returns a copy of parent associated with policy,
+// which HandleStream uses to retry batches which fail to be published with
+// a transient error. Other errors are returned immediately.
+//
+// Without a retry policy, HandleStream returns the first error processing
+// a batch.
+func ContextWithRetryPolicy(parent context.Context, policy RetryPolicy) context.Context {
+	return context.WithValue(parent, retryPolicyKey{}, policy)
+}
+
+func retryPolicyFromContext(ctx context.Context) (RetryPolicy, bool) {
+	policy, ok := ctx.Value(retryPolicyKey{}).(RetryPolicy)
+	return policy, ok && policy.MaxAttempts > 1
+}
+
+func (p RetryPolicy) transient(err error) bool {
+	if p.Transient != nil {
+		return p.Transient(err)
+	}
+	return IsTransientError(err)
+}
+
+// backoff returns the time to wait before the given retry, starting at 1.
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	d := p.Backoff
+	for i := 1; i < retry; i++ {
+		d *= 2
+		if p.MaxBackoff > 0 && d >= p.MaxBackoff {
+			break
+		}
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	return d
+}
+
+// contextWithRetry returns a copy of ctx associated with a publish.RetryFunc
+// retrying according to policy, so that only the publisher retries batches
+// it rejects, and processors preceding it process each batch once.
+//
+// The stream's semaphore is released while waiting to retry, so that other
+// streams can be read in the meantime, and re-acquired before retrying.
+func (p *Processor) contextWithRetry(ctx context.Context, policy RetryPolicy) context.Context {
+	return publish.ContextWithRetry(ctx, func(ctx context.Context, attempts int, err error) bool {
+		if attempts >= policy.MaxAttempts || !policy.transient(err) {
+			return false
+		}
+		retry := true
+		p.withoutSemaphore(func() {
+			timer := time.NewTimer(policy.backoff(attempts))
+			defer timer.Stop()
+			select {
+			case <-ctx.Done():
+				retry = false
+			case <-timer.C:
+			}
+		})
+		return retry
+	})
+}
@@ -0,0 +1,71 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package stream
+
+import (
+	"context"
+
+	"github.com/elastic/apm-server/model"
+)
+
+// SamplingOverride overrides the sampling decisions made by agents for
+// transactions decoded by HandleStream.
+type SamplingOverride interface {
+	// Sampled returns the sampling decision for the transaction event.
+	// The agent's decision is held in event.Transaction.Sampled.
+	Sampled(event *model.APMEvent) bool
+}
+
+// SamplingOverrideFunc is a function type that implements SamplingOverride.
+type SamplingOverrideFunc func(*model.APMEvent) bool
+
+// Sampled returns f(event).
+func (f SamplingOverrideFunc) Sampled(event *model.APMEvent) bool {
+	return f(event)
+}
+
+type samplingOverrideKey struct{}
+
+// ContextWithSamplingOverride returns a copy of parent associated with
+// override, which HandleStream applies to the transactions decoded from
+// the stream. Without an override, agents' sampling decisions are honored.
+//
+// Transactions which are sampled by the override, but were not sampled by
+// the agent, have their RepresentativeCount set to 1, as they are sampled
+// regardless of the agent's sampling rate. The RepresentativeCount of
+// transactions unsampled by the override is left unchanged.
+func ContextWithSamplingOverride(parent context.Context, override SamplingOverride) context.Context {
+	return context.WithValue(parent, samplingOverrideKey{}, override)
+}
+
+func samplingOverrideFromContext(ctx context.Context) SamplingOverride {
+	override, _ := ctx.Value(samplingOverrideKey{}).(SamplingOverride)
+	return override
+}
+
+// overrideSampled applies override to event, if it is a transaction event.
+func overrideSampled(override SamplingOverride, event *model.APMEvent) {
+	if event.Processor != model.TransactionProcessor {
+		return
+	}
+	sampled := override.Sampled(event)
+	if sampled && !event.Transaction.Sampled {
+		event.Transaction.RepresentativeCount = 1
+	}
+	event.Transaction.Sampled = sampled
+}
@@ -0,0 +1,89 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package stream
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/elastic/elastic-agent-libs/logp"
+
+	"github.com/elastic/apm-server/beater/config"
+	logs "github.com/elastic/apm-server/log"
+	"github.com/elastic/apm-server/model"
+	"github.com/elastic/apm-server/model/modeldecoder"
+)
+
+var errNegativeSpanCount = errors.New("invalid transaction: negative span count")
+
+var (
+	// spanCountLoggerOnce guards the creation of spanCountLogger, which is
+	// deferred until first use so that it picks up the configured logger
+	// rather than the one in place at package initialisation.
+	spanCountLoggerOnce sync.Once
+	spanCountLogger     *logp.Logger
+)
+
+// negativeSpanCountLogger returns the rate-limited logger used for logging
+// transactions with negative span counts, which may be sent by a buggy
+// agent for every transaction.
+func negativeSpanCountLogger() *logp.Logger {
+	spanCountLoggerOnce.Do(func() {
+		spanCountLogger = logp.NewLogger(logs.Handler, logs.WithRateLimit(time.Minute))
+	})
+	return spanCountLogger
+}
+
+// checkSpanCounts checks the span counts of transactions decoded on top of
+// input.Base, handling negative counts according to policy, one of the
+// config.IntakeNegativeSpanCount* values. An empty policy is treated as
+// config.IntakeNegativeSpanCountClamp. Transactions with negative span
+// counts are logged, subject to rate limiting, and counted in the "negative_span_counts" metric.
+//
+// If policy is config.IntakeNegativeSpanCountReject, checkSpanCounts returns
+// an error. Otherwise, negative counts are set to zero, with a warning.
+func checkSpanCounts(policy string, input *modeldecoder.Input, events model.Batch) error {
+	for i := range events {
+		event := &events[i]
+		if event.Transaction == nil || !event.Transaction.SpanCount.Negative() {
+			continue
+		}
+		mNegativeSpanCounts.Inc()
+		negativeSpanCountLogger().Warnw(errNegativeSpanCount.Error(),
+			"service.name", event.Service.Name,
+			"transaction.id", event.Transaction.ID,
+			"transaction.span_count.dropped", spanCountValue(event.Transaction.SpanCount.Dropped),
+			"transaction.span_count.started", spanCountValue(event.Transaction.SpanCount.Started),
+		)
+		if policy == config.IntakeNegativeSpanCountReject {
+			return errNegativeSpanCount
+		}
+		event.Transaction.SpanCount.ClampNegative()
+		input.Warnf(WarningSpanCountNegative, "transaction span count is negative and was set to zero")
+	}
+	return nil
+}
+
+// spanCountValue returns *count, or nil if count is nil, for logging.
+func spanCountValue(count *int) interface{} {
+	if count == nil {
+		return nil
+	}
+	return *count
+}
@@ -0,0 +1,212 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package stream
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/elastic/go-hdrhistogram"
+
+	"github.com/elastic/apm-server/model"
+)
+
+const (
+	// maxStreamLatency holds the maximum stream latency, in microseconds,
+	// recorded by an IntakeStatsRecorder. Greater latencies are recorded
+	// as maxStreamLatency.
+	maxStreamLatency = int64(time.Hour / time.Microsecond)
+)
+
+// IntakeStats holds intake statistics aggregated over an interval.
+type IntakeStats struct {
+	// Interval holds the duration over which the statistics were aggregated.
+	Interval time.Duration
+
+	// Accepted holds the number of accepted events, keyed by event type:
+	// "transaction", "span", "error", "metric", or "profile".
+	Accepted map[string]int64
+
+	// Rejected holds the number of events rejected as invalid, too large,
+	// or due to the in-flight limit, keyed by event type. Events of an
+	// unrecognized type are recorded as "unknown".
+	Rejected map[string]int64
+
+	// Bytes holds the number of uncompressed bytes read from streams.
+	Bytes int64
+
+	// Streams holds the number of streams handled.
+	Streams int64
+
+	// Latency holds percentiles of the time taken to handle a stream,
+	// from the start of reading until its last batch was processed.
+	Latency LatencyPercentiles
+}
+
+// LatencyPercentiles holds latency percentiles.
+type LatencyPercentiles struct {
+	P50 time.Duration
+	P95 time.Duration
+	P99 time.Duration
+}
+
+// IntakeStatsRecorder aggregates intake statistics recorded by the
+// processors sharing it, for periodic reporting to a callback.
+//
+// A nil *IntakeStatsRecorder records nothing.
+type IntakeStatsRecorder struct {
+	mu       sync.Mutex
+	accepted map[string]int64
+	rejected map[string]int64
+	bytes    int64
+	latency  *hdrhistogram.Histogram
+}
+
+// NewIntakeStatsRecorder returns a new IntakeStatsRecorder.
+func NewIntakeStatsRecorder() *IntakeStatsRecorder {
+	return &IntakeStatsRecorder{
+		accepted: make(map[string]int64),
+		rejected: make(map[string]int64),
+		latency:  hdrhistogram.New(1, maxStreamLatency, 2),
+	}
+}
+
+// Run invokes callback every interval with the statistics recorded since
+// the previous invocation, until ctx is cancelled.
+func (r *IntakeStatsRecorder) Run(ctx context.Context, interval time.Duration, callback func(IntakeStats)) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	last := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case now := <-ticker.C:
+			callback(r.take(now.Sub(last)))
+			last = now
+		}
+	}
+}
+
+// take returns the statistics recorded so far, and resets them.
+func (r *IntakeStatsRecorder) take(interval time.Duration) IntakeStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stats := IntakeStats{
+		Interval: interval,
+		Accepted: r.accepted,
+		Rejected: r.rejected,
+		Bytes:    r.bytes,
+		Streams:  r.latency.TotalCount(),
+		Latency: LatencyPercentiles{
+			P50: time.Duration(r.latency.ValueAtQuantile(50)) * time.Microsecond,
+			P95: time.Duration(r.latency.ValueAtQuantile(95)) * time.Microsecond,
+			P99: time.Duration(r.latency.ValueAtQuantile(99)) * time.Microsecond,
+		},
+	}
+	r.accepted = make(map[string]int64, len(r.accepted))
+	r.rejected = make(map[string]int64, len(r.rejected))
+	r.bytes = 0
+	r.latency.Reset()
+	return stats
+}
+
+// countEventTypes returns the number of events in batch, keyed by event
+// type, for recording with recordAccepted once the batch is processed.
+// Events must be counted before the batch is passed to a
+// model.BatchProcessor, which takes ownership of it.
+func (r *IntakeStatsRecorder) countEventTypes(batch model.Batch) map[string]int64 {
+	if r == nil {
+		return nil
+	}
+	counts := make(map[string]int64)
+	for _, event := range batch {
+		counts[event.Processor.Event]++
+	}
+	return counts
+}
+
+// recordAccepted records accepted events, counted by countEventTypes.
+func (r *IntakeStatsRecorder) recordAccepted(counts map[string]int64) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for eventType, n := range counts {
+		r.accepted[eventType] += n
+	}
+}
+
+// recordRejected records an event of the given intake event type as rejected.
+func (r *IntakeStatsRecorder) recordRejected(eventType string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.rejected[intakeStatsEventType(eventType)]++
+}
+
+// recordStream records a stream of the given size in bytes, which
+// took latency to handle.
+func (r *IntakeStatsRecorder) recordStream(bytes int64, latency time.Duration) {
+	if r == nil {
+		return
+	}
+	us := latency.Microseconds()
+	if us > maxStreamLatency {
+		us = maxStreamLatency
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.bytes += bytes
+	r.latency.RecordValue(us)
+}
+
+// intakeStatsEventType returns the event type under which intake events
+// of the given type are recorded, matching model.Processor.Event.
+func intakeStatsEventType(eventType string) string {
+	switch eventType {
+	case errorEventType, rumv3ErrorEventType:
+		return model.ErrorProcessor.Event
+	case transactionEventType, rumv3TransactionEventType:
+		return model.TransactionProcessor.Event
+	case spanEventType:
+		return model.SpanProcessor.Event
+	case metricsetEventType:
+		return model.MetricsetProcessor.Event
+	case profileEventType:
+		return model.ProfileProcessor.Event
+	}
+	return unknownEventType
+}
+
+// countingReader counts the bytes read from an io.Reader.
+type countingReader struct {
+	io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.n += int64(n)
+	return n, err
+}
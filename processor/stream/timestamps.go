@@ -0,0 +1,64 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package stream
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/elastic/apm-server/beater/config"
+	"github.com/elastic/apm-server/model"
+	"github.com/elastic/apm-server/model/modeldecoder"
+)
+
+// checkTimestamps checks that the timestamps of events decoded on top of
+// input.Base are within window of input.Base.Timestamp, the time at which
+// the request was received, handling events outside the window according
+// to policy, one of the config.IntakeTimestampOutOfWindow* values. An empty
+// policy is treated as config.IntakeTimestampOutOfWindowClamp. Events outside
+// the window are counted in the "timestamps_out_of_window" metric.
+//
+// If policy is config.IntakeTimestampOutOfWindowDrop, checkTimestamps
+// returns an error. Otherwise, the timestamps of events outside the window
+// are set to input.Base.Timestamp, with a warning.
+//
+// Timestamps are not checked if window is zero, or the request time is
+// unknown.
+func checkTimestamps(window time.Duration, policy string, input *modeldecoder.Input, events model.Batch) error {
+	received := input.Base.Timestamp
+	if window <= 0 || received.IsZero() {
+		return nil
+	}
+	for i := range events {
+		event := &events[i]
+		if skew := event.Timestamp.Sub(received); skew >= -window && skew <= window {
+			continue
+		}
+		mTimestampsOutOfWindow.Inc()
+		if policy == config.IntakeTimestampOutOfWindowDrop {
+			return fmt.Errorf(
+				"invalid event: timestamp %s is more than %s from the request time %s",
+				event.Timestamp.UTC().Format(time.RFC3339Nano), window,
+				received.UTC().Format(time.RFC3339Nano),
+			)
+		}
+		event.Timestamp = received
+		input.Warnf(WarningTimestampClamped, "event timestamp is more than %s from the request time and was set to the request time", window)
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package stream
+
+import (
+	"context"
+
+	"github.com/elastic/apm-server/model"
+)
+
+// BatchTransform filters or modifies a batch of events decoded by
+// HandleStream, e.g. to drop health-check transactions, before it is
+// processed. Unlike per-event processing, a BatchTransform may inspect
+// the whole batch to make its decisions.
+type BatchTransform func(*model.Batch)
+
+type batchTransformKey struct{}
+
+// ContextWithBatchTransform returns a copy of parent associated with
+// transform, which HandleStream applies to each batch of events decoded
+// from the stream before it is passed to the BatchProcessor. If the
+// transformed batch is empty, the BatchProcessor is not called.
+//
+// Events removed by transform are not counted as accepted.
+func ContextWithBatchTransform(parent context.Context, transform BatchTransform) context.Context {
+	return context.WithValue(parent, batchTransformKey{}, transform)
+}
+
+func batchTransformFromContext(ctx context.Context) BatchTransform {
+	transform, _ := ctx.Value(batchTransformKey{}).(BatchTransform)
+	return transform
+}
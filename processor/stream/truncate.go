@@ -0,0 +1,37 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package stream
+
+import (
+	"github.com/elastic/apm-server/model"
+	"github.com/elastic/apm-server/model/modeldecoder"
+)
+
+// truncateTransactions truncates the names and types of transactions
+// decoded on top of input.Base to at most nameMaxLength and typeMaxLength
+// characters, with a warning, so they are truncated before transaction
+// metrics are aggregated. If a maximum is zero or less, the length is not
+// limited.
+func truncateTransactions(nameMaxLength, typeMaxLength int, input *modeldecoder.Input, events model.Batch) {
+	for i := range events {
+		event := &events[i]
+		if event.Transaction != nil && event.Transaction.TruncateNameType(nameMaxLength, typeMaxLength) {
+			input.Warnf(WarningTransactionTruncated, "transaction name or type exceeds the maximum length and was truncated")
+		}
+	}
+}
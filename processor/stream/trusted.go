@@ -0,0 +1,152 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package stream
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/pkg/errors"
+
+	"github.com/elastic/apm-server/decoder"
+	"github.com/elastic/apm-server/model"
+	"github.com/elastic/apm-server/model/modeldecoder"
+)
+
+// HandleTrustedStream processes the ND-JSON events held in data in batches
+// of batchSize at a time, like HandleStream. It is intended for trusted
+// internal sources which have already validated their events, and skips
+// much of the bookkeeping HandleStream does to report problems with input:
+// lines are decoded directly from data, and no Result is recorded.
+//
+// The safety contract of HandleTrustedStream is that data must hold
+// well-formed ND-JSON, as produced by agents: a metadata line, followed
+// by event lines of recognized types, each holding a single JSON object.
+// In exchange for speed, HandleTrustedStream:
+//
+//   - ignores MaxEventSize, MaxMetadataSize and the InFlightLimiter, so
+//     data must already have been bounded by the caller;
+//   - ignores the per-request options associated with ctx, such as the
+//     event rate limiter and sampling override;
+//   - does not record Stats, or the sizes of accepted and rejected events;
+//   - skips empty lines, and does not otherwise check for malformed lines;
+//   - stops at the first line that cannot be decoded, returning an error
+//     which does not include the line's content. Events of the batch being
+//     decoded are discarded, but earlier batches will have been processed.
+//
+// Decoded events share baseEvent, extended with the stream's metadata, and
+// are not cloned; default labels are still added to events, cloning their
+// labels. The decoded events do not reference data, which may be reused
+// once HandleTrustedStream returns.
+//
+// HandleTrustedStream returns ErrShuttingDown if Shutdown has been called.
+func (p *Processor) HandleTrustedStream(
+	ctx context.Context,
+	baseEvent model.APMEvent,
+	data []byte,
+	batchSize int,
+	processor model.BatchProcessor,
+) error {
+	if !p.beginStream() {
+		return ErrShuttingDown
+	}
+	defer p.streams.Done()
+
+	select {
+	case p.sem <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-p.sem }()
+
+	r := newTrustedStreamReader(data)
+	if !r.next() {
+		return errors.New("EOF while reading metadata")
+	}
+	if err := p.decodeMetadata(r, &baseEvent); err != nil {
+		return errors.Wrap(err, "failed to decode metadata")
+	}
+	if p.ServiceDenylist != nil && p.ServiceDenylist.Denied(ctx, baseEvent.Service.Name, baseEvent.Service.Environment) {
+		return ErrServiceDisabled
+	}
+
+	input := modeldecoder.Input{
+		Base:                         baseEvent,
+		DropCookies:                  p.cookies.Drop,
+		MaxCookies:                   p.cookies.Max,
+		TransactionMarksKeySanitizer: p.TransactionMarksKeySanitizer,
+	}
+	var batch model.Batch
+	for lines := 0; r.next(); {
+		eventType := p.identifyEventType(r.line)
+		decodedLen := len(batch)
+		if err := p.decodeEvent(eventType, r, &input, &batch); err != nil {
+			return errors.Wrap(err, "failed to decode event")
+		}
+		if len(p.defaultLabels) > 0 {
+			for i := range batch[decodedLen:] {
+				p.addDefaultLabels(string(eventType), &batch[decodedLen+i])
+			}
+		}
+		if lines++; lines == batchSize {
+			// ProcessBatch takes ownership of batch.
+			if err := processor.ProcessBatch(ctx, &batch); err != nil {
+				return err
+			}
+			batch, lines = nil, 0
+		}
+	}
+	if len(batch) > 0 {
+		return processor.ProcessBatch(ctx, &batch)
+	}
+	return nil
+}
+
+// trustedStreamReader decodes ND-JSON lines held in memory.
+type trustedStreamReader struct {
+	decoder.JSONDecoder
+	data       []byte
+	line       []byte
+	lineReader bytes.Reader
+}
+
+func newTrustedStreamReader(data []byte) *trustedStreamReader {
+	r := &trustedStreamReader{data: data}
+	r.JSONDecoder = decoder.NewJSONDecoder(&r.lineReader)
+	return r
+}
+
+// next advances r to the next non-empty line, to be decoded with Decode,
+// returning false if there are no more lines.
+func (r *trustedStreamReader) next() bool {
+	for len(r.data) > 0 {
+		line := r.data
+		if i := bytes.IndexByte(line, '\n'); i >= 0 {
+			line, r.data = line[:i], r.data[i+1:]
+		} else {
+			r.data = nil
+		}
+		if len(line) == 0 {
+			continue
+		}
+		r.line = line
+		r.lineReader.Reset(line)
+		return true
+	}
+	return false
+}
@@ -142,10 +142,15 @@ func (p *Publisher) ProcessBatch(ctx context.Context, batch *model.Batch) error
 }
 
 // Send tries to forward pendingReq to the publishers worker. If the queue is full,
-// an error is returned.
+// an error is returned, unless the request is retried according to the RetryFunc
+// associated with ctx by ContextWithRetry.
 //
 // Calling Send after Stop will return an error without enqueuing the request.
 func (p *Publisher) Send(ctx context.Context, req PendingReq) error {
+	return Retry(ctx, func() error { return p.send(ctx, req) })
+}
+
+func (p *Publisher) send(ctx context.Context, req PendingReq) error {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
 	if p.stopping {
@@ -105,6 +105,41 @@ func TestPublisherStopShutdownInactive(t *testing.T) {
 	assert.NoError(t, publisher.Stop(context.Background()))
 }
 
+func TestRetry(t *testing.T) {
+	send := func(errs ...error) func() error {
+		return func() error {
+			if len(errs) == 0 {
+				return nil
+			}
+			err := errs[0]
+			errs = errs[1:]
+			return err
+		}
+	}
+	var retries []int
+	ctx := publish.ContextWithRetry(context.Background(), func(ctx context.Context, attempts int, err error) bool {
+		assert.Equal(t, publish.ErrFull, err)
+		retries = append(retries, attempts)
+		return attempts < 3
+	})
+
+	// Requests rejected with ErrFull are retried while RetryFunc returns true.
+	assert.NoError(t, publish.Retry(ctx, send(publish.ErrFull, publish.ErrFull)))
+	assert.Equal(t, []int{1, 2}, retries)
+
+	retries = nil
+	assert.Equal(t, publish.ErrFull, publish.Retry(ctx, send(publish.ErrFull, publish.ErrFull, publish.ErrFull)))
+	assert.Equal(t, []int{1, 2, 3}, retries)
+
+	// Other errors are not retried.
+	retries = nil
+	assert.Equal(t, publish.ErrChannelClosed, publish.Retry(ctx, send(publish.ErrChannelClosed)))
+	assert.Empty(t, retries)
+
+	// Without a RetryFunc, ErrFull is not retried.
+	assert.Equal(t, publish.ErrFull, publish.Retry(context.Background(), send(publish.ErrFull)))
+}
+
 func BenchmarkPublisher(b *testing.B) {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
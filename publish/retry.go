@@ -0,0 +1,52 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package publish
+
+import "context"
+
+// RetryFunc is called when a request cannot be published because the
+// queue is full, with the number of attempts made so far and the error.
+// If it returns true, publishing is attempted again. RetryFunc may block,
+// e.g. to back off, and should return false once ctx is done.
+type RetryFunc func(ctx context.Context, attempts int, err error) bool
+
+type retryKey struct{}
+
+// ContextWithRetry returns a copy of parent associated with retry, which
+// Publisher.Send uses to retry requests rejected with ErrFull. Only the
+// enqueueing of the request is retried, so processors preceding the
+// publisher process each batch once.
+func ContextWithRetry(parent context.Context, retry RetryFunc) context.Context {
+	return context.WithValue(parent, retryKey{}, retry)
+}
+
+// Retry calls send, retrying according to the RetryFunc associated with
+// ctx by ContextWithRetry, if any, while send fails with ErrFull. Retry
+// returns the last error returned by send.
+//
+// Retry is used by Publisher.Send, and may be used by other terminal
+// processors whose requests are rejected as a whole when they are full.
+func Retry(ctx context.Context, send func() error) error {
+	retry, _ := ctx.Value(retryKey{}).(RetryFunc)
+	for attempts := 1; ; attempts++ {
+		err := send()
+		if err != ErrFull || retry == nil || !retry(ctx, attempts, err) {
+			return err
+		}
+	}
+}
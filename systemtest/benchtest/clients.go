@@ -19,13 +19,16 @@ package benchtest
 
 import (
 	"context"
-	"crypto/tls"
+	"io/fs"
 	"net/url"
+	"os"
 	"path/filepath"
+	"sync/atomic"
 	"testing"
 
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
 	"golang.org/x/time/rate"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
@@ -36,12 +39,24 @@ import (
 	"go.elastic.co/apm/v2/transport"
 )
 
+// serverIndex holds the index into serverURLs of the next
+// server to be targeted by a client.
+var serverIndex uint64
+
+// nextServerURL returns the next of the target APM Server URLs,
+// so that clients are distributed round-robin across them.
+func nextServerURL() *url.URL {
+	i := atomic.AddUint64(&serverIndex, 1) - 1
+	return serverURLs[i%uint64(len(serverURLs))]
+}
+
 // NewTracer returns a new Elastic APM tracer, configured
-// to send to the target APM Server.
+// to send to the next target APM Server.
 func NewTracer(tb testing.TB) *apm.Tracer {
 	httpTransport, err := transport.NewHTTPTransport(transport.HTTPTransportOptions{
-		ServerURLs:  []*url.URL{serverURL},
-		SecretToken: *secretToken,
+		ServerURLs:      []*url.URL{nextServerURL()},
+		SecretToken:     *secretToken,
+		TLSClientConfig: tlsConfig.Clone(),
 	})
 	if err != nil {
 		tb.Fatal(err)
@@ -52,13 +67,17 @@ func NewTracer(tb testing.TB) *apm.Tracer {
 	if err != nil {
 		tb.Fatal(err)
 	}
+	if d := FlushInterval(); d > 0 {
+		tracer.SetRequestDuration(d)
+	}
 	tb.Cleanup(tracer.Close)
 	return tracer
 }
 
 // NewOTLPExporter returns a new OpenTelemetry Go exporter, configured
-// to export to the target APM Server.
+// to export to the next target APM Server.
 func NewOTLPExporter(tb testing.TB) *otlptrace.Exporter {
+	serverURL := nextServerURL()
 	endpoint := serverURL.Host
 	if serverURL.Port() == "" {
 		switch serverURL.Scheme {
@@ -80,9 +99,7 @@ func NewOTLPExporter(tb testing.TB) *otlptrace.Exporter {
 	if serverURL.Scheme == "http" {
 		opts = append(opts, otlptracegrpc.WithInsecure())
 	} else {
-		tlsCredentials := credentials.NewTLS(&tls.Config{
-			InsecureSkipVerify: true,
-		})
+		tlsCredentials := credentials.NewTLS(tlsConfig.Clone())
 		opts = append(opts, otlptracegrpc.WithTLSCredentials(tlsCredentials))
 	}
 	exporter, err := otlptracegrpc.New(context.Background(), opts...)
@@ -93,23 +110,59 @@ func NewOTLPExporter(tb testing.TB) *otlptrace.Exporter {
 	return exporter
 }
 
+// newOTLPHTTPExporter returns a new OpenTelemetry Go exporter, configured
+// to export to the OTLP/HTTP traces endpoint of the APM Server at serverURL.
+// Failed exports are not retried, so each export is a single request.
+func newOTLPHTTPExporter(serverURL *url.URL, token string) (*otlptrace.Exporter, error) {
+	opts := []otlptracehttp.Option{
+		otlptracehttp.WithEndpoint(serverURL.Host),
+		otlptracehttp.WithRetry(otlptracehttp.RetryConfig{Enabled: false}),
+	}
+	if token != "" {
+		opts = append(opts, otlptracehttp.WithHeaders(map[string]string{
+			"Authorization": "Bearer " + token,
+		}))
+	}
+	if serverURL.Scheme == "http" {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	} else {
+		opts = append(opts, otlptracehttp.WithTLSClientConfig(tlsConfig.Clone()))
+	}
+	return otlptracehttp.New(context.Background(), opts...)
+}
+
 // NewEventHandler creates a eventhandler which loads the files matching the
-// passed regex.
+// passed regex, and sends them to the next target APM Server. If -corpus is specified, files are loaded from the corpus
+// directory rather than the embedded events; if no files in the corpus match
+// the pattern, all of its .ndjson files are loaded. If -flush-interval is
+// specified, the handler sends at most one batch per flush interval.
 func NewEventHandler(tb testing.TB, p string, l *rate.Limiter) *eventhandler.Handler {
-	h, err := newEventHandler(p, serverURL.String(), *secretToken, l)
+	h, err := newEventHandler(p, nextServerURL().String(), *secretToken, l)
 	if err != nil {
 		tb.Fatal(err)
 	}
+	h.SetFlushInterval(FlushInterval())
 	return h
 }
 
 func newEventHandler(p, url, token string, l *rate.Limiter) (*eventhandler.Handler, error) {
 	// We call the HTTPTransport constructor to avoid copying all the config
 	// parsing that creates the `*http.Client`.
-	t, err := transport.NewHTTPTransport(transport.HTTPTransportOptions{})
+	t, err := transport.NewHTTPTransport(transport.HTTPTransportOptions{
+		TLSClientConfig: tlsConfig.Clone(),
+	})
 	if err != nil {
 		return nil, err
 	}
 	transp := eventhandler.NewTransport(t.Client, url, token)
+	if *corpus != "" {
+		corpusFS := os.DirFS(*corpus)
+		// Captured corpora need not follow the agent naming of the embedded
+		// events (e.g. go*.ndjson), so fall back to replaying all files.
+		if matches, err := fs.Glob(corpusFS, p); err != nil || len(matches) == 0 {
+			p = "*.ndjson"
+		}
+		return eventhandler.New(p, transp, corpusFS, l)
+	}
 	return eventhandler.New(filepath.Join("events", p), transp, events, l)
 }
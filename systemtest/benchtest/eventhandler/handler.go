@@ -25,10 +25,16 @@ import (
 	"errors"
 	"io"
 	"io/fs"
+	"time"
 
 	"golang.org/x/time/rate"
 )
 
+// maxLineSize holds the maximum size of an ND-JSON line which may be loaded.
+// Captured event corpora may contain events much larger than the default
+// bufio.Scanner limit of 64KB.
+const maxLineSize = 1024 * 1024
+
 var (
 	metaHeader    = []byte(`{"metadata":`)
 	rumMetaHeader = []byte(`{"m":`)
@@ -46,6 +52,9 @@ type Handler struct {
 	transport *Transport
 	limiter   *rate.Limiter
 	batches   []batch
+
+	flushInterval time.Duration
+	lastSent      time.Time
 }
 
 // New creates a new tracehandler.Handler from a glob expression, a filesystem,
@@ -87,6 +96,7 @@ func New(p string, t *Transport, storage fs.FS, l *rate.Limiter) (*Handler, erro
 			return nil, err
 		}
 		s := bufio.NewScanner(f)
+		s.Buffer(nil, maxLineSize)
 		var scanned uint
 		for s.Scan() {
 			line := s.Bytes()
@@ -125,6 +135,9 @@ func New(p string, t *Transport, storage fs.FS, l *rate.Limiter) (*Handler, erro
 			scanned = 0
 		}
 
+		if err := s.Err(); err != nil {
+			return nil, err
+		}
 		if err := writer.Close(); err != nil {
 			return nil, err
 		}
@@ -154,10 +167,38 @@ func (h *Handler) SendBatches(ctx context.Context) (uint, error) {
 	return sentEvents, nil
 }
 
+// NumBatches returns the number of batches loaded by the handler.
+func (h *Handler) NumBatches() int {
+	return len(h.batches)
+}
+
+// SendBatch sends the i'th loaded batch to the configured transport. Returns
+// the number of documents sent and any transport errors.
+func (h *Handler) SendBatch(ctx context.Context, i int) (uint, error) {
+	return h.sendBatch(ctx, h.batches[i])
+}
+
+// SetFlushInterval sets the minimum interval between the batches sent by
+// the handler, emulating an agent flushing its events every d. If d is zero,
+// batches are sent as fast as the limiter allows.
+func (h *Handler) SetFlushInterval(d time.Duration) {
+	h.flushInterval = d
+}
+
 func (h *Handler) sendBatch(ctx context.Context, b batch) (uint, error) {
+	if h.flushInterval > 0 && !h.lastSent.IsZero() {
+		timer := time.NewTimer(time.Until(h.lastSent.Add(h.flushInterval)))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return 0, ctx.Err()
+		case <-timer.C:
+		}
+	}
 	if err := h.limiter.WaitN(ctx, int(b.items)); err != nil {
 		return 0, err
 	}
+	h.lastSent = time.Now()
 	defer b.r.Seek(0, io.SeekStart)
 	// NOTE(marclop) RUM event replaying is not yet supported.
 	if err := h.transport.SendV2Events(ctx, b.r); err != nil {
@@ -184,6 +225,23 @@ func (h *Handler) WarmUpServer(ctx context.Context, threshold uint) error {
 	}
 }
 
+// WarmUpServerPaced will "warm up" the remote APM Server by sending events
+// until pace returns an error, which is then returned. Before each batch is
+// sent, pace is called with the number of events in the batch, and may block
+// to control the rate at which events are sent, in addition to the limiter.
+func (h *Handler) WarmUpServerPaced(ctx context.Context, pace func(ctx context.Context, events uint) error) error {
+	for {
+		for _, batch := range h.batches {
+			if err := pace(ctx, batch.items); err != nil {
+				return err
+			}
+			if _, err := h.sendBatch(ctx, batch); err != nil {
+				return err
+			}
+		}
+	}
+}
+
 type compressedWriter struct {
 	zwriter *zlib.Writer
 	buf     *bytes.Buffer
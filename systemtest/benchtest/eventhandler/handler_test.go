@@ -22,6 +22,7 @@ import (
 	"bytes"
 	"compress/zlib"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -189,6 +190,25 @@ func TestHandlerSendBatches(t *testing.T) {
 	})
 }
 
+func TestHandlerSendBatch(t *testing.T) {
+	handler, srv := newHandler(t, "testdata", "python*.ndjson", rate.NewLimiter(rate.Inf, 0))
+	t.Cleanup(srv.close)
+	require.Equal(t, 2, handler.NumBatches())
+
+	var total uint
+	for i := 0; i < handler.NumBatches(); i++ {
+		n, err := handler.SendBatch(context.Background(), i)
+		require.NoError(t, err)
+		assert.Equal(t, handler.batches[i].items, n)
+		total += n
+	}
+	b, err := os.ReadFile(filepath.Join("testdata", "python-test.ndjson"))
+	require.NoError(t, err)
+	assert.Equal(t, string(b), srv.got.String())
+	assert.Equal(t, uint(32), total)
+	assert.Equal(t, uint(32), srv.received)
+}
+
 func TestHandlerWarmUp(t *testing.T) {
 	t.Run("success", func(t *testing.T) {
 		h, srv := newHandler(t, "testdata", "python*.ndjson", rate.NewLimiter(rate.Inf, 0))
@@ -224,3 +244,42 @@ func TestHandlerWarmUp(t *testing.T) {
 		assert.Less(t, srv.received, warmupEvents)
 	})
 }
+
+func TestHandlerWarmUpPaced(t *testing.T) {
+	h, srv := newHandler(t, "testdata", "python*.ndjson", rate.NewLimiter(rate.Inf, 0))
+	t.Cleanup(srv.close)
+
+	errDone := errors.New("done")
+	var paced uint
+	err := h.WarmUpServerPaced(context.Background(), func(ctx context.Context, events uint) error {
+		if paced+events > 1000 {
+			return errDone
+		}
+		paced += events
+		return nil
+	})
+	assert.Equal(t, errDone, err)
+	assert.Equal(t, paced, srv.received)
+	assert.Greater(t, srv.received, uint(0))
+}
+
+func TestHandlerFlushInterval(t *testing.T) {
+	h, srv := newHandler(t, "testdata", "python*.ndjson", rate.NewLimiter(rate.Inf, 0))
+	t.Cleanup(srv.close)
+	h.SetFlushInterval(100 * time.Millisecond)
+
+	// There are 2 batches, the second of which is sent a flush
+	// interval after the first.
+	start := time.Now()
+	n, err := h.SendBatches(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, uint(32), n)
+	assert.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+
+	// The flush interval applies across calls.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = h.SendBatches(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Equal(t, uint(32), srv.received)
+}
@@ -47,6 +47,11 @@ type expvar struct {
 	// does the same.
 	UncompressedBytes     int64 `json:"apm-server.decoder.uncompressed.bytes"`
 	AvailableBulkRequests int64 `json:"output.elasticsearch.bulk_requests.available"`
+
+	// LastGCPauseNs holds the longest of the servers' most recent GC
+	// pauses. It is derived from memstats.PauseNs, which is otherwise
+	// not aggregated.
+	LastGCPauseNs int64 `json:"-"`
 }
 
 type ElasticResponseStats struct {
@@ -115,6 +120,13 @@ func queryExpvar(ctx context.Context, out *expvar, srv string) error {
 		aggregateLibbeatStats(s.LibbeatStats, &result.LibbeatStats)
 		result.UncompressedBytes += s.UncompressedBytes
 		result.AvailableBulkRequests += s.AvailableBulkRequests
+		if s.NumGC > 0 {
+			// PauseNs is a circular buffer of the most recent 256 GC
+			// pauses, the latest being at PauseNs[(NumGC+255)%256].
+			if pause := int64(s.PauseNs[(s.NumGC+255)%256]); pause > result.LastGCPauseNs {
+				result.LastGCPauseNs = pause
+			}
+		}
 	}
 	*out = result
 	return nil
@@ -45,6 +45,8 @@ const (
 	ErrorElasticResponses
 	ErrorOTLPTracesResponses
 	ErrorOTLPMetricsResponses
+	GCPauseTotalNs
+	LastGCPauseNs
 )
 
 type AggregateStats struct {
@@ -154,6 +156,8 @@ func (c *Collector) accumulate(e expvar) {
 	c.processMetric(MemBytes, int64(e.TotalAlloc))
 	c.processMetric(HeapAlloc, int64(e.HeapAlloc))
 	c.processMetric(HeapObjects, int64(e.HeapObjects))
+	c.processMetric(GCPauseTotalNs, int64(e.PauseTotalNs))
+	c.processMetric(LastGCPauseNs, e.LastGCPauseNs)
 }
 
 func (c *Collector) processMetric(m Metric, val int64) {
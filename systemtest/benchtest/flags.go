@@ -18,10 +18,14 @@
 package benchtest
 
 import (
+	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
+	"math"
 	"net/url"
 	"os"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
@@ -30,27 +34,43 @@ import (
 )
 
 var (
-	server        = flag.String("server", getenvDefault("ELASTIC_APM_SERVER_URL", "http://localhost:8200"), "apm-server URL")
-	count         = flag.Uint("count", 1, "run benchmarks `n` times")
-	agentsListStr = flag.String("agents", "1", "comma-separated `list` of agent counts to run each benchmark with")
-	benchtime     = flag.Duration("benchtime", time.Second, "run each benchmark for duration `d`")
-	secretToken   = flag.String("secret-token", os.Getenv("ELASTIC_APM_SECRET_TOKEN"), "secret token for APM Server")
-	match         = flag.String("run", "", "run only benchmarks matching `regexp`")
-	secure        = flag.Bool("secure", boolFromEnv("ELASTIC_APM_VERIFY_SERVER_CERT", false), "validate the remote server TLS certificates")
+	server               = flag.String("server", getenvDefault("ELASTIC_APM_SERVER_URL", "http://localhost:8200"), "comma-separated `list` of apm-server URLs, sent to round-robin")
+	count                = flag.Uint("count", 1, "run benchmarks `n` times")
+	agentsListStr        = flag.String("agents", "1", "comma-separated `list` of agent counts to run each benchmark with")
+	flushIntervalListStr = flag.String("flush-interval", "", "comma-separated `list` of per-agent flush intervals to run each benchmark with, for each of -agents; empty uses the agents' defaults")
+	benchtime            = flag.Duration("benchtime", time.Second, "run each benchmark for duration `d`")
+	secretToken          = flag.String("secret-token", os.Getenv("ELASTIC_APM_SECRET_TOKEN"), "secret token for APM Server")
+	match                = flag.String("run", "", "run only benchmarks matching `regexp`")
+	secure               = flag.Bool("secure", boolFromEnv("ELASTIC_APM_VERIFY_SERVER_CERT", false), "validate the remote server TLS certificates")
+	clientCert           = flag.String("client-cert", "", "PEM-encoded TLS client certificate `file` for mutual TLS, requires -client-key")
+	clientKey            = flag.String("client-key", "", "PEM-encoded TLS client key `file` for mutual TLS, requires -client-cert")
+	caCert               = flag.String("ca-cert", "", "PEM-encoded CA certificates `file` to validate the remote server TLS certificates with, requires -secure")
 
 	cpuprofile   = flag.String("cpuprofile", "", "Write a CPU profile to the specified file before exiting.")
 	memprofile   = flag.String("memprofile", "", "Write an allocation profile to the file  before exiting.")
 	mutexprofile = flag.String("mutexprofile", "", "Write a mutex contention profile to the file  before exiting.")
 	blockprofile = flag.String("blockprofile", "", "Write a goroutine blocking profile to the file before exiting.")
 
-	warmupEvents = flag.Uint("warmup-events", 5000, "The number of events that will be used to warm up the APM Server before each benchmark")
-	maxRate      = flag.String("max-rate", "-1eps", "Max event rate with a burst size of max(1000, 2*eps), >= 0 values evaluate to Inf")
-	detailed     = flag.Bool("detailed", false, "Get detailed metrics recorded during benchmark")
+	checkGoroutineLeak     = flag.Bool("check-goroutine-leak", false, "Fail if the number of goroutines in apmbench after the benchmarks exceeds the number before by more than -goroutine-leak-threshold, writing a goroutine dump to -blockprofile if set")
+	goroutineLeakThreshold = flag.Int("goroutine-leak-threshold", 10, "The number of additional goroutines tolerated by -check-goroutine-leak")
 
-	maxEPM     int
-	agentsList []int
-	serverURL  *url.URL
-	runRE      *regexp.Regexp
+	warmupEvents   = flag.Uint("warmup-events", 5000, "The number of events that will be used to warm up the APM Server before each benchmark")
+	warmupDuration = flag.Duration("warmup-duration", 0, "Warm up the APM Server for duration `d`, ramping the event rate linearly from zero to -max-rate (or 1000 eps per agent if unlimited). Mutually exclusive with -warmup-events")
+	maxRate        = flag.String("max-rate", "-1eps", "Max event rate with a burst size of max(1000, 2*eps), as events per s, m, h or d, e.g. 0.5eps or 2eph; <= 0 values evaluate to Inf")
+	detailed       = flag.Bool("detailed", false, "Get detailed metrics recorded during benchmark")
+	outputJSON     = flag.String("output-json", "", "Write the benchmark results to `file` as JSON Lines, in addition to stderr")
+	metricsURL     = flag.String("metrics-url", "", "Scrape the APM Server's expvar `url`, e.g. http://localhost:8200/debug/vars, for goroutines, heap and GC pauses during each benchmark")
+	protocol       = flag.String("protocol", string(ProtocolIntake), "Send the agent benchmarks' events over protocol `p`: intake, otlp (OTLP/HTTP traces) or mixed")
+	otlpRatio      = flag.Float64("otlp-ratio", 0.5, "The fraction of requests sent over OTLP/HTTP with -protocol=mixed, between 0 and 1")
+	corpus         = flag.String("corpus", "", "Replay the .ndjson files in directory `dir` instead of the embedded events, during warm-up and agent benchmarks")
+
+	maxEPM         float64
+	benchProtocol  Protocol
+	agentsList     []int
+	flushIntervals []time.Duration
+	serverURLs     []*url.URL
+	runRE          *regexp.Regexp
+	tlsConfig      *tls.Config
 )
 
 func getenvDefault(name, defaultValue string) string {
@@ -78,12 +98,70 @@ func parseFlags() error {
 		agentsList = append(agentsList, n)
 	}
 
+	// Parse -flush-interval.
+	intervals, err := parseFlushIntervals(*flushIntervalListStr)
+	if err != nil {
+		return err
+	}
+	flushIntervals = intervals
+
 	// Parse -server.
-	u, err := url.Parse(*server)
+	urls, err := parseServerURLs(*server)
+	if err != nil {
+		return err
+	}
+	serverURLs = urls
+
+	// Parse -secure, -client-cert, -client-key and -ca-cert.
+	cfg, err := newTLSClientConfig(*secure, *clientCert, *clientKey, *caCert)
 	if err != nil {
 		return err
 	}
-	serverURL = u
+	tlsConfig = cfg
+
+	// Parse -metrics-url.
+	if *metricsURL != "" {
+		if err := checkMetricsURL(*metricsURL); err != nil {
+			return err
+		}
+	}
+
+	// Parse -warmup-events and -warmup-duration.
+	var warmupEventsSet bool
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "warmup-events" {
+			warmupEventsSet = true
+		}
+	})
+	if err := checkWarmupFlags(warmupEventsSet, *warmupDuration); err != nil {
+		return err
+	}
+
+	// Parse -goroutine-leak-threshold.
+	if *goroutineLeakThreshold < 0 {
+		return fmt.Errorf("invalid value %d for -goroutine-leak-threshold, must not be negative", *goroutineLeakThreshold)
+	}
+
+	// Parse -protocol and -otlp-ratio.
+	p, err := parseProtocol(*protocol)
+	if err != nil {
+		return err
+	}
+	benchProtocol = p
+	if err := checkOTLPRatio(*otlpRatio); err != nil {
+		return err
+	}
+
+	// Parse -corpus.
+	if *corpus != "" {
+		matches, err := filepath.Glob(filepath.Join(*corpus, "*.ndjson"))
+		if err != nil {
+			return err
+		}
+		if len(matches) == 0 {
+			return fmt.Errorf("invalid value %q for -corpus, directory contains no .ndjson files", *corpus)
+		}
+	}
 
 	// Parse -run.
 	if *match != "" {
@@ -97,23 +175,11 @@ func parseFlags() error {
 	}
 
 	// Parse -max-rate
-	errStr := "invalid value %s for -max-rate, valid examples: 5eps or 10epm"
-	r := strings.Split(*maxRate, "ep")
-	if len(r) != 2 {
-		return fmt.Errorf(errStr, *maxRate)
-	}
-	rateVal, err := strconv.Atoi(r[0])
+	epm, err := parseMaxRate(*maxRate)
 	if err != nil {
-		return fmt.Errorf(errStr, *maxRate)
-	}
-	switch r[1] {
-	case "s":
-		maxEPM = rateVal * 60
-	case "m":
-		maxEPM = rateVal
-	default:
-		return fmt.Errorf(errStr, *maxRate)
+		return err
 	}
+	maxEPM = epm
 
 	// Set flags in package testing.
 	testing.Init()
@@ -123,6 +189,100 @@ func parseFlags() error {
 	return nil
 }
 
+// checkWarmupFlags checks that -warmup-duration is valid, and that it is not
+// combined with an explicitly set -warmup-events.
+func checkWarmupFlags(warmupEventsSet bool, warmupDuration time.Duration) error {
+	if warmupDuration < 0 {
+		return fmt.Errorf("invalid value %s for -warmup-duration, must not be negative", warmupDuration)
+	}
+	if warmupEventsSet && warmupDuration > 0 {
+		return errors.New("-warmup-events and -warmup-duration are mutually exclusive, set only one of them")
+	}
+	return nil
+}
+
+// parseMaxRate parses a -max-rate value, consisting of a decimal magnitude
+// followed by "eps", "epm", "eph" or "epd", into events per minute.
+func parseMaxRate(s string) (float64, error) {
+	errStr := "invalid value %s for -max-rate, valid examples: 5eps, 0.5eps, 10epm, 2eph or 100epd"
+	i := strings.Index(s, "ep")
+	if i == -1 || len(s) != i+len("ep")+1 {
+		return 0, fmt.Errorf(errStr, s)
+	}
+	rateVal, err := strconv.ParseFloat(s[:i], 64)
+	if err != nil || math.IsNaN(rateVal) || math.IsInf(rateVal, 0) {
+		return 0, fmt.Errorf(errStr, s)
+	}
+	switch s[i+len("ep")] {
+	case 's':
+		return rateVal * 60, nil
+	case 'm':
+		return rateVal, nil
+	case 'h':
+		return rateVal / 60, nil
+	case 'd':
+		return rateVal / (24 * 60), nil
+	}
+	return 0, fmt.Errorf(errStr, s)
+}
+
+// parseFlushIntervals parses a comma-separated list of positive durations.
+// If the list is empty, a single zero duration is returned, denoting that
+// the agents' default flush interval should be used.
+func parseFlushIntervals(s string) ([]time.Duration, error) {
+	var intervals []time.Duration
+	for _, val := range strings.Split(s, ",") {
+		val = strings.TrimSpace(val)
+		if val == "" {
+			continue
+		}
+		d, err := time.ParseDuration(val)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid value %q for -flush-interval", val)
+		}
+		intervals = append(intervals, d)
+	}
+	if len(intervals) == 0 {
+		intervals = []time.Duration{0}
+	}
+	return intervals, nil
+}
+
+// parseServerURLs parses a comma-separated list of absolute http or https URLs.
+func parseServerURLs(s string) ([]*url.URL, error) {
+	var urls []*url.URL
+	for _, val := range strings.Split(s, ",") {
+		val = strings.TrimSpace(val)
+		if val == "" {
+			continue
+		}
+		u, err := url.Parse(val)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value %q for -server: %w", val, err)
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid value %q for -server, expected an http or https URL with a host", val)
+		}
+		urls = append(urls, u)
+	}
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("invalid value %q for -server, expected at least one URL", s)
+	}
+	return urls, nil
+}
+
+// checkMetricsURL checks that s is an absolute http or https URL.
+func checkMetricsURL(s string) error {
+	u, err := url.Parse(s)
+	if err != nil {
+		return fmt.Errorf("invalid value %q for -metrics-url: %w", s, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid value %q for -metrics-url, expected an http or https URL with a host", s)
+	}
+	return nil
+}
+
 func boolFromEnv(varName string, defaultVal bool) bool {
 	envVal := os.Getenv(varName)
 	if envVal == "" {
@@ -0,0 +1,72 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package benchtest
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"time"
+)
+
+// goroutineLeakSettleTimeout holds the maximum amount of time to wait for
+// the goroutines started during the benchmarks to exit, before reporting
+// a goroutine leak.
+const goroutineLeakSettleTimeout = 5 * time.Second
+
+// checkGoroutineLeaks waits up to timeout for the number of goroutines to
+// exceed before by no more than threshold. If it does not, an error is
+// returned, and the stacks of all goroutines are written to dumpPath, if
+// non-empty, overwriting any block profile written there.
+func checkGoroutineLeaks(before, threshold int, timeout time.Duration, dumpPath string) error {
+	http.DefaultClient.CloseIdleConnections()
+	deadline := time.Now().Add(timeout)
+	after := runtime.NumGoroutine()
+	for after-before > threshold && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+		after = runtime.NumGoroutine()
+	}
+	if after-before <= threshold {
+		return nil
+	}
+	err := fmt.Errorf(
+		"goroutine leak: %d goroutines before the benchmarks and %d after, exceeding the threshold of %d",
+		before, after, threshold,
+	)
+	if dumpPath == "" {
+		return err
+	}
+	if dumpErr := writeGoroutineDump(dumpPath); dumpErr != nil {
+		return fmt.Errorf("%w (failed to write goroutine dump: %v)", err, dumpErr)
+	}
+	return fmt.Errorf("%w, goroutine dump written to %s", err, dumpPath)
+}
+
+func writeGoroutineDump(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := pprof.Lookup("goroutine").WriteTo(f, 2); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
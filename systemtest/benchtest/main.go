@@ -19,7 +19,6 @@ package benchtest
 
 import (
 	"context"
-	"crypto/tls"
 	"embed"
 	"errors"
 	"fmt"
@@ -40,11 +39,23 @@ import (
 	"go.elastic.co/apm/v2/stacktrace"
 	"golang.org/x/time/rate"
 
+	"github.com/elastic/apm-server/systemtest/benchtest/eventhandler"
 	"github.com/elastic/apm-server/systemtest/benchtest/expvar"
 )
 
 const waitInactiveTimeout = 30 * time.Second
 
+// currentFlushInterval holds the -flush-interval of the benchmark
+// permutation being run, or zero if the agents' default is used.
+var currentFlushInterval time.Duration
+
+// FlushInterval returns the per-agent flush interval of the benchmark
+// permutation being run, as configured with -flush-interval, or zero
+// if benchmarks should use the agents' default.
+func FlushInterval() time.Duration {
+	return currentFlushInterval
+}
+
 // events holds the current stored events.
 //go:embed events/*.ndjson
 var events embed.FS
@@ -59,75 +70,132 @@ type benchmark struct {
 	f    BenchmarkFunc
 }
 
-func runBenchmark(f BenchmarkFunc) (testing.BenchmarkResult, bool, error) {
+// runBenchmark runs f, returning its result along with the number of error
+// responses returned by the APM Servers during the final run.
+func runBenchmark(f BenchmarkFunc) (testing.BenchmarkResult, int64, bool, error) {
 	// Run the benchmark. testing.Benchmark will invoke the function
 	// multiple times, but only returns the final result.
 	var ok bool
-	var collector *expvar.Collector
+	var errorResponses int64
+	var collectors []*expvar.Collector
+	var metrics *expvar.Collector
 	result := testing.Benchmark(func(b *testing.B) {
 		ctx, cancel := context.WithCancel(context.Background())
 		defer cancel()
-		var err error
-		collector, err = expvar.StartNewCollector(ctx, *server, 100*time.Millisecond)
-		if err != nil {
-			b.Error(err)
-			ok = !b.Failed()
-			return
+		if *metricsURL != "" {
+			metrics = startServerMetrics(ctx, *metricsURL, serverMetricsInterval)
+		}
+		collectors = make([]*expvar.Collector, len(serverURLs))
+		for i, serverURL := range serverURLs {
+			collector, err := expvar.StartNewCollector(ctx, serverURL.String(), 100*time.Millisecond)
+			if err != nil {
+				b.Error(err)
+				ok = !b.Failed()
+				return
+			}
+			collectors[i] = collector
 		}
 
+		resetProtocolStats()
 		limiter := getNewLimiter(maxEPM)
 		b.ResetTimer()
 		f(b, limiter)
 		if !b.Failed() {
-			watcher, err := collector.WatchMetric(expvar.ActiveEvents, 0)
-			if err != nil {
-				b.Error(err)
-			} else if status := <-watcher; !status {
-				b.Error("failed to wait for APM server to be inactive")
+			for _, collector := range collectors {
+				watcher, err := collector.WatchMetric(expvar.ActiveEvents, 0)
+				if err != nil {
+					b.Error(err)
+				} else if status := <-watcher; !status {
+					b.Error("failed to wait for APM server to be inactive")
+				}
 			}
 		}
 		ok = !b.Failed()
 	})
 	if result.Extra != nil {
-		addExpvarMetrics(&result, collector, *detailed)
+		errorResponses = addExpvarMetrics(&result, collectors, *detailed)
+		addProtocolMetrics(&result)
+		if metrics != nil {
+			addServerMetrics(&result, metrics)
+		}
 	}
-	return result, ok, nil
+	return result, errorResponses, ok, nil
 }
 
-func addExpvarMetrics(result *testing.BenchmarkResult, collector *expvar.Collector, detailed bool) {
-	result.Bytes = collector.Delta(expvar.Bytes)
-	result.MemAllocs = uint64(collector.Delta(expvar.MemAllocs))
-	result.MemBytes = uint64(collector.Delta(expvar.MemBytes))
-	result.Extra["events/sec"] = float64(collector.Delta(expvar.TotalEvents)) / result.T.Seconds()
+// addExpvarMetrics adds the metrics recorded by collectors to result. Counters
+// are summed across the collectors, maximums are the maximum across them, and
+// means are averaged. The number of error responses returned by the servers
+// is returned, so it can be reported without being derived from a rate.
+func addExpvarMetrics(result *testing.BenchmarkResult, collectors []*expvar.Collector, detailed bool) int64 {
+	delta := func(m expvar.Metric) int64 {
+		var sum int64
+		for _, collector := range collectors {
+			sum += collector.Delta(m)
+		}
+		return sum
+	}
+	maximum := func(m expvar.Metric) float64 {
+		var max int64
+		for i, collector := range collectors {
+			if v := collector.Get(m).Max; i == 0 || v > max {
+				max = v
+			}
+		}
+		return float64(max)
+	}
+	average := func(m expvar.Metric) float64 {
+		var sum float64
+		for _, collector := range collectors {
+			sum += collector.Get(m).Mean
+		}
+		return sum / float64(len(collectors))
+	}
+
+	result.Bytes = delta(expvar.Bytes)
+	result.MemAllocs = uint64(delta(expvar.MemAllocs))
+	result.MemBytes = uint64(delta(expvar.MemBytes))
+	result.Extra["events/sec"] = float64(delta(expvar.TotalEvents)) / result.T.Seconds()
 	if detailed {
-		result.Extra["txs/sec"] = float64(collector.Delta(expvar.TransactionsProcessed)) / result.T.Seconds()
-		result.Extra["spans/sec"] = float64(collector.Delta(expvar.SpansProcessed)) / result.T.Seconds()
-		result.Extra["metrics/sec"] = float64(collector.Delta(expvar.MetricsProcessed)) / result.T.Seconds()
-		result.Extra["errors/sec"] = float64(collector.Delta(expvar.ErrorsProcessed)) / result.T.Seconds()
-		result.Extra["gc_cycles"] = float64(collector.Delta(expvar.NumGC))
-		result.Extra["max_rss"] = float64(collector.Get(expvar.RSSMemoryBytes).Max)
-		result.Extra["max_goroutines"] = float64(collector.Get(expvar.Goroutines).Max)
-		result.Extra["max_heap_alloc"] = float64(collector.Get(expvar.HeapAlloc).Max)
-		result.Extra["max_heap_objects"] = float64(collector.Get(expvar.HeapObjects).Max)
-		result.Extra["mean_available_indexers"] = float64(collector.Get(expvar.AvailableBulkRequests).Mean)
+		result.Extra["txs/sec"] = float64(delta(expvar.TransactionsProcessed)) / result.T.Seconds()
+		result.Extra["spans/sec"] = float64(delta(expvar.SpansProcessed)) / result.T.Seconds()
+		result.Extra["metrics/sec"] = float64(delta(expvar.MetricsProcessed)) / result.T.Seconds()
+		result.Extra["errors/sec"] = float64(delta(expvar.ErrorsProcessed)) / result.T.Seconds()
+		result.Extra["gc_cycles"] = float64(delta(expvar.NumGC))
+		result.Extra["max_rss"] = maximum(expvar.RSSMemoryBytes)
+		result.Extra["max_goroutines"] = maximum(expvar.Goroutines)
+		result.Extra["max_heap_alloc"] = maximum(expvar.HeapAlloc)
+		result.Extra["max_heap_objects"] = maximum(expvar.HeapObjects)
+		result.Extra["mean_available_indexers"] = average(expvar.AvailableBulkRequests)
 	}
 
 	// Record the number of error responses returned by the server: lower is better.
-	errorResponses := collector.Delta(expvar.ErrorElasticResponses) +
-		collector.Delta(expvar.ErrorOTLPTracesResponses) +
-		collector.Delta(expvar.ErrorOTLPMetricsResponses)
+	errorResponses := delta(expvar.ErrorElasticResponses) +
+		delta(expvar.ErrorOTLPTracesResponses) +
+		delta(expvar.ErrorOTLPMetricsResponses)
 	if detailed || errorResponses > 0 {
 		result.Extra["error_responses/sec"] = float64(errorResponses) / result.T.Seconds()
 	}
+	return errorResponses
 }
 
-func fullBenchmarkName(name string, agents int) string {
+// fullBenchmarkName returns the name of the permutation of the named
+// benchmark run with the given number of agents and flush interval.
+func fullBenchmarkName(name string, agents int, flushInterval time.Duration) string {
+	if flushInterval > 0 {
+		name += "/flush=" + flushInterval.String()
+	}
 	if agents != 1 {
 		return fmt.Sprintf("%s-%d", name, agents)
 	}
 	return name
 }
 
+// matchBenchmark reports whether re, if non-nil, matches either the name
+// of a benchmark or the full name of one of its permutations.
+func matchBenchmark(re *regexp.Regexp, name, fullName string) bool {
+	return re == nil || re.MatchString(name) || re.MatchString(fullName)
+}
+
 func benchmarkFuncName(f BenchmarkFunc) (string, error) {
 	ffunc := runtime.FuncForPC(reflect.ValueOf(f).Pointer())
 	if ffunc == nil {
@@ -141,11 +209,11 @@ func benchmarkFuncName(f BenchmarkFunc) (string, error) {
 	return name, nil
 }
 
-func getNewLimiter(epm int) *rate.Limiter {
+func getNewLimiter(epm float64) *rate.Limiter {
 	if epm <= 0 {
 		return rate.NewLimiter(rate.Inf, 0)
 	}
-	eps := float64(epm) / float64(60)
+	eps := epm / 60
 	return rate.NewLimiter(rate.Limit(eps), getBurstSize(int(math.Ceil(eps))))
 }
 
@@ -167,11 +235,24 @@ func Run(allBenchmarks ...BenchmarkFunc) error {
 	if err := parseFlags(); err != nil {
 		return err
 	}
-	// Sets the http.DefaultClient.Transport.TLSClientConfig.InsecureSkipVerify
-	// to match the "-secure" flag value.
+	goroutinesBefore := runtime.NumGoroutine()
+	if err := runBenchmarks(allBenchmarks); err != nil {
+		return err
+	}
+	if *checkGoroutineLeak {
+		return checkGoroutineLeaks(goroutinesBefore, *goroutineLeakThreshold, goroutineLeakSettleTimeout, *blockprofile)
+	}
+	return nil
+}
+
+// runBenchmarks runs the benchmarks matching -run, and writes the
+// profiles requested by the flags.
+func runBenchmarks(allBenchmarks []BenchmarkFunc) error {
+	// Sets the http.DefaultClient.Transport.TLSClientConfig to match the
+	// "-secure", "-client-cert", "-client-key" and "-ca-cert" flag values.
 	verifyTLS := *secure
 	http.DefaultClient.Transport = &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: !verifyTLS},
+		TLSClientConfig: tlsConfig.Clone(),
 	}
 	os.Setenv("ELASTIC_APM_VERIFY_SERVER_CERT", fmt.Sprint(verifyTLS))
 	var profiles profiles
@@ -198,12 +279,10 @@ func Run(allBenchmarks ...BenchmarkFunc) error {
 		if err != nil {
 			return err
 		}
-		if matchRE == nil || matchRE.MatchString(name) {
-			benchmarks = append(benchmarks, benchmark{
-				name: name,
-				f:    benchmarkFunc,
-			})
-		}
+		benchmarks = append(benchmarks, benchmark{
+			name: name,
+			f:    benchmarkFunc,
+		})
 	}
 	sort.Slice(benchmarks, func(i, j int) bool {
 		return benchmarks[i].name < benchmarks[j].name
@@ -211,40 +290,78 @@ func Run(allBenchmarks ...BenchmarkFunc) error {
 
 	var maxLen int
 	for _, agents := range agentsList {
-		for _, benchmark := range benchmarks {
-			if n := len(fullBenchmarkName(benchmark.name, agents)); n > maxLen {
-				maxLen = n
+		for _, flushInterval := range flushIntervals {
+			for _, benchmark := range benchmarks {
+				name := fullBenchmarkName(benchmark.name, agents, flushInterval)
+				if !matchBenchmark(matchRE, benchmark.name, name) {
+					continue
+				}
+				if n := len(name); n > maxLen {
+					maxLen = n
+				}
 			}
 		}
 	}
 
 	// Warm up the APM Server with the specified `-agents`. Only the first
 	// value in the list will be used.
-	if len(agentsList) > 0 && *warmupEvents > 0 {
+	if len(agentsList) > 0 && (*warmupDuration > 0 || *warmupEvents > 0) {
 		agents := agentsList[0]
-		if err := warmup(agents, *warmupEvents, serverURL.String(), *secretToken); err != nil {
+		urls := make([]string, len(serverURLs))
+		for i, serverURL := range serverURLs {
+			urls[i] = serverURL.String()
+		}
+		var err error
+		if *warmupDuration > 0 {
+			err = warmupRamp(agents, *warmupDuration, urls, *secretToken)
+		} else {
+			err = warmup(agents, *warmupEvents, urls, *secretToken)
+		}
+		if err != nil {
 			return fmt.Errorf("warm-up failed with %d agents: %v", agents, err)
 		}
 	}
 
+	var jsonOutput *os.File
+	if *outputJSON != "" {
+		f, err := os.Create(*outputJSON)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		jsonOutput = f
+	}
+
 	for _, agents := range agentsList {
 		runtime.GOMAXPROCS(int(agents))
-		for _, benchmark := range benchmarks {
-			name := fullBenchmarkName(benchmark.name, agents)
-			for i := 0; i < int(*count); i++ {
-				profileChan := profiles.record(name)
-				result, ok, err := runBenchmark(benchmark.f)
-				if err != nil {
-					return err
+		for _, flushInterval := range flushIntervals {
+			currentFlushInterval = flushInterval
+			for _, benchmark := range benchmarks {
+				name := fullBenchmarkName(benchmark.name, agents, flushInterval)
+				if !matchBenchmark(matchRE, benchmark.name, name) {
+					continue
 				}
-				if !ok {
-					fmt.Fprintf(os.Stderr, "--- FAIL: %s\n", name)
-					return fmt.Errorf("benchmark %q failed", name)
-				} else {
-					fmt.Fprintf(os.Stderr, "%-*s\t%s\t%s\n", maxLen, name, result, result.MemString())
-				}
-				if err := <-profileChan; err != nil {
-					return err
+				for i := 0; i < int(*count); i++ {
+					profileChan := profiles.record(name)
+					result, errorResponses, ok, err := runBenchmark(benchmark.f)
+					if err != nil {
+						return err
+					}
+					if !ok {
+						fmt.Fprintf(os.Stderr, "--- FAIL: %s\n", name)
+						return fmt.Errorf("benchmark %q failed", name)
+					} else {
+						fmt.Fprintf(os.Stderr, "%-*s\t%s\t%s\n", maxLen, name, result, result.MemString())
+					}
+					if jsonOutput != nil {
+						r := newJSONResult(benchmark.name, agents, flushInterval, i, result, errorResponses)
+						if err := writeJSONResult(jsonOutput, r); err != nil {
+							return fmt.Errorf("failed to write -output-json: %w", err)
+						}
+					}
+					if err := <-profileChan; err != nil {
+						return err
+					}
 				}
 			}
 		}
@@ -252,7 +369,9 @@ func Run(allBenchmarks ...BenchmarkFunc) error {
 	return nil
 }
 
-func warmup(agents int, events uint, url, token string) error {
+// warmup sends events to the APM Servers at urls, distributing the agents
+// round-robin across them, and waits for all of the servers to be inactive.
+func warmup(agents int, events uint, urls []string, token string) error {
 	// Assume a base ingest rate of at least 1000 per second, and dynamically
 	// set the context timeout based on this ingest rate, or if lower, default
 	// to 15 seconds. The default 5000 / 1000 ~= 5, so the default 15 seconds
@@ -264,19 +383,52 @@ func warmup(agents int, events uint, url, token string) error {
 	timeout := warmupTimeout(1000, events, maxEPM, agents, runtime.GOMAXPROCS(0))
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
+	return warmupAgents(ctx, agents, urls, token, func(ctx context.Context, h *eventhandler.Handler) error {
+		return h.WarmUpServer(ctx, events)
+	})
+}
 
+// warmupRamp sends events to the APM Servers at urls for the given duration,
+// distributing the agents round-robin across them, with the combined event
+// rate of the agents increasing linearly from zero to -max-rate, or to
+// defaultWarmupRampEPS per agent if -max-rate is unlimited. It then waits
+// for all of the servers to be inactive.
+func warmupRamp(agents int, duration time.Duration, urls []string, token string) error {
+	eps := maxEPM / 60
+	if eps <= 0 {
+		eps = defaultWarmupRampEPS * float64(agents)
+	}
+	ramp := newRamp(duration, eps)
+	// Allow for the batches in flight at the end of the ramp to be sent.
+	ctx, cancel := context.WithTimeout(context.Background(), duration+waitInactiveTimeout)
+	defer cancel()
+	return warmupAgents(ctx, agents, urls, token, func(ctx context.Context, h *eventhandler.Handler) error {
+		if err := h.WarmUpServerPaced(ctx, ramp.wait); err != errRampDone {
+			return err
+		}
+		return nil
+	})
+}
+
+// warmupAgents runs f concurrently for each of the agents, with an event
+// handler sending to urls round-robin, and then waits for all of the servers
+// to be inactive.
+func warmupAgents(
+	ctx context.Context, agents int, urls []string, token string,
+	f func(context.Context, *eventhandler.Handler) error,
+) error {
 	errs := make(chan error, agents)
 	rl := getNewLimiter(maxEPM)
 	var wg sync.WaitGroup
 	for i := 0; i < agents; i++ {
-		h, err := newEventHandler(`*.ndjson`, url, token, rl)
+		h, err := newEventHandler(`*.ndjson`, urls[i%len(urls)], token, rl)
 		if err != nil {
 			return fmt.Errorf("unable to create warm-up handler: %w", err)
 		}
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			if err := h.WarmUpServer(ctx, events); err != nil {
+			if err := f(ctx, h); err != nil {
 				errs <- err
 			}
 		}()
@@ -292,18 +444,20 @@ func warmup(agents int, events uint, url, token string) error {
 	if err := merr.Err(); err != nil {
 		return err
 	}
-	ctx, cancel = context.WithTimeout(context.Background(), waitInactiveTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), waitInactiveTimeout)
 	defer cancel()
-	if err := expvar.WaitUntilServerInactive(ctx, url); err != nil {
-		return fmt.Errorf("received error waiting for server inactive: %w", err)
+	for _, url := range urls {
+		if err := expvar.WaitUntilServerInactive(ctx, url); err != nil {
+			return fmt.Errorf("received error waiting for server %s inactive: %w", url, err)
+		}
 	}
 	return nil
 }
 
 // warmupTimeout calculates the timeout for the warm up.
-func warmupTimeout(ingestRate float64, events uint, epm, agents, cpus int) time.Duration {
+func warmupTimeout(ingestRate float64, events uint, epm float64, agents, cpus int) time.Duration {
 	if epm > 0 {
-		ingestRate = math.Min(ingestRate, float64(epm/60))
+		ingestRate = math.Min(ingestRate, epm/60)
 	}
 	// Divide the number of agents (concurrency) by the number of gomaxprocs.
 	// This allows the timeout calculation to respect how much concurrent work
@@ -19,18 +19,38 @@ package benchtest
 
 import (
 	"bufio"
+	"bytes"
 	"compress/zlib"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"io"
+	"math"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
 
 	"github.com/elastic/apm-server/systemtest/benchtest/expvar"
 )
@@ -84,7 +104,7 @@ func Test_warmup(t *testing.T) {
 					w.WriteHeader(http.StatusAccepted)
 				}))
 				defer srv.Close()
-				err := warmup(c.agents, events, srv.URL, "")
+				err := warmup(c.agents, events, []string{srv.URL}, "")
 				assert.NoError(t, err)
 				assert.GreaterOrEqual(t, received, uint64(events))
 			})
@@ -92,11 +112,149 @@ func Test_warmup(t *testing.T) {
 	}
 }
 
+func Test_warmupCorpus(t *testing.T) {
+	dir := t.TempDir()
+	corpusFile := strings.Join([]string{
+		`{"metadata":{"service":{"name":"corpus","agent":{"name":"go","version":"1.0.0"}}}}`,
+		`{"transaction":{"id":"a","trace_id":"b","type":"request","duration":1,"span_count":{"started":0}}}`,
+		`{"span":{"id":"c","trace_id":"b","parent_id":"a","name":"span","type":"db","duration":1}}`,
+		`{"error":{"id":"d","exception":{"message":"boom"}}}`,
+		`{"metricset":{"samples":{"value":{"value":1}}}}`,
+	}, "\n")
+	err := os.WriteFile(filepath.Join(dir, "captured.ndjson"), []byte(corpusFile), 0644)
+	require.NoError(t, err)
+	// Files without the .ndjson extension are ignored.
+	err = os.WriteFile(filepath.Join(dir, "README"), []byte("ignored"), 0644)
+	require.NoError(t, err)
+
+	origCorpus := *corpus
+	defer func() { *corpus = origCorpus }()
+	*corpus = dir
+
+	var mu sync.Mutex
+	eventTypes := make(map[string]int)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/debug/vars" {
+			w.Write([]byte(`{"libbeat.output.events.active":0}`))
+		}
+		if !strings.HasPrefix(r.URL.Path, "/intake") {
+			return
+		}
+		zreader, err := zlib.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		defer zreader.Close()
+		scanner := bufio.NewScanner(zreader)
+		mu.Lock()
+		defer mu.Unlock()
+		for scanner.Scan() {
+			var event map[string]json.RawMessage
+			if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+			for k := range event {
+				eventTypes[k]++
+			}
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	err = warmup(1, 8, []string{srv.URL}, "")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{
+		"metadata":    2,
+		"transaction": 2,
+		"span":        2,
+		"error":       2,
+		"metricset":   2,
+	}, eventTypes)
+}
+
+func Test_newEventHandlerCorpusFallback(t *testing.T) {
+	dir := t.TempDir()
+	corpusFile := strings.Join([]string{
+		`{"metadata":{"service":{"name":"corpus","agent":{"name":"go","version":"1.0.0"}}}}`,
+		`{"transaction":{"id":"a","trace_id":"b","type":"request","duration":1,"span_count":{"started":0}}}`,
+	}, "\n")
+	err := os.WriteFile(filepath.Join(dir, "captured.ndjson"), []byte(corpusFile), 0644)
+	require.NoError(t, err)
+
+	origCorpus := *corpus
+	defer func() { *corpus = origCorpus }()
+	*corpus = dir
+
+	// The per-agent patterns match no files in the corpus,
+	// so all of the corpus files are used instead.
+	for _, p := range []string{`*.ndjson`, `go*.ndjson`, `nodejs*.ndjson`, `python*.ndjson`, `ruby*.ndjson`} {
+		h, err := newEventHandler(p, "http://localhost:8200", "", nil)
+		require.NoError(t, err, p)
+		assert.NotNil(t, h, p)
+	}
+}
+
+func Test_warmupMultipleServers(t *testing.T) {
+	var received [2]uint64
+	var srvs [2]*httptest.Server
+	for i := range srvs {
+		i := i
+		srvs[i] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/debug/vars" {
+				w.Write([]byte(`{"libbeat.output.events.active":0}`))
+			}
+			if !strings.HasPrefix(r.URL.Path, "/intake") {
+				return
+			}
+			atomic.AddUint64(&received[i], 1)
+			io.Copy(io.Discard, r.Body)
+			w.WriteHeader(http.StatusAccepted)
+		}))
+		defer srvs[i].Close()
+	}
+
+	err := warmup(2, 100, []string{srvs[0].URL, srvs[1].URL}, "")
+	require.NoError(t, err)
+	assert.NotZero(t, atomic.LoadUint64(&received[0]))
+	assert.NotZero(t, atomic.LoadUint64(&received[1]))
+}
+
+func Test_parseServerURLs(t *testing.T) {
+	urls, err := parseServerURLs("http://a:8200, https://b:8200,")
+	require.NoError(t, err)
+	require.Len(t, urls, 2)
+	assert.Equal(t, "http://a:8200", urls[0].String())
+	assert.Equal(t, "https://b:8200", urls[1].String())
+
+	for _, s := range []string{"", " , ", "http://a:8200,localhost:8200", "http://a:8200,ftp://b", "http://a:8200,http://%zz"} {
+		_, err := parseServerURLs(s)
+		assert.Error(t, err, s)
+	}
+	_, err = parseServerURLs("http://a:8200,localhost:8200")
+	assert.EqualError(t, err, `invalid value "localhost:8200" for -server, expected an http or https URL with a host`)
+}
+
+func Test_nextServerURL(t *testing.T) {
+	origServerURLs := serverURLs
+	defer func() { serverURLs = origServerURLs }()
+	urls, err := parseServerURLs("http://a:8200,http://b:8200,http://c:8200")
+	require.NoError(t, err)
+	serverURLs = urls
+
+	counts := make(map[string]int)
+	for i := 0; i < 9; i++ {
+		counts[nextServerURL().Host]++
+	}
+	assert.Equal(t, map[string]int{"a:8200": 3, "b:8200": 3, "c:8200": 3}, counts)
+}
+
 func Test_warmupTimeout(t *testing.T) {
 	type args struct {
 		ingestRate float64
 		events     uint
-		epm        int
+		epm        float64
 		agents     int
 		cpus       int
 	}
@@ -208,6 +366,7 @@ func TestAddExpvarMetrics(t *testing.T) {
 		responseMetrics []string
 		memstatsMetrics []string
 		expectedResult  map[string]float64
+		expectedErrors  int64
 	}{
 		{
 			name:     "with false detailed flag and no error resp",
@@ -235,6 +394,7 @@ func TestAddExpvarMetrics(t *testing.T) {
 				"events/sec":          10,
 				"error_responses/sec": 1,
 			},
+			expectedErrors: 1,
 		},
 		{
 			name:     "with true detailed flag and error resp",
@@ -270,6 +430,7 @@ func TestAddExpvarMetrics(t *testing.T) {
 				"mean_available_indexers": 0,
 				"error_responses/sec":     1,
 			},
+			expectedErrors: 1,
 		},
 	}
 
@@ -287,9 +448,10 @@ func TestAddExpvarMetrics(t *testing.T) {
 				Extra: make(map[string]float64),
 				T:     time.Second,
 			}
-			addExpvarMetrics(&r, collector, tt.detailed)
+			errorResponses := addExpvarMetrics(&r, []*expvar.Collector{collector}, tt.detailed)
 
 			assert.Equal(t, tt.expectedResult, r.Extra)
+			assert.Equal(t, tt.expectedErrors, errorResponses)
 		})
 	}
 }
@@ -341,3 +503,438 @@ func createResponse(metrics, memstats []string) string {
 
 	return resp.String()
 }
+
+func Test_writeJSONResult(t *testing.T) {
+	var buf strings.Builder
+	results := []testing.BenchmarkResult{{
+		T:     2 * time.Second,
+		Bytes: 2048,
+		Extra: map[string]float64{"events/sec": 12.5},
+	}, {
+		T:     2 * time.Second,
+		Bytes: 4096,
+		Extra: map[string]float64{"events/sec": 25, "error_responses/sec": 1.5},
+	}}
+	errorResponses := []int64{0, 3}
+	for i, result := range results {
+		err := writeJSONResult(&buf, newJSONResult("BenchmarkAgentGo", 4, 0, i, result, errorResponses[i]))
+		require.NoError(t, err)
+	}
+	err := writeJSONResult(&buf, newJSONResult("BenchmarkAgentGo", 4, time.Second, 0, results[0], 0))
+	require.NoError(t, err)
+	assert.Equal(t, ""+
+		`{"name":"BenchmarkAgentGo","agents":4,"iteration":0,"events_per_sec":12.5,"bytes_per_sec":1024,"error_count":0}`+"\n"+
+		`{"name":"BenchmarkAgentGo","agents":4,"iteration":1,"events_per_sec":25,"bytes_per_sec":2048,"error_count":3}`+"\n"+
+		`{"name":"BenchmarkAgentGo","agents":4,"flush_interval":"1s","iteration":0,"events_per_sec":12.5,"bytes_per_sec":1024,"error_count":0}`+"\n",
+		buf.String(),
+	)
+}
+
+func Test_parseMaxRate(t *testing.T) {
+	for s, expected := range map[string]float64{
+		"5eps":   300,
+		"0.5eps": 30,
+		"10epm":  10,
+		"2eph":   2.0 / 60,
+		"100epd": 100.0 / (24 * 60),
+		"-1eps":  -60,
+		"0epm":   0,
+	} {
+		epm, err := parseMaxRate(s)
+		require.NoError(t, err, s)
+		assert.InDelta(t, expected, epm, 1e-9, s)
+	}
+	for _, s := range []string{"", "5", "eps", "5ep", "5epw", "5epss", "five eps", "NaNeps", "Infeps", "5e"} {
+		_, err := parseMaxRate(s)
+		assert.EqualError(t, err, fmt.Sprintf("invalid value %s for -max-rate, valid examples: 5eps, 0.5eps, 10epm, 2eph or 100epd", s))
+	}
+
+	// Values <= 0 evaluate to Inf.
+	epm, err := parseMaxRate("-1eps")
+	require.NoError(t, err)
+	assert.Equal(t, rate.Inf, getNewLimiter(epm).Limit())
+	epm, err = parseMaxRate("2eph")
+	require.NoError(t, err)
+	assert.InDelta(t, 2.0/3600, float64(getNewLimiter(epm).Limit()), 1e-12)
+}
+
+func Test_ramp(t *testing.T) {
+	// Target 1000 eps over 1s: 500 events in total, of which 125
+	// in the first half, as the rate increases linearly.
+	r := newRamp(time.Second, 1000)
+	ctx := context.Background()
+	start := time.Now()
+	var sent uint
+	for {
+		if err := r.wait(ctx, 25); err != nil {
+			assert.Equal(t, errRampDone, err)
+			break
+		}
+		if sent < 125 {
+			assert.Less(t, time.Since(start), 600*time.Millisecond)
+		}
+		sent += 25
+	}
+	assert.Equal(t, uint(500), sent)
+	assert.GreaterOrEqual(t, time.Since(start), 900*time.Millisecond)
+
+	// Cancelling the context interrupts waiting.
+	r = newRamp(time.Hour, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, r.wait(ctx, 1), context.Canceled)
+}
+
+func Test_warmupRamp(t *testing.T) {
+	var received uint64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/debug/vars" {
+			w.Write([]byte(`{"libbeat.output.events.active":0}`))
+		}
+		if !strings.HasPrefix(r.URL.Path, "/intake") {
+			return
+		}
+		zreader, err := zlib.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		defer zreader.Close()
+		scanner := bufio.NewScanner(zreader)
+		scanner.Buffer(nil, 1024*1024)
+		var events uint64
+		for scanner.Scan() {
+			if !bytes.HasPrefix(scanner.Bytes(), []byte(`{"metadata":`)) {
+				events++
+			}
+		}
+		atomic.AddUint64(&received, events)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	origMaxEPM := maxEPM
+	defer func() { maxEPM = origMaxEPM }()
+	maxEPM = 6000 * 60
+
+	start := time.Now()
+	err := warmupRamp(2, 500*time.Millisecond, []string{srv.URL}, "")
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, time.Since(start), 400*time.Millisecond)
+	// At most 6000*0.5/2 events are sent during the ramp.
+	assert.NotZero(t, atomic.LoadUint64(&received))
+	assert.LessOrEqual(t, atomic.LoadUint64(&received), uint64(1500))
+}
+
+func Test_checkWarmupFlags(t *testing.T) {
+	assert.NoError(t, checkWarmupFlags(false, 0))
+	assert.NoError(t, checkWarmupFlags(true, 0))
+	assert.NoError(t, checkWarmupFlags(false, time.Minute))
+	assert.EqualError(t, checkWarmupFlags(true, time.Minute), "-warmup-events and -warmup-duration are mutually exclusive, set only one of them")
+	assert.EqualError(t, checkWarmupFlags(false, -time.Second), "invalid value -1s for -warmup-duration, must not be negative")
+}
+
+func Test_serverMetrics(t *testing.T) {
+	var requests int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/debug/vars" {
+			t.Errorf("unexpected path: %s", r.URL.Path)
+		}
+		// The first query observes one GC cycle, and later queries
+		// observe a second, longer, GC pause.
+		if atomic.AddInt64(&requests, 1) <= 12 {
+			fmt.Fprint(w, `{"beat.runtime.goroutines":4,"memstats":{"HeapAlloc":1024,"NumGC":1,"PauseTotalNs":10,"PauseNs":[10]}}`)
+			return
+		}
+		fmt.Fprint(w, `{"beat.runtime.goroutines":9,"memstats":{"HeapAlloc":4096,"NumGC":2,"PauseTotalNs":1010,"PauseNs":[10,1000]}}`)
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	collector := startServerMetrics(ctx, srv.URL+"/debug/vars", 10*time.Millisecond)
+	require.NotNil(t, collector)
+	assert.Eventually(t, func() bool {
+		return collector.Get(expvar.Goroutines).Max == 9
+	}, 5*time.Second, time.Millisecond)
+	cancel()
+
+	result := testing.BenchmarkResult{Extra: map[string]float64{}}
+	addServerMetrics(&result, collector)
+	assert.Equal(t, map[string]float64{
+		"server_max_goroutines":  9,
+		"server_max_heap_alloc":  4096,
+		"server_max_gc_pause_ns": 1000,
+		"server_gc_pause_ns":     1000,
+	}, result.Extra)
+}
+
+func Test_serverMetricsUnreachable(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+
+	collector := startServerMetrics(context.Background(), srv.URL, time.Millisecond)
+	assert.Nil(t, collector)
+}
+
+func Test_checkMetricsURL(t *testing.T) {
+	assert.NoError(t, checkMetricsURL("http://localhost:8200/debug/vars"))
+	assert.NoError(t, checkMetricsURL("https://apm.example.com:443/debug/vars"))
+	assert.EqualError(t, checkMetricsURL("localhost:8200"),
+		`invalid value "localhost:8200" for -metrics-url, expected an http or https URL with a host`)
+	assert.Error(t, checkMetricsURL("http://%zz"))
+}
+
+func Test_newTLSClientConfig(t *testing.T) {
+	dir := t.TempDir()
+	writePEM := func(name, typ string, der []byte) string {
+		path := filepath.Join(dir, name)
+		err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600)
+		require.NoError(t, err)
+		return path
+	}
+
+	// Create a self-signed client certificate, trusted by the server.
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "benchtest"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+	certFile := writePEM("client.crt", "CERTIFICATE", certDER)
+	keyFile := writePEM("client.key", "PRIVATE KEY", keyDER)
+	clientCert, err := x509.ParseCertificate(certDER)
+	require.NoError(t, err)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	srv.StartTLS()
+	defer srv.Close()
+	caCertFile := writePEM("ca.crt", "CERTIFICATE", srv.Certificate().Raw)
+
+	get := func(cfg *tls.Config) error {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}
+		resp, err := client.Get(srv.URL)
+		if err != nil {
+			return err
+		}
+		return resp.Body.Close()
+	}
+
+	cfg, err := newTLSClientConfig(true, certFile, keyFile, caCertFile)
+	require.NoError(t, err)
+	assert.NoError(t, get(cfg))
+
+	// Without -secure, the server certificate is not verified.
+	cfg, err = newTLSClientConfig(false, certFile, keyFile, "")
+	require.NoError(t, err)
+	assert.NoError(t, get(cfg))
+
+	// Without -ca-cert, the server certificate is not trusted.
+	cfg, err = newTLSClientConfig(true, certFile, keyFile, "")
+	require.NoError(t, err)
+	assert.Error(t, get(cfg))
+
+	// Without a client certificate, the server rejects the client.
+	cfg, err = newTLSClientConfig(true, "", "", caCertFile)
+	require.NoError(t, err)
+	assert.Error(t, get(cfg))
+
+	_, err = newTLSClientConfig(true, certFile, "", "")
+	assert.EqualError(t, err, "-client-cert and -client-key must be set together")
+	_, err = newTLSClientConfig(true, "", keyFile, "")
+	assert.EqualError(t, err, "-client-cert and -client-key must be set together")
+	_, err = newTLSClientConfig(false, "", "", caCertFile)
+	assert.EqualError(t, err, "-ca-cert requires -secure, server certificates are not verified otherwise")
+	_, err = newTLSClientConfig(true, keyFile, certFile, "")
+	assert.ErrorContains(t, err, "invalid value for -client-cert or -client-key")
+	_, err = newTLSClientConfig(true, "", "", keyFile)
+	assert.EqualError(t, err, fmt.Sprintf("invalid value %q for -ca-cert, no PEM-encoded certificates found", keyFile))
+}
+
+func Test_parseFlushIntervals(t *testing.T) {
+	intervals, err := parseFlushIntervals("")
+	require.NoError(t, err)
+	assert.Equal(t, []time.Duration{0}, intervals)
+
+	intervals, err = parseFlushIntervals("100ms, 1s,10s")
+	require.NoError(t, err)
+	assert.Equal(t, []time.Duration{100 * time.Millisecond, time.Second, 10 * time.Second}, intervals)
+
+	_, err = parseFlushIntervals("1s,10")
+	assert.EqualError(t, err, `invalid value "10" for -flush-interval`)
+	_, err = parseFlushIntervals("0s")
+	assert.EqualError(t, err, `invalid value "0s" for -flush-interval`)
+}
+
+func Test_parseProtocol(t *testing.T) {
+	for _, s := range []string{"intake", "otlp", "mixed"} {
+		p, err := parseProtocol(s)
+		require.NoError(t, err)
+		assert.Equal(t, Protocol(s), p)
+	}
+	_, err := parseProtocol("jaeger")
+	assert.EqualError(t, err, `invalid value "jaeger" for -protocol, valid values: intake, otlp or mixed`)
+}
+
+func Test_checkOTLPRatio(t *testing.T) {
+	for _, ratio := range []float64{0, 0.25, 1} {
+		assert.NoError(t, checkOTLPRatio(ratio))
+	}
+	for _, ratio := range []float64{-0.1, 1.1, math.NaN()} {
+		assert.Error(t, checkOTLPRatio(ratio))
+	}
+}
+
+func Test_ProtocolHandler(t *testing.T) {
+	var intakeRequests, otlpRequests uint64
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		switch r.URL.Path {
+		case "/intake/v2/events":
+			atomic.AddUint64(&intakeRequests, 1)
+			w.WriteHeader(http.StatusAccepted)
+		case "/v1/traces":
+			atomic.AddUint64(&otlpRequests, 1)
+			w.Header().Set("Content-Type", "application/x-protobuf")
+			w.WriteHeader(http.StatusOK)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	// Don't leave idle client connections behind, which would otherwise
+	// be counted by Test_checkGoroutineLeaks.
+	srv.Config.SetKeepAlivesEnabled(false)
+	srv.Start()
+	defer srv.Close()
+	serverURL, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+
+	// Replay a corpus of 10 batches.
+	dir := t.TempDir()
+	var corpusLines []string
+	for i := 0; i < 10; i++ {
+		corpusLines = append(corpusLines,
+			`{"metadata":{"service":{"name":"corpus","agent":{"name":"go","version":"1.0.0"}}}}`,
+			`{"transaction":{"id":"a","trace_id":"b","type":"request","duration":1,"span_count":{"started":0}}}`,
+		)
+	}
+	err = os.WriteFile(filepath.Join(dir, "captured.ndjson"), []byte(strings.Join(corpusLines, "\n")), 0644)
+	require.NoError(t, err)
+	origCorpus := *corpus
+	defer func() { *corpus = origCorpus }()
+	*corpus = dir
+
+	for _, test := range []struct {
+		protocol     Protocol
+		ratio        float64
+		intake, otlp uint64
+	}{
+		{protocol: ProtocolIntake, ratio: 0.5, intake: 10, otlp: 0},
+		{protocol: ProtocolOTLP, ratio: 0.5, intake: 0, otlp: 10},
+		{protocol: ProtocolMixed, ratio: 0.5, intake: 5, otlp: 5},
+		{protocol: ProtocolMixed, ratio: 0.2, intake: 8, otlp: 2},
+		{protocol: ProtocolMixed, ratio: 0, intake: 10, otlp: 0},
+	} {
+		atomic.StoreUint64(&intakeRequests, 0)
+		atomic.StoreUint64(&otlpRequests, 0)
+		resetProtocolStats()
+
+		h, err := newProtocolHandler(test.protocol, test.ratio, "*.ndjson", serverURL, "", nil)
+		require.NoError(t, err)
+		require.Equal(t, 10, h.intake.NumBatches())
+		_, err = h.SendBatches(context.Background())
+		require.NoError(t, err)
+		h.close()
+
+		name := fmt.Sprintf("%s/%v", test.protocol, test.ratio)
+		assert.Equal(t, test.intake, atomic.LoadUint64(&intakeRequests), name)
+		assert.Equal(t, test.otlp, atomic.LoadUint64(&otlpRequests), name)
+		assert.Equal(t, int64(test.intake), intakeProtocolStats.requests, name)
+		assert.Equal(t, int64(test.otlp), otlpProtocolStats.requests, name)
+		assert.Equal(t, int64(test.intake), intakeProtocolStats.events, name)
+		assert.Equal(t, int64(test.otlp*otlpSpansPerRequest), otlpProtocolStats.events, name)
+	}
+}
+
+func Test_addProtocolMetrics(t *testing.T) {
+	resetProtocolStats()
+	defer resetProtocolStats()
+	intakeProtocolStats.record(10, 2*time.Millisecond, nil)
+	intakeProtocolStats.record(30, 4*time.Millisecond, errors.New("boom"))
+
+	result := testing.BenchmarkResult{T: 2 * time.Second, Extra: make(map[string]float64)}
+	addProtocolMetrics(&result)
+	assert.Equal(t, map[string]float64{
+		"intake_requests/sec":        1,
+		"intake_events/sec":          20,
+		"intake_failed_requests/sec": 0.5,
+		"intake_mean_latency_ms":     3,
+	}, result.Extra)
+}
+
+func Test_fullBenchmarkName(t *testing.T) {
+	assert.Equal(t, "BenchmarkAgentGo", fullBenchmarkName("BenchmarkAgentGo", 1, 0))
+	assert.Equal(t, "BenchmarkAgentGo-4", fullBenchmarkName("BenchmarkAgentGo", 4, 0))
+	assert.Equal(t, "BenchmarkAgentGo/flush=1s", fullBenchmarkName("BenchmarkAgentGo", 1, time.Second))
+	assert.Equal(t, "BenchmarkAgentGo/flush=500ms-4", fullBenchmarkName("BenchmarkAgentGo", 4, 500*time.Millisecond))
+
+	re := regexp.MustCompile(`AgentGo/flush=1s-4$`)
+	assert.True(t, matchBenchmark(re, "BenchmarkAgentGo", "BenchmarkAgentGo/flush=1s-4"))
+	assert.False(t, matchBenchmark(re, "BenchmarkAgentGo", "BenchmarkAgentGo/flush=10s-4"))
+	assert.False(t, matchBenchmark(re, "BenchmarkAgentGo", "BenchmarkAgentGo/flush=1s"))
+	assert.True(t, matchBenchmark(regexp.MustCompile(`^BenchmarkAgentGo$`), "BenchmarkAgentGo", "BenchmarkAgentGo/flush=1s-4"))
+	assert.True(t, matchBenchmark(nil, "BenchmarkAgentGo", "BenchmarkAgentGo-4"))
+}
+
+func Test_checkGoroutineLeaks(t *testing.T) {
+	// Other goroutines may start or exit concurrently, so
+	// allow for some noise in the goroutine counts.
+	before := runtime.NumGoroutine()
+	assert.NoError(t, checkGoroutineLeaks(before, 5, 0, ""))
+
+	// Goroutines exiting within the timeout are not leaks.
+	exited := make(chan struct{})
+	for i := 0; i < 20; i++ {
+		go func() { <-exited }()
+	}
+	time.AfterFunc(50*time.Millisecond, func() { close(exited) })
+	assert.NoError(t, checkGoroutineLeaks(before, 5, 5*time.Second, ""))
+
+	var wg sync.WaitGroup
+	leaked := make(chan struct{})
+	defer wg.Wait()
+	defer close(leaked)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-leaked
+		}()
+	}
+	assert.NoError(t, checkGoroutineLeaks(before, 30, 0, ""))
+	err := checkGoroutineLeaks(before, 10, 0, "")
+	assert.Error(t, err)
+	assert.Regexp(t, `^goroutine leak: \d+ goroutines before the benchmarks and \d+ after, exceeding the threshold of 10$`, err.Error())
+
+	dumpPath := filepath.Join(t.TempDir(), "goroutines.txt")
+	err = checkGoroutineLeaks(before, 10, 0, dumpPath)
+	assert.Error(t, err)
+	assert.True(t, strings.HasSuffix(err.Error(), ", goroutine dump written to "+dumpPath))
+	dump, err := os.ReadFile(dumpPath)
+	require.NoError(t, err)
+	assert.Contains(t, string(dump), "Test_checkGoroutineLeaks.func")
+}
@@ -29,8 +29,9 @@ import (
 	"github.com/google/pprof/profile"
 )
 
+// fetchProfile fetches a profile from the first of the target APM Servers.
 func fetchProfile(urlPath string, duration time.Duration) (*profile.Profile, error) {
-	req, err := http.NewRequest("GET", *server+urlPath, nil)
+	req, err := http.NewRequest("GET", serverURLs[0].String()+urlPath, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,295 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package benchtest
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/time/rate"
+
+	"github.com/elastic/apm-server/systemtest/benchtest/eventhandler"
+)
+
+// otlpSpansPerRequest holds the number of spans sent in each OTLP/HTTP
+// request by a ProtocolHandler.
+const otlpSpansPerRequest = 100
+
+// Protocol identifies the protocol used by a ProtocolHandler to send events.
+type Protocol string
+
+const (
+	// ProtocolIntake sends events to the intake/v2 events endpoint.
+	ProtocolIntake Protocol = "intake"
+
+	// ProtocolOTLP sends spans to the OTLP/HTTP traces endpoint.
+	ProtocolOTLP Protocol = "otlp"
+
+	// ProtocolMixed splits requests between the intake/v2 events and
+	// OTLP/HTTP traces endpoints according to -otlp-ratio.
+	ProtocolMixed Protocol = "mixed"
+)
+
+// parseProtocol parses a -protocol value.
+func parseProtocol(s string) (Protocol, error) {
+	switch p := Protocol(s); p {
+	case ProtocolIntake, ProtocolOTLP, ProtocolMixed:
+		return p, nil
+	}
+	return "", fmt.Errorf("invalid value %q for -protocol, valid values: intake, otlp or mixed", s)
+}
+
+// checkOTLPRatio checks that an -otlp-ratio value is between 0 and 1.
+func checkOTLPRatio(ratio float64) error {
+	if math.IsNaN(ratio) || ratio < 0 || ratio > 1 {
+		return fmt.Errorf("invalid value %v for -otlp-ratio, must be between 0 and 1", ratio)
+	}
+	return nil
+}
+
+// protocolStats records the requests sent by ProtocolHandlers over a
+// protocol during a benchmark run.
+type protocolStats struct {
+	requests int64
+	failures int64
+	events   int64
+	latency  int64 // total nanoseconds
+}
+
+var (
+	intakeProtocolStats protocolStats
+	otlpProtocolStats   protocolStats
+)
+
+func (s *protocolStats) record(events uint, d time.Duration, err error) {
+	atomic.AddInt64(&s.requests, 1)
+	atomic.AddInt64(&s.events, int64(events))
+	atomic.AddInt64(&s.latency, int64(d))
+	if err != nil {
+		atomic.AddInt64(&s.failures, 1)
+	}
+}
+
+func (s *protocolStats) reset() {
+	atomic.StoreInt64(&s.requests, 0)
+	atomic.StoreInt64(&s.failures, 0)
+	atomic.StoreInt64(&s.events, 0)
+	atomic.StoreInt64(&s.latency, 0)
+}
+
+// resetProtocolStats resets the statistics recorded by ProtocolHandlers.
+func resetProtocolStats() {
+	intakeProtocolStats.reset()
+	otlpProtocolStats.reset()
+}
+
+// addProtocolMetrics adds the per-protocol request rate, event rate,
+// failure rate and mean request latency recorded by ProtocolHandlers to
+// result. Metrics are only added for protocols which were used.
+func addProtocolMetrics(result *testing.BenchmarkResult) {
+	for _, p := range []struct {
+		name  string
+		stats *protocolStats
+	}{
+		{string(ProtocolIntake), &intakeProtocolStats},
+		{string(ProtocolOTLP), &otlpProtocolStats},
+	} {
+		requests := atomic.LoadInt64(&p.stats.requests)
+		if requests == 0 {
+			continue
+		}
+		seconds := result.T.Seconds()
+		latency := time.Duration(atomic.LoadInt64(&p.stats.latency) / requests)
+		result.Extra[p.name+"_requests/sec"] = float64(requests) / seconds
+		result.Extra[p.name+"_events/sec"] = float64(atomic.LoadInt64(&p.stats.events)) / seconds
+		result.Extra[p.name+"_failed_requests/sec"] = float64(atomic.LoadInt64(&p.stats.failures)) / seconds
+		result.Extra[p.name+"_mean_latency_ms"] = float64(latency) / float64(time.Millisecond)
+	}
+}
+
+// ProtocolHandler sends events to an APM Server using the protocol
+// configured with -protocol: stored events to the intake/v2 events
+// endpoint, generated spans to the OTLP/HTTP traces endpoint, or
+// a mix of both, split by -otlp-ratio.
+type ProtocolHandler struct {
+	protocol  Protocol
+	otlpRatio float64
+	limiter   *rate.Limiter
+	rand      *rand.Rand
+
+	intake *eventhandler.Handler
+	otlp   *otlptrace.Exporter
+
+	flushInterval time.Duration
+	lastOTLPSent  time.Time
+
+	requests     uint
+	otlpRequests uint
+}
+
+// NewProtocolHandler returns a new ProtocolHandler, sending to the next
+// target APM Server. Events sent to the intake/v2 events endpoint are loaded
+// as described for NewEventHandler, from the files matching p.
+func NewProtocolHandler(tb testing.TB, p string, l *rate.Limiter) *ProtocolHandler {
+	h, err := newProtocolHandler(benchProtocol, *otlpRatio, p, nextServerURL(), *secretToken, l)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	h.SetFlushInterval(FlushInterval())
+	tb.Cleanup(h.close)
+	return h
+}
+
+func newProtocolHandler(
+	protocol Protocol, otlpRatio float64,
+	p string, serverURL *url.URL, token string,
+	l *rate.Limiter,
+) (*ProtocolHandler, error) {
+	if l == nil {
+		l = rate.NewLimiter(rate.Inf, 0)
+	}
+	intake, err := newEventHandler(p, serverURL.String(), token, l)
+	if err != nil {
+		return nil, err
+	}
+	switch protocol {
+	case ProtocolIntake:
+		otlpRatio = 0
+	case ProtocolOTLP:
+		otlpRatio = 1
+	}
+	var otlp *otlptrace.Exporter
+	if otlpRatio > 0 {
+		if otlp, err = newOTLPHTTPExporter(serverURL, token); err != nil {
+			return nil, err
+		}
+	}
+	return &ProtocolHandler{
+		protocol:  protocol,
+		otlpRatio: otlpRatio,
+		limiter:   l,
+		rand:      rand.New(rand.NewSource(time.Now().UnixNano())),
+		intake:    intake,
+		otlp:      otlp,
+	}, nil
+}
+
+func (h *ProtocolHandler) close() {
+	if h.otlp != nil {
+		h.otlp.Shutdown(context.Background())
+	}
+}
+
+// SetFlushInterval sets the minimum interval between the requests sent by
+// the handler over each protocol, emulating an agent flushing its events
+// every d. If d is zero, requests are sent as fast as the limiter allows.
+func (h *ProtocolHandler) SetFlushInterval(d time.Duration) {
+	h.flushInterval = d
+	h.intake.SetFlushInterval(d)
+}
+
+// SendBatches sends one request for each of the stored intake batches,
+// choosing the protocol of each request so that the fraction sent over
+// OTLP/HTTP approaches -otlp-ratio. Returns the total number of events
+// sent and any transport errors.
+func (h *ProtocolHandler) SendBatches(ctx context.Context) (uint, error) {
+	var sentEvents uint
+	for i := 0; i < h.intake.NumBatches(); i++ {
+		var sent uint
+		var err error
+		start := time.Now()
+		if h.nextIsOTLP() {
+			sent, err = h.sendOTLP(ctx)
+			otlpProtocolStats.record(sent, time.Since(start), err)
+		} else {
+			sent, err = h.intake.SendBatch(ctx, i)
+			intakeProtocolStats.record(sent, time.Since(start), err)
+		}
+		sentEvents += sent
+		if err != nil {
+			return sentEvents, err
+		}
+	}
+	return sentEvents, nil
+}
+
+// nextIsOTLP reports whether the next request should be sent over
+// OTLP/HTTP, and records the choice.
+func (h *ProtocolHandler) nextIsOTLP() bool {
+	h.requests++
+	if float64(h.otlpRequests+1) <= h.otlpRatio*float64(h.requests) {
+		h.otlpRequests++
+		return true
+	}
+	return false
+}
+
+func (h *ProtocolHandler) sendOTLP(ctx context.Context) (uint, error) {
+	if h.flushInterval > 0 && !h.lastOTLPSent.IsZero() {
+		timer := time.NewTimer(time.Until(h.lastOTLPSent.Add(h.flushInterval)))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return 0, ctx.Err()
+		case <-timer.C:
+		}
+	}
+	if err := h.limiter.WaitN(ctx, otlpSpansPerRequest); err != nil {
+		return 0, err
+	}
+	h.lastOTLPSent = time.Now()
+	if err := h.otlp.ExportSpans(ctx, h.newSpans(otlpSpansPerRequest)); err != nil {
+		return 0, err
+	}
+	return otlpSpansPerRequest, nil
+}
+
+// newSpans returns n sampled server spans, each with new trace and span IDs.
+func (h *ProtocolHandler) newSpans(n int) []sdktrace.ReadOnlySpan {
+	end := time.Now()
+	start := end.Add(-time.Millisecond)
+	stubs := make(tracetest.SpanStubs, n)
+	for i := range stubs {
+		var traceID trace.TraceID
+		var spanID trace.SpanID
+		h.rand.Read(traceID[:])
+		h.rand.Read(spanID[:])
+		stubs[i] = tracetest.SpanStub{
+			Name: "name",
+			SpanContext: trace.NewSpanContext(trace.SpanContextConfig{
+				TraceID:    traceID,
+				SpanID:     spanID,
+				TraceFlags: trace.FlagsSampled,
+			}),
+			SpanKind:  trace.SpanKindServer,
+			StartTime: start,
+			EndTime:   end,
+		}
+	}
+	return stubs.Snapshots()
+}
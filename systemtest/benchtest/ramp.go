@@ -0,0 +1,81 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package benchtest
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+// defaultWarmupRampEPS holds the per-agent event rate that the warm-up ramp
+// increases to when -max-rate is unlimited. This matches the base ingest
+// rate assumed for -warmup-events.
+const defaultWarmupRampEPS = 1000
+
+// errRampDone is returned by ramp.wait once the ramp has ended.
+var errRampDone = errors.New("ramp done")
+
+// ramp paces events so that their combined rate increases linearly from zero
+// to a target rate over a duration. It is safe for concurrent use, so a single
+// ramp may be shared by all agents.
+//
+// With a rate of eps*t/duration at time t, the number of events sent by time t
+// is eps*t²/(2*duration). Events are paced by waiting until the time at which
+// the events sent so far, including those about to be sent, are permitted.
+type ramp struct {
+	duration time.Duration
+	eps      float64
+
+	mu     sync.Mutex
+	start  time.Time
+	events float64
+}
+
+func newRamp(duration time.Duration, eps float64) *ramp {
+	return &ramp{duration: duration, eps: eps}
+}
+
+// wait blocks until the given number of events may be sent. The ramp starts
+// with the first call to wait. If the events may only be sent after the end
+// of the ramp, wait returns errRampDone immediately.
+func (r *ramp) wait(ctx context.Context, events uint) error {
+	r.mu.Lock()
+	if r.start.IsZero() {
+		r.start = time.Now()
+	}
+	r.events += float64(events)
+	seconds := math.Sqrt(2 * r.duration.Seconds() * r.events / r.eps)
+	offset := time.Duration(seconds * float64(time.Second))
+	start := r.start
+	r.mu.Unlock()
+
+	if offset > r.duration {
+		return errRampDone
+	}
+	timer := time.NewTimer(time.Until(start.Add(offset)))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,78 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package benchtest
+
+import (
+	"encoding/json"
+	"io"
+	"testing"
+	"time"
+)
+
+// jsonResult holds the results of a single benchmark run, as written
+// to the -output-json file. The field names must remain stable, as
+// they are consumed by CI to compare benchmark runs over time.
+type jsonResult struct {
+	// Name holds the name of the benchmark, excluding the agents suffix.
+	Name string `json:"name"`
+
+	// Agents holds the number of agents the benchmark was run with.
+	Agents int `json:"agents"`
+
+	// FlushInterval holds the per-agent flush interval the benchmark
+	// was run with, if -flush-interval was specified.
+	FlushInterval string `json:"flush_interval,omitempty"`
+
+	// Iteration holds the zero-based index of the run, up to -count.
+	Iteration int `json:"iteration"`
+
+	// EventsPerSecond holds the number of events processed by the
+	// APM Servers per second.
+	EventsPerSecond float64 `json:"events_per_sec"`
+
+	// BytesPerSecond holds the number of uncompressed bytes received
+	// by the APM Servers per second.
+	BytesPerSecond float64 `json:"bytes_per_sec"`
+
+	// ErrorCount holds the number of error responses returned by the
+	// APM Servers' outputs and OTLP receivers.
+	ErrorCount int64 `json:"error_count"`
+}
+
+func newJSONResult(name string, agents int, flushInterval time.Duration, iteration int, result testing.BenchmarkResult, errorResponses int64) jsonResult {
+	seconds := result.T.Seconds()
+	out := jsonResult{
+		Name:            name,
+		Agents:          agents,
+		Iteration:       iteration,
+		EventsPerSecond: result.Extra["events/sec"],
+		ErrorCount:      errorResponses,
+	}
+	if flushInterval > 0 {
+		out.FlushInterval = flushInterval.String()
+	}
+	if seconds > 0 {
+		out.BytesPerSecond = float64(result.Bytes) / seconds
+	}
+	return out
+}
+
+// writeJSONResult writes r to w as a single line of JSON.
+func writeJSONResult(w io.Writer, r jsonResult) error {
+	return json.NewEncoder(w).Encode(r)
+}
@@ -0,0 +1,56 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package benchtest
+
+import (
+	"context"
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/elastic/apm-server/systemtest/benchtest/expvar"
+)
+
+// serverMetricsInterval is the interval at which -metrics-url is scraped.
+const serverMetricsInterval = 250 * time.Millisecond
+
+// startServerMetrics starts collecting the expvar metrics served at url until
+// ctx is done, for reporting the server's goroutines, heap and GC pauses.
+//
+// Scrape errors do not fail the benchmark: if the endpoint is unreachable
+// the error is logged, and nil is returned.
+func startServerMetrics(ctx context.Context, url string, interval time.Duration) *expvar.Collector {
+	collector, err := expvar.StartNewCollector(ctx, strings.TrimSuffix(url, "/debug/vars"), interval)
+	if err != nil {
+		log.Printf("failed to scrape server metrics from %s: %s", url, err)
+		return nil
+	}
+	return collector
+}
+
+// addServerMetrics adds the server metrics recorded by collector to result.
+//
+// The longest GC pause is sampled: it is the longest of the most recent
+// GC pauses observed at each scrape.
+func addServerMetrics(result *testing.BenchmarkResult, collector *expvar.Collector) {
+	result.Extra["server_max_goroutines"] = float64(collector.Get(expvar.Goroutines).Max)
+	result.Extra["server_max_heap_alloc"] = float64(collector.Get(expvar.HeapAlloc).Max)
+	result.Extra["server_max_gc_pause_ns"] = float64(collector.Get(expvar.LastGCPauseNs).Max)
+	result.Extra["server_gc_pause_ns"] = float64(collector.Delta(expvar.GCPauseTotalNs))
+}
@@ -0,0 +1,61 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package benchtest
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// newTLSClientConfig returns the TLS configuration for clients of the APM
+// Server. Server certificates are verified if verify is true, against the
+// PEM-encoded CA certificates in caCertFile if specified, or the system pool
+// otherwise. If certFile and keyFile are specified, the PEM-encoded
+// certificate and key they contain are presented to the server for mutual
+// TLS.
+func newTLSClientConfig(verify bool, certFile, keyFile, caCertFile string) (*tls.Config, error) {
+	if (certFile == "") != (keyFile == "") {
+		return nil, errors.New("-client-cert and -client-key must be set together")
+	}
+	if caCertFile != "" && !verify {
+		return nil, errors.New("-ca-cert requires -secure, server certificates are not verified otherwise")
+	}
+	cfg := &tls.Config{InsecureSkipVerify: !verify}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for -client-cert or -client-key: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	if caCertFile != "" {
+		pem, err := os.ReadFile(caCertFile)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for -ca-cert: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("invalid value %q for -ca-cert, no PEM-encoded certificates found", caCertFile)
+		}
+		cfg.RootCAs = pool
+	}
+	return cfg, nil
+}
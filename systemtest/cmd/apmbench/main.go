@@ -50,9 +50,13 @@ func Benchmark1000Transactions(b *testing.B, l *rate.Limiter) {
 func BenchmarkOTLPTraces(b *testing.B, l *rate.Limiter) {
 	b.RunParallel(func(pb *testing.PB) {
 		exporter := benchtest.NewOTLPExporter(b)
+		batcherOpts := []sdktrace.BatchSpanProcessorOption{sdktrace.WithBlocking()}
+		if d := benchtest.FlushInterval(); d > 0 {
+			batcherOpts = append(batcherOpts, sdktrace.WithBatchTimeout(d))
+		}
 		tracerProvider := sdktrace.NewTracerProvider(
 			sdktrace.WithSampler(sdktrace.AlwaysSample()),
-			sdktrace.WithBatcher(exporter, sdktrace.WithBlocking()),
+			sdktrace.WithBatcher(exporter, batcherOpts...),
 		)
 		tracer := tracerProvider.Tracer("tracer")
 		for pb.Next() {
@@ -94,7 +98,7 @@ func BenchmarkAgentRuby(b *testing.B, l *rate.Limiter) {
 
 func benchmarkAgent(b *testing.B, l *rate.Limiter, expr string) {
 	b.RunParallel(func(pb *testing.PB) {
-		h := benchtest.NewEventHandler(b, expr, l)
+		h := benchtest.NewProtocolHandler(b, expr, l)
 		for pb.Next() {
 			h.SendBatches(context.Background())
 		}
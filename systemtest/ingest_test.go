@@ -121,9 +121,19 @@ func TestIngestPipelineEventDuration(t *testing.T) {
 		// No transaction.* field, no update.
 		source: `{"@timestamp": "2022-02-15", "observer": {"version": "8.2.0"}, "processor": {"event": "transaction"}}`,
 	}, {
-		// Set transaction.duration.us to zero if event.duration not found.
-		source:                        `{"@timestamp": "2022-02-15", "observer": {"version": "8.2.0"}, "processor": {"event": "transaction"}, "transaction": {}}`,
-		expectedTransactionDurationUS: 0.0,
+		// Leave transaction.duration.us unset if event.duration not found.
+		source: `{"@timestamp": "2022-02-15", "observer": {"version": "8.2.0"}, "processor": {"event": "transaction"}, "transaction": {}}`,
+	}, {
+		// Leave transaction.duration.us unset if event.duration is zero.
+		source: `{"@timestamp": "2022-02-15", "observer": {"version": "8.2.0"}, "processor": {"event": "transaction"}, "event": {"duration": 0}, "transaction": {}}`,
+	}, {
+		// Set transaction.duration.us to event.duration/1000.
+		source:                        `{"@timestamp": "2022-02-15", "observer": {"version": "8.2.0"}, "processor": {"event": "transaction"}, "event": {"duration": 2500}, "transaction": {}}`,
+		expectedTransactionDurationUS: 2.0,
+	}, {
+		// Set span.duration.us to zero if event.duration not found.
+		source:                 `{"@timestamp": "2022-02-15", "observer": {"version": "8.2.0"}, "processor": {"event": "span"}, "span": {}}`,
+		expectedSpanDurationUS: 0.0,
 	}, {
 		// Set span.duration.us to event.duration/1000.
 		source:                 `{"@timestamp": "2022-02-15", "observer": {"version": "8.2.0"}, "processor": {"event": "span"}, "event": {"duration": 2500}, "span": {}}`,
@@ -108,7 +108,7 @@ func TestRUMAllowServiceNames(t *testing.T) {
 
 	respBody, _ := io.ReadAll(resp.Body)
 	assert.Equal(t, http.StatusForbidden, resp.StatusCode, string(respBody))
-	assert.Equal(t, `{"accepted":0,"errors":[{"message":"unauthorized: anonymous access not permitted for service \"disallowed\""}]}`+"\n", string(respBody))
+	assert.Equal(t, `{"version":1,"accepted":0,"lines_seen":2,"bytes_seen":241,"errors":[{"code":"unauthorized","message":"unauthorized: anonymous access not permitted for service \"disallowed\""}]}`+"\n", string(respBody))
 }
 
 func TestRUMRateLimit(t *testing.T) {